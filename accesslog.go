@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"github.com/skyfii/shuttle/log"
+)
+
+// The access log is written in shuttle's own key=value format by default.
+// With -access-log-format it's written in the common or combined log format,
+// or a custom format of Apache style directives, so log pipelines such as
+// GoAccess, awstats or grok patterns can read it unchanged. Those lines are
+// written without the log's timestamp, to stderr or the -access-log file.
+
+const (
+	commonLogFormat   = `%h %l %u %t "%r" %>s %b`
+	combinedLogFormat = commonLogFormat + ` "%{Referer}i" "%{User-Agent}i"`
+
+	clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+// One request to log.
+type accessEntry struct {
+	req      *http.Request
+	status   int
+	backend  backendAttempt
+	err      error
+	duration time.Duration
+	// the length of the response body, or -1 if it isn't known
+	bytes int64
+}
+
+// A directive of a format appends its field of the entry to the line.
+type accessField func(line []byte, e *accessEntry) []byte
+
+type accessLogger struct {
+	sync.Mutex
+	fields []accessField
+	out    io.Writer
+	line   []byte
+}
+
+// The access log, or nil for shuttle's own format.
+var accessLog *accessLogger
+
+// Set the format of the access log, written to the file at path, or stderr
+// if path is empty.
+func setAccessLog(format, path string) error {
+	switch format {
+	case "":
+		return nil
+	case "common":
+		format = commonLogFormat
+	case "combined":
+		format = combinedLogFormat
+	}
+
+	fields, err := parseAccessFormat(format)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stderr
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		out = f
+	}
+
+	accessLog = &accessLogger{fields: fields, out: out}
+	return nil
+}
+
+// Compile a format of Apache style directives, such as "%h %t \"%r\"".
+func parseAccessFormat(format string) ([]accessField, error) {
+	var fields []accessField
+	for len(format) > 0 {
+		i := strings.IndexByte(format, '%')
+		if i < 0 {
+			fields = append(fields, literalField(format))
+			break
+		}
+		if i > 0 {
+			fields = append(fields, literalField(format[:i]))
+		}
+		format = format[i+1:]
+
+		// %{name}i and the like take an argument
+		arg := ""
+		if strings.HasPrefix(format, "{") {
+			end := strings.IndexByte(format, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated %%{ in access log format")
+			}
+			arg, format = format[1:end], format[end+1:]
+		}
+		// the final status, which is the only one shuttle has
+		format = strings.TrimPrefix(format, ">")
+
+		if format == "" {
+			return nil, fmt.Errorf("access log format ends with %%")
+		}
+		field, err := accessDirective(format[0], arg)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+		format = format[1:]
+	}
+	return fields, nil
+}
+
+func literalField(s string) accessField {
+	return func(line []byte, e *accessEntry) []byte {
+		return append(line, s...)
+	}
+}
+
+// Return the field of a directive.
+func accessDirective(d byte, arg string) (accessField, error) {
+	switch d {
+	case '%':
+		return literalField("%"), nil
+	case 'h':
+		return stringField(func(e *accessEntry) string { return accessHost(e.req) }), nil
+	case 'l':
+		return literalField("-"), nil
+	case 'u':
+		return stringField(func(e *accessEntry) string {
+			user, _, _ := e.req.BasicAuth()
+			return user
+		}), nil
+	case 't':
+		return func(line []byte, e *accessEntry) []byte {
+			start := time.Now().Add(-e.duration)
+			line = append(line, '[')
+			line = start.AppendFormat(line, clfTimeFormat)
+			return append(line, ']')
+		}, nil
+	case 'r':
+		return stringField(func(e *accessEntry) string {
+			return e.req.Method + " " + e.req.RequestURI + " " + e.req.Proto
+		}), nil
+	case 's':
+		return func(line []byte, e *accessEntry) []byte {
+			return strconv.AppendInt(line, int64(e.status), 10)
+		}, nil
+	case 'b', 'B':
+		return func(line []byte, e *accessEntry) []byte {
+			switch {
+			case e.bytes > 0:
+				return strconv.AppendInt(line, e.bytes, 10)
+			case d == 'b':
+				return append(line, '-')
+			}
+			return append(line, '0')
+		}, nil
+	case 'D':
+		return func(line []byte, e *accessEntry) []byte {
+			return strconv.AppendInt(line, int64(e.duration/time.Microsecond), 10)
+		}, nil
+	case 'T':
+		return func(line []byte, e *accessEntry) []byte {
+			return strconv.AppendInt(line, int64(e.duration/time.Second), 10)
+		}, nil
+	case 'm':
+		return stringField(func(e *accessEntry) string { return e.req.Method }), nil
+	case 'U':
+		return stringField(func(e *accessEntry) string { return e.req.URL.Path }), nil
+	case 'q':
+		return stringField(func(e *accessEntry) string {
+			if e.req.URL.RawQuery == "" {
+				return ""
+			}
+			return "?" + e.req.URL.RawQuery
+		}), nil
+	case 'H':
+		return stringField(func(e *accessEntry) string { return e.req.Proto }), nil
+	case 'v':
+		return stringField(func(e *accessEntry) string { return e.req.Host }), nil
+	case 'i':
+		if arg == "" {
+			return nil, fmt.Errorf("%%i needs a header name, as %%{User-Agent}i")
+		}
+		return stringField(func(e *accessEntry) string { return e.req.Header.Get(arg) }), nil
+	case 'x':
+		return shuttleField(arg)
+	}
+	return nil, fmt.Errorf("unknown access log directive %%%c", d)
+}
+
+// Return the field of one of shuttle's own values, as %{backend}x.
+func shuttleField(name string) (accessField, error) {
+	switch name {
+	case "id":
+		return stringField(func(e *accessEntry) string { return e.req.Header.Get(RequestIDHeader) }), nil
+	case "backend":
+		return stringField(func(e *accessEntry) string { return e.backend.Addr }), nil
+	case "backend_name":
+		return stringField(func(e *accessEntry) string { return e.backend.Name }), nil
+	case "attempt":
+		return func(line []byte, e *accessEntry) []byte {
+			return strconv.AppendInt(line, int64(e.backend.Attempt), 10)
+		}, nil
+	case "error":
+		return stringField(func(e *accessEntry) string {
+			if e.err == nil {
+				return ""
+			}
+			return e.err.Error()
+		}), nil
+	}
+	return nil, fmt.Errorf("unknown access log value %%{%s}x", name)
+}
+
+// A field of a string value, escaped so it can't break the quoting of the
+// line, or "-" when it's empty.
+func stringField(value func(e *accessEntry) string) accessField {
+	return func(line []byte, e *accessEntry) []byte {
+		v := value(e)
+		if v == "" {
+			return append(line, '-')
+		}
+		q := strconv.Quote(v)
+		return append(line, q[1:len(q)-1]...)
+	}
+}
+
+// The client's address without the port, or the first address forwarded by
+// a trusted proxy.
+func accessHost(r *http.Request) string {
+	addr := clientAddr(r)
+	if i := strings.IndexByte(addr, ','); i >= 0 {
+		addr = addr[:i]
+	}
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func (l *accessLogger) log(e *accessEntry) {
+	l.Lock()
+	defer l.Unlock()
+
+	line := l.line[:0]
+	for _, f := range l.fields {
+		line = f(line, e)
+	}
+	line = append(line, '\n')
+	l.line = line
+
+	if _, err := l.out.Write(line); err != nil {
+		log.Errorf("ERROR: Writing the access log: %s", err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"github.com/skyfii/shuttle/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Obtain and renew certificates for the registered virtual hosts through
+// ACME, e.g. Let's Encrypt. Challenges are answered with HTTP-01 on the HTTP
+// listener, and renewed certificates are served as soon as they're issued.
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// nil unless ACME is enabled
+var acmeManager *autocert.Manager
+
+// Enable ACME, caching account keys and certificates in dir.
+// An empty directoryURL uses Let's Encrypt.
+func setupACME(dir, email, directoryURL string) {
+	if directoryURL == "" {
+		directoryURL = autocert.DefaultACMEDirectory
+	}
+
+	acmeManager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(dir),
+		HostPolicy: acmeHostPolicy,
+		Email:      email,
+		Client:     &acme.Client{DirectoryURL: directoryURL},
+	}
+	log.Printf("INFO: ACME certificates enabled from %s", directoryURL)
+}
+
+// Only request certificates for hosts that route to a service.
+func acmeHostPolicy(_ context.Context, host string) error {
+	if Registry.GetVHostService(host) == nil {
+		return fmt.Errorf("acme: no service for host %s", host)
+	}
+	return nil
+}
+
+// Answer the HTTP-01 challenge if this is a challenge request.
+func acmeChallenge(w http.ResponseWriter, req *http.Request) bool {
+	if acmeManager == nil || !strings.HasPrefix(req.URL.Path, acmeChallengePath) {
+		return false
+	}
+
+	acmeManager.HTTPHandler(nil).ServeHTTP(w, req)
+	return true
+}
+
+// Return a certificate from ACME for the requested host, or nil if ACME isn't
+// enabled or the certificate can't be obtained.
+func acmeCertificate(hello *tls.ClientHelloInfo) *tls.Certificate {
+	if acmeManager == nil || hello.ServerName == "" {
+		return nil
+	}
+
+	cert, err := acmeManager.GetCertificate(hello)
+	if err != nil {
+		log.Warnf("WARN: No ACME certificate for %s: %s", hello.ServerName, err)
+		return nil
+	}
+	return cert
+}
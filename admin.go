@@ -1,13 +1,17 @@
 package main
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"github.com/skyfii/shuttle/client"
 	"github.com/skyfii/shuttle/log"
 	"github.com/gorilla/mux"
@@ -18,12 +22,56 @@ func getConfig(w http.ResponseWriter, r *http.Request) {
 }
 
 func getStats(w http.ResponseWriter, r *http.Request) {
+	if consistent, _ := strconv.ParseBool(r.URL.Query().Get("consistent")); consistent {
+		taken, stats := Registry.Snapshot()
+		w.Header().Set("X-Snapshot-Time", taken.Format(time.RFC3339Nano))
+		if len(stats) == 0 {
+			w.WriteHeader(503)
+		}
+		w.Write(marshal(stats))
+		return
+	}
+
 	if len(Registry.Config().Services) == 0 {
 		w.WriteHeader(503)
 	}
 	w.Write(marshal(Registry.Stats()))
 }
 
+// Long-poll for the stats which changed since a generation. The threshold is
+// the smallest change in a counter which is reported, and the timeout is in
+// milliseconds.
+func getStatsDelta(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var since uint64
+	var threshold int64
+	timeout := deltaTimeout
+
+	var err error
+	if v := query.Get("since"); v != "" {
+		since, err = strconv.ParseUint(v, 10, 64)
+	}
+	if v := query.Get("threshold"); v != "" && err == nil {
+		threshold, err = strconv.ParseInt(v, 10, 64)
+	}
+	if v := query.Get("timeout"); v != "" && err == nil {
+		var ms int64
+		ms, err = strconv.ParseInt(v, 10, 64)
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if timeout > deltaMaxTimeout {
+		timeout = deltaMaxTimeout
+	}
+
+	w.Write(marshal(Registry.StatsDelta(since, threshold, timeout, r.Context().Done())))
+}
+
 func getServiceStats(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
@@ -60,19 +108,56 @@ func postConfig(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	err = json.Unmarshal(body, &cfg)
+	cfg, err = parseConfig("posted config", body)
 	if err != nil {
 		log.Errorln("ERROR: ",err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if err := Registry.UpdateConfig(cfg); err != nil {
-		log.Errorln("ERROR: ",err)
+	// apply nothing unless every service can be applied
+	atomic, _ := strconv.ParseBool(r.URL.Query().Get("atomic"))
+
+	// keep the health state of backends moved between services
+	migrate, _ := strconv.ParseBool(r.URL.Query().Get("migrate"))
+
+	txn, status, err := configTxns.Submit(cfg, atomic, migrate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set(ConfigTxnHeader, strconv.FormatUint(status.ID, 10))
+
+	// return once it's queued, leaving the status to /_config/txn/{id}
+	if async, _ := strconv.ParseBool(r.URL.Query().Get("async")); async {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(marshal(status))
+		return
+	}
+
+	status = txn.Wait()
+	if status.State == txnFailed {
+		log.Errorln("ERROR: ", status.Error)
 		// TODO: differentiate between ServerError and BadRequest
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.Write(marshal(status.Report))
+}
+
+// Return the status of a config transaction.
+func getConfigTxn(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status, err := configTxns.Status(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	w.Write(marshal(status))
 }
 
 // Update a service and/or backends.
@@ -103,15 +188,37 @@ func postService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// replace the whole config of an existing service, rather than merging
+	if replace, _ := strconv.ParseBool(r.URL.Query().Get("replace")); replace {
+		err = Registry.ReplaceService(svcCfg)
+		if err != nil {
+			log.Errorf("ERROR: %s", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		go writeStateConfig()
+		w.Write(marshal(Registry.Config()))
+		return
+	}
+
 	cfg := client.Config{
 		Services: []client.ServiceConfig{svcCfg},
 	}
 
-	err = Registry.UpdateConfig(cfg)
-	//FIXME: this doesn't return an error for an empty or broken service
+	// applied in turn with the pushes to /_config
+	txn, status, err := configTxns.Submit(cfg, false, false)
 	if err != nil {
-		log.Error("ERROR: ",err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set(ConfigTxnHeader, strconv.FormatUint(status.ID, 10))
+
+	status = txn.Wait()
+	//FIXME: this doesn't return an error for an empty or broken service
+	if status.State == txnFailed {
+		log.Error("ERROR: ", status.Error)
+		http.Error(w, status.Error, http.StatusBadRequest)
 		return
 	}
 
@@ -206,22 +313,289 @@ func deleteBackend(w http.ResponseWriter, r *http.Request) {
 	w.Write(marshal(Registry.Config()))
 }
 
+// Reload the HTTPS certificates from disk.
+func reloadCerts(w http.ResponseWriter, r *http.Request) {
+	if err := httpsCerts.Reload(); err != nil {
+		log.Errorln("ERROR: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(marshal(httpsCerts.Names()))
+}
+
+// Force a backend up or down, or return it to its observed health.
+func setBackendState(state string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		serviceName := vars["service"]
+		backendName := vars["backend"]
+
+		err := Registry.SetBackendState(serviceName, backendName, state)
+		switch err {
+		case nil:
+		case ErrNoService, ErrNoBackend:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		go writeStateConfig()
+		w.Write(marshal(Registry.Config()))
+	}
+}
+
+// Get or set the fraction of a service's requests which are traced
+func getTrace(w http.ResponseWriter, r *http.Request) {
+	cfg, err := Registry.ServiceConfig(mux.Vars(r)["service"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Write(marshal(client.TraceConfig{Sample: cfg.TraceSample}))
+}
+
+func postTrace(w http.ResponseWriter, r *http.Request) {
+	var cfg client.TraceConfig
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := Registry.SetTraceSample(mux.Vars(r)["service"], cfg.Sample)
+	switch err {
+	case nil:
+	case ErrNoService:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	go writeStateConfig()
+	w.Write(marshal(cfg))
+}
+
+// Drain or enable a service, returning its stats with the drain's progress.
+func setServiceDrain(drain bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serviceName := mux.Vars(r)["service"]
+
+		var err error
+		if drain {
+			err = Registry.DrainService(serviceName)
+		} else {
+			err = Registry.EnableService(serviceName)
+		}
+		switch err {
+		case nil:
+		case ErrNoService:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		serviceStats, err := Registry.ServiceStats(serviceName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Write(marshal(serviceStats))
+	}
+}
+
+// Drain a batch of backends, returning the drain's status.
+func postDrain(w http.ResponseWriter, r *http.Request) {
+	var req client.DrainRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Backends) == 0 {
+		http.Error(w, "no backends to drain", http.StatusBadRequest)
+		return
+	}
+
+	status, err := drains.Start(req)
+	switch err {
+	case nil:
+	case ErrNoService, ErrNoBackend:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	go writeStateConfig()
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(marshal(status))
+}
+
+func getDrain(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status, err := drains.Status(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Write(marshal(status))
+}
+
+// Return the process's usage against its limits.
+func getProcessStats(w http.ResponseWriter, r *http.Request) {
+	w.Write(marshal(selfLimit.Stats()))
+}
+
+// Return the Go runtime's effective settings and GC stats.
+func getRuntimeStats(w http.ResponseWriter, r *http.Request) {
+	w.Write(marshal(runtimeStats()))
+}
+
 func addHandlers() {
 	r := mux.NewRouter()
 	r.HandleFunc("/", getStats).Methods("GET")
 	r.HandleFunc("/", postConfig).Methods("PUT", "POST")
 	r.HandleFunc("/_config", getConfig).Methods("GET")
 	r.HandleFunc("/_config", postConfig).Methods("PUT", "POST")
+	r.HandleFunc("/_config/txn/{id}", getConfigTxn).Methods("GET")
 	r.HandleFunc("/_stats", getStats).Methods("GET")
+	r.HandleFunc("/_stats/delta", getStatsDelta).Methods("GET")
+	r.HandleFunc("/_certs", reloadCerts).Methods("PUT", "POST")
+	r.HandleFunc("/_process", getProcessStats).Methods("GET")
+	r.HandleFunc("/_runtime", getRuntimeStats).Methods("GET")
+	r.HandleFunc("/_ready", getReady).Methods("GET")
+	r.HandleFunc("/_drain", postDrain).Methods("POST")
+	r.HandleFunc("/_drain/{id}", getDrain).Methods("GET")
 	r.HandleFunc("/{service}", getServiceStats).Methods("GET")
 	r.HandleFunc("/{service}/_config", getServiceConfig).Methods("GET")
 	r.HandleFunc("/{service}/_stats", getServiceStats).Methods("GET")
+	r.HandleFunc("/{service}/_trace", getTrace).Methods("GET")
+	r.HandleFunc("/{service}/_trace", postTrace).Methods("PUT", "POST")
+	r.HandleFunc("/{service}/_drain", setServiceDrain(true)).Methods("PUT", "POST")
+	r.HandleFunc("/{service}/_enable", setServiceDrain(false)).Methods("PUT", "POST")
 	r.HandleFunc("/{service}", postService).Methods("PUT", "POST")
 	r.HandleFunc("/{service}", deleteService).Methods("DELETE")
 	r.HandleFunc("/{service}/{backend}", getBackend).Methods("GET")
 	r.HandleFunc("/{service}/{backend}", postBackend).Methods("PUT", "POST")
 	r.HandleFunc("/{service}/{backend}", deleteBackend).Methods("DELETE")
-	http.Handle("/", r)
+	r.HandleFunc("/{service}/{backend}/_up", setBackendState(client.AdminUp)).Methods("PUT", "POST")
+	r.HandleFunc("/{service}/{backend}/_down", setBackendState(client.AdminDown)).Methods("PUT", "POST")
+	r.HandleFunc("/{service}/{backend}/_auto", setBackendState("")).Methods("PUT", "POST")
+	http.Handle("/", adminAuth(negotiateAPIVersion(r)))
+}
+
+// Require a token for the admin API when one is configured. The token may be
+// sent as a bearer token, or as the password with basic auth. The read-only
+// token only allows GET and HEAD requests.
+func adminAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" && adminReadToken == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		token := ""
+		if _, pass, ok := r.BasicAuth(); ok {
+			token = pass
+		} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+
+		readOnly := r.Method == "GET" || r.Method == "HEAD"
+		switch {
+		case token == "":
+		case tokenMatch(token, adminToken):
+			h.ServeHTTP(w, r)
+			return
+		case tokenMatch(token, adminReadToken):
+			if readOnly {
+				h.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, "read-only token", http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="shuttle"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// Compare a token in constant time. An empty expected token never matches.
+func tokenMatch(token, expected string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// Load the admin server's certificate, and the CAs for client certificates.
+func adminTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(adminCert, adminKey)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	serverTLS.apply(tlsCfg)
+
+	if adminClientCA != "" {
+		pool, err := loadClientCAs(adminClientCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsCfg.ClientCAs = pool
+	}
+
+	return tlsCfg, nil
+}
+
+// Only allow reads through to the handler.
+func readOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "read-only", http.StatusMethodNotAllowed)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Serve the admin API's stats and config read-only on the -stats address,
+// for dashboards and monitoring on a wider network than the admin server.
+// The admin tokens still apply. With -admin-cert it's served over https, but
+// without requiring client certificates.
+func serveStatsMirror(handler http.Handler) {
+	log.Println("INFO: Stats server listening on", statsListenAddr)
+
+	listener, err := net.Listen("tcp", statsListenAddr)
+	if err != nil {
+		log.Fatalf("FATAL: Stats server failed and exited with %s", err)
+	}
+
+	if adminCert != "" {
+		tlsCfg, err := adminTLSConfig()
+		if err != nil {
+			log.Fatalf("FATAL: Stats server TLS: %s", err)
+		}
+		tlsCfg.ClientAuth = tls.NoClientCert
+		tlsCfg.ClientCAs = nil
+		listener = tls.NewListener(listener, tlsCfg)
+	}
+
+	http.Serve(listener, readOnly(handler))
 }
 
 func startAdminHTTPServer(wg *sync.WaitGroup) {
@@ -249,5 +623,13 @@ func startAdminHTTPServer(wg *sync.WaitGroup) {
 		log.Fatalf("FATAL: Admin server failed and exited with %s", err)
 	}
 
+	if adminCert != "" {
+		tlsCfg, err := adminTLSConfig()
+		if err != nil {
+			log.Fatalf("FATAL: Admin server TLS: %s", err)
+		}
+		listener = tls.NewListener(listener, tlsCfg)
+	}
+
 	http.Serve(listener, nil)
 }
@@ -1,16 +1,46 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	rtdebug "runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/andybalholm/brotli"
 	"github.com/skyfii/shuttle/client"
+	"github.com/skyfii/shuttle/log"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	. "gopkg.in/check.v1"
 )
 
@@ -189,6 +219,54 @@ func (s *HTTPSuite) TestReAddBackend(c *C) {
 	c.Assert(string(secBody), DeepEquals, string(firstBody))
 }
 
+func (s *HTTPSuite) TestBackendAdminState(c *C) {
+	svcDef := bytes.NewReader([]byte(`{"address": "127.0.0.1:9000"}`))
+	req, _ := http.NewRequest("PUT", s.httpSvr.URL+"/testService", svcDef)
+	_, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	backendDef := bytes.NewReader([]byte(`{"address": "127.0.0.1:9001"}`))
+	req, _ = http.NewRequest("PUT", s.httpSvr.URL+"/testService/testBackend", backendDef)
+	_, err = http.DefaultClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	setState := func(action string) int {
+		req, _ := http.NewRequest("PUT", s.httpSvr.URL+"/testService/testBackend/"+action, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	c.Assert(setState("_down"), Equals, http.StatusOK)
+	stats, err := Registry.BackendStats("testService", "testBackend")
+	c.Assert(err, IsNil)
+	c.Assert(stats.AdminState, Equals, client.AdminDown)
+	c.Assert(Registry.GetService("testService").Available(), Equals, 0)
+
+	// the state is saved in the config
+	svcCfg, err := Registry.ServiceConfig("testService")
+	c.Assert(err, IsNil)
+	c.Assert(svcCfg.Backends[0].AdminState, Equals, client.AdminDown)
+
+	c.Assert(setState("_auto"), Equals, http.StatusOK)
+	c.Assert(Registry.GetService("testService").Available(), Equals, 1)
+
+	req, _ = http.NewRequest("PUT", s.httpSvr.URL+"/testService/missing/_down", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+}
+
 func (s *HTTPSuite) TestSimulAdd(c *C) {
 	start := make(chan struct{})
 	testWG := new(sync.WaitGroup)
@@ -512,6 +590,171 @@ func (s *HTTPSuite) TestErrorPage(c *C) {
 	c.Assert(resp.Header.Get("Last-Modified"), Equals, errServer.addr)
 }
 
+// Error pages are templates, may be read from files, and are refreshed.
+func (s *HTTPSuite) TestErrorPageTemplates(c *C) {
+	file := filepath.Join(c.MkDir(), "502.html")
+	err := ioutil.WriteFile(file, []byte("{{.Status}} {{.StatusText}} from {{.Service}} for {{.RequestID}}"), 0644)
+	c.Assert(err, IsNil)
+
+	var version int64 = 1
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "version %d", atomic.LoadInt64(&version))
+	}))
+	defer remote.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Addr: s.backendServers[0].addr},
+		},
+		ErrorPages: map[string][]int{
+			"file:" + file: []int{502},
+			remote.URL:     []int{504},
+		},
+		ErrorPagesRefresh: 100,
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	get := func(path string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+path, nil)
+		if err != nil {
+			c.Fatal(err)
+		}
+		req.Host = "test-vhost"
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, body := get("/error?code=502")
+	c.Assert(resp.StatusCode, Equals, 502)
+	c.Assert(strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html"), Equals, true)
+	c.Assert(body, Equals, "502 Bad Gateway from VHostTest for "+resp.Header.Get(RequestIDHeader))
+
+	_, body = get("/error?code=504")
+	c.Assert(body, Equals, "version 1")
+
+	// a stale page is fetched again in the background
+	atomic.StoreInt64(&version, 2)
+	time.Sleep(150 * time.Millisecond)
+	get("/error?code=504")
+	time.Sleep(50 * time.Millisecond)
+
+	_, body = get("/error?code=504")
+	c.Assert(body, Equals, "version 2")
+}
+
+// Each request gets an ID, passed to the backend and shown on error pages,
+// unless it comes with one from a trusted proxy.
+func (s *HTTPSuite) TestRequestID(c *C) {
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "request {{.RequestID}} failed")
+	}))
+	defer page.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Addr: s.backendServers[0].addr},
+		},
+		ErrorPages: map[string][]int{
+			page.URL: []int{502},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	get := func(path, id string) (string, string) {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+path, nil)
+		if err != nil {
+			c.Fatal(err)
+		}
+		req.Host = "test-vhost"
+		if id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.Header.Get(RequestIDHeader), string(body)
+	}
+
+	// the backend sees the ID returned to the client
+	id, body := get("/header?name=X-Request-Id", "")
+	c.Assert(len(id), Equals, 16)
+	c.Assert(body, Equals, id)
+
+	id, body = get("/header?name=X-Request-Id", "edge-1234")
+	c.Assert(id, Equals, "edge-1234")
+	c.Assert(body, Equals, id)
+
+	id, _ = get("/header?name=X-Request-Id", "<script>")
+	c.Assert(id, Not(Equals), "<script>")
+
+	id, body = get("/error?code=502", "")
+	c.Assert(body, Equals, "request "+id+" failed")
+
+	// only a trusted proxy's ID is kept
+	trustedProxies.Set([]string{"10.0.0.0/8"})
+	defer trustedProxies.Set(nil)
+
+	id, body = get("/header?name=X-Request-Id", "edge-1234")
+	c.Assert(id, Not(Equals), "edge-1234")
+	c.Assert(body, Equals, id)
+}
+
+func (s *HTTPSuite) TestErrorPageIfEmpty(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+	}
+
+	okServer := s.backendServers[0]
+	errServer := s.backendServers[1]
+
+	svcCfg.Backends = append(svcCfg.Backends, client.BackendConfig{
+		Addr: okServer.addr,
+		Name: okServer.addr,
+	})
+
+	svcCfg.ErrorPages = map[string][]int{
+		"http://" + errServer.addr + "/error": []int{400, 502, 503},
+	}
+	svcCfg.ErrorPagesIfEmpty = []int{503}
+
+	err := Registry.AddService(svcCfg)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	// a 503 with a body is passed through from the backend
+	checkHTTP("http://"+s.httpAddr+"/error?code=503", "test-vhost", okServer.addr, 503, c)
+	// an empty 503 gets the error page
+	checkHTTP("http://"+s.httpAddr+"/error?code=503&empty=1", "test-vhost", errServer.addr, 503, c)
+	// 502 isn't listed, so it's always replaced
+	checkHTTP("http://"+s.httpAddr+"/error?code=502", "test-vhost", errServer.addr, 502, c)
+
+	// and the setting round-trips through the config
+	c.Assert(Registry.GetService("VHostTest").config().ErrorPagesIfEmpty, DeepEquals, []int{503})
+}
+
 func (s *HTTPSuite) TestUpdateServiceDefaults(c *C) {
 	svcCfg := client.ServiceConfig{
 		Name: "TestService",
@@ -615,6 +858,39 @@ func (s *HTTPSuite) TestGlobalDefaults(c *C) {
 }
 
 // Test that we can route to Vhosts based on SNI
+func (s *HTTPSuite) TestMaxRequests(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostTest1",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"vhost1.test"},
+		Backends: []client.BackendConfig{
+			{Addr: s.backendServers[0].addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	httpRouter.MaxRequests = 2
+	defer func() { httpRouter.MaxRequests = 0 }()
+
+	get := func() *http.Response {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		req.Host = "vhost1.test"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	c.Assert(get().Close, Equals, false)
+	c.Assert(get().Close, Equals, true)
+}
+
 func (s *HTTPSuite) TestHTTPSRouter(c *C) {
 	srv1 := s.backendServers[0]
 	srv2 := s.backendServers[1]
@@ -765,3 +1041,3058 @@ func (s *HTTPSuite) TestMaintenanceMode(c *C) {
 
 	checkHTTP("https://vhost1.test:"+s.httpsPort+"/addr", "vhost1.test", errServer.addr, 503, c)
 }
+
+func (s *HTTPSuite) TestMaintenanceBypass(c *C) {
+	mainServer := s.backendServers[0]
+
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostTest1",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"vhost1.test"},
+		Backends: []client.BackendConfig{
+			{Addr: mainServer.addr},
+		},
+		MaintenanceMode:  true,
+		MaintenanceToken: "letmein",
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	get := func(token string) int {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		if err != nil {
+			c.Fatal(err)
+		}
+		req.Host = "vhost1.test"
+		if token != "" {
+			req.Header.Set(MaintenanceBypassHeader, token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	c.Assert(get(""), Equals, http.StatusServiceUnavailable)
+	c.Assert(get("wrong"), Equals, http.StatusServiceUnavailable)
+	c.Assert(get("letmein"), Equals, http.StatusOK)
+
+	// allow our local address through without a token
+	svcCfg.MaintenanceToken = ""
+	svcCfg.MaintenanceAllow = []string{"127.0.0.0/8"}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	c.Assert(get(""), Equals, http.StatusOK)
+}
+
+// The maintenance response can be customized, and scheduled for a window
+// without maintenance mode.
+func (s *HTTPSuite) TestMaintenanceResponse(c *C) {
+	mainServer := s.backendServers[0]
+
+	start := time.Now().Add(-time.Minute)
+	end := time.Now().Add(time.Hour)
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostTest1",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"vhost1.test"},
+		Backends: []client.BackendConfig{
+			{Addr: mainServer.addr},
+		},
+		Maintenance: &client.MaintenanceConfig{
+			Status:      http.StatusTooManyRequests,
+			Body:        `{"service": "{{.Service}}", "path": "{{.Path}}"}`,
+			ContentType: "application/json",
+			Start:       &start,
+			End:         &end,
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	get := func(path ...string) (*http.Response, string) {
+		u := "http://" + s.httpAddr + "/addr"
+		if len(path) > 0 {
+			u = "http://" + s.httpAddr + path[0]
+		}
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			c.Fatal(err)
+		}
+		req.Host = "vhost1.test"
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, body := get()
+	c.Assert(resp.StatusCode, Equals, http.StatusTooManyRequests)
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "application/json")
+	c.Assert(body, Equals, `{"service": "VHostTest1", "path": "/addr"}`)
+
+	// defaults to the time left in the window
+	retry, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+	c.Assert(retry > 3500 && retry <= 3600, Equals, true)
+
+	svc := Registry.GetService("VHostTest1")
+	c.Assert(svc.Available(), Equals, 0)
+
+	// once the window is over the backends are used again
+	later := time.Now().Add(time.Hour)
+	svcCfg.Maintenance = &client.MaintenanceConfig{Start: &later}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	resp, _ = get()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	// maintenance mode uses the configured status and Retry-After
+	svcCfg.MaintenanceMode = true
+	svcCfg.Maintenance = &client.MaintenanceConfig{RetryAfter: 120}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	resp, _ = get()
+	c.Assert(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(resp.Header.Get("Retry-After"), Equals, "120")
+
+	// the request's values are escaped in an HTML body
+	svcCfg.Maintenance = &client.MaintenanceConfig{Body: "<p>{{.Path}}</p>"}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	resp, body = get("/%3Cscript%3Ealert(1)%3C/script%3E")
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "text/html; charset=utf-8")
+	c.Assert(body, Equals, "<p>/&lt;script&gt;alert(1)&lt;/script&gt;</p>")
+}
+
+// ACME only issues for registered vhosts, and challenges are answered before
+// routing to a service.
+func (s *HTTPSuite) TestACME(c *C) {
+	setupACME(c.MkDir(), "", "http://127.0.0.1:1/directory")
+	defer func() { acmeManager = nil }()
+
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "backend", Addr: s.backendServers[0].addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	c.Assert(acmeHostPolicy(context.Background(), "test-vhost"), IsNil)
+	c.Assert(acmeHostPolicy(context.Background(), "unknown-vhost"), NotNil)
+
+	// the unknown token is a 404 from the challenge handler, not the backend
+	req, _ := http.NewRequest("GET", "http://test-vhost"+acmeChallengePath+"token", nil)
+	w := httptest.NewRecorder()
+	httpRouter.ServeHTTP(w, req)
+
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+	c.Assert(w.Header().Get("X-Request-Id"), Equals, "")
+}
+
+// A wildcard certificate from disk is used before asking ACME for the host.
+func (s *HTTPSuite) TestACMEWildcard(c *C) {
+	var requests int64
+	directory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		http.NotFound(w, r)
+	}))
+	defer directory.Close()
+
+	setupACME(c.MkDir(), "", directory.URL+"/directory")
+	defer func() { acmeManager = nil }()
+	defer func() { httpsCerts = &certStore{} }()
+
+	svcCfg := client.ServiceConfig{
+		Name:         "ACMEWildcardTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"app.wild.test"},
+		Backends: []client.BackendConfig{
+			{Name: "backend", Addr: s.backendServers[0].addr},
+		},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	dir := c.MkDir()
+	wild := writeTestCert(c, dir, "*.wild.test")
+	c.Assert(httpsCerts.Load(dir), IsNil)
+
+	cert, err := httpsCerts.GetCertificate(&tls.ClientHelloInfo{ServerName: "App.Wild.Test"})
+	c.Assert(err, IsNil)
+	c.Assert(cert.Certificate[0], DeepEquals, wild.Raw)
+	c.Assert(atomic.LoadInt64(&requests), Equals, int64(0))
+}
+
+// The stats mirror answers reads, and refuses changes.
+func (s *HTTPSuite) TestStatsMirror(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name: "MirrorTest",
+		Addr: "127.0.0.1:9001",
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	mirror := httptest.NewServer(readOnly(http.DefaultServeMux))
+	defer mirror.Close()
+
+	resp, err := http.Get(mirror.URL + "/MirrorTest/_config")
+	if err != nil {
+		c.Fatal(err)
+	}
+	var cfg client.ServiceConfig
+	err = json.NewDecoder(resp.Body).Decode(&cfg)
+	resp.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(cfg.Name, Equals, "MirrorTest")
+
+	req, _ := http.NewRequest("DELETE", mirror.URL+"/MirrorTest", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusMethodNotAllowed)
+
+	resp, err = http.Post(mirror.URL+"/_config", "application/json", strings.NewReader(`{"services": []}`))
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusMethodNotAllowed)
+
+	c.Assert(Registry.GetService("MirrorTest"), NotNil)
+}
+
+// Create a certificate signed by parent, or self-signed if parent is nil.
+func genTestCert(c *C, cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	c.Assert(err, IsNil)
+
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+	return cert, key
+}
+
+// Require client certificates for a vhost, and pass the subject to the backend
+func (s *HTTPSuite) TestClientCert(c *C) {
+	ca, caKey := genTestCert(c, "test-ca", true, nil, nil)
+	clientCert, _ := genTestCert(c, "test-client", false, ca, caKey)
+	otherCA, otherKey := genTestCert(c, "other-ca", true, nil, nil)
+	otherCert, _ := genTestCert(c, "other-client", false, otherCA, otherKey)
+
+	caFile := filepath.Join(c.MkDir(), "ca.pem")
+	err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644)
+	c.Assert(err, IsNil)
+
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"mtls-vhost"},
+		ClientCA:     caFile,
+		Backends: []client.BackendConfig{
+			{Name: "backend", Addr: s.backendServers[0].addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	// the handshake only asks for a certificate on this vhost
+	getConfig := clientAuthConfig(&tls.Config{})
+	tlsCfg, err := getConfig(&tls.ClientHelloInfo{ServerName: "mtls-vhost"})
+	c.Assert(err, IsNil)
+	c.Assert(tlsCfg.ClientAuth, Equals, tls.RequireAndVerifyClientCert)
+
+	tlsCfg, err = getConfig(&tls.ClientHelloInfo{ServerName: "other-vhost"})
+	c.Assert(err, IsNil)
+	c.Assert(tlsCfg, IsNil)
+
+	svc := Registry.GetService("VHostTest")
+	get := func(certs ...*x509.Certificate) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://mtls-vhost/header?name="+ClientCertSubjectHeader, nil)
+		req.Header.Set(ClientCertSubjectHeader, "CN=spoofed")
+		if certs != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: certs}
+		}
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, req)
+		return w
+	}
+
+	c.Assert(get().Code, Equals, http.StatusForbidden)
+	c.Assert(get(otherCert).Code, Equals, http.StatusForbidden)
+
+	w := get(clientCert)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "CN=test-client")
+}
+
+// Write a self-signed cert and key for cn into dir, for loadCerts.
+func writeTestCert(c *C, dir, cn string) *x509.Certificate {
+	cert, key := genTestCert(c, cn, false, nil, nil)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "test.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "test.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	c.Assert(err, IsNil)
+	return cert
+}
+
+// Reload certificates from disk through the admin API
+func (s *HTTPSuite) TestReloadCerts(c *C) {
+	defer func() { httpsCerts = &certStore{} }()
+
+	dir := c.MkDir()
+	first := writeTestCert(c, dir, "first.test")
+	c.Assert(httpsCerts.Load(dir), IsNil)
+
+	cert, err := httpsCerts.GetCertificate(&tls.ClientHelloInfo{ServerName: "first.test"})
+	c.Assert(err, IsNil)
+	c.Assert(cert.Certificate[0], DeepEquals, first.Raw)
+
+	second := writeTestCert(c, dir, "second.test")
+
+	req, _ := http.NewRequest("POST", "/_certs", nil)
+	w := httptest.NewRecorder()
+	reloadCerts(w, req)
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	names := []string{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &names), IsNil)
+	c.Assert(names, DeepEquals, []string{"second.test"})
+
+	cert, err = httpsCerts.GetCertificate(&tls.ClientHelloInfo{ServerName: "second.test"})
+	c.Assert(err, IsNil)
+	c.Assert(cert.Certificate[0], DeepEquals, second.Raw)
+
+	// a failed reload keeps the current certificates
+	os.Remove(filepath.Join(dir, "test.key"))
+	os.Remove(filepath.Join(dir, "test.pem"))
+
+	w = httptest.NewRecorder()
+	reloadCerts(w, req)
+	c.Assert(w.Code, Equals, http.StatusInternalServerError)
+	c.Assert(httpsCerts.Names(), DeepEquals, []string{"second.test"})
+}
+
+// Parse the TLS policy flags, and negotiate with the resulting config
+func (s *HTTPSuite) TestTLSPolicy(c *C) {
+	_, err := parseTLSPolicy("1.4", "", "", "")
+	c.Assert(err, NotNil)
+	_, err = parseTLSPolicy("", "TLS_NOT_A_CIPHER", "", "")
+	c.Assert(err, NotNil)
+	_, err = parseTLSPolicy("", "", "P123", "")
+	c.Assert(err, NotNil)
+
+	policy, err := parseTLSPolicy("1.2", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "P256, X25519", "h2,http/1.1")
+	c.Assert(err, IsNil)
+	c.Assert(policy.MinVersion, Equals, uint16(tls.VersionTLS12))
+	c.Assert(policy.CipherSuites, DeepEquals, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256})
+	c.Assert(policy.CurvePreferences, DeepEquals, []tls.CurveID{tls.CurveP256, tls.X25519})
+	c.Assert(policy.NextProtos, DeepEquals, []string{"h2", "http/1.1"})
+
+	cert, key := genTestCert(c, "policy.test", false, nil, nil)
+	serverCfg := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+	}
+	policy.apply(serverCfg)
+
+	handshake := func(clientCfg *tls.Config) (tls.ConnectionState, error) {
+		cliConn, srvConn := net.Pipe()
+		defer cliConn.Close()
+		defer srvConn.Close()
+
+		go tls.Server(srvConn, serverCfg).Handshake()
+
+		conn := tls.Client(cliConn, clientCfg)
+		err := conn.Handshake()
+		return conn.ConnectionState(), err
+	}
+
+	state, err := handshake(&tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12, NextProtos: []string{"http/1.1"}})
+	c.Assert(err, IsNil)
+	c.Assert(state.CipherSuite, Equals, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)
+	c.Assert(state.NegotiatedProtocol, Equals, "http/1.1")
+
+	_, err = handshake(&tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11})
+	c.Assert(err, NotNil)
+}
+
+// Require tokens for admin requests, with a read-only role
+func (s *HTTPSuite) TestAdminAuth(c *C) {
+	adminToken, adminReadToken = "rw-token", "ro-token"
+	defer func() { adminToken, adminReadToken = "", "" }()
+
+	do := func(method, token string, basic bool) int {
+		req, _ := http.NewRequest(method, s.httpSvr.URL+"/_config", bytes.NewReader([]byte("{}")))
+		if basic {
+			req.SetBasicAuth("admin", token)
+		} else if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	c.Assert(do("GET", "", false), Equals, http.StatusUnauthorized)
+	c.Assert(do("GET", "wrong", false), Equals, http.StatusUnauthorized)
+	c.Assert(do("GET", "ro-token", false), Equals, http.StatusOK)
+	c.Assert(do("POST", "ro-token", false), Equals, http.StatusForbidden)
+	c.Assert(do("GET", "rw-token", true), Equals, http.StatusOK)
+	c.Assert(do("POST", "rw-token", false), Equals, http.StatusOK)
+
+	// the client sends its token with every request
+	cl := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+	_, err := cl.GetConfig()
+	c.Assert(err, NotNil)
+
+	cl.SetToken("ro-token")
+	_, err = cl.GetConfig()
+	c.Assert(err, IsNil)
+}
+
+// Serve the admin API over https, requiring a client certificate
+func (s *HTTPSuite) TestAdminTLS(c *C) {
+	ca, caKey := genTestCert(c, "admin-ca", true, nil, nil)
+	srvCert, srvKey := genTestCert(c, "admin-server", false, ca, caKey)
+	cliCert, cliKey := genTestCert(c, "admin-client", false, ca, caKey)
+
+	dir := c.MkDir()
+	srvKeyDER, err := x509.MarshalECPrivateKey(srvKey)
+	c.Assert(err, IsNil)
+
+	adminCert = filepath.Join(dir, "admin.pem")
+	adminKey = filepath.Join(dir, "admin.key")
+	adminClientCA = filepath.Join(dir, "ca.pem")
+	defer func() { adminCert, adminKey, adminClientCA = "", "", "" }()
+
+	c.Assert(ioutil.WriteFile(adminCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srvCert.Raw}), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(adminKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: srvKeyDER}), 0600), IsNil)
+	c.Assert(ioutil.WriteFile(adminClientCA, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644), IsNil)
+
+	tlsCfg, err := adminTLSConfig()
+	c.Assert(err, IsNil)
+
+	srv := httptest.NewUnstartedServer(http.DefaultServeMux)
+	srv.TLS = tlsCfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	cl := client.NewClient(srv.URL)
+	cl.SetTLSConfig(&tls.Config{RootCAs: roots})
+	_, err = cl.GetConfig()
+	c.Assert(err, NotNil)
+
+	cl.SetTLSConfig(&tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cliCert.Raw}, PrivateKey: cliKey}},
+	})
+	_, err = cl.GetConfig()
+	c.Assert(err, IsNil)
+}
+
+// HTTP requests over the rate limit get a 429
+func (s *HTTPSuite) TestRateLimit(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "RateLimitTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		RateLimit:    0.1,
+		RateBurst:    1,
+		Backends: []client.BackendConfig{
+			{Name: s.backendServers[0].addr, Addr: s.backendServers[0].addr},
+		},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", s.backendServers[0].addr, 200, c)
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", "too many requests\n", 429, c)
+
+	stats, err := Registry.ServiceStats(svcCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(stats.RateLimited, Equals, int64(1))
+}
+
+// HTTP requests over the service or global connection limit get the 503
+// error page
+func (s *HTTPSuite) TestMaxConnections(c *C) {
+	okServer := s.backendServers[0]
+	errServer := s.backendServers[1]
+
+	svcCfg := client.ServiceConfig{
+		Name:           "MaxConnTest",
+		Addr:           "127.0.0.1:9000",
+		VirtualHosts:   []string{"test-vhost"},
+		MaxConnections: 1,
+		Backends: []client.BackendConfig{
+			{Name: okServer.addr, Addr: okServer.addr},
+		},
+		ErrorPages: map[string][]int{
+			"http://" + errServer.addr + "/error": []int{400, 503},
+		},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	svc := Registry.GetService(svcCfg.Name)
+	c.Assert(svc, NotNil)
+
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", okServer.addr, 200, c)
+
+	// hold the service's only slot
+	c.Assert(svc.acquireConn(), Equals, true)
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", errServer.addr, 503, c)
+	svc.releaseConn()
+
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", okServer.addr, 200, c)
+
+	// and the global limit
+	connLimit.SetLimit(1)
+	defer connLimit.SetLimit(0)
+	c.Assert(connLimit.acquire(), Equals, true)
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", errServer.addr, 503, c)
+	connLimit.release()
+
+	stats, err := Registry.ServiceStats(svcCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(stats.ConnLimited, Equals, int64(2))
+}
+
+// The trace sample is set at runtime, and sampled requests get a new span
+func (s *HTTPSuite) TestTraceSample(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "TraceTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: s.backendServers[0].addr, Addr: s.backendServers[0].addr},
+		},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	httpClient := &http.Client{Transport: &http.Transport{Dial: localDial}}
+	traceparent := func(sent string) string {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/header?name=Traceparent", nil)
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+		if sent != "" {
+			req.Header.Set("Traceparent", sent)
+		}
+
+		resp, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return string(body)
+	}
+
+	unsampled := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00"
+	sampled := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+	// nothing is traced by default, and the client's header is untouched
+	c.Assert(traceparent(""), Equals, "")
+	c.Assert(traceparent(unsampled), Equals, unsampled)
+
+	// the client's sampling decision is always followed
+	tp := traceparent(sampled)
+	c.Assert(tp, Matches, "00-0af7651916cd43dd8448eb211c80319c-[0-9a-f]{16}-01")
+	c.Assert(tp, Not(Equals), sampled)
+
+	cl := client.NewClient(s.httpSvr.URL)
+	c.Assert(cl.SetTraceSample(svcCfg.Name, 2), NotNil)
+	c.Assert(cl.SetTraceSample("nonexistent", 1), NotNil)
+	c.Assert(cl.SetTraceSample(svcCfg.Name, 1), IsNil)
+
+	c.Assert(traceparent(""), Matches, "00-[0-9a-f]{32}-[0-9a-f]{16}-01")
+	tp = traceparent(unsampled)
+	c.Assert(tp, Matches, "00-0af7651916cd43dd8448eb211c80319c-[0-9a-f]{16}-01")
+
+	svc, err := Registry.ServiceConfig(svcCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(svc.TraceSample, Equals, 1.0)
+}
+
+// Headers are stripped and set before the request is proxied
+func (s *HTTPSuite) TestHeaderPolicy(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "HeaderTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		StripHeaders: []string{"X-Forwarded-For", "X-Internal"},
+		SetHeaders:   map[string]string{"X-Env": "test"},
+		Backends: []client.BackendConfig{
+			{Name: s.backendServers[0].addr, Addr: s.backendServers[0].addr},
+		},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	httpClient := &http.Client{Transport: &http.Transport{Dial: localDial}}
+	header := func(name string) string {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/header?name="+name, nil)
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		req.Header.Set("X-Internal", "spoofed")
+		req.Header.Set("X-Env", "prod")
+
+		resp, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return string(body)
+	}
+
+	// only shuttle's own view of the client address is forwarded
+	c.Assert(header("X-Forwarded-For"), Equals, "127.0.0.1")
+	c.Assert(header("X-Internal"), Equals, "")
+	c.Assert(header("X-Env"), Equals, "test")
+}
+
+// Too many errors mark the service degraded, and apply the mitigation until
+// the errors leave the window
+func (s *HTTPSuite) TestErrorBudget(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "BudgetTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		ErrorBudget: &client.ErrorBudgetConfig{
+			Threshold:   0.5,
+			Window:      500,
+			MinRequests: 3,
+			Mitigation:  client.MitigateMaintenance,
+		},
+		Backends: []client.BackendConfig{
+			{Name: s.backendServers[0].addr, Addr: s.backendServers[0].addr},
+		},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	addr := s.backendServers[0].addr
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", addr, 200, c)
+	checkHTTP("http://"+s.httpAddr+"/error?code=500", "test-vhost", addr, 500, c)
+
+	stats, err := Registry.ServiceStats(svcCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Degraded, Equals, false)
+
+	checkHTTP("http://"+s.httpAddr+"/error?code=502", "test-vhost", addr, 502, c)
+
+	stats, err = Registry.ServiceStats(svcCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Degraded, Equals, true)
+	c.Assert(stats.ErrorRate > 0.6, Equals, true)
+	c.Assert(stats.Features, DeepEquals, []string{"error_budget"})
+
+	// the maintenance response is served while degraded
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", "", 503, c)
+
+	time.Sleep(600 * time.Millisecond)
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", addr, 200, c)
+
+	stats, err = Registry.ServiceStats(svcCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Degraded, Equals, false)
+}
+
+// Backends aren't tried once the client has gone away, and the abort isn't
+// counted as an HTTP error
+func (s *HTTPSuite) TestClientAborted(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "AbortTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: s.backendServers[0].addr, Addr: s.backendServers[0].addr},
+		},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	svc := Registry.GetService(svcCfg.Name)
+	c.Assert(svc, NotNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req := httptest.NewRequest("GET", "http://test-vhost/addr", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	svc.ServeHTTP(rec, req)
+	c.Assert(rec.Body.Len(), Equals, 0)
+
+	stats, err := Registry.ServiceStats(svcCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(stats.ClientAborted, Equals, int64(1))
+	c.Assert(stats.HTTPErrors, Equals, int64(0))
+	c.Assert(stats.Backends[0].Conns, Equals, int64(0))
+}
+
+// Sign a test token with an EC key, or an HMAC secret
+func signTestJWT(c *C, key interface{}, kid string, claims map[string]interface{}) string {
+	alg := "ES256"
+	if _, ok := key.([]byte); ok {
+		alg = "HS256"
+	}
+
+	hdr, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	c.Assert(err, IsNil)
+	body, err := json.Marshal(claims)
+	c.Assert(err, IsNil)
+
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(body)
+
+	var sig []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		c.Assert(err, IsNil)
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// Requests need a valid token, and the subject is passed to the backend
+func (s *HTTPSuite) TestJWT(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "EC",
+				"kid": "test-key",
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+				"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+			}},
+		})
+	}))
+	defer jwks.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:         "JWTTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		JWT: &client.JWTConfig{
+			JWKSURL:  jwks.URL,
+			Secret:   "shared-secret",
+			Issuer:   "test-issuer",
+			Audience: "shuttle",
+		},
+		Backends: []client.BackendConfig{
+			{Name: s.backendServers[0].addr, Addr: s.backendServers[0].addr},
+		},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	httpClient := &http.Client{Transport: &http.Transport{Dial: localDial}}
+	get := func(token string) (int, string) {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/header?name="+JWTSubjectHeader, nil)
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+		req.Header.Set(JWTSubjectHeader, "spoofed")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return resp.StatusCode, string(body)
+	}
+
+	claims := map[string]interface{}{
+		"sub": "user-1",
+		"iss": "test-issuer",
+		"aud": []string{"other", "shuttle"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+
+	code, _ := get("")
+	c.Assert(code, Equals, http.StatusUnauthorized)
+
+	code, body := get(signTestJWT(c, key, "test-key", claims))
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, "user-1")
+
+	code, body = get(signTestJWT(c, []byte("shared-secret"), "", claims))
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, "user-1")
+
+	code, _ = get(signTestJWT(c, []byte("wrong-secret"), "", claims))
+	c.Assert(code, Equals, http.StatusUnauthorized)
+
+	claims["aud"] = "other"
+	code, _ = get(signTestJWT(c, key, "test-key", claims))
+	c.Assert(code, Equals, http.StatusUnauthorized)
+
+	claims["aud"] = "shuttle"
+	claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	code, _ = get(signTestJWT(c, key, "test-key", claims))
+	c.Assert(code, Equals, http.StatusUnauthorized)
+}
+
+// The JWKS is fetched again without holding up requests, which use the
+// cached keys meanwhile.
+func (s *HTTPSuite) TestJWKSRefresh(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	var fetches int64
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&fetches, 1) == 2 {
+			close(fetching)
+			<-release
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "EC",
+				"kid": "test-key",
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+				"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+			}},
+		})
+	}))
+	defer jwks.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	v := newJWTVerifier("JWKSTest", &client.JWTConfig{JWKSURL: jwks.URL})
+	c.Assert(v.keys("test-key"), HasLen, 1)
+
+	// the keys are due to be fetched again
+	v.Lock()
+	v.fetched = time.Now().Add(-jwksRefresh - time.Second)
+	v.Unlock()
+
+	refreshed := make(chan []crypto.PublicKey)
+	go func() {
+		refreshed <- v.keys("test-key")
+	}()
+	<-fetching
+
+	cached := make(chan []crypto.PublicKey)
+	go func() {
+		cached <- v.keys("test-key")
+	}()
+	select {
+	case keys := <-cached:
+		c.Assert(keys, HasLen, 1)
+	case <-time.After(5 * time.Second):
+		c.Fatal("the cached keys weren't used while fetching the JWKS")
+	}
+
+	close(release)
+	c.Assert(<-refreshed, HasLen, 1)
+	c.Assert(atomic.LoadInt64(&fetches), Equals, int64(2))
+}
+
+// A consistent snapshot rolls up each service from the same counters reported
+// for its backends
+func (s *HTTPSuite) TestConsistentStats(c *C) {
+	srv := s.backendServers[0]
+	svcCfg := client.ServiceConfig{
+		Name:         "SnapshotTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: srv.addr, Addr: srv.addr},
+		},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	for i := 0; i < 4; i++ {
+		checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", srv.addr, 200, c)
+	}
+
+	resp, err := http.Get(s.httpSvr.URL + "/_stats?consistent=true")
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	taken, err := time.Parse(time.RFC3339Nano, resp.Header.Get("X-Snapshot-Time"))
+	c.Assert(err, IsNil)
+	c.Assert(time.Since(taken) < time.Minute, Equals, true)
+
+	var stats []ServiceStat
+	c.Assert(json.NewDecoder(resp.Body).Decode(&stats), IsNil)
+	c.Assert(stats, HasLen, 1)
+	c.Assert(stats[0].Name, Equals, svcCfg.Name)
+	c.Assert(stats[0].HTTPConns, Equals, int64(4))
+	c.Assert(stats[0].Backends, HasLen, 1)
+
+	c.Assert(stats[0].Conns, Equals, stats[0].Backends[0].Conns)
+	c.Assert(stats[0].Sent, Equals, stats[0].Backends[0].Sent)
+}
+
+// Delta requests wait for a change, and return only what changed
+func (s *HTTPSuite) TestStatsDelta(c *C) {
+	srv := s.backendServers[0]
+	svcCfg := client.ServiceConfig{
+		Name:         "DeltaTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: srv.addr, Addr: srv.addr},
+		},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+
+	getDelta := func(query string) StatsDelta {
+		resp, err := http.Get(s.httpSvr.URL + "/_stats/delta?" + query)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		var delta StatsDelta
+		c.Assert(json.NewDecoder(resp.Body).Decode(&delta), IsNil)
+		return delta
+	}
+
+	// an unknown generation gets everything
+	delta := getDelta("since=0")
+	c.Assert(delta.Full, Equals, true)
+	c.Assert(delta.Services, HasLen, 1)
+	gen := delta.Generation
+
+	// nothing changes
+	delta = getDelta(fmt.Sprintf("since=%d&timeout=300", gen))
+	c.Assert(delta.Generation, Equals, gen)
+	c.Assert(delta.Services, HasLen, 0)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", srv.addr, 200, c)
+	}()
+
+	delta = getDelta(fmt.Sprintf("since=%d&timeout=5000", gen))
+	c.Assert(delta.Full, Equals, false)
+	c.Assert(delta.Generation > gen, Equals, true)
+	c.Assert(delta.Services, HasLen, 1)
+	c.Assert(delta.Services[0].HTTPConns, Equals, int64(1))
+
+	// the bytes for a single request are well under the threshold
+	gen = delta.Generation
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", srv.addr, 200, c)
+	delta = getDelta(fmt.Sprintf("since=%d&threshold=100000&timeout=300", gen))
+	c.Assert(delta.Services, HasLen, 0)
+
+	c.Assert(Registry.RemoveService(svcCfg.Name), IsNil)
+	delta = getDelta(fmt.Sprintf("since=%d&timeout=5000", gen))
+	c.Assert(delta.Removed, DeepEquals, []string{svcCfg.Name})
+
+	resp, err := http.Get(s.httpSvr.URL + "/_stats/delta?since=bad")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+}
+
+// HTTP/2 clients are proxied to HTTP/2 backends, with trailers
+func (s *HTTPSuite) TestHTTP2(c *C) {
+	backend := httptest.NewUnstartedServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+		w.Header().Set("X-Te", r.Header.Get("Te"))
+		io.WriteString(w, "ok")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}), &http2.Server{}))
+	backend.Start()
+	defer backend.Close()
+	backendAddr := backend.Listener.Addr().String()
+
+	svcCfg := client.ServiceConfig{
+		Name:         "HTTP2Test",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		HTTP2:        true,
+		Backends: []client.BackendConfig{
+			{Name: backendAddr, Addr: backendAddr},
+		},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	server := &http.Server{Addr: "127.0.0.1:0"}
+	router := NewHostRouter(server)
+	configureH2C(server)
+	ready := make(chan bool)
+	go router.Start(ready)
+	<-ready
+	defer router.Stop()
+
+	h2Client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, nw, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(nw, addr)
+		},
+	}}
+
+	get := func(httpClient *http.Client) *http.Response {
+		req, err := http.NewRequest("GET", "http://"+router.listener.Addr().String()+"/", nil)
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+		req.Header.Set("Te", "trailers")
+
+		resp, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		c.Assert(string(body), Equals, "ok")
+		return resp
+	}
+
+	resp := get(h2Client)
+	c.Assert(resp.ProtoMajor, Equals, 2)
+	c.Assert(resp.Header.Get("X-Proto"), Equals, "HTTP/2.0")
+	c.Assert(resp.Header.Get("X-Te"), Equals, "trailers")
+	c.Assert(resp.Trailer.Get("Grpc-Status"), Equals, "0")
+
+	// HTTP/1.1 clients are still served, and proxied over HTTP/2
+	resp = get(http.DefaultClient)
+	c.Assert(resp.ProtoMajor, Equals, 1)
+	c.Assert(resp.Header.Get("X-Proto"), Equals, "HTTP/2.0")
+
+	// h2 is preferred when negotiating with TLS clients
+	tlsServer := &http.Server{TLSConfig: &tls.Config{NextProtos: []string{"http/1.1"}}}
+	c.Assert(configureHTTP2(tlsServer), IsNil)
+	c.Assert(tlsServer.TLSConfig.NextProtos, DeepEquals, []string{"h2", "http/1.1"})
+}
+
+// gRPC failures in the trailers count as errors, and proxy errors are
+// returned as a grpc-status
+func (s *HTTPSuite) TestGRPC(c *C) {
+	codes := map[string]string{"/ok": "0", "/notfound": "5", "/internal": "13"}
+	backend := httptest.NewUnstartedServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", codes[r.URL.Path])
+	}), &http2.Server{}))
+	backend.Start()
+	defer backend.Close()
+	backendAddr := backend.Listener.Addr().String()
+
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:         "GRPCTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		HTTP2:        true,
+		Backends: []client.BackendConfig{
+			{Name: backendAddr, Addr: backendAddr},
+		},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	downCfg := client.ServiceConfig{
+		Name:         "GRPCDownTest",
+		Addr:         "127.0.0.1:9001",
+		VirtualHosts: []string{"grpc-down"},
+		HTTP2:        true,
+		Backends: []client.BackendConfig{
+			{Name: deadAddr, Addr: deadAddr},
+		},
+	}
+	c.Assert(Registry.AddService(downCfg), IsNil)
+	defer Registry.RemoveService(downCfg.Name)
+
+	server := &http.Server{Addr: "127.0.0.1:0"}
+	router := NewHostRouter(server)
+	configureH2C(server)
+	ready := make(chan bool)
+	go router.Start(ready)
+	<-ready
+	defer router.Stop()
+
+	h2Client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, nw, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(nw, addr)
+		},
+	}}
+
+	call := func(host, path string) *http.Response {
+		req, err := http.NewRequest("POST", "http://"+router.listener.Addr().String()+path, strings.NewReader(""))
+		c.Assert(err, IsNil)
+		req.Host = host
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Te", "trailers")
+
+		resp, err := h2Client.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		_, err = ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return resp
+	}
+
+	for path, code := range codes {
+		resp := call("test-vhost", path)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(resp.Trailer.Get("Grpc-Status"), Equals, code)
+	}
+
+	// only the server's failure is an error
+	stats, err := Registry.ServiceStats(svcCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(stats.HTTPErrors, Equals, int64(1))
+
+	resp := call("grpc-down", "/ok")
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("Grpc-Status"), Equals, "14")
+
+	stats, err = Registry.ServiceStats(downCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(stats.HTTPErrors, Equals, int64(1))
+}
+
+// The access log and debug headers name the backend, and the attempt which
+// reached it
+func (s *HTTPSuite) TestBackendAttempt(c *C) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	okServer := s.backendServers[0]
+	svcCfg := client.ServiceConfig{
+		Name:         "AttemptTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "dead", Addr: deadAddr},
+			{Name: "ok", Addr: okServer.addr},
+		},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	var logs bytes.Buffer
+	output := log.SetOutput(&logs)
+	defer log.SetOutput(output)
+
+	// round robin starts one of the requests on the dead backend
+	attempts := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(resp.Header.Get("X-Backend"), Equals, okServer.addr)
+		c.Assert(resp.Header.Get("X-Backend-Name"), Equals, "ok")
+		attempts[resp.Header.Get("X-Backend-Attempt")] = true
+	}
+
+	// stop capturing before the logs are read
+	log.SetOutput(output)
+	c.Assert(attempts, DeepEquals, map[string]bool{"1": true, "2": true})
+	c.Assert(strings.Contains(logs.String(), "backend="+okServer.addr+" backend-name=ok attempt=2 status=200"), Equals, true)
+}
+
+// Upgrade requests are spliced through to the backend, and counted while open.
+func (s *HTTPSuite) TestWebSocketUpgrade(c *C) {
+	// a backend which echoes lines once upgraded
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		for {
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			brw.WriteString("echo: " + line)
+			brw.Flush()
+		}
+	}))
+	defer backend.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:         "UpgradeTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "echo", Addr: backend.Listener.Addr().String()},
+		},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	// an ordinary request still goes through the Transport
+	checkHTTP("http://"+s.httpAddr+"/", "test-vhost", "upgrade required\n", http.StatusUpgradeRequired, c)
+
+	conn, err := net.Dial("tcp", s.httpAddr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "GET /socket HTTP/1.1\r\nHost: test-vhost\r\nConnection: keep-alive, Upgrade\r\nUpgrade: echo\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, http.StatusSwitchingProtocols)
+	c.Assert(resp.Header.Get("Upgrade"), Equals, "echo")
+
+	for _, msg := range []string{"hello\n", "world\n"} {
+		io.WriteString(conn, msg)
+		line, err := br.ReadString('\n')
+		c.Assert(err, IsNil)
+		c.Assert(line, Equals, "echo: "+msg)
+	}
+
+	svc := Registry.GetService(svcCfg.Name)
+	stats := svc.Stats()
+	c.Assert(stats.Upgrades, Equals, int64(1))
+	c.Assert(stats.UpgradeActive, Equals, int64(1))
+
+	conn.Close()
+	for i := 0; i < 20 && svc.Stats().UpgradeActive != 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(svc.Stats().UpgradeActive, Equals, int64(0))
+}
+
+// Services sharing a vhost split its requests by their header routes.
+func (s *HTTPSuite) TestHeaderRoutes(c *C) {
+	svcs := []client.ServiceConfig{
+		{
+			Name:         "DefaultRoute",
+			Addr:         "127.0.0.1:9000",
+			VirtualHosts: []string{"test-vhost"},
+			Backends:     []client.BackendConfig{{Name: "default", Addr: s.backendServers[0].addr}},
+		},
+		{
+			Name:         "TenantRoute",
+			Addr:         "127.0.0.1:9001",
+			VirtualHosts: []string{"test-vhost"},
+			HeaderRoutes: []client.HeaderRoute{{Header: "x-tenant", Value: "ACME"}},
+			Backends:     []client.BackendConfig{{Name: "tenant", Addr: s.backendServers[1].addr}},
+		},
+		{
+			Name:         "MobileRoute",
+			Addr:         "127.0.0.1:9002",
+			VirtualHosts: []string{"test-vhost"},
+			HeaderRoutes: []client.HeaderRoute{{Header: "User-Agent", Regexp: "(?i)mobile"}},
+			Backends:     []client.BackendConfig{{Name: "mobile", Addr: s.backendServers[2].addr}},
+		},
+	}
+	for _, svcCfg := range svcs {
+		c.Assert(Registry.AddService(svcCfg), IsNil)
+		defer Registry.RemoveService(svcCfg.Name)
+	}
+
+	route := func(header http.Header) string {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+		req.Header = header
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		return resp.Header.Get("X-Backend")
+	}
+
+	// requests without a matching header always go to the default service
+	for i := 0; i < 3; i++ {
+		c.Assert(route(http.Header{}), Equals, s.backendServers[0].addr)
+		c.Assert(route(http.Header{"X-Tenant": {"other"}}), Equals, s.backendServers[0].addr)
+	}
+
+	c.Assert(route(http.Header{"X-Tenant": {"acme"}}), Equals, s.backendServers[1].addr)
+	c.Assert(route(http.Header{"User-Agent": {"Example/1.0 (Mobile)"}}), Equals, s.backendServers[2].addr)
+
+	c.Assert(Registry.GetService("TenantRoute").Config().HeaderRoutes, DeepEquals, svcs[1].HeaderRoutes)
+
+	// a routed service without backends still gets its requests
+	c.Assert(Registry.UpdateService(client.ServiceConfig{
+		Name:         "TenantRoute",
+		Addr:         "127.0.0.1:9001",
+		VirtualHosts: []string{"test-vhost"},
+		HeaderRoutes: svcs[1].HeaderRoutes,
+		Backends:     []client.BackendConfig{},
+	}), IsNil)
+
+	req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+	c.Assert(err, IsNil)
+	req.Host = "test-vhost"
+	req.Header.Set("X-Tenant", "acme")
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusBadGateway)
+}
+
+// Older backends can be sent bodies with a Content-Length, no headers named
+// in Connection, and no protocol upgrades.
+func (s *HTTPSuite) TestHTTPCompat(c *C) {
+	type seen struct {
+		ContentLength    int64
+		TransferEncoding []string
+		Connection       string
+		Hop              string
+		Upgrade          string
+		Body             string
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Connection", "X-Resp-Hop")
+		w.Header().Set("X-Resp-Hop", "1")
+		w.Write(marshal(seen{
+			ContentLength:    r.ContentLength,
+			TransferEncoding: r.TransferEncoding,
+			Connection:       r.Header.Get("Connection"),
+			Hop:              r.Header.Get("X-Hop"),
+			Upgrade:          r.Header.Get("Upgrade"),
+			Body:             string(body),
+		}))
+	}))
+	defer backend.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:                "VHostTest",
+		Addr:                "127.0.0.1:9000",
+		VirtualHosts:        []string{"test-vhost"},
+		ForceHTTP11:         true,
+		NoChunked:           true,
+		NormalizeConnection: true,
+		Backends:            []client.BackendConfig{{Name: "legacy", Addr: backend.Listener.Addr().String()}},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	do := func() (*http.Response, seen) {
+		// a body of unknown length is sent chunked
+		body := struct{ io.Reader }{strings.NewReader("legacy body")}
+		req, err := http.NewRequest("POST", "http://"+s.httpAddr+"/", body)
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+		req.Header.Set("Connection", "X-Hop, Upgrade")
+		req.Header.Set("X-Hop", "secret")
+		req.Header.Set("Upgrade", "websocket")
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+
+		var got seen
+		c.Assert(json.NewDecoder(resp.Body).Decode(&got), IsNil)
+		return resp, got
+	}
+
+	resp, got := do()
+	c.Assert(got, DeepEquals, seen{
+		ContentLength: int64(len("legacy body")),
+		Connection:    "keep-alive",
+		Body:          "legacy body",
+	})
+	c.Assert(resp.Header.Get("X-Resp-Hop"), Equals, "")
+
+	svcCfg.ForceHTTP11 = false
+	svcCfg.NoChunked = false
+	svcCfg.NormalizeConnection = false
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+
+	resp, got = do()
+	c.Assert(got.ContentLength, Equals, int64(-1))
+	c.Assert(got.TransferEncoding, DeepEquals, []string{"chunked"})
+	c.Assert(got.Hop, Equals, "secret")
+	c.Assert(resp.Header.Get("X-Resp-Hop"), Equals, "1")
+}
+
+// Concurrent config pushes are applied one at a time in the order of their
+// transaction IDs, and each transaction's status can be read back.
+func (s *HTTPSuite) TestConfigTxns(c *C) {
+	defer Registry.RemoveService("TxnTest")
+
+	post := func(query string, timeout int) (*http.Response, ConfigTxnStatus) {
+		cfg := client.Config{
+			Services: []client.ServiceConfig{{Name: "TxnTest", Addr: "127.0.0.1:9000", ServerTimeout: timeout}},
+		}
+		resp, err := http.Post(s.httpSvr.URL+"/_config"+query, "application/json", bytes.NewReader(marshal(cfg)))
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+
+		var status ConfigTxnStatus
+		if query != "" {
+			c.Assert(json.NewDecoder(resp.Body).Decode(&status), IsNil)
+		}
+		return resp, status
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	pushed := map[uint64]bool{}
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(timeout int) {
+			defer wg.Done()
+			resp, status := post("?async=true", timeout*1000)
+			c.Check(resp.StatusCode, Equals, http.StatusAccepted)
+			c.Check(resp.Header.Get(ConfigTxnHeader), Equals, strconv.FormatUint(status.ID, 10))
+
+			mu.Lock()
+			pushed[status.ID] = true
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	c.Assert(pushed, HasLen, 10)
+
+	// a synchronous push waits behind the others
+	resp, _ := post("", 500)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	id, err := strconv.ParseUint(resp.Header.Get(ConfigTxnHeader), 10, 64)
+	c.Assert(err, IsNil)
+	c.Assert(Registry.GetService("TxnTest").Config().ServerTimeout, Equals, 500)
+
+	get := func(txnID uint64) ConfigTxnStatus {
+		resp, err := http.Get(fmt.Sprintf("%s/_config/txn/%d", s.httpSvr.URL, txnID))
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+
+		var status ConfigTxnStatus
+		c.Assert(json.NewDecoder(resp.Body).Decode(&status), IsNil)
+		return status
+	}
+
+	// each finished before the next one started
+	var finished time.Time
+	for txnID := id - 10; txnID <= id; txnID++ {
+		c.Assert(pushed[txnID] || txnID == id, Equals, true)
+
+		status := get(txnID)
+		c.Assert(status.State, Equals, txnApplied)
+		c.Assert(status.Report.Applied, DeepEquals, []string{"TxnTest"})
+		c.Assert(status.Finished.Before(finished), Equals, false)
+		finished = *status.Finished
+	}
+
+	resp, err = http.Get(s.httpSvr.URL + "/_config/txn/999999")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+}
+
+// Report the services applied from a config, and apply nothing in atomic mode
+// when any fails.
+func (s *HTTPSuite) TestAtomicConfig(c *C) {
+	existing := client.ServiceConfig{Name: "AtomicExisting", Addr: "127.0.0.1:9000", ServerTimeout: 1000}
+	c.Assert(Registry.AddService(existing), IsNil)
+	defer Registry.RemoveService(existing.Name)
+	defer Registry.RemoveService("AtomicNew")
+
+	post := func(query string, cfg client.Config) (int, ApplyReport) {
+		resp, err := http.Post(s.httpSvr.URL+"/_config"+query, "application/json", bytes.NewReader(marshal(cfg)))
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+
+		var report ApplyReport
+		c.Assert(json.NewDecoder(resp.Body).Decode(&report), IsNil)
+		return resp.StatusCode, report
+	}
+
+	// changing the ClientTimeout requires a new listener
+	cfg := client.Config{
+		Services: []client.ServiceConfig{
+			{Name: "AtomicNew", Addr: "127.0.0.1:9001"},
+			{Name: "AtomicExisting", Addr: "127.0.0.1:9000", ClientTimeout: 1234},
+		},
+	}
+
+	status, report := post("?atomic=true", cfg)
+	c.Assert(status, Equals, http.StatusInternalServerError)
+	c.Assert(report.Applied, DeepEquals, []string{})
+	c.Assert(report.Rejected, DeepEquals, map[string]string{"AtomicExisting": ErrInvalidServiceUpdate.Error()})
+	c.Assert(Registry.GetService("AtomicNew"), IsNil)
+
+	status, report = post("", cfg)
+	c.Assert(status, Equals, http.StatusInternalServerError)
+	c.Assert(report.Applied, DeepEquals, []string{"AtomicNew"})
+	c.Assert(report.Rejected, HasLen, 1)
+	c.Assert(Registry.GetService("AtomicNew"), NotNil)
+
+	// a service which can't bind rolls back those applied before it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	cfg = client.Config{
+		Services: []client.ServiceConfig{
+			{Name: "AtomicExisting", Addr: "127.0.0.1:9000", ServerTimeout: 2000},
+			{Name: "AtomicAdded", Addr: "127.0.0.1:9002"},
+			{Name: "AtomicUnbound", Addr: l.Addr().String()},
+		},
+	}
+
+	status, report = post("?atomic=true", cfg)
+	c.Assert(status, Equals, http.StatusInternalServerError)
+	c.Assert(report.Applied, DeepEquals, []string{})
+	c.Assert(report.Rejected["AtomicUnbound"], Not(Equals), "")
+	c.Assert(Registry.GetService("AtomicAdded"), IsNil)
+	c.Assert(Registry.GetService("AtomicUnbound"), IsNil)
+	c.Assert(Registry.GetService("AtomicExisting").Config().ServerTimeout, Equals, 1000)
+
+	status, report = post("?atomic=true", client.Config{Services: cfg.Services[:2]})
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(report.Applied, DeepEquals, []string{"AtomicExisting", "AtomicAdded"})
+	c.Assert(Registry.RemoveService("AtomicAdded"), IsNil)
+	c.Assert(Registry.GetService("AtomicExisting").Config().ServerTimeout, Equals, 2000)
+}
+
+// An atomic config which is rolled back leaves the globals as they were.
+func (s *HTTPSuite) TestAtomicConfigGlobals(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	before := Registry.Config()
+	limit := atomic.LoadInt64(&connLimit.limit)
+
+	cfg := client.Config{
+		Balance:        "LC",
+		ServerTimeout:  4321,
+		MaxConnections: 7,
+		Services: []client.ServiceConfig{
+			{Name: "GlobalsAdded", Addr: "127.0.0.1:9003"},
+			{Name: "GlobalsUnbound", Addr: l.Addr().String()},
+		},
+	}
+
+	report, err := Registry.ApplyConfig(cfg, true, false)
+	c.Assert(err, NotNil)
+	c.Assert(report.Applied, DeepEquals, []string{})
+	c.Assert(Registry.GetService("GlobalsAdded"), IsNil)
+
+	after := Registry.Config()
+	c.Assert(after.Balance, Equals, before.Balance)
+	c.Assert(after.ServerTimeout, Equals, before.ServerTimeout)
+	c.Assert(after.MaxConnections, Equals, before.MaxConnections)
+	c.Assert(atomic.LoadInt64(&connLimit.limit), Equals, limit)
+}
+
+// Retry idempotent requests after a failed response status, and count the
+// failures against the backend's health.
+func (s *HTTPSuite) TestRetryStatus(c *C) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	failAddr := failing.Listener.Addr().String()
+
+	okServer := s.backendServers[0]
+	svcCfg := client.ServiceConfig{
+		Name:          "RetryTest",
+		Addr:          "127.0.0.1:9000",
+		VirtualHosts:  []string{"test-vhost"},
+		RetryStatus:   []int{502, 503},
+		Fall:          1,
+		CheckInterval: 60000,
+		Backends: []client.BackendConfig{
+			{Name: "failing", Addr: failAddr, CheckAddr: failAddr},
+			{Name: "ok", Addr: okServer.addr},
+		},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	do := func(method string) *http.Response {
+		req, err := http.NewRequest(method, "http://"+s.httpAddr+"/addr", nil)
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		return resp
+	}
+
+	// round robin starts one of them on the failing backend
+	attempts := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		resp := do("GET")
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(resp.Header.Get("X-Backend"), Equals, okServer.addr)
+		attempts[resp.Header.Get("X-Backend-Attempt")] = true
+	}
+	c.Assert(attempts["2"], Equals, true)
+
+	// the failure marked the backend down
+	stats, err := Registry.BackendStats(svcCfg.Name, "failing")
+	c.Assert(err, IsNil)
+	c.Assert(stats.Up, Equals, false)
+	c.Assert(stats.Errors, Equals, int64(1))
+	c.Assert(stats.LastError, Equals, "HTTP 503 Service Unavailable")
+
+	// a POST isn't retried, so one of them gets the failed response
+	c.Assert(Registry.GetService(svcCfg.Name).get("failing").SetAdminState(client.AdminUp), IsNil)
+	statuses := map[int]bool{}
+	for i := 0; i < 2; i++ {
+		statuses[do("POST").StatusCode] = true
+	}
+	c.Assert(statuses, DeepEquals, map[int]bool{http.StatusOK: true, http.StatusServiceUnavailable: true})
+}
+
+// A buffered idempotent request is replayed on the next backend when the
+// connection fails after it was sent.
+func (s *HTTPSuite) TestReplayBody(c *C) {
+	// read the whole request, then hang up without a response
+	dropping := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		c.Assert(err, IsNil)
+		conn.Close()
+	}))
+	defer dropping.Close()
+
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer echo.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:          "ReplayTest",
+		Addr:          "127.0.0.1:9000",
+		VirtualHosts:  []string{"test-vhost"},
+		ReplayBody:    1024,
+		Fall:          10,
+		CheckInterval: 60000,
+		Backends: []client.BackendConfig{
+			{Name: "dropping", Addr: dropping.Listener.Addr().String()},
+			{Name: "echo", Addr: echo.Listener.Addr().String()},
+		},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	do := func(method, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, "http://"+s.httpAddr+"/", strings.NewReader(body))
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		got, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(got)
+	}
+
+	// round robin starts one of them on the dropping backend
+	attempts := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		resp, body := do("PUT", "replayed body")
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(body, Equals, "replayed body")
+		attempts[resp.Header.Get("X-Backend-Attempt")] = true
+	}
+	c.Assert(attempts["2"], Equals, true)
+
+	// a POST isn't replayed, and neither is a body over the limit
+	statuses := map[int]bool{}
+	for i := 0; i < 2; i++ {
+		resp, _ := do("POST", "not replayed")
+		statuses[resp.StatusCode] = true
+	}
+	c.Assert(statuses[http.StatusBadGateway], Equals, true)
+
+	statuses = map[int]bool{}
+	for i := 0; i < 2; i++ {
+		resp, _ := do("PUT", strings.Repeat("x", 2048))
+		statuses[resp.StatusCode] = true
+	}
+	c.Assert(statuses[http.StatusBadGateway], Equals, true)
+}
+
+// Paths and vhosts excepted from the HTTPSRedirect are served over http.
+func (s *HTTPSuite) TestHTTPSRedirectExcept(c *C) {
+	srv := s.backendServers[0]
+	svcCfg := client.ServiceConfig{
+		Name:                "RedirectExcept",
+		Addr:                "127.0.0.1:9000",
+		HTTPSRedirect:       true,
+		HTTPSRedirectExcept: []string{"/addr", "Plain.Test"},
+		VirtualHosts:        []string{"secure.test", "plain.test"},
+		Backends:            []client.BackendConfig{{Name: "srv", Addr: srv.addr}},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	status := func(host, path string) int {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+path, nil)
+		c.Assert(err, IsNil)
+		req.Host = host
+
+		resp, err := client.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	c.Assert(status("secure.test", "/error?code=200"), Equals, http.StatusMovedPermanently)
+	c.Assert(status("secure.test", "/addr"), Equals, http.StatusOK)
+	c.Assert(status("plain.test", "/error?code=200"), Equals, http.StatusOK)
+	c.Assert(status("plain.test:80", "/error?code=200"), Equals, http.StatusOK)
+
+	// exceptions can be removed at runtime
+	svcCfg.HTTPSRedirectExcept = []string{}
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	c.Assert(status("secure.test", "/addr"), Equals, http.StatusMovedPermanently)
+}
+
+// Header rules rewrite requests to the backends and responses to the client.
+func (s *HTTPSuite) TestHeaderRules(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "HeaderRules",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		SetHeaders:   map[string]string{"X-Env": "test"},
+		HeaderRules: []client.HeaderRule{
+			{Action: client.HeaderAdd, Header: "X-Tag", Value: "shuttle"},
+			{Action: client.HeaderRemove, Header: "X-Env"},
+			{Action: client.HeaderSet, Header: "Strict-Transport-Security", Value: "max-age=31536000", Response: true},
+			{Action: client.HeaderRemove, Header: "X-Backend-Attempt", Response: true},
+			{Action: "replace", Header: "X-Invalid"},
+		},
+		Backends: []client.BackendConfig{
+			{Name: s.backendServers[0].addr, Addr: s.backendServers[0].addr},
+		},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	get := func(name string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/header?name="+name, nil)
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return resp, string(body)
+	}
+
+	_, body := get("X-Tag")
+	c.Assert(body, Equals, "shuttle")
+	_, body = get("X-Env")
+	c.Assert(body, Equals, "")
+
+	resp, _ := get("X-Tag")
+	c.Assert(resp.Header.Get("Strict-Transport-Security"), Equals, "max-age=31536000")
+	c.Assert(resp.Header.Get("X-Backend-Attempt"), Equals, "")
+	c.Assert(resp.Header.Get("X-Backend"), Equals, s.backendServers[0].addr)
+
+	svc := Registry.GetService(svcCfg.Name)
+	c.Assert(svc.Config().HeaderRules, DeepEquals, svcCfg.HeaderRules)
+	c.Assert(svc.headerRules, HasLen, 4)
+}
+
+// X-Forwarded-Proto is only honored from a trusted proxy.
+func (s *HTTPSuite) TestTrustedProxies(c *C) {
+	srv := s.backendServers[0]
+	svcCfg := client.ServiceConfig{
+		Name:          "TrustedProxies",
+		Addr:          "127.0.0.1:9000",
+		HTTPSRedirect: true,
+		VirtualHosts:  []string{"secure.test"},
+		Backends:      []client.BackendConfig{{Name: "srv", Addr: srv.addr}},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+	defer trustedProxies.Set(nil)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	status := func() int {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		c.Assert(err, IsNil)
+		req.Host = "secure.test"
+		req.Header.Set("X-Forwarded-Proto", "https")
+
+		resp, err := client.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// every peer is trusted by default
+	c.Assert(status(), Equals, http.StatusOK)
+
+	trustedProxies.Set([]string{"10.0.0.0/8"})
+	c.Assert(status(), Equals, http.StatusMovedPermanently)
+
+	trustedProxies.Set([]string{"10.0.0.0/8", "127.0.0.1"})
+	c.Assert(status(), Equals, http.StatusOK)
+
+	// a list of only invalid entries trusts nothing
+	trustedProxies.Set([]string{"not-a-cidr"})
+	c.Assert(trustedProxies.Trusted("127.0.0.1:1234"), Equals, false)
+
+	trustedProxies.Set([]string{"::1/128", "192.168.0.0/16"})
+	c.Assert(trustedProxies.Trusted("[::1]:1234"), Equals, true)
+	c.Assert(trustedProxies.Trusted("192.168.1.1:80"), Equals, true)
+	c.Assert(trustedProxies.Trusted("10.0.0.1:80"), Equals, false)
+}
+
+// Low priority requests are shed first while the service is overloaded.
+func (s *HTTPSuite) TestPriorityShedding(c *C) {
+	addr := s.backendServers[0].addr
+	svcCfg := client.ServiceConfig{
+		Name:         "PriorityTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		ErrorBudget: &client.ErrorBudgetConfig{
+			Threshold:   0.5,
+			Window:      500,
+			MinRequests: 2,
+		},
+		Priority: &client.PriorityConfig{
+			Header: "X-Priority",
+			Levels: map[string]int{"high": 2, "normal": 1},
+		},
+		Backends: []client.BackendConfig{{Name: addr, Addr: addr}},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	status := func(priority string) int {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+		if priority != "" {
+			req.Header.Set("X-Priority", priority)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	c.Assert(status(""), Equals, http.StatusOK)
+
+	// a spent error budget is full load, shedding all but the top priority
+	checkHTTP("http://"+s.httpAddr+"/error?code=502", "test-vhost", addr, 502, c)
+	checkHTTP("http://"+s.httpAddr+"/error?code=502", "test-vhost", addr, 502, c)
+	c.Assert(status(""), Equals, http.StatusServiceUnavailable)
+	c.Assert(status("Normal"), Equals, http.StatusServiceUnavailable)
+	c.Assert(status("high"), Equals, http.StatusOK)
+
+	stats, err := Registry.ServiceStats(svcCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Shed, Equals, int64(2))
+	c.Assert(stats.Features, DeepEquals, []string{"error_budget", "priority"})
+
+	// each level is shed at a proportionally higher load
+	shedder := newLoadShedder("test", svcCfg.Priority)
+	low, _ := http.NewRequest("GET", "/", nil)
+	normal, _ := http.NewRequest("GET", "/", nil)
+	normal.Header.Set("X-Priority", "normal")
+	c.Assert(shedder.shed(low, 79), Equals, false)
+	c.Assert(shedder.shed(low, 80), Equals, true)
+	c.Assert(shedder.shed(normal, 80), Equals, false)
+	c.Assert(shedder.shed(normal, 90), Equals, true)
+}
+
+// Paths are rewritten before they're proxied, and redirect rules are answered
+// without a backend.
+func (s *HTTPSuite) TestRewritesAndRedirects(c *C) {
+	addr := s.backendServers[0].addr
+	svcCfg := client.ServiceConfig{
+		Name:         "RewriteTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost", "other-vhost"},
+		Rewrites: []client.RewriteRule{
+			{StripPrefix: "/api"},
+			{VirtualHost: "other-vhost", Regexp: "^/v1/(.*)$", Replace: "/$1"},
+			{Regexp: "("},
+		},
+		Redirects: []client.RedirectRule{
+			{Regexp: "^/old/(.*)$", Target: "https://{host}/new/$1", Status: 308},
+			{VirtualHost: "other-vhost", Regexp: "^/moved$", Target: "/addr", Status: 302},
+			{Regexp: "^/bad$", Target: "/addr", Status: 200},
+		},
+		Backends: []client.BackendConfig{{Name: addr, Addr: addr}},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	checkHTTP("http://"+s.httpAddr+"/api/addr", "test-vhost", addr, 200, c)
+	checkHTTP("http://"+s.httpAddr+"/v1/addr", "other-vhost", addr, 200, c)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	redirect := func(host, path string) (int, string) {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+path, nil)
+		c.Assert(err, IsNil)
+		req.Host = host
+
+		resp, err := client.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header.Get("Location")
+	}
+
+	code, loc := redirect("test-vhost", "/old/page?q=1")
+	c.Assert(code, Equals, http.StatusPermanentRedirect)
+	c.Assert(loc, Equals, "https://test-vhost/new/page?q=1")
+
+	code, loc = redirect("other-vhost", "/moved")
+	c.Assert(code, Equals, http.StatusFound)
+	c.Assert(loc, Equals, "/addr")
+
+	// rules limited to another vhost, or with an invalid status, are ignored
+	code, _ = redirect("test-vhost", "/v1/addr")
+	c.Assert(code, Equals, http.StatusNotFound)
+	code, _ = redirect("test-vhost", "/moved")
+	c.Assert(code, Equals, http.StatusNotFound)
+	code, _ = redirect("test-vhost", "/bad")
+	c.Assert(code, Equals, http.StatusNotFound)
+
+	stats, err := Registry.ServiceStats(svcCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Features, DeepEquals, []string{"rewrites", "redirects"})
+}
+
+// Forwarding headers are appended to from a trusted client, and replaced
+// otherwise.
+func (s *HTTPSuite) TestForwardedHeaders(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "ForwardedTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: s.backendServers[0].addr, Addr: s.backendServers[0].addr},
+		},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+	defer trustedProxies.Set(nil)
+
+	header := func(name string) string {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/header?name="+name, nil)
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("Forwarded", "for=192.0.2.1;proto=https")
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return string(body)
+	}
+
+	c.Assert(header("X-Forwarded-For"), Equals, "192.0.2.1, 127.0.0.1")
+	c.Assert(header("X-Real-Ip"), Equals, "192.0.2.1")
+	c.Assert(header("X-Forwarded-Proto"), Equals, "https")
+	c.Assert(header("X-Forwarded-Host"), Equals, "test-vhost")
+	c.Assert(header("Forwarded"), Equals, "for=192.0.2.1;proto=https, for=127.0.0.1;host=test-vhost;proto=http")
+
+	// an untrusted client's values are replaced
+	trustedProxies.Set([]string{"10.0.0.0/8"})
+	c.Assert(header("X-Forwarded-For"), Equals, "127.0.0.1")
+	c.Assert(header("X-Real-Ip"), Equals, "127.0.0.1")
+	c.Assert(header("X-Forwarded-Proto"), Equals, "http")
+	c.Assert(header("Forwarded"), Equals, "for=127.0.0.1;host=test-vhost;proto=http")
+
+	svcCfg.Forwarded = client.ForwardedTrust
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	c.Assert(header("X-Forwarded-For"), Equals, "192.0.2.1, 127.0.0.1")
+
+	trustedProxies.Set(nil)
+	svcCfg.Forwarded = client.ForwardedOverride
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	c.Assert(header("X-Forwarded-For"), Equals, "127.0.0.1")
+}
+
+// Responses are compressed for clients which accept it, and the bytes saved
+// are counted.
+func (s *HTTPSuite) TestCompress(c *C) {
+	text := strings.Repeat("compress me ", 1000)
+	nextEvent := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "small")
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, text)
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "data: first\n\n")
+			w.(http.Flusher).Flush()
+			select {
+			case <-nextEvent:
+			case <-r.Context().Done():
+				return
+			}
+			io.WriteString(w, "data: second\n\n")
+		default:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, text)
+		}
+	}))
+	defer backend.Close()
+
+	addr := backend.Listener.Addr().String()
+	svcCfg := client.ServiceConfig{
+		Name:         "CompressTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Compress:     &client.CompressConfig{},
+		Backends:     []client.BackendConfig{{Name: addr, Addr: addr}},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	httpClient := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	get := func(path, accept string) *http.Response {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+path, nil)
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+		req.Header.Set("Accept-Encoding", accept)
+
+		resp, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		return resp
+	}
+
+	resp := get("/", "br;q=1.0, gzip;q=0.8")
+	c.Assert(resp.Header.Get("Content-Encoding"), Equals, "br")
+	c.Assert(resp.Header.Get("Vary"), Equals, "Accept-Encoding")
+	body, err := ioutil.ReadAll(brotli.NewReader(resp.Body))
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, text)
+	resp.Body.Close()
+
+	resp = get("/", "br;q=0.5, gzip")
+	c.Assert(resp.Header.Get("Content-Encoding"), Equals, "gzip")
+	zr, err := gzip.NewReader(resp.Body)
+	c.Assert(err, IsNil)
+	body, err = ioutil.ReadAll(zr)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, text)
+	resp.Body.Close()
+
+	for _, tc := range []struct{ path, accept string }{
+		{"/", "gzip;q=0, identity"},
+		{"/small", "gzip"},
+		{"/image", "gzip"},
+	} {
+		resp := get(tc.path, tc.accept)
+		c.Assert(resp.Header.Get("Content-Encoding"), Equals, "", Commentf("%s", tc.path))
+		resp.Body.Close()
+	}
+
+	resp = get("/", "deflate")
+	c.Assert(resp.Header.Get("Content-Encoding"), Equals, "deflate")
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// each event is flushed through the compressor as it arrives
+	resp = get("/events", "gzip")
+	c.Assert(resp.Header.Get("Content-Encoding"), Equals, "gzip")
+	zr, err = gzip.NewReader(resp.Body)
+	c.Assert(err, IsNil)
+	events := bufio.NewReader(zr)
+	event := make(chan string)
+	go func() {
+		line, _ := events.ReadString('\n')
+		event <- line
+	}()
+	select {
+	case line := <-event:
+		c.Assert(line, Equals, "data: first\n")
+	case <-time.After(5 * time.Second):
+		c.Fatal("first event not received")
+	}
+	close(nextEvent)
+	body, err = ioutil.ReadAll(events)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "\ndata: second\n\n")
+	resp.Body.Close()
+
+	stats, err := Registry.ServiceStats(svcCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Compressed, Equals, int64(4))
+	c.Assert(stats.CompressSaved > int64(len(text)), Equals, true)
+	c.Assert(stats.Features, DeepEquals, []string{"compress"})
+}
+
+// New requests are refused while the process is over its own limits.
+func (s *HTTPSuite) TestSelfLimit(c *C) {
+	addr := s.backendServers[0].addr
+	svcCfg := client.ServiceConfig{
+		Name:         "SelfLimitTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends:     []client.BackendConfig{{Name: addr, Addr: addr}},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	limiter := &selfLimiter{maxRSS: 100 << 20, maxCPU: 200}
+	orig := selfLimit
+	selfLimit = limiter
+	defer func() { selfLimit = orig }()
+
+	now := time.Now()
+	limiter.update(now, 50<<20, 50)
+	c.Assert(limiter.Stats().Shedding, Equals, false)
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", addr, 200, c)
+
+	limiter.update(now, 101<<20, 50)
+	stats := limiter.Stats()
+	c.Assert(stats.Shedding, Equals, true)
+	c.Assert(stats.Reason, Equals, "RSS 101MB over 100MB")
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", "", 503, c)
+
+	svcStats, err := Registry.ServiceStats(svcCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(svcStats.Overloaded, Equals, int64(1))
+
+	resp, err := http.Get(s.httpSvr.URL + "/_process")
+	c.Assert(err, IsNil)
+	var procStats ProcessStat
+	c.Assert(json.NewDecoder(resp.Body).Decode(&procStats), IsNil)
+	resp.Body.Close()
+	c.Assert(procStats.Shedding, Equals, true)
+	c.Assert(procStats.Shed, Equals, int64(1))
+
+	// shedding continues until usage is below 90% of the limits
+	limiter.update(now, 95<<20, 50)
+	c.Assert(limiter.Stats().Shedding, Equals, true)
+	limiter.update(now, 80<<20, 190)
+	c.Assert(limiter.Stats().Shedding, Equals, true)
+	limiter.update(now, 80<<20, 150)
+	c.Assert(limiter.Stats().Shedding, Equals, false)
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", addr, 200, c)
+
+	limiter.update(now, 80<<20, 250)
+	c.Assert(limiter.Stats().Reason, Equals, "CPU 250% over 200%")
+}
+
+// The runtime settings can be changed in the config, and are reported by the
+// runtime endpoint.
+func (s *HTTPSuite) TestRuntimeTuning(c *C) {
+	procs := runtime.GOMAXPROCS(0)
+	gcPercent := rtdebug.SetGCPercent(100)
+	defer func() {
+		runtime.GOMAXPROCS(procs)
+		rtdebug.SetGCPercent(gcPercent)
+		rtdebug.SetMemoryLimit(math.MaxInt64)
+		runtimeTuning.Lock()
+		runtimeTuning.gogc = -2
+		runtimeTuning.Unlock()
+	}()
+
+	cfg := client.Config{GOGC: 50, MemoryLimit: 512, GOMAXPROCS: 1}
+	c.Assert(Registry.UpdateConfig(cfg), IsNil)
+
+	resp, err := http.Get(s.httpSvr.URL + "/_runtime")
+	c.Assert(err, IsNil)
+	var stats RuntimeStat
+	c.Assert(json.NewDecoder(resp.Body).Decode(&stats), IsNil)
+	resp.Body.Close()
+
+	c.Assert(stats.GOGC, Equals, 50)
+	c.Assert(stats.MemoryLimit, Equals, int64(512<<20))
+	c.Assert(stats.GOMAXPROCS, Equals, 1)
+	c.Assert(stats.GoVersion, Equals, runtime.Version())
+
+	c.Assert(parseCPUMax("max 100000\n"), Equals, 0.0)
+	c.Assert(parseCPUMax("250000 100000\n"), Equals, 2.5)
+	c.Assert(parseCPUMax("-1 100000"), Equals, 0.0)
+}
+
+// Request bodies over the service's limit are refused with a 413, whether
+// their length is declared or they're sent chunked.
+func (s *HTTPSuite) TestMaxRequestBody(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "%d", len(body))
+	}))
+	defer backend.Close()
+
+	addr := backend.Listener.Addr().String()
+	svcCfg := client.ServiceConfig{
+		Name:           "BodyTest",
+		Addr:           "127.0.0.1:9000",
+		VirtualHosts:   []string{"test-vhost"},
+		MaxRequestBody: 1024,
+		Backends:       []client.BackendConfig{{Name: addr, Addr: addr}},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	post := func(body io.Reader, size int64) (int, string) {
+		req, err := http.NewRequest("POST", "http://"+s.httpAddr+"/", body)
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+		req.ContentLength = size
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		out, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(out)
+	}
+
+	code, body := post(strings.NewReader(strings.Repeat("x", 1024)), 1024)
+	c.Assert(code, Equals, 200)
+	c.Assert(body, Equals, "1024")
+
+	code, _ = post(strings.NewReader(strings.Repeat("x", 1025)), 1025)
+	c.Assert(code, Equals, http.StatusRequestEntityTooLarge)
+
+	// an unknown length is sent chunked
+	code, body = post(strings.NewReader(strings.Repeat("x", 1000)), -1)
+	c.Assert(code, Equals, 200)
+	c.Assert(body, Equals, "1000")
+
+	code, _ = post(strings.NewReader(strings.Repeat("x", 64<<10)), -1)
+	c.Assert(code, Equals, http.StatusRequestEntityTooLarge)
+
+	svc := Registry.GetService(svcCfg.Name)
+	stats := svc.Stats()
+	c.Assert(stats.TooLarge, Equals, int64(2))
+	c.Assert(stats.HTTPErrors, Equals, int64(0))
+}
+
+// A service's HTTP timeouts answer slow backends with a 504, and close idle
+// client connections.
+func (s *HTTPSuite) TestHTTPTimeouts(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow-headers":
+			time.Sleep(300 * time.Millisecond)
+		case "/slow-body":
+			w.WriteHeader(200)
+			w.(http.Flusher).Flush()
+			time.Sleep(300 * time.Millisecond)
+		}
+		io.WriteString(w, "done")
+	}))
+	defer backend.Close()
+
+	addr := backend.Listener.Addr().String()
+	svcCfg := client.ServiceConfig{
+		Name:                  "TimeoutTest",
+		Addr:                  "127.0.0.1:9000",
+		VirtualHosts:          []string{"test-vhost"},
+		ResponseHeaderTimeout: 100,
+		Backends:              []client.BackendConfig{{Name: addr, Addr: addr}},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	get := func(path string) (int, string) {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+path, nil)
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	code, body := get("/")
+	c.Assert(code, Equals, 200)
+	c.Assert(body, Equals, "done")
+
+	code, _ = get("/slow-headers")
+	c.Assert(code, Equals, http.StatusGatewayTimeout)
+
+	// the body may take longer than the headers
+	code, body = get("/slow-body")
+	c.Assert(code, Equals, 200)
+	c.Assert(body, Equals, "done")
+
+	// the whole request is limited too
+	svcCfg.ResponseHeaderTimeout = 1000
+	svcCfg.RequestTimeout = 100
+	svcCfg.IdleTimeout = 100
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	c.Assert(Registry.GetService(svcCfg.Name).Config().ResponseHeaderTimeout, Equals, 1000)
+
+	code, _ = get("/slow-headers")
+	c.Assert(code, Equals, http.StatusGatewayTimeout)
+
+	// the client connection is closed once idle past the service's timeout
+	conn, err := net.Dial("tcp", s.httpAddr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test-vhost\r\n\r\n")
+	resp, err := http.ReadResponse(br, nil)
+	c.Assert(err, IsNil)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, 200)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	_, err = br.ReadByte()
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+}
+
+// Responses are flushed at the service's flush interval, and server-sent
+// events on every write.
+func (s *HTTPSuite) TestFlushInterval(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/events" {
+			w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		}
+		io.WriteString(w, "first\n")
+		w.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		io.WriteString(w, "second\n")
+	}))
+	defer backend.Close()
+
+	addr := backend.Listener.Addr().String()
+	svcCfg := client.ServiceConfig{
+		Name:          "FlushTest",
+		Addr:          "127.0.0.1:9000",
+		VirtualHosts:  []string{"test-vhost"},
+		FlushInterval: 5000,
+		Backends:      []client.BackendConfig{{Name: addr, Addr: addr}},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	// the time until the first line of the response is read
+	firstLine := func(path string) time.Duration {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+path, nil)
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+
+		line, err := bufio.NewReader(resp.Body).ReadString('\n')
+		c.Assert(err, IsNil)
+		c.Assert(line, Equals, "first\n")
+		return time.Since(start)
+	}
+
+	c.Assert(firstLine("/") >= 300*time.Millisecond, Equals, true)
+	c.Assert(firstLine("/events") < 300*time.Millisecond, Equals, true)
+
+	svcCfg.FlushInterval = -1
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	c.Assert(Registry.GetService(svcCfg.Name).Config().FlushInterval, Equals, -1)
+	c.Assert(firstLine("/") < 300*time.Millisecond, Equals, true)
+}
+
+// A backend's circuit breaker opens after consecutive failures, sending its
+// requests to the other backends, and closes after a successful trial.
+func (s *HTTPSuite) TestCircuitBreaker(c *C) {
+	var failing int32 = 1
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer flaky.Close()
+	flakyAddr := flaky.Listener.Addr().String()
+
+	okServer := s.backendServers[0]
+	svcCfg := client.ServiceConfig{
+		Name:           "BreakerTest",
+		Addr:           "127.0.0.1:9000",
+		VirtualHosts:   []string{"test-vhost"},
+		CircuitBreaker: &client.CircuitBreakerConfig{Errors: 2, Cooldown: 200},
+		Backends: []client.BackendConfig{
+			{Name: "flaky", Addr: flakyAddr},
+			{Name: "ok", Addr: okServer.addr},
+		},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	get := func() *http.Response {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		return resp
+	}
+
+	breaker := func() string {
+		stats, err := Registry.BackendStats(svcCfg.Name, "flaky")
+		c.Assert(err, IsNil)
+		return stats.Breaker
+	}
+
+	c.Assert(breaker(), Equals, "closed")
+
+	errors := 0
+	for i := 0; i < 4; i++ {
+		if get().StatusCode == http.StatusInternalServerError {
+			errors++
+		}
+	}
+	c.Assert(errors, Equals, 2)
+	c.Assert(breaker(), Equals, "open")
+
+	// requests fail fast to the ok backend
+	for i := 0; i < 4; i++ {
+		resp := get()
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(resp.Header.Get("X-Backend"), Equals, okServer.addr)
+		c.Assert(resp.Header.Get("X-Backend-Attempt"), Equals, "1")
+	}
+
+	// after the cooldown, a successful trial closes the breaker
+	time.Sleep(250 * time.Millisecond)
+	c.Assert(breaker(), Equals, "half_open")
+	atomic.StoreInt32(&failing, 0)
+	for i := 0; i < 2; i++ {
+		c.Assert(get().StatusCode, Equals, http.StatusOK)
+	}
+	c.Assert(breaker(), Equals, "closed")
+}
+
+func (s *HTTPSuite) TestLatencyHistograms(c *C) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+		io.WriteString(w, "ok")
+	}))
+	defer slow.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:         "LatencyTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "slow", Addr: slow.Listener.Addr().String()},
+		},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	for i := 0; i < 4; i++ {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/", nil)
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+	}
+
+	stats, err := Registry.ServiceStats(svcCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Latency, NotNil)
+	c.Assert(stats.Latency.Count, Equals, int64(4))
+	// in the 25-50ms bucket
+	c.Assert(stats.Latency.P50 >= 25 && stats.Latency.P50 <= 50, Equals, true)
+	c.Assert(stats.Latency.P99 >= stats.Latency.P50, Equals, true)
+	c.Assert(stats.VHostLatency["test-vhost"].Count, Equals, int64(4))
+
+	backend, err := Registry.BackendStats(svcCfg.Name, "slow")
+	c.Assert(err, IsNil)
+	c.Assert(backend.Latency.Count, Equals, int64(4))
+	c.Assert(backend.Latency.Mean >= 30, Equals, true)
+}
+
+// Requests ending in a configured status are written to a ring of capture
+// files, with their bodies.
+func (s *HTTPSuite) TestErrorCapture(c *C) {
+	dir := c.MkDir()
+	srv := s.backendServers[0]
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		ErrorCapture: &client.ErrorCaptureConfig{Dir: dir, Status: []int{500}, MaxFiles: 2},
+		Backends:     []client.BackendConfig{{Name: "srv", Addr: srv.addr}},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	do := func(path, body string) {
+		req, err := http.NewRequest("PUT", "http://"+s.httpAddr+path, strings.NewReader(body))
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+
+		// the client still gets the whole response
+		got, _ := ioutil.ReadAll(resp.Body)
+		c.Assert(string(got), Equals, srv.addr)
+	}
+
+	do("/addr", "not captured")
+	files, _ := filepath.Glob(filepath.Join(dir, "*.http"))
+	c.Assert(files, HasLen, 0)
+
+	for i := 0; i < 3; i++ {
+		do("/error?code=500", fmt.Sprintf("request %d", i))
+	}
+	files, _ = filepath.Glob(filepath.Join(dir, svcCfg.Name+"-*.http"))
+	c.Assert(files, HasLen, 2)
+
+	sort.Strings(files)
+	capture, err := ioutil.ReadFile(files[1])
+	c.Assert(err, IsNil)
+	for _, part := range []string{
+		"# backend srv (" + srv.addr + "), attempt 1\n",
+		"PUT /error?code=500 HTTP/1.1\r\nHost: test-vhost\r\n",
+		"\r\n\r\nrequest 2\n\n",
+		"HTTP/1.1 500 Internal Server Error\r\n",
+		"\r\n\r\n" + srv.addr,
+	} {
+		c.Assert(strings.Contains(string(capture), part), Equals, true, Commentf("%q", part))
+	}
+}
+
+// Methods not in a service's AllowMethods get a 405 from the proxy.
+func (s *HTTPSuite) TestAllowMethods(c *C) {
+	srv := s.backendServers[0]
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		AllowMethods: []string{"GET", "head"},
+		Backends:     []client.BackendConfig{{Name: "srv", Addr: srv.addr}},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	do := func(method string) *http.Response {
+		req, err := http.NewRequest(method, "http://"+s.httpAddr+"/addr", nil)
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		return resp
+	}
+
+	c.Assert(do("GET").StatusCode, Equals, http.StatusOK)
+	c.Assert(do("HEAD").StatusCode, Equals, http.StatusOK)
+
+	for _, method := range []string{"TRACE", "OPTIONS", "POST"} {
+		resp := do(method)
+		c.Assert(resp.StatusCode, Equals, http.StatusMethodNotAllowed)
+		c.Assert(resp.Header.Get("Allow"), Equals, "GET, HEAD")
+		c.Assert(resp.Header.Get("X-Backend"), Equals, "")
+	}
+
+	stats := Registry.GetService(svcCfg.Name).Stats()
+	c.Assert(stats.BadMethod, Equals, int64(3))
+}
+
+func (s *HTTPSuite) TestOutlierDetection(c *C) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "error", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:         "OutlierTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		OutlierDetection: &client.OutlierDetectionConfig{
+			MinRequests:  2,
+			EjectionTime: 300,
+		},
+		Backends: []client.BackendConfig{
+			{Name: "failing", Addr: failing.Listener.Addr().String()},
+			{Name: "ok0", Addr: s.backendServers[0].addr},
+			{Name: "ok1", Addr: s.backendServers[1].addr},
+		},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	get := func() int {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	ejected := func() bool {
+		stats, err := Registry.BackendStats(svcCfg.Name, "failing")
+		c.Assert(err, IsNil)
+		return stats.Ejected
+	}
+
+	errors := 0
+	for i := 0; i < 9; i++ {
+		if get() != http.StatusOK {
+			errors++
+		}
+	}
+	c.Assert(ejected(), Equals, true)
+	c.Assert(errors <= 3, Equals, true)
+
+	// the ejected backend is out of the rotation
+	for i := 0; i < 6; i++ {
+		c.Assert(get(), Equals, http.StatusOK)
+	}
+
+	// an ok backend isn't ejected for the errors of the failing one
+	stats, err := Registry.BackendStats(svcCfg.Name, "ok0")
+	c.Assert(err, IsNil)
+	c.Assert(stats.Ejected, Equals, false)
+
+	time.Sleep(350 * time.Millisecond)
+	c.Assert(ejected(), Equals, false)
+	c.Assert(Registry.GetService(svcCfg.Name).Config().OutlierDetection, NotNil)
+}
+
+func (s *HTTPSuite) TestVirtualBackends(c *C) {
+	pool := client.ServiceConfig{
+		Name:         "PoolTest",
+		Addr:         "127.0.0.1:9001",
+		VirtualHosts: []string{"pool-vhost"},
+		Backends:     []client.BackendConfig{{Name: "b0", Addr: s.backendServers[0].addr}},
+	}
+	c.Assert(Registry.AddService(pool), IsNil)
+	defer Registry.RemoveService(pool.Name)
+
+	front := client.ServiceConfig{
+		Name:         "VHostTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{{
+			Name:      "pool",
+			Addr:      "service://" + pool.Name,
+			CheckAddr: "service://" + pool.Name,
+		}},
+	}
+	c.Assert(Registry.AddService(front), IsNil)
+	defer Registry.RemoveService(front.Name)
+
+	get := func(path string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+path, nil)
+		c.Assert(err, IsNil)
+		req.Host = "test-vhost"
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return resp, string(body)
+	}
+
+	// the request passes through the pool service in-process
+	resp, body := get("/addr")
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(body, Equals, s.backendServers[0].addr)
+	c.Assert(resp.Header.Get("X-Backend"), Equals, "service://"+pool.Name)
+	c.Assert(Registry.GetService(pool.Name).Stats().HTTPConns, Equals, int64(1))
+
+	// the in-process hop adds nothing to the forwarding headers
+	_, body = get("/header?name=X-Forwarded-For")
+	c.Assert(body, Equals, "127.0.0.1")
+
+	// a TCP service hands its connections to the service's listener
+	tcp := client.ServiceConfig{
+		Name:     "TCPFront",
+		Addr:     "127.0.0.1:9002",
+		Backends: []client.BackendConfig{{Name: "echo", Addr: "service://Echo"}},
+	}
+	echo := client.ServiceConfig{
+		Name:     "Echo",
+		Addr:     "127.0.0.1:9003",
+		Backends: []client.BackendConfig{{Name: "b0", Addr: s.servers[0].addr}},
+	}
+	c.Assert(Registry.AddService(echo), IsNil)
+	defer Registry.RemoveService(echo.Name)
+	c.Assert(Registry.AddService(tcp), IsNil)
+	defer Registry.RemoveService(tcp.Name)
+	checkResp(tcp.Addr, s.servers[0].addr, c)
+
+	// a check through a service fallback gets an in-process connection
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	b := NewBackend(client.BackendConfig{
+		Name:          "fallback",
+		Addr:          deadAddr,
+		CheckAddr:     deadAddr,
+		FallbackAddrs: []string{"service://" + echo.Name},
+	})
+	b.check()
+	c.Assert(b.Stats().CheckOK, Equals, 1)
+
+	// the health check follows the pool's backends
+	c.Assert(checkService(pool.Name), IsNil)
+	pool.Backends = []client.BackendConfig{}
+	c.Assert(Registry.UpdateService(pool), IsNil)
+	c.Assert(checkService(pool.Name), NotNil)
+	c.Assert(checkService("missing"), NotNil)
+}
+
+func (s *HTTPSuite) TestSecurityHeaders(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost", "test-vhost-2"},
+		SecurityHeaders: []client.SecurityHeadersConfig{
+			{},
+			{VirtualHost: "test-vhost-2", Preset: client.SecurityStrict, FrameOptions: "off"},
+		},
+		Backends: []client.BackendConfig{{Name: "b0", Addr: s.backendServers[0].addr}},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	get := func(host, proto string) http.Header {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		c.Assert(err, IsNil)
+		req.Host = host
+		if proto != "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		return resp.Header
+	}
+
+	h := get("test-vhost", "")
+	c.Assert(h.Get("X-Content-Type-Options"), Equals, "nosniff")
+	c.Assert(h.Get("X-Frame-Options"), Equals, "SAMEORIGIN")
+	c.Assert(h.Get("Referrer-Policy"), Equals, "strict-origin-when-cross-origin")
+	// HSTS is only sent over HTTPS
+	c.Assert(h.Get("Strict-Transport-Security"), Equals, "")
+
+	h = get("test-vhost", "https")
+	c.Assert(h.Get("Strict-Transport-Security"), Equals, "max-age=31536000")
+
+	h = get("test-vhost-2", "https")
+	c.Assert(h.Get("Strict-Transport-Security"), Equals, "max-age=63072000; includeSubDomains; preload")
+	c.Assert(h.Get("Referrer-Policy"), Equals, "no-referrer")
+	c.Assert(h.Get("X-Frame-Options"), Equals, "")
+
+	c.Assert(Registry.GetService(svcCfg.Name).Config().SecurityHeaders, DeepEquals, svcCfg.SecurityHeaders)
+}
+
+// Drain a service through the admin API, and enable it again
+func (s *HTTPSuite) TestServiceDrain(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends:     []client.BackendConfig{{Name: "b0", Addr: s.backendServers[0].addr}},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", s.backendServers[0].addr, 200, c)
+
+	c.Assert(Registry.DrainService(svcCfg.Name), IsNil)
+	c.Assert(Registry.DrainService("missing"), Equals, ErrNoService)
+
+	// requests are refused, and so are connections to the listener
+	req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+	c.Assert(err, IsNil)
+	req.Host = "test-vhost"
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+
+	_, err = net.DialTimeout("tcp", svcCfg.Addr, time.Second)
+	c.Assert(err, NotNil)
+
+	stats, err := Registry.ServiceStats(svcCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Drain, NotNil)
+	c.Assert(stats.Drain.Rejected, Equals, int64(1))
+	c.Assert(stats.Drain.Open, Equals, int64(0))
+	c.Assert(stats.Drain.Done, Equals, true)
+
+	c.Assert(Registry.EnableService(svcCfg.Name), IsNil)
+	stats, err = Registry.ServiceStats(svcCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Drain, IsNil)
+
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", s.backendServers[0].addr, 200, c)
+	conn, err := net.DialTimeout("tcp", svcCfg.Addr, time.Second)
+	c.Assert(err, IsNil)
+	conn.Close()
+}
+
+// The admin API is served under a version prefix, or with a version header,
+// as well as on the legacy routes.
+func (s *HTTPSuite) TestAPIVersion(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name: "VersionTest",
+		Addr: "127.0.0.1:9001",
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	admin := httptest.NewServer(http.DefaultServeMux)
+	defer admin.Close()
+
+	get := func(path, version string) *http.Response {
+		req, err := http.NewRequest("GET", admin.URL+path, nil)
+		c.Assert(err, IsNil)
+		if version != "" {
+			req.Header.Set(APIVersionHeader, version)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		return resp
+	}
+
+	for _, path := range []string{"/VersionTest/_config", "/v1/VersionTest/_config"} {
+		resp := get(path, "")
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(resp.Header.Get(APIVersionHeader), Equals, "1")
+	}
+
+	c.Assert(get("/v1/VersionTest/_config", "1").StatusCode, Equals, http.StatusOK)
+	c.Assert(get("/v1", "").StatusCode, Equals, http.StatusOK)
+	c.Assert(get("/v1/missing", "").StatusCode, Equals, http.StatusNotFound)
+	c.Assert(get("/VersionTest/_config", "2").StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(get("/v1/VersionTest/_config", "2").StatusCode, Equals, http.StatusBadRequest)
+
+	// handlers see the negotiated version
+	var version int
+	h := negotiateAPIVersion(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version = requestAPIVersion(r)
+		c.Assert(r.URL.Path, Equals, "/_stats")
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/_stats", nil))
+	c.Assert(version, Equals, 1)
+
+	// a service can't take the name of a version prefix
+	err := Registry.AddService(client.ServiceConfig{Name: "v1", Addr: "127.0.0.1:9002"})
+	c.Assert(err, ErrorMatches, "service name v1 is reserved.*")
+	c.Assert(Registry.GetService("v1"), IsNil)
+
+	report, err := Registry.ApplyConfig(client.Config{
+		Services: []client.ServiceConfig{{Name: "v1", Addr: "127.0.0.1:9002"}},
+	}, false, false)
+	c.Assert(err, NotNil)
+	c.Assert(report.Rejected["v1"], Matches, "service name v1 is reserved.*")
+	c.Assert(Registry.GetService("v1"), IsNil)
+
+	// but a name only starting with one is fine
+	c.Assert(Registry.AddService(client.ServiceConfig{Name: "v1api", Addr: "127.0.0.1:9002"}), IsNil)
+	defer Registry.RemoveService("v1api")
+	c.Assert(get("/v1api/_config", "").StatusCode, Equals, http.StatusOK)
+	c.Assert(get("/v1/v1api/_config", "").StatusCode, Equals, http.StatusOK)
+}
+
+// Pushes past the capacity of the config queue are refused rather than
+// blocking the queue.
+func (s *HTTPSuite) TestConfigQueueFull(c *C) {
+	// hold up the txn being applied, so the others wait in the queue
+	Registry.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			Registry.Unlock()
+		}
+	}()
+
+	var txns []*configTxn
+	for i := 0; i <= configTxnQueue; i++ {
+		txn, _, err := configTxns.Submit(client.Config{}, false, false)
+		c.Assert(err, IsNil)
+		txns = append(txns, txn)
+		if i == 0 {
+			// wait for the first to be taken from the queue
+			for {
+				status, err := configTxns.Status(txn.status.ID)
+				c.Assert(err, IsNil)
+				if status.State == txnApplying {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+
+	_, _, err := configTxns.Submit(client.Config{}, false, false)
+	c.Assert(err, Equals, ErrConfigQueueFull)
+
+	resp, err := http.Post(s.httpSvr.URL+"/_config", "application/json", strings.NewReader(`{"services": []}`))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+
+	// the status can still be read, and the queue drains once it can apply
+	status, err := configTxns.Status(txns[len(txns)-1].status.ID)
+	c.Assert(err, IsNil)
+	c.Assert(status.State, Equals, txnQueued)
+
+	Registry.Unlock()
+	locked = false
+	for _, txn := range txns {
+		c.Assert(txn.Wait().State, Equals, txnApplied)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The admin API is versioned, so the shape of its stats and config can
+// change without breaking the tooling built on it. Every route is served
+// under a /v{N}/ prefix for each supported version, and the legacy routes
+// without a prefix stay on version 1. A client may instead ask for a version
+// with the X-Shuttle-API-Version header, and every response names the
+// version it was served with in the same header. Handlers which change shape
+// between versions check requestAPIVersion.
+
+const (
+	APIVersionHeader = "X-Shuttle-API-Version"
+
+	// the version of the routes without a prefix
+	legacyAPIVersion = 1
+)
+
+// Every version the admin API can serve, oldest first.
+var apiVersions = []int{1}
+
+type apiVersionKey struct{}
+
+// Return the admin API version a request is served with.
+func requestAPIVersion(r *http.Request) int {
+	if v, ok := r.Context().Value(apiVersionKey{}).(int); ok {
+		return v
+	}
+	return legacyAPIVersion
+}
+
+func supportedAPIVersion(version int) bool {
+	for _, v := range apiVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Service names of the form v{N} are reserved for the version prefixes, since
+// /v1 would otherwise name both the root of version 1 and a service.
+func checkServiceName(name string) error {
+	if len(name) > 1 && name[0] == 'v' {
+		if _, err := strconv.ParseUint(name[1:], 10, 32); err == nil {
+			return fmt.Errorf("service name %s is reserved for the admin API version prefix /%s", name, name)
+		}
+	}
+	return nil
+}
+
+// Return the version of a path with a version prefix, and the path without
+// it.
+func splitAPIVersion(path string) (int, string, bool) {
+	for _, v := range apiVersions {
+		prefix := fmt.Sprintf("/v%d", v)
+		switch {
+		case path == prefix:
+			return v, "/", true
+		case strings.HasPrefix(path, prefix+"/"):
+			return v, strings.TrimPrefix(path, prefix), true
+		}
+	}
+	return 0, path, false
+}
+
+// Negotiate the admin API version of a request from its path prefix and its
+// header, and serve it from the unprefixed routes. A version which isn't
+// supported, or a header naming another version than the path, is a 400.
+func negotiateAPIVersion(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version, path, prefixed := splitAPIVersion(r.URL.Path)
+
+		if hv := r.Header.Get(APIVersionHeader); hv != "" {
+			v, err := strconv.Atoi(hv)
+			if err != nil || !supportedAPIVersion(v) || (prefixed && v != version) {
+				http.Error(w, fmt.Sprintf("unsupported API version %q, supported versions are %v", hv, apiVersions),
+					http.StatusBadRequest)
+				return
+			}
+			version = v
+		}
+		if version == 0 {
+			version = legacyAPIVersion
+		}
+
+		w.Header().Set(APIVersionHeader, strconv.Itoa(version))
+
+		r = r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version))
+		if prefixed {
+			u := *r.URL
+			u.Path = path
+			u.RawPath = ""
+			r.URL = &u
+		}
+		h.ServeHTTP(w, r)
+	})
+}
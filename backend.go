@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"io"
 	"net"
+	"reflect"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -24,9 +27,32 @@ type Backend struct {
 	Active     int64
 	HTTPActive int64
 	Network    string
+	Container  string
+	SendProxy  string
+
+	// time to the response headers of the HTTP requests it answered
+	latency latencyHist
+
+	// other addresses to dial when Addr fails, and the index into all of the
+	// addresses of the last one that connected
+	FallbackAddrs []string
+	dialIdx       int
+
+	// administrative override of the health checks
+	adminState string
+
+	// polled for the backend's own report of its load
+	LoadURL  string
+	load     float64
+	loadTime time.Time
+
+	// daily windows with another weight
+	Schedule []client.ScheduleWindow
+	schedule []scheduleWindow
 
 	// these are loaded from the service, so a backend doesn't need to access
 	// the service struct at all.
+	service       string
 	dialTimeout   time.Duration
 	rwTimeout     time.Duration
 	checkInterval time.Duration
@@ -37,12 +63,46 @@ type Backend struct {
 	fallCount     int
 	checkFail     int
 
+	// results of the most recent health checks
+	lastCheck  time.Time
+	lastChange time.Time
+	lastError  string
+
+	// flap dampening
+	flapCount    int
+	flapWindow   time.Duration
+	flapHoldDown time.Duration
+	flaps        []time.Time
+	dampenLevel  int
+	holdUntil    time.Time
+
+	// bind the service's listener after the first passing check
+	lazyBind bool
+
+	// stops HTTP requests after consecutive failures
+	breaker *circuitBreaker
+
+	// skipped by UDP balancing after a session got no response
+	suspectUntil time.Time
+
+	// taken out of the rotation as an outlier
+	ejectedUntil time.Time
+
+	// remove the backend once the check address hasn't resolved for this long
+	dnsFailTimeout time.Duration
+	dnsFailSince   time.Time
+
 	startCheck sync.Once
 	// stop the health-check loop
 	stopCheck chan interface{}
 
-	// so we only need to ResolveUDPAddr once
+	// so we only need to ResolveUDPAddr once per check
 	udpAddr *net.UDPAddr
+	// number of ports when the Addr is a UDP port range
+	udpPorts int
+
+	// addresses from the last lookup of a hostname Addr
+	resolved []string
 }
 
 // The json stats we return for the backend
@@ -60,18 +120,67 @@ type BackendStat struct {
 	HTTPActive int64  `json:"http_active"`
 	CheckOK    int    `json:"check_success"`
 	CheckFail  int    `json:"check_fail"`
+	AdminState string `json:"admin_state,omitempty"`
+
+	// FallbackAddrs lists the backend's other addresses, and DialAddr the one
+	// new connections are made to first, which was the last to connect.
+	FallbackAddrs []string `json:"fallback_addresses,omitempty"`
+	DialAddr      string   `json:"dial_address,omitempty"`
+
+	// Load is the most recent load reported by the backend's load_url,
+	// omitted once it's stale.
+	Load *float64 `json:"load,omitempty"`
+
+	// Suspect is set while a UDP backend is skipped for not responding to a
+	// client session.
+	Suspect bool `json:"suspect,omitempty"`
+
+	// Breaker is the state of the backend's circuit breaker, "closed",
+	// "open" or "half_open", if the service has one.
+	Breaker string `json:"circuit_breaker,omitempty"`
+
+	// Ejected is set while the backend is out of the rotation as an outlier.
+	Ejected bool `json:"ejected,omitempty"`
+
+	// Latency is the time to the response headers of the HTTP requests the
+	// backend answered, in milliseconds.
+	Latency *LatencyStat `json:"latency,omitempty"`
+
+	// HoldUntil is set while a flapping backend is held down.
+	HoldUntil time.Time `json:"hold_until"`
+
+	// Resolved lists the IP addresses found for a hostname Addr on the last
+	// check.
+	Resolved []string `json:"resolved,omitempty"`
+
+	// LastCheck is the time of the most recent health check, and LastChange
+	// the last time the backend was marked up or down.
+	LastCheck  time.Time `json:"last_check"`
+	LastChange time.Time `json:"last_change"`
+	// Consecutive failed checks, and the error from the most recent failure.
+	FailCount int    `json:"consecutive_failures"`
+	LastError string `json:"last_error,omitempty"`
 }
 
 func NewBackend(cfg client.BackendConfig) *Backend {
 	b := &Backend{
-		Name:      cfg.Name,
-		Addr:      cfg.Addr,
-		CheckAddr: cfg.CheckAddr,
-		Weight:    cfg.Weight,
-		Network:   cfg.Network,
-		stopCheck: make(chan interface{}),
+		Name:       cfg.Name,
+		Addr:       cfg.Addr,
+		CheckAddr:  cfg.CheckAddr,
+		Weight:     cfg.Weight,
+		Network:    cfg.Network,
+		Container:  cfg.Container,
+		SendProxy:  cfg.SendProxy,
+		LoadURL:    cfg.LoadURL,
+		adminState: cfg.AdminState,
+		stopCheck:  make(chan interface{}),
 	}
 
+	b.FallbackAddrs = append(b.FallbackAddrs, cfg.FallbackAddrs...)
+
+	b.Schedule = append(b.Schedule, cfg.Schedule...)
+	b.schedule = newSchedule(b.Name, b.Schedule)
+
 	// don't want a weight of 0
 	if b.Weight == 0 {
 		b.Weight = 1
@@ -81,10 +190,22 @@ func NewBackend(cfg client.BackendConfig) *Backend {
 		b.Network = "tcp"
 	}
 
-	switch b.Network {
-	case "udp", "udp4", "udp6":
+	if b.Container != "" {
+		addr, err := resolveContainer(b.Container, b.Network)
+		if err != nil {
+			log.Errorf("ERROR: Unable to resolve container for backend %s: %s", b.Name, err)
+		} else {
+			// keep checking the same address if that was configured
+			if b.CheckAddr == b.Addr {
+				b.CheckAddr = addr
+			}
+			b.Addr = addr
+		}
+	}
+
+	if _, udp := splitNetwork(b.Network); udp != "" {
 		var err error
-		b.udpAddr, err = net.ResolveUDPAddr(b.Network, b.Addr)
+		b.udpAddr, b.udpPorts, err = resolveUDPRange(udp, b.Addr)
 		if err != nil {
 			log.Errorf("ERROR: %s", err.Error())
 			b.up = false
@@ -96,6 +217,13 @@ func NewBackend(cfg client.BackendConfig) *Backend {
 
 // Copy the backend state into a BackendStat struct.
 func (b *Backend) Stats() BackendStat {
+	stats := b.stateStats()
+	b.countStats(&stats)
+	return stats
+}
+
+// Copy the backend state, without the traffic counters.
+func (b *Backend) stateStats() BackendStat {
 	b.Lock()
 	defer b.Unlock()
 
@@ -104,25 +232,123 @@ func (b *Backend) Stats() BackendStat {
 		Addr:       b.Addr,
 		CheckAddr:  b.CheckAddr,
 		Up:         b.up,
-		Weight:     b.Weight,
-		Sent:       atomic.LoadInt64(&b.Sent),
-		Rcvd:       atomic.LoadInt64(&b.Rcvd),
-		Errors:     atomic.LoadInt64(&b.Errors),
-		Conns:      atomic.LoadInt64(&b.Conns),
-		Active:     atomic.LoadInt64(&b.Active),
-		HTTPActive: atomic.LoadInt64(&b.HTTPActive),
+		Weight:     b.currentWeight(),
 		CheckOK:    b.checkOK,
 		CheckFail:  b.checkFail,
+		AdminState: b.adminState,
+		Suspect:    time.Now().Before(b.suspectUntil),
+		Breaker:    b.breaker.State(),
+		Ejected:    time.Now().Before(b.ejectedUntil),
+		Resolved:   b.resolved,
+		HoldUntil:  b.holdUntil,
+		LastCheck:  b.lastCheck,
+		LastChange: b.lastChange,
+		FailCount:  b.fallCount,
+		LastError:  b.lastError,
+	}
+
+	if len(b.FallbackAddrs) > 0 {
+		stats.FallbackAddrs = b.FallbackAddrs
+		stats.DialAddr = b.addrs()[b.dialIdx]
+	}
+
+	if !b.loadTime.IsZero() && time.Since(b.loadTime) <= loadStaleChecks*b.checkInterval {
+		load := b.load
+		stats.Load = &load
 	}
 
 	return stats
 }
 
+// Load the traffic counters, which are only updated atomically.
+func (b *Backend) countStats(stats *BackendStat) {
+	stats.Sent = atomic.LoadInt64(&b.Sent)
+	stats.Rcvd = atomic.LoadInt64(&b.Rcvd)
+	stats.Errors = atomic.LoadInt64(&b.Errors)
+	stats.Conns = atomic.LoadInt64(&b.Conns)
+	stats.Active = atomic.LoadInt64(&b.Active)
+	stats.HTTPActive = atomic.LoadInt64(&b.HTTPActive)
+	stats.Latency = b.latency.Stats()
+}
+
+// Up reports if the backend can take connections. An administrative state
+// overrides the health checks.
 func (b *Backend) Up() bool {
 	b.Lock()
-	up := b.up
-	b.Unlock()
-	return up
+	defer b.Unlock()
+
+	switch b.adminState {
+	case client.AdminUp:
+		return true
+	case client.AdminDown:
+		return false
+	}
+	return b.up
+}
+
+// Usable reports if the backend should be balanced. With ignoreHealth set, as
+// in panic mode, only an administrative down state or a scheduled weight of 0
+// excludes the backend.
+func (b *Backend) Usable(ignoreHealth bool) bool {
+	if b.currentWeight() == 0 {
+		return false
+	}
+	if !ignoreHealth {
+		return b.Up() && !b.Ejected()
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	return b.adminState != client.AdminDown
+}
+
+// Take the backend out of the rotation until the given time, as an outlier.
+func (b *Backend) eject(until time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	b.ejectedUntil = until
+}
+
+// Ejected reports if the backend is out of the rotation as an outlier.
+func (b *Backend) Ejected() bool {
+	b.Lock()
+	defer b.Unlock()
+	return time.Now().Before(b.ejectedUntil)
+}
+
+// Mark the backend suspect for d, after a UDP session got no response.
+func (b *Backend) setSuspect(d time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	b.suspectUntil = time.Now().Add(d)
+}
+
+func (b *Backend) clearSuspect() {
+	b.Lock()
+	defer b.Unlock()
+	b.suspectUntil = time.Time{}
+}
+
+// Suspect reports if the backend recently failed to respond to a UDP session.
+func (b *Backend) Suspect() bool {
+	b.Lock()
+	defer b.Unlock()
+	return time.Now().Before(b.suspectUntil)
+}
+
+// Force the backend up or down, or return it to its observed health with an
+// empty state.
+func (b *Backend) SetAdminState(state string) error {
+	switch state {
+	case "", client.AdminUp, client.AdminDown:
+	default:
+		return ErrInvalidAdminState
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.adminState = state
+	return nil
 }
 
 // Return the struct for marshaling into a json config
@@ -131,11 +357,17 @@ func (b *Backend) Config() client.BackendConfig {
 	defer b.Unlock()
 
 	cfg := client.BackendConfig{
-		Name:      b.Name,
-		Addr:      b.Addr,
-		CheckAddr: b.CheckAddr,
-		Weight:    b.Weight,
+		Name:       b.Name,
+		Addr:       b.Addr,
+		CheckAddr:  b.CheckAddr,
+		Weight:     b.Weight,
+		Container:  b.Container,
+		AdminState: b.adminState,
+		SendProxy:  b.SendProxy,
+		LoadURL:    b.LoadURL,
 	}
+	cfg.FallbackAddrs = append(cfg.FallbackAddrs, b.FallbackAddrs...)
+	cfg.Schedule = append(cfg.Schedule, b.Schedule...)
 
 	return cfg
 }
@@ -153,28 +385,138 @@ func (b *Backend) Stop() {
 	close(b.stopCheck)
 }
 
+// Longest time a flapping backend is held down
+const maxHoldDown = time.Hour
+
+// checkLimiter bounds the number of concurrent health checks. A nil semaphore is
+// unlimited.
+type checkLimiter struct {
+	sync.Mutex
+	sem chan struct{}
+}
+
+// All health checks share a single limit.
+var checkLimit = &checkLimiter{}
+
+// Set the limit, where n <= 0 is unlimited. Checks already running
+// release their slot in the previous semaphore.
+func (l *checkLimiter) SetLimit(n int) {
+	l.Lock()
+	defer l.Unlock()
+
+	if n <= 0 {
+		l.sem = nil
+		return
+	}
+	if l.sem != nil && cap(l.sem) == n {
+		return
+	}
+	log.Printf("INFO: Limiting concurrent health checks to %d", n)
+	l.sem = make(chan struct{}, n)
+}
+
+// Wait for a free slot, returning the semaphore to release.
+func (l *checkLimiter) acquire() chan struct{} {
+	l.Lock()
+	sem := l.sem
+	l.Unlock()
+
+	if sem != nil {
+		sem <- struct{}{}
+	}
+	return sem
+}
+
+func (l *checkLimiter) release(sem chan struct{}) {
+	if sem != nil {
+		<-sem
+	}
+}
+
 func (b *Backend) check() {
 	if b.CheckAddr == "" {
+		// nothing to check, but keep following a hostname's address
+		if err := b.resolve(); err != nil {
+			log.Warnf("WARN: Unable to resolve backend %s: %s", b.Name, err)
+		}
 		return
 	}
 
+	sem := checkLimit.acquire()
+	defer checkLimit.release(sem)
+
 	up := true
-	if c, e := net.DialTimeout("tcp", b.CheckAddr, b.dialTimeout); e == nil {
-		c.(*net.TCPConn).SetLinger(0)
+	reason := ""
+	if e := b.resolve(); e != nil {
+		log.Warnf("WARN: Backend check for %s failed to resolve: %s", b.Name, e)
+		up = false
+		reason = e.Error()
+
+		if b.checkDNS(e) {
+			return
+		}
+	} else if name := virtualService(b.CheckAddr); name != "" {
+		if e := checkService(name); e != nil {
+			log.Warnf("WARN: Backend check for %s failed with error: %s", b.Name, e)
+			up = false
+			reason = e.Error()
+		}
+	} else if c, e := b.checkDial(); e == nil {
+		if tc, ok := c.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+		}
 		c.Close()
 	} else {
-		log.Warnf("WARN: Backend check for %s failed with error:", e)
+		log.Warnf("WARN: Backend check for %s failed with error: %s", b.Name, e)
 		up = false
+		reason = e.Error()
+
+		if b.checkDNS(e) || b.checkContainer() {
+			return
+		}
 	}
 
 	b.Lock()
-	defer b.Unlock()
+	wasUp := b.up
+	b.lastCheck = time.Now()
+	defer func() {
+		isUp := b.up
+		if wasUp != isUp {
+			b.dampen(b.lastCheck)
+			isUp = b.up
+		}
+		if wasUp != isUp {
+			b.lastChange = b.lastCheck
+		}
+		b.Unlock()
+
+		if wasUp != isUp {
+			healthWebhook.Send(HealthEvent{
+				Service:  b.service,
+				Backend:  b.Name,
+				Addr:     b.Addr,
+				OldState: stateName(wasUp),
+				NewState: stateName(isUp),
+				Reason:   reason,
+				Time:     time.Now(),
+			})
+		}
+	}()
+
 	if up {
+		b.dnsFailSince = time.Time{}
 		log.Debugf("DEBUG: Check OK for %s/%s", b.Name, b.CheckAddr)
 		b.fallCount = 0
 		b.riseCount++
 		b.checkOK++
+		if b.checkOK == 1 && b.lazyBind {
+			go Registry.bindService(b.service)
+		}
 		if b.riseCount >= b.rise {
+			if b.lastCheck.Before(b.holdUntil) {
+				log.Debugf("DEBUG: Backend %s/%s held down until %s", b.service, b.Name, b.holdUntil)
+				return
+			}
 			if !b.up {
 				log.Warnf("WARN: Marking backend %s Up", b.Name)
 			}
@@ -182,6 +524,7 @@ func (b *Backend) check() {
 		}
 	} else {
 		log.Debugf("DEBUG: Check failed for %s/%s", b.Name, b.CheckAddr)
+		b.lastError = reason
 		b.riseCount = 0
 		b.fallCount++
 		b.checkFail++
@@ -194,6 +537,292 @@ func (b *Backend) check() {
 	}
 }
 
+// Count a failure seen while proxying against the backend, like a failed
+// health check, so it's marked down after Fall consecutive failures. Only
+// backends with a check address are marked down, since only the checks can
+// bring them back up.
+func (b *Backend) passiveFail(reason string) {
+	atomic.AddInt64(&b.Errors, 1)
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.CheckAddr == "" {
+		return
+	}
+
+	b.lastError = reason
+	b.riseCount = 0
+	b.fallCount++
+	if b.fallCount < b.fall || !b.up {
+		return
+	}
+
+	log.Warnf("WARN: Marking backend %s Down after %s", b.Name, reason)
+	b.up = false
+	b.lastChange = time.Now()
+
+	healthWebhook.Send(HealthEvent{
+		Service:  b.service,
+		Backend:  b.Name,
+		Addr:     b.Addr,
+		OldState: stateName(true),
+		NewState: stateName(false),
+		Reason:   reason,
+		Time:     b.lastChange,
+	})
+}
+
+// Record a state change, and hold the backend down once it changes flapCount
+// times within the flapWindow. Each consecutive hold down doubles in length,
+// until the backend stays stable for a full window.
+// Backend *must* be locked.
+func (b *Backend) dampen(now time.Time) {
+	if b.flapCount <= 0 || b.flapWindow <= 0 {
+		return
+	}
+
+	// drop changes outside of the window
+	recent := b.flaps[:0]
+	for _, t := range b.flaps {
+		if now.Sub(t) < b.flapWindow {
+			recent = append(recent, t)
+		}
+	}
+	b.flaps = append(recent, now)
+
+	if !b.holdUntil.IsZero() && now.Sub(b.holdUntil) > b.flapWindow && len(b.flaps) == 1 {
+		// stable since the last hold down
+		b.dampenLevel = 0
+	}
+
+	if len(b.flaps) < b.flapCount {
+		return
+	}
+
+	hold := b.flapHoldDown << uint(b.dampenLevel)
+	if hold > maxHoldDown || hold <= 0 {
+		hold = maxHoldDown
+	} else {
+		b.dampenLevel++
+	}
+
+	log.Warnf("WARN: Backend %s/%s changed state %d times in %s, holding down for %s",
+		b.service, b.Name, len(b.flaps), b.flapWindow, hold)
+
+	b.flaps = nil
+	b.holdUntil = now.Add(hold)
+	b.up = false
+}
+
+// Track how long the check address has failed to resolve, and deregister the
+// backend once that exceeds the dnsFailTimeout.
+// Returns true if the backend is being removed.
+func (b *Backend) checkDNS(err error) bool {
+	if b.dnsFailTimeout == 0 {
+		return false
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if _, ok := err.(*net.DNSError); !ok {
+		b.dnsFailSince = time.Time{}
+		return false
+	}
+
+	if b.dnsFailSince.IsZero() {
+		b.dnsFailSince = time.Now()
+		return false
+	}
+
+	if time.Since(b.dnsFailSince) < b.dnsFailTimeout {
+		return false
+	}
+
+	log.Errorf("ERROR: Check address for backend %s/%s has not resolved for %s, removing backend",
+		b.service, b.Name, b.dnsFailTimeout)
+
+	healthWebhook.Send(HealthEvent{
+		Service:  b.service,
+		Backend:  b.Name,
+		Addr:     b.Addr,
+		OldState: stateName(b.up),
+		NewState: "removed",
+		Reason:   err.Error(),
+		Time:     time.Now(),
+	})
+
+	// Removing the backend stops this health check loop, so it has to happen
+	// outside of it.
+	go func() {
+		if err := Registry.RemoveBackend(b.service, b.Name); err != nil {
+			log.Errorf("ERROR: Unable to remove backend %s/%s: %s", b.service, b.Name, err)
+			return
+		}
+		writeStateConfig()
+	}()
+	return true
+}
+
+// Look up a hostname Addr, so a failure to resolve fails the health check,
+// and UDP backends follow a change in address. IP addresses are left as is.
+func (b *Backend) resolve() error {
+	if virtualService(b.Addr) != "" {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(b.Addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return nil
+	}
+
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return err
+	}
+
+	var udpAddr *net.UDPAddr
+	var udpPorts int
+	if _, udp := splitNetwork(b.Network); udp != "" {
+		udpAddr, udpPorts, err = resolveUDPRange(udp, b.Addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if !reflect.DeepEqual(addrs, b.resolved) && b.resolved != nil {
+		log.Printf("INFO: Backend %s/%s %s resolved to %s", b.service, b.Name, host, strings.Join(addrs, ","))
+	}
+	b.resolved = addrs
+
+	if udpAddr != nil {
+		b.udpAddr = udpAddr
+		b.udpPorts = udpPorts
+	}
+	return nil
+}
+
+// Return the address for UDP backends. When the backend has a port range,
+// offset selects the port matching the service's port in its own range.
+func (b *Backend) UDPAddr(offset int) *net.UDPAddr {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.udpAddr == nil || offset == 0 || offset >= b.udpPorts {
+		return b.udpAddr
+	}
+
+	addr := *b.udpAddr
+	addr.Port += offset
+	return &addr
+}
+
+// Resolve the container address again after a failed check, since it may
+// have been restarted with a new port mapping.
+// Returns true if the backend is being replaced.
+func (b *Backend) checkContainer() bool {
+	if b.Container == "" {
+		return false
+	}
+
+	addr, err := resolveContainer(b.Container, b.Network)
+	if err != nil {
+		log.Warnf("WARN: Unable to resolve container for backend %s/%s: %s", b.service, b.Name, err)
+		return false
+	}
+
+	if addr == b.Addr {
+		return false
+	}
+
+	log.Printf("INFO: Container %s for backend %s/%s moved from %s to %s",
+		b.Container, b.service, b.Name, b.Addr, addr)
+
+	// Replacing the backend stops this health check loop, and NewBackend will
+	// pick up the new address.
+	cfg := b.Config()
+	go func() {
+		if err := Registry.AddBackend(b.service, cfg); err != nil {
+			log.Errorf("ERROR: Unable to replace backend %s/%s: %s", b.service, b.Name, err)
+			return
+		}
+		writeStateConfig()
+	}()
+	return true
+}
+
+// All of the backend's addresses, starting with Addr.
+// Backend *must* be locked.
+func (b *Backend) addrs() []string {
+	return append([]string{b.Addr}, b.FallbackAddrs...)
+}
+
+// Dial the backend, starting with the last address that connected and
+// falling back to each of the others in turn. The error is from the last
+// address tried.
+func (b *Backend) dial(ctx context.Context, dialer *net.Dialer, network string) (net.Conn, error) {
+	b.Lock()
+	addrs := b.addrs()
+	start := b.dialIdx
+	b.Unlock()
+
+	var err error
+	for i := range addrs {
+		idx := (start + i) % len(addrs)
+
+		var conn net.Conn
+		if name := virtualService(addrs[idx]); name != "" {
+			conn, err = dialService(ctx, b.service, name)
+		} else if sctpNetwork(network) {
+			conn, err = dialSCTP(ctx, dialer, network, addrs[idx])
+		} else {
+			conn, err = dialer.DialContext(ctx, network, addrs[idx])
+		}
+		if err == nil {
+			if idx != start {
+				log.Printf("INFO: Backend %s/%s now connecting to %s", b.service, b.Name, addrs[idx])
+				b.Lock()
+				b.dialIdx = idx
+				b.Unlock()
+			}
+			return conn, nil
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+		if len(addrs) > 1 {
+			log.Debugf("DEBUG: Unable to connect to backend %s/%s at %s: %s", b.service, b.Name, addrs[idx], err)
+		}
+	}
+	return nil, err
+}
+
+// Connect to the check address. When that's the backend's Addr, the check
+// passes if any of the backend's addresses connect.
+func (b *Backend) checkDial() (net.Conn, error) {
+	// an SCTP backend is checked with an SCTP connect
+	network := "tcp"
+	if sctpNetwork(b.Network) {
+		network, _ = splitNetwork(b.Network)
+	}
+
+	if b.CheckAddr == b.Addr && len(b.FallbackAddrs) > 0 {
+		return b.dial(context.Background(), &net.Dialer{Timeout: b.dialTimeout}, network)
+	}
+	if sctpNetwork(network) {
+		return dialSCTP(context.Background(), &net.Dialer{Timeout: b.dialTimeout}, network, b.CheckAddr)
+	}
+	return net.DialTimeout("tcp", b.CheckAddr, b.dialTimeout)
+}
+
 // Periodically check the status of this backend
 func (b *Backend) healthCheck() {
 	t := time.NewTicker(b.checkInterval)
@@ -205,6 +834,7 @@ func (b *Backend) healthCheck() {
 			return
 		case <-t.C:
 			b.check()
+			b.pollLoad()
 		}
 	}
 }
@@ -214,6 +844,25 @@ type closeReader interface {
 	CloseRead() error
 }
 
+// Write a PROXY header for cliConn to the backend, using the backend's
+// version if set, otherwise the service's.
+func (b *Backend) sendProxyHeader(srvConn, cliConn net.Conn, version string) error {
+	if b.SendProxy != "" {
+		version = b.SendProxy
+	}
+	if version == "" {
+		return nil
+	}
+
+	hdr, err := proxyHeader(version, cliConn.RemoteAddr(), cliConn.LocalAddr())
+	if err != nil {
+		return err
+	}
+
+	_, err = srvConn.Write(hdr)
+	return err
+}
+
 func (b *Backend) Proxy(srvConn, cliConn net.Conn) {
 	log.Debugf("DEBUG: Initiating proxy: %s/%s-%s/%s",
 		cliConn.RemoteAddr(),
@@ -226,7 +875,7 @@ func (b *Backend) Proxy(srvConn, cliConn net.Conn) {
 	// but all updates will be done atomically.
 
 	bConn := &shuttleConn{
-		TCPConn:   srvConn.(*net.TCPConn),
+		Conn:      srvConn,
 		rwTimeout: b.rwTimeout,
 		read:      &b.Rcvd,
 		written:   &b.Sent,
@@ -254,7 +903,9 @@ func (b *Backend) Proxy(srvConn, cliConn net.Conn) {
 		log.Debugf("DEBUG: Client %s/%s closed connection", cliConn.RemoteAddr(), cliConn.LocalAddr())
 		// the client closed first, so any more packets here are invalid, and
 		// we can SetLinger(0) to recycle the port faster.
-		bConn.TCPConn.SetLinger(0)
+		if tcpConn, ok := srvConn.(*net.TCPConn); ok {
+			tcpConn.SetLinger(0)
+		}
 		bConn.CloseRead()
 		waitFor = backendClosed
 	case <-backendClosed:
@@ -285,7 +936,7 @@ func broker(dst, src net.Conn, srcClosed chan bool, written, errors *int64) {
 // This will allow the server to close connections that are broken at the
 // network level.
 type shuttleConn struct {
-	*net.TCPConn
+	net.Conn
 	rwTimeout time.Duration
 
 	// count bytes read and written through this connection
@@ -294,38 +945,86 @@ type shuttleConn struct {
 
 	// decrement when closed
 	connected *int64
+
+	// A deadline set on the connection is kept if it's sooner than the
+	// rwTimeout. net/http sets one in the past to interrupt a pending read
+	// when the connection is hijacked, which must not be pushed back.
+	deadlineMu   sync.Mutex
+	readDeadline time.Time
 }
 
 func (c *shuttleConn) Read(b []byte) (int, error) {
 	if c.rwTimeout > 0 {
-		err := c.TCPConn.SetReadDeadline(time.Now().Add(c.rwTimeout))
+		c.deadlineMu.Lock()
+		err := c.Conn.SetReadDeadline(c.nextReadDeadline())
+		c.deadlineMu.Unlock()
 		if err != nil {
 			return 0, err
 		}
 	}
-	n, err := c.TCPConn.Read(b)
+	n, err := c.Conn.Read(b)
 	atomic.AddInt64(c.read, int64(n))
 	return n, err
 }
 
 func (c *shuttleConn) Write(b []byte) (int, error) {
 	if c.rwTimeout > 0 {
-		err := c.TCPConn.SetWriteDeadline(time.Now().Add(c.rwTimeout))
+		err := c.Conn.SetWriteDeadline(time.Now().Add(c.rwTimeout))
 		if err != nil {
 			return 0, err
 		}
 	}
 
-	n, err := c.TCPConn.Write(b)
+	n, err := c.Conn.Write(b)
 	atomic.AddInt64(c.written, int64(n))
 	return n, err
 }
 
+// The sooner of the deadline set on the connection and the rwTimeout.
+// deadlineMu *must* be locked.
+func (c *shuttleConn) nextReadDeadline() time.Time {
+	if c.rwTimeout <= 0 {
+		return c.readDeadline
+	}
+
+	deadline := time.Now().Add(c.rwTimeout)
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+		deadline = c.readDeadline
+	}
+	return deadline
+}
+
+func (c *shuttleConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(c.nextReadDeadline())
+}
+
+func (c *shuttleConn) SetDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	if err := c.Conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetReadDeadline(c.nextReadDeadline())
+}
+
 func (c *shuttleConn) Close() error {
 	if c.connected != nil {
 		atomic.AddInt64(c.connected, -1)
 	}
-	return c.TCPConn.Close()
+	return c.Conn.Close()
+}
+
+// Close the read side of the connection, or all of it when it can't be half
+// closed, as with a virtual backend.
+func (c *shuttleConn) CloseRead() error {
+	if cr, ok := c.Conn.(closeReader); ok {
+		return cr.CloseRead()
+	}
+	return c.Conn.Close()
 }
 
 // Empty function to override the ReadFrom in *net.TCPConn
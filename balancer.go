@@ -31,6 +31,8 @@ func (s *Service) roundRobin() []*Backend {
 		s.lastCount = 0
 	}
 
+	ignoreHealth := s.checkPanic()
+
 	// if our backend was over-weight, but we can't find another, use this
 	var reuse *Backend
 
@@ -39,8 +41,8 @@ func (s *Service) roundRobin() []*Backend {
 	for i := 0; i < count; i++ {
 		backend := s.Backends[s.lastBackend]
 
-		if backend.Up() {
-			if s.lastCount >= int(backend.Weight) {
+		if backend.Usable(ignoreHealth) {
+			if s.lastCount >= backend.currentWeight() {
 				// used too many times, but save it just in case
 				reuse = backend
 				s.lastBackend = (s.lastBackend + 1) % count
@@ -71,7 +73,7 @@ func (s *Service) roundRobin() []*Backend {
 	for i := 0; i < count-1; i++ {
 		lastBackend = (lastBackend + 1) % count
 		backend := s.Backends[lastBackend]
-		if backend.Up() {
+		if backend.Usable(ignoreHealth) {
 			balanced = append(balanced, backend)
 		}
 	}
@@ -96,9 +98,11 @@ func (s *Service) leastConn() []*Backend {
 	// return the backends in the order of least connections
 	var balanced []*Backend
 
+	ignoreHealth := s.checkPanic()
+
 	// Accumulate all backends that are currently Up
 	for _, b := range s.Backends {
-		if b.Up() {
+		if b.Usable(ignoreHealth) {
 			balanced = append(balanced, b)
 		}
 	}
@@ -112,6 +116,30 @@ func (s *Service) leastConn() []*Backend {
 	return balanced
 }
 
+// Return the backends for the next UDP datagram. A FanOut service uses every
+// usable backend, otherwise this is the next backend in round robin order.
+func (s *Service) udpBackends() []*Backend {
+	s.Lock()
+	if !s.FanOut {
+		s.Unlock()
+		if backend := s.udpRoundRobin(); backend != nil {
+			return []*Backend{backend}
+		}
+		return nil
+	}
+	defer s.Unlock()
+
+	ignoreHealth := s.checkPanic()
+
+	var backends []*Backend
+	for _, b := range s.Backends {
+		if b.Usable(ignoreHealth) {
+			backends = append(backends, b)
+		}
+	}
+	return backends
+}
+
 // Simple, but still weighted, RR for UDP where we don't don't have active
 // connections or connection failures.
 func (s *Service) udpRoundRobin() *Backend {
@@ -133,15 +161,17 @@ func (s *Service) udpRoundRobin() *Backend {
 		s.lastCount = 0
 	}
 
+	ignoreHealth := s.checkPanic()
+
 	// if our backend was over-weight, but we can't find another, use this
-	var backend, reuse *Backend
+	var reuse *Backend
 
-	// Find the next Up backend to call
+	// Find the next Up backend to call, skipping any that haven't responded
 	for i := 0; i < count; i++ {
-		backend = s.Backends[s.lastBackend]
+		backend := s.Backends[s.lastBackend]
 
-		if backend.Up() {
-			if s.lastCount >= int(backend.Weight) {
+		if backend.Usable(ignoreHealth) && !backend.Suspect() {
+			if s.lastCount >= backend.currentWeight() {
 				// used too many times, but save it just in case
 				reuse = backend
 				s.lastBackend = (s.lastBackend + 1) % count
@@ -150,21 +180,60 @@ func (s *Service) udpRoundRobin() *Backend {
 			}
 
 			s.lastCount++
-			break
+			return backend
 		}
 
 		s.lastBackend = (s.lastBackend + 1) % count
 	}
 
-	if backend != nil {
-		return backend
-	}
-
 	if reuse != nil {
 		return reuse
 	}
 
-	return nil
+	// nothing is available, so make a best effort with the next backend
+	return s.Backends[s.lastBackend]
+}
+
+// COST returns the backends in the order of their cost, from the service's
+// cost function.
+func (s *Service) leastCost() []*Backend {
+	s.Lock()
+	defer s.Unlock()
+
+	count := len(s.Backends)
+	switch count {
+	case 0:
+		return nil
+	case 1:
+		// fast track for the single backend case
+		return s.Backends[0:1]
+	}
+
+	ignoreHealth := s.checkPanic()
+
+	byCost := &ByCost{}
+	for _, b := range s.Backends {
+		if b.Usable(ignoreHealth) {
+			byCost.backends = append(byCost.backends, b)
+			byCost.costs = append(byCost.costs, s.cost(b))
+		}
+	}
+
+	if len(byCost.backends) == 0 {
+		return nil
+	}
+
+	sort.Stable(byCost)
+
+	return byCost.backends
+}
+
+// The default cost of a backend: the load it last reported plus its active
+// connections, divided by its weight, so heavier backends take more.
+func backendCost(b *Backend) float64 {
+	load, _ := b.reportedLoad()
+	active := atomic.LoadInt64(&b.Active) + atomic.LoadInt64(&b.HTTPActive)
+	return (load + float64(active)) / float64(b.currentWeight())
 }
 
 type ByActive []*Backend
@@ -176,3 +245,16 @@ func (s ByActive) Less(i, j int) bool {
 	jActive := atomic.LoadInt64(&(s[j].Active))
 	return iActive < jActive
 }
+
+// Backends along with their costs, computed once before sorting.
+type ByCost struct {
+	backends []*Backend
+	costs    []float64
+}
+
+func (s *ByCost) Len() int { return len(s.backends) }
+func (s *ByCost) Swap(i, j int) {
+	s.backends[i], s.backends[j] = s.backends[j], s.backends[i]
+	s.costs[i], s.costs[j] = s.costs[j], s.costs[i]
+}
+func (s *ByCost) Less(i, j int) bool { return s.costs[i] < s.costs[j] }
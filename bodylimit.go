@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Limits on the size of HTTP request bodies, so small backends aren't sent
+// uploads larger than they'll accept, and the buffering of small bodies, so a
+// request can be sent again to another backend.
+
+// Limit the request body to max bytes, or report false if its declared
+// length is already over the limit. A body of unknown length fails with
+// ErrBodyTooLarge once it passes the limit, which the proxy answers with a
+// 413.
+func limitRequestBody(r *http.Request, max int64) bool {
+	if max <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+
+	if r.ContentLength > max {
+		return false
+	}
+
+	if r.ContentLength < 0 {
+		r.Body = &limitedBody{ReadCloser: r.Body, remaining: max}
+	}
+	return true
+}
+
+// A request body which fails past a size limit.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+
+	// read one more byte than allowed to find a body over the limit
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = -1
+		return n, ErrBodyTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// Buffer the body of an idempotent request of at most max bytes, so it can be
+// replayed on another backend, and report if it can be. A larger body is
+// streamed to the backend as it would be without buffering.
+func bufferRequestBody(r *http.Request, max int64) (bool, error) {
+	if max <= 0 || !idempotent(r.Method) {
+		return false, nil
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return true, nil
+	}
+	if r.ContentLength > max {
+		return false, nil
+	}
+
+	// already buffered to be sent with a Content-Length
+	if r.GetBody != nil {
+		return true, nil
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		if errors.Is(err, ErrBodyTooLarge) {
+			return false, ErrBodyTooLarge
+		}
+		return false, ErrClientAborted
+	}
+
+	if int64(len(buf)) > max {
+		// send what was read ahead of the rest of the body
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return false, nil
+	}
+
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return true, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+	"github.com/skyfii/shuttle/client"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Default time a circuit breaker stays open
+const defaultBreakerCooldown = 10 * time.Second
+
+// States of a backend's circuit breaker, as reported in the BackendStat
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+var ErrBreakerOpen = errors.New("circuit breaker open")
+
+// circuitBreaker stops HTTP requests to a backend after consecutive failures.
+// Once open, requests fail fast to the next backend until the cooldown has
+// passed, when a single trial request is let through. Its success closes the
+// breaker, and its failure opens it for another cooldown. A nil
+// *circuitBreaker is always closed.
+type circuitBreaker struct {
+	sync.Mutex
+	cfg      client.CircuitBreakerConfig
+	cooldown time.Duration
+
+	// consecutive failures while closed
+	failures  int
+	state     string
+	openUntil time.Time
+	// a trial request is in flight while half open, which is given up on
+	// after another cooldown in case its outcome is never recorded
+	trialUntil time.Time
+}
+
+// Return a breaker for one backend, or nil if none is configured.
+func newCircuitBreaker(cfg *client.CircuitBreakerConfig) *circuitBreaker {
+	if cfg == nil || cfg.Errors <= 0 {
+		return nil
+	}
+
+	b := &circuitBreaker{
+		cfg:      *cfg,
+		cooldown: time.Duration(cfg.Cooldown) * time.Millisecond,
+		state:    breakerClosed,
+	}
+	if b.cooldown <= 0 {
+		b.cooldown = defaultBreakerCooldown
+	}
+	return b
+}
+
+// Allow reports if a request may be sent to the backend, letting through the
+// trial request once an open breaker's cooldown has passed.
+func (b *circuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case breakerOpen:
+		if now.Before(b.openUntil) {
+			return false
+		}
+		b.state = breakerHalfOpen
+	case breakerHalfOpen:
+		if now.Before(b.trialUntil) {
+			return false
+		}
+	default:
+		return true
+	}
+
+	b.trialUntil = now.Add(b.cooldown)
+	return true
+}
+
+// Record the outcome of a request to the backend.
+func (b *circuitBreaker) Record(name string, failed bool) {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if !failed {
+		if b.state != breakerClosed {
+			log.Printf("INFO: Closing circuit breaker for backend %s", name)
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.cfg.Errors {
+		if b.state == breakerClosed {
+			log.Warnf("WARN: Opening circuit breaker for backend %s after %d errors", name, b.failures)
+		}
+		b.state = breakerOpen
+		b.openUntil = time.Now().Add(b.cooldown)
+		b.failures = 0
+	}
+}
+
+// Return the state of the breaker, or "" if there is none.
+func (b *circuitBreaker) State() string {
+	if b == nil {
+		return ""
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state == breakerOpen && !time.Now().Before(b.openUntil) {
+		return breakerHalfOpen
+	}
+	return b.state
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"github.com/skyfii/shuttle/client"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Captures mirror the raw bytes of sampled TCP connections to a sink for
+// protocol debugging. The format is shuttle's own, not pcap: each chunk of
+// data is written as a frame of a single direction byte, '>' from the client
+// or '<' from the backend, a 4 byte big endian length, and the data itself.
+//
+// The sink is opened and written by its own goroutine, so a slow or
+// unreachable sink never holds up the connection. Frames which don't fit in
+// its queue are dropped.
+
+const (
+	captureFromClient = '>'
+	captureFromServer = '<'
+
+	// Default limit of bytes captured per connection
+	defaultCaptureBytes = 1 << 20
+
+	// extension of capture files
+	captureExt = ".tap"
+
+	// frames waiting to be written to the sink before more are dropped
+	captureQueue = 256
+
+	// timeout to connect to, and write to, a capture address
+	captureTimeout = 2 * time.Second
+)
+
+// capture decides which connections to tap for a service, and enforces the
+// configured rate limit.
+type capture struct {
+	sync.Mutex
+	cfg     client.CaptureConfig
+	service string
+
+	// connections seen, for sampling
+	seen int64
+
+	// captures started in the current minute
+	window      time.Time
+	windowCount int
+}
+
+func newCapture(service string, cfg *client.CaptureConfig) *capture {
+	if cfg == nil || (cfg.Addr == "" && cfg.Dir == "") {
+		return nil
+	}
+
+	c := &capture{
+		cfg:     *cfg,
+		service: service,
+	}
+
+	if c.cfg.Sample <= 0 {
+		c.cfg.Sample = 1
+	}
+	if c.cfg.MaxBytes <= 0 {
+		c.cfg.MaxBytes = defaultCaptureBytes
+	}
+	return c
+}
+
+// Return the conn, tapped if it's selected for capture.
+func (c *capture) Tap(conn net.Conn) net.Conn {
+	if c == nil {
+		return conn
+	}
+
+	c.Lock()
+	c.seen++
+	if c.seen%int64(c.cfg.Sample) != 0 {
+		c.Unlock()
+		return conn
+	}
+
+	if c.cfg.Rate > 0 {
+		now := time.Now()
+		if now.Sub(c.window) >= time.Minute {
+			c.window = now
+			c.windowCount = 0
+		}
+		if c.windowCount >= c.cfg.Rate {
+			c.Unlock()
+			return conn
+		}
+		c.windowCount++
+	}
+	c.Unlock()
+
+	log.Debugf("DEBUG: Capturing connection %s for %s", conn.RemoteAddr(), c.service)
+	frames := make(chan []byte, captureQueue)
+	go c.mirror(conn.RemoteAddr(), frames)
+
+	return &tapConn{
+		Conn:      conn,
+		frames:    frames,
+		remaining: c.cfg.MaxBytes,
+	}
+}
+
+// Write the frames of a connection to its sink until they're closed.
+func (c *capture) mirror(remote net.Addr, frames <-chan []byte) {
+	sink, err := c.openSink(remote)
+	if err != nil {
+		log.Warnf("WARN: Unable to open capture for %s: %s", c.service, err)
+		return
+	}
+	defer sink.Close()
+
+	for frame := range frames {
+		if conn, ok := sink.(net.Conn); ok {
+			conn.SetWriteDeadline(time.Now().Add(captureTimeout))
+		}
+		if _, err := sink.Write(frame); err != nil {
+			log.Warnf("WARN: Unable to write capture for %s: %s", c.service, err)
+			return
+		}
+	}
+}
+
+func (c *capture) openSink(remote net.Addr) (io.WriteCloser, error) {
+	if c.cfg.Addr != "" {
+		return net.DialTimeout("tcp", c.cfg.Addr, captureTimeout)
+	}
+
+	name := fmt.Sprintf("%s-%d-%s%s", c.service, time.Now().UnixNano(),
+		strings.Replace(remote.String(), ":", "_", -1), captureExt)
+
+	f, err := os.Create(filepath.Join(c.cfg.Dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	c.prune()
+	return f, nil
+}
+
+// remove the oldest capture files for this service beyond MaxFiles
+func (c *capture) prune() {
+	pruneCaptures(filepath.Join(c.cfg.Dir, c.service+"-*"+captureExt), c.cfg.MaxFiles)
+}
+
+// Remove the oldest of the capture files matching pattern beyond max. A max
+// of 0 keeps them all.
+func pruneCaptures(pattern string, max int) {
+	if max <= 0 {
+		return
+	}
+
+	files, err := filepath.Glob(pattern)
+	if err != nil || len(files) <= max {
+		return
+	}
+
+	// the timestamp in the name sorts oldest first
+	sort.Strings(files)
+	for _, f := range files[:len(files)-max] {
+		if err := os.Remove(f); err != nil {
+			log.Warnf("WARN: Unable to remove capture %s: %s", f, err)
+		}
+	}
+}
+
+// A net.Conn that copies everything read and written to a capture sink, up to
+// a limit of bytes.
+type tapConn struct {
+	net.Conn
+
+	sync.Mutex
+	frames    chan []byte
+	remaining int64
+	dropped   int64
+}
+
+func (t *tapConn) Read(b []byte) (int, error) {
+	n, err := t.Conn.Read(b)
+	if n > 0 {
+		t.capture(captureFromClient, b[:n])
+	}
+	return n, err
+}
+
+func (t *tapConn) Write(b []byte) (int, error) {
+	n, err := t.Conn.Write(b)
+	if n > 0 {
+		t.capture(captureFromServer, b[:n])
+	}
+	return n, err
+}
+
+// Queue a frame of the data for the sink, or drop it if the queue is full.
+func (t *tapConn) capture(dir byte, b []byte) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.frames == nil {
+		return
+	}
+
+	if int64(len(b)) > t.remaining {
+		b = b[:t.remaining]
+	}
+
+	frame := make([]byte, 5+len(b))
+	frame[0] = dir
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(b)))
+	copy(frame[5:], b)
+
+	select {
+	case t.frames <- frame:
+	default:
+		t.dropped += int64(len(b))
+	}
+
+	t.remaining -= int64(len(b))
+	if t.remaining <= 0 {
+		t.stop()
+	}
+}
+
+// Close the queue of frames, so the sink is closed once it's written.
+// The tapConn *must* be locked.
+func (t *tapConn) stop() {
+	close(t.frames)
+	t.frames = nil
+	if t.dropped > 0 {
+		log.Warnf("WARN: Dropped %d bytes of the capture of %s, the sink is too slow", t.dropped, t.Conn.RemoteAddr())
+	}
+}
+
+func (t *tapConn) CloseRead() error {
+	return t.Conn.(closeReader).CloseRead()
+}
+
+func (t *tapConn) Close() error {
+	t.Lock()
+	if t.frames != nil {
+		t.stop()
+	}
+	t.Unlock()
+	return t.Conn.Close()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"github.com/skyfii/shuttle/log"
+)
+
+// The certificates served by the HTTPS listener. These are looked up for
+// every handshake, so they can be reloaded without restarting the listener,
+// and existing connections keep the certificate they were established with.
+type certStore struct {
+	sync.Mutex
+	dir string
+
+	// Certificates and NameToCertificate as loaded by loadCerts
+	cfg *tls.Config
+
+	// newest modification time of the files when they were loaded
+	modTime time.Time
+}
+
+var httpsCerts = &certStore{}
+
+// Load the certificates from dir, replacing the current certificates only if
+// the load succeeds.
+func (c *certStore) Load(dir string) error {
+	modTime := certsModTime(dir)
+
+	cfg, err := loadCerts(dir)
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.dir = dir
+	c.modTime = modTime
+	if err != nil {
+		return err
+	}
+
+	c.cfg = cfg
+	log.Printf("INFO: Loaded %d certificates from %s", len(cfg.Certificates), dir)
+	return nil
+}
+
+// Reload the certificates from the same directory.
+func (c *certStore) Reload() error {
+	c.Lock()
+	dir := c.dir
+	c.Unlock()
+
+	if dir == "" {
+		return fmt.Errorf("no certificate directory loaded")
+	}
+	return c.Load(dir)
+}
+
+// Return the names of the loaded certificates.
+func (c *certStore) Names() []string {
+	c.Lock()
+	defer c.Unlock()
+
+	names := []string{}
+	if c.cfg == nil {
+		return names
+	}
+
+	for name := range c.cfg.NameToCertificate {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetCertificate for the tls.Config. A certificate from disk for the name, or
+// for its wildcard as tls.Config matches them, is preferred, then one from
+// ACME, and finally the first certificate loaded.
+func (c *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.Lock()
+	cfg := c.cfg
+	c.Unlock()
+
+	name := strings.ToLower(hello.ServerName)
+	if cfg != nil {
+		if cert, ok := cfg.NameToCertificate[name]; ok {
+			return cert, nil
+		}
+
+		labels := strings.Split(name, ".")
+		if len(labels) > 1 {
+			labels[0] = "*"
+			if cert, ok := cfg.NameToCertificate[strings.Join(labels, ".")]; ok {
+				return cert, nil
+			}
+		}
+	}
+
+	if cert := acmeCertificate(hello); cert != nil {
+		return cert, nil
+	}
+
+	if cfg != nil {
+		return &cfg.Certificates[0], nil
+	}
+	return nil, fmt.Errorf("no certificate for %s", name)
+}
+
+// Check the directory every interval, and reload the certificates when any
+// have been modified.
+func (c *certStore) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.Lock()
+		dir, loaded := c.dir, c.modTime
+		c.Unlock()
+
+		if !certsModTime(dir).After(loaded) {
+			continue
+		}
+
+		log.Printf("INFO: Certificates in %s changed, reloading", dir)
+		if err := c.Load(dir); err != nil {
+			log.Errorf("ERROR: Unable to reload certificates: %s", err)
+		}
+	}
+}
+
+// Return the newest modification time of the cert and key files in dir.
+func certsModTime(dir string) time.Time {
+	var newest time.Time
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return newest
+	}
+
+	for _, f := range files {
+		ext := filepath.Ext(f.Name())
+		if ext != ".pem" && ext != ".key" {
+			continue
+		}
+		if f.ModTime().After(newest) {
+			newest = f.ModTime()
+		}
+	}
+	return newest
+}
@@ -2,32 +2,67 @@ package client
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 )
 
 // Client is an http client for communicating with the shuttle server api
 type Client struct {
 	httpClient *http.Client
+	transport  *http.Transport
 	addr       string
 }
 
-// An http client for communicating with the shuttle server.
+// An http client for communicating with the shuttle server. The addr is
+// "host:port", or a URL with an "https://" scheme for a server started with
+// -admin-cert.
 func NewClient(addr string) *Client {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
 	return &Client{
-		httpClient: &http.Client{Timeout: 2 * time.Second},
-		addr:       addr,
+		httpClient: &http.Client{Timeout: 2 * time.Second, Transport: transport},
+		transport:  transport,
+		addr:       strings.TrimSuffix(addr, "/"),
 	}
 }
 
+// SetTLSConfig sets the config for an https server, e.g. to verify it with a
+// private CA, or to send a client certificate.
+func (c *Client) SetTLSConfig(cfg *tls.Config) {
+	c.transport.TLSClientConfig = cfg
+}
+
+// SetToken sends token as a bearer token with every request, for a shuttle
+// server started with -admin-token or -admin-read-token.
+func (c *Client) SetToken(token string) {
+	c.httpClient.Transport = &tokenTransport{token: token, base: c.transport}
+}
+
+// adds the Authorization header to each request
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(req)
+}
+
 // GetConfig retrieves the configuration for a running shuttle server.
 func (c *Client) GetConfig() (*Config, error) {
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/_config", c.addr), nil)
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/_config", c.addr), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -62,7 +97,7 @@ func (c *Client) UpdateConfig(config *Config) error {
 		return err
 	}
 
-	resp, err := c.httpClient.Post(fmt.Sprintf("http://%s/_config", c.addr), "application/json",
+	resp, err := c.httpClient.Post(fmt.Sprintf("%s/_config", c.addr), "application/json",
 		bytes.NewBuffer(js))
 	if err != nil {
 		return err
@@ -83,7 +118,7 @@ func (c *Client) UpdateService(service *ServiceConfig) error {
 		return err
 	}
 
-	resp, err := c.httpClient.Post(fmt.Sprintf("http://%s/%s", c.addr, service.Name), "application/json",
+	resp, err := c.httpClient.Post(fmt.Sprintf("%s/%s", c.addr, service.Name), "application/json",
 		bytes.NewBuffer(js))
 	if err != nil {
 		return err
@@ -96,9 +131,30 @@ func (c *Client) UpdateService(service *ServiceConfig) error {
 	return nil
 }
 
+// ReplaceService adds a service, or replaces the whole config of an existing
+// service on the same address without closing its listener.
+func (c *Client) ReplaceService(service *ServiceConfig) error {
+	js, err := json.Marshal(service)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Post(fmt.Sprintf("%s/%s?replace=true", c.addr, service.Name), "application/json",
+		bytes.NewBuffer(js))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to replace shuttle service '%s': %s", service.Name, resp.Status)
+	}
+	return nil
+}
+
 // RemoveService removes a service and its backends from a running shuttle server.
 func (c *Client) RemoveService(service string) error {
-	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s/%s", c.addr, service), nil)
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/%s", c.addr, service), nil)
 	if err != nil {
 		return err
 	}
@@ -123,7 +179,7 @@ func (c *Client) UpdateBackend(service string, backend *BackendConfig) error {
 		return err
 	}
 
-	resp, err := c.httpClient.Post(fmt.Sprintf("http://%s/%s/%s", c.addr, service, backend.Name), "application/json",
+	resp, err := c.httpClient.Post(fmt.Sprintf("%s/%s/%s", c.addr, service, backend.Name), "application/json",
 		bytes.NewBuffer(js))
 	if err != nil {
 		return err
@@ -138,7 +194,7 @@ func (c *Client) UpdateBackend(service string, backend *BackendConfig) error {
 
 // RemoveBackend removes a backend from its service on a running shuttle server.
 func (c *Client) RemoveBackend(service, backend string) error {
-	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s/%s/%s", c.addr, service, backend), nil)
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/%s/%s", c.addr, service, backend), nil)
 	if err != nil {
 		return err
 	}
@@ -154,3 +210,46 @@ func (c *Client) RemoveBackend(service, backend string) error {
 	}
 	return nil
 }
+
+// SetBackendState forces a backend "up" or "down" regardless of its health
+// checks. An empty state returns the backend to its observed health.
+func (c *Client) SetBackendState(service, backend, state string) error {
+	action := "_auto"
+	switch state {
+	case AdminUp:
+		action = "_up"
+	case AdminDown:
+		action = "_down"
+	}
+
+	resp, err := c.httpClient.Post(fmt.Sprintf("%s/%s/%s/%s", c.addr, service, backend, action), "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to set state of shuttle backend '%s/%s': %s", service, backend, resp.Status)
+	}
+	return nil
+}
+
+// SetTraceSample sets the fraction of a service's HTTP requests which are
+// traced, from 0 to 1.
+func (c *Client) SetTraceSample(service string, sample float64) error {
+	js, err := json.Marshal(TraceConfig{Sample: sample})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Post(fmt.Sprintf("%s/%s/_trace", c.addr, service), "application/json", bytes.NewBuffer(js))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to set trace sample for shuttle service '%s': %s", service, resp.Status)
+	}
+	return nil
+}
@@ -4,12 +4,14 @@ import (
 	"encoding/json"
 	"reflect"
 	"sort"
+	"time"
 )
 
 const (
 	// Balancing schemes
 	RoundRobin = "RR"
 	LeastConn  = "LC"
+	LeastCost  = "COST"
 
 	// Default timeout in milliseconds for clients and server connections
 	DefaultTimeout = 2000
@@ -29,6 +31,31 @@ const (
 	// Default for Fall and Rise is 2
 	DefaultFall = 2
 	DefaultRise = 2
+
+	// Administrative states for a backend, overriding the health checks.
+	// An empty AdminState uses the observed health.
+	AdminUp   = "up"
+	AdminDown = "down"
+
+	// Mitigations applied while a service's error budget is exceeded.
+	// MitigateMaintenance serves the maintenance response to HTTP requests,
+	// and MitigateNoRetry stops trying other backends after one fails.
+	MitigateMaintenance = "maintenance"
+	MitigateNoRetry     = "no_retry"
+
+	// Actions of a HeaderRule
+	HeaderAdd    = "add"
+	HeaderSet    = "set"
+	HeaderRemove = "remove"
+
+	// Handling of upstream forwarding headers. ForwardedTrust always keeps
+	// and appends to them, and ForwardedOverride always replaces them.
+	ForwardedTrust    = "trust"
+	ForwardedOverride = "override"
+
+	// Presets of SecurityHeadersConfig
+	SecurityBasic  = "basic"
+	SecurityStrict = "strict"
 )
 
 var (
@@ -41,9 +68,14 @@ var (
 // Config is the global configuration for all Services.
 // Defaults set here can be overridden by individual services.
 type Config struct {
+	// Version is the ConfigVersion the config was written with. Older
+	// configs are migrated when they're loaded.
+	Version int `json:"version,omitempty"`
+
 	// Balance method
-	// Valid values are "RR" for RoundRobin, the default, and "LC" for
-	// LeastConnected.
+	// Valid values are "RR" for RoundRobin, the default, "LC" for
+	// LeastConnected, and "COST" for the lowest cost from the backends'
+	// active connections, reported load and weight.
 	Balance string `json:"balance,omitempty"`
 
 	// CheckInterval is in time in milliseconds between service health checks.
@@ -74,10 +106,69 @@ type Config struct {
 	// have an "X-Forwarded-Proto: https" header.
 	HTTPSRedirect bool `json:"https-redirect"`
 
+	// MaxChecks limits the number of health checks running concurrently
+	// across all services. A value of 0 is unlimited.
+	MaxChecks int `json:"max_checks,omitempty"`
+
+	// MaxConnections limits the number of concurrent TCP connections and
+	// HTTP requests across all services. New connections over the limit are
+	// reset, and HTTP requests get a 503. A value of 0 is unlimited.
+	MaxConnections int `json:"max_connections,omitempty"`
+
+	// MaxRSS is a soft limit on the process's resident memory in megabytes,
+	// and MaxCPU on its CPU use as a percentage of one core. New connections
+	// and requests are refused while either is exceeded. A value of 0 is
+	// unlimited.
+	MaxRSS int `json:"max_rss,omitempty"`
+	MaxCPU int `json:"max_cpu,omitempty"`
+
+	// GOGC sets the Go GC target percentage, with a negative value turning
+	// the GC off. MemoryLimit is the Go runtime's soft memory limit in
+	// megabytes, and GOMAXPROCS overrides the number of threads running Go
+	// code, which otherwise follows the container's CPU quota. A value of 0
+	// leaves each unchanged.
+	GOGC        int `json:"gogc,omitempty"`
+	MemoryLimit int `json:"memory_limit,omitempty"`
+	GOMAXPROCS  int `json:"gomaxprocs,omitempty"`
+
+	// HealthWebhook is a URL which receives a json POST every time a backend
+	// is marked up or down. As it may hold credentials, it may be given as
+	// "env:NAME" or "file:PATH" to read it from the environment or a file.
+	HealthWebhook string `json:"health_webhook,omitempty"`
+
+	// HealthWebhooks are more destinations for the health events, each with
+	// its own payload, such as a Slack message or a PagerDuty event. An
+	// empty list removes them.
+	HealthWebhooks []WebhookConfig `json:"health_webhooks,omitempty"`
+
+	// TrustedProxies is a list of CIDRs or addresses of upstream proxies.
+	// X-Forwarded-Proto and X-Forwarded-For are only honored for the
+	// https_redirect check and request logging, and an X-Request-Id kept,
+	// when the direct peer is in this list; otherwise the peer is treated as
+	// the client. When no list is set every peer is trusted, and an empty
+	// list resets it.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// IdleServiceTTL is the time in milliseconds a service may have no
+	// backends and no traffic before it's flagged as idle, and removed with
+	// ReapIdleServices. Each is sent to the health webhooks. A value of 0
+	// leaves it unchanged, and a negative value never flags services.
+	IdleServiceTTL   int  `json:"idle_service_ttl,omitempty"`
+	ReapIdleServices bool `json:"reap_idle_services,omitempty"`
+
+	// Profiles are named service configs, such as "internal-api", which
+	// services refer to with their Profile to share the same timeouts,
+	// checks, balancing and error pages. A service inherits every value it
+	// leaves unset from its profile, and follows changes to the profile.
+	Profiles map[string]ServiceConfig `json:"profiles,omitempty"`
+
 	// Services is a slice of ServiceConfig for each service. A service
 	// corresponds to one listening connection, and a number of backends to
 	// proxy.
 	Services []ServiceConfig `json:"services"`
+
+	// Templates are expanded into more Services when the config is loaded.
+	Templates []ServiceTemplate `json:"templates,omitempty"`
 }
 
 // Marshal returns an entire config as a json []byte.
@@ -92,16 +183,78 @@ func (c *Config) String() string {
 	return string(c.Marshal())
 }
 
+// WebhookConfig is a destination for health events, and the payload posted
+// to it.
+type WebhookConfig struct {
+	// URL may be given as "env:NAME" or "file:PATH", like the
+	// HealthWebhook.
+	URL string `json:"url"`
+
+	// Format is a built-in payload: "json" for the HealthEvent itself,
+	// "slack" for a Slack message, or "pagerduty" for a PagerDuty v2 event
+	// using the "routing_key" param. Default is "json".
+	Format string `json:"format,omitempty"`
+
+	// Template replaces the Format with a Go text/template, given the
+	// event, the .Params, and a one line .Summary of the event. The "json"
+	// function quotes a value for a json payload.
+	Template string `json:"template,omitempty"`
+
+	// Params are passed to the template. Each may be given as "env:NAME"
+	// or "file:PATH".
+	Params map[string]string `json:"params,omitempty"`
+
+	// ContentType of the payload. Default is "application/json".
+	ContentType string `json:"content_type,omitempty"`
+
+	// Headers are added to each request, such as an Authorization header,
+	// and may also be given as "env:NAME" or "file:PATH".
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// TraceConfig is the tracing state of a service, read and set through the
+// /{service}/_trace endpoint.
+type TraceConfig struct {
+	// Sample is the fraction of HTTP requests traced, from 0 to 1.
+	Sample float64 `json:"sample"`
+}
+
+// DrainRequest is posted to /_drain to drain a batch of backends. Each is
+// set admin down, and the drain is done once their open connections and
+// requests have finished, or the Timeout in milliseconds has passed. The
+// final DrainStatus is then posted to the Callback URL, if set.
+type DrainRequest struct {
+	Backends []DrainTarget `json:"backends"`
+	Timeout  int           `json:"timeout,omitempty"`
+	Callback string        `json:"callback,omitempty"`
+}
+
+// DrainTarget names a backend of a service to drain.
+type DrainTarget struct {
+	Service string `json:"service"`
+	Backend string `json:"backend"`
+}
+
 // BackendConfig defines the parameters unique for individual backends.
 type BackendConfig struct {
 	// Name must be unique for this service.
 	// Used for reference and for the HTTP API.
 	Name string `json:"name"`
 
-	// Addr must in the form ip:port
+	// Addr must in the form ip:port. The backend of a UDP port range service
+	// may use a range of the same size, "ip:first-last", to receive each
+	// port's traffic on the matching port. A TCP or HTTP backend may be
+	// another service in the same shuttle, as "service://name".
 	Addr string `json:"address"`
 
-	// Network must be "tcp" or "udp".
+	// FallbackAddrs are other addresses of the same backend, such as its IPv6
+	// address, tried in order when Addr can't be dialed. The backend stays
+	// one backend for balancing, stats and health checks. UDP backends only
+	// use Addr.
+	FallbackAddrs []string `json:"fallback_addresses,omitempty"`
+
+	// Network must be "tcp", "udp", or "tcp+udp" to listen on both with the
+	// same backends, or "sctp" on Linux.
 	// Default is "tcp"
 	Network string `json:"network,omitempty"`
 
@@ -112,6 +265,50 @@ type BackendConfig struct {
 
 	// Weight is always used for RoundRobin balancing. Default is 1
 	Weight int `json:"weight"`
+
+	// Container, in the form "name:port", resolves Addr through the docker
+	// API to the host address mapped to the container's port. The address is
+	// resolved again when the health check fails, to follow container
+	// restarts. Requires shuttle to be started with the -docker option.
+	Container string `json:"container,omitempty"`
+
+	// AdminState forces the backend "up" or "down" regardless of its health
+	// checks. An empty value uses the observed health.
+	AdminState string `json:"admin_state,omitempty"`
+
+	// SendProxy overrides the service's SendProxy for this backend.
+	SendProxy string `json:"send_proxy,omitempty"`
+
+	// LoadURL is polled with each health check for the backend's current
+	// load, as a number or a json object with a "load" field, which is
+	// added to its cost for "COST" balancing.
+	LoadURL string `json:"load_url,omitempty"`
+
+	// Schedule changes the backend's weight during daily windows, such as
+	// taking a batch cluster out of the rotation during peak hours. The
+	// first window containing the current time sets the weight, and Weight
+	// is used outside of them.
+	Schedule []ScheduleWindow `json:"schedule,omitempty"`
+}
+
+// A daily window of a backend's schedule.
+type ScheduleWindow struct {
+	// Days the window applies, as "mon" through "sun". Default is every day.
+	Days []string `json:"days,omitempty"`
+
+	// Start and End of the window as "15:04". A window ending before it
+	// starts runs past midnight, into the next day, and one ending when it
+	// starts lasts all day.
+	Start string `json:"start"`
+	End   string `json:"end"`
+
+	// Timezone is the IANA name of the zone the window is in, such as
+	// "Australia/Sydney". Default is the local time of the shuttle host.
+	Timezone string `json:"timezone,omitempty"`
+
+	// Weight is the backend's weight during the window. A weight of 0
+	// takes the backend out of the rotation.
+	Weight int `json:"weight"`
 }
 
 // return a copy of the BackendConfig with default values set
@@ -122,13 +319,19 @@ func (b BackendConfig) SetDefaults() BackendConfig {
 	if b.Network == "" {
 		b.Network = DefaultNet
 	}
+	if len(b.FallbackAddrs) == 0 {
+		b.FallbackAddrs = nil
+	}
+	if len(b.Schedule) == 0 {
+		b.Schedule = nil
+	}
 	return b
 }
 
 func (b BackendConfig) Equal(other BackendConfig) bool {
 	b = b.SetDefaults()
 	other = other.SetDefaults()
-	return b == other
+	return reflect.DeepEqual(b, other)
 }
 
 func (b *BackendConfig) Marshal() []byte {
@@ -159,17 +362,29 @@ type ServiceConfig struct {
 	// and in the HTTP API.
 	Name string `json:"name"`
 
+	// Profile names the entry in the config's Profiles the service inherits
+	// its unset values from.
+	Profile string `json:"profile,omitempty"`
+
 	// Addr is the listening address for this service. Must be in the form
-	// "ip:addr"
+	// "ip:addr". A UDP service may listen on a range of ports with
+	// "ip:first-last". With port 0 the system picks the port, which is
+	// reported in BoundAddr.
 	Addr string `json:"address"`
 
-	// Network must be "tcp" or "udp".
+	// BoundAddr is the address the service is listening on, as reported by
+	// shuttle. It's ignored in a config sent to shuttle.
+	BoundAddr string `json:"bound_address,omitempty"`
+
+	// Network must be "tcp", "udp", or "tcp+udp" to listen on both with the
+	// same backends, or "sctp" on Linux.
 	// Default is "tcp"
 	Network string `json:"network,omitempty"`
 
 	// Balance method
-	// Valid values are "RR" for RoundRobin, the default, and "LC" for
-	// LeastConnected.
+	// Valid values are "RR" for RoundRobin, the default, "LC" for
+	// LeastConnected, and "COST" for the lowest cost from the backends'
+	// active connections, reported load and weight.
 	Balance string `json:"balance,omitempty"`
 
 	// CheckInterval is in time in milliseconds between service health checks.
@@ -194,11 +409,41 @@ type ServiceConfig struct {
 	// backend service, including name resolution.
 	DialTimeout int `json:"connect_timeout"`
 
+	// RequestTimeout is the longest time in milliseconds an HTTP request may
+	// take, from being routed to the end of the response, before a 504.
+	// ResponseHeaderTimeout is the longest a backend may take to send its
+	// response headers. IdleTimeout closes a client's keep-alive connection
+	// once it's been idle that long after a request to the service. A value
+	// of 0 leaves each unlimited, other than by the client and server
+	// timeouts.
+	RequestTimeout        int `json:"request_timeout,omitempty"`
+	ResponseHeaderTimeout int `json:"response_header_timeout,omitempty"`
+	IdleTimeout           int `json:"idle_timeout,omitempty"`
+
+	// FlushInterval is how often, in milliseconds, an HTTP response is
+	// flushed to the client while it's copied from the backend. A value of -1
+	// flushes every write, as for long polling, and a longer interval buffers
+	// more of a bulk response. The default of 0 flushes every second.
+	// Server-sent events are always flushed on every write.
+	FlushInterval int `json:"flush_interval,omitempty"`
+
 	// HTTPSRedirect when set to true, redirects non-https request to https. The
 	// request may either have Scheme set to 'https',  or have an
 	// "X-Forwarded-Proto: https" header.
 	HTTPSRedirect bool `json:"https-redirect"`
 
+	// HTTPSRedirectExcept lists exceptions to HTTPSRedirect, served over
+	// plain http. Entries starting with "/" are path prefixes, such as
+	// "/.well-known/" or a health endpoint, and others are virtual hosts.
+	HTTPSRedirectExcept []string `json:"https_redirect_except,omitempty"`
+
+	// Forwarded controls the X-Forwarded-For, X-Forwarded-Proto,
+	// X-Forwarded-Host, X-Real-IP and Forwarded headers sent to the
+	// backends. Values from upstream are kept and appended to when the
+	// client is a trusted proxy, and replaced otherwise. "trust" keeps them
+	// from every client, and "override" always replaces them.
+	Forwarded string `json:"forwarded,omitempty"`
+
 	// Virtualhosts is a set of virtual hostnames for which this service should
 	// handle HTTP requests.
 	VirtualHosts []string `json:"virtual_hosts,omitempty"`
@@ -206,15 +451,566 @@ type ServiceConfig struct {
 	// ErrorPages are responses to be returned for HTTP error codes. Each page
 	// is defined by a URL mapped and is mapped to a list of error codes that
 	// should return the content at the URL. Error pages are retrieved ahead of
-	// time if possible, and cached.
+	// time if possible, and cached. A page may also be a local file, given as
+	// "file:PATH" or an absolute path. A page is a Go text/template given the
+	// .Status, .StatusText, .RequestID, .Service, .Host and .Time.
 	ErrorPages map[string][]int `json:"error_pages,omitempty"`
 
+	// ErrorPagesRefresh is the time in milliseconds after which the cached
+	// error pages are fetched again, keeping the cached page if that fails.
+	// A value of 0 never refreshes them.
+	ErrorPagesRefresh int `json:"error_pages_refresh,omitempty"`
+
+	// ErrorPagesIfEmpty lists status codes where a backend's response is
+	// only replaced by the error page when it has no body. Responses with a
+	// body are passed through to the client unchanged.
+	ErrorPagesIfEmpty []int `json:"error_pages_if_empty,omitempty"`
+
+	// RetryStatus lists backend response codes, such as 502 and 503, treated
+	// as a failure of the backend. Idempotent requests without a body are
+	// retried on the next backend, and each failure counts against the
+	// backend's health like a failed check.
+	RetryStatus []int `json:"retry_status,omitempty"`
+
+	// AllowMethods lists the HTTP methods passed on to the backends, such as
+	// ["GET", "HEAD", "POST"]. Other methods, such as TRACE or OPTIONS, get
+	// a 405 from the proxy. Without it every method is allowed.
+	AllowMethods []string `json:"allow_methods,omitempty"`
+
 	// Backends is a list of all servers handling connections for this service.
 	Backends []BackendConfig `json:"backends,omitempty"`
 
 	// Maintenance mode is a flag to return 503 status codes to clients
 	// without visiting backends.
 	MaintenanceMode bool `json:"maintenance_mode"`
+
+	// LazyBind delays opening the service's listener until a backend has
+	// passed a health check, so clients aren't accepted with nowhere to go.
+	LazyBind bool `json:"lazy_bind,omitempty"`
+
+	// SNIRouting reads the server name from the TLS ClientHello of each
+	// connection, and proxies it to the backends of the service with a
+	// matching virtual host, without terminating TLS. Connections without a
+	// matching name use this service's backends.
+	SNIRouting bool `json:"sni_routing,omitempty"`
+
+	// FanOut sends a copy of each datagram received by a UDP service to
+	// every healthy backend, rather than balancing them. Replies from all the
+	// backends are returned to the client.
+	FanOut bool `json:"fan_out,omitempty"`
+
+	// UDPResponseWindow is the time in milliseconds a UDP backend has to
+	// reply to a new client session. A backend that doesn't reply is
+	// suspect, and skipped by the balancer for one CheckInterval or until it
+	// replies to another session. A value of 0 expects no replies.
+	UDPResponseWindow int `json:"udp_response_window,omitempty"`
+
+	// UDPPacketRate and UDPByteRate are the sustained datagrams and bytes
+	// per second accepted from each source IP, with bursts of up to
+	// UDPPacketBurst and UDPByteBurst. Datagrams over either limit are
+	// dropped. A rate of 0 is unlimited, and a burst of 0 allows one
+	// second's worth.
+	UDPPacketRate  float64 `json:"udp_packet_rate,omitempty"`
+	UDPPacketBurst int     `json:"udp_packet_burst,omitempty"`
+	UDPByteRate    float64 `json:"udp_byte_rate,omitempty"`
+	UDPByteBurst   int     `json:"udp_byte_burst,omitempty"`
+
+	// RateLimit is the sustained rate of TCP connections or HTTP requests
+	// per second allowed from each client IP, with bursts of up to RateBurst.
+	// TCP connections over the limit are reset, and HTTP requests get a 429
+	// response. A RateLimit of 0 is unlimited, and a RateBurst of 0 allows
+	// one second's worth.
+	RateLimit float64 `json:"rate_limit,omitempty"`
+	RateBurst int     `json:"rate_burst,omitempty"`
+
+	// TraceSample is the fraction of HTTP requests, from 0 to 1, which are
+	// traced with a W3C traceparent header and logged. Requests already
+	// sampled by the client are always traced. It can be changed at runtime
+	// through the /{service}/_trace endpoint.
+	TraceSample float64 `json:"trace_sample,omitempty"`
+
+	// BindRetry is the time in milliseconds to keep retrying the listener
+	// when the service's address is in use, rather than failing to add the
+	// service.
+	BindRetry int `json:"bind_retry,omitempty"`
+
+	// FlapCount is the number of up/down changes within FlapWindow
+	// milliseconds that holds a backend down for FlapHoldDown milliseconds.
+	// The hold down doubles each time the backend flaps again. A FlapCount
+	// of 0 disables dampening.
+	FlapCount    int `json:"flap_count,omitempty"`
+	FlapWindow   int `json:"flap_window,omitempty"`
+	FlapHoldDown int `json:"flap_hold_down,omitempty"`
+
+	// PanicThreshold is a percentage of healthy backends. When fewer are up,
+	// the health checks are ignored and connections are balanced across all
+	// backends, so the last healthy ones aren't overwhelmed. A value of 0
+	// disables panic mode.
+	PanicThreshold int `json:"panic_threshold,omitempty"`
+
+	// MaxConnections limits the number of concurrent TCP connections and
+	// HTTP requests for this service, in addition to the global limit.
+	// A value of 0 is unlimited.
+	MaxConnections int `json:"max_connections,omitempty"`
+
+	// MaxRequestBody is the largest HTTP request body, in bytes, sent on to
+	// the backends. Larger requests get a 413. A value of 0 is unlimited.
+	MaxRequestBody int64 `json:"max_request_body,omitempty"`
+
+	// ReplayBody is the largest HTTP request body, in bytes, buffered so a
+	// GET, HEAD, PUT or other idempotent request which fails after it was
+	// sent to a backend can be replayed on the next one. Without it, only
+	// requests which couldn't connect, or bodiless requests answered with a
+	// RetryStatus, are retried. A value of 0 buffers nothing.
+	ReplayBody int64 `json:"replay_body,omitempty"`
+
+	// ClientTOS sets the IP TOS byte (DSCP << 2) on client connections to
+	// this service. A value of 0 leaves the system default. It can only be
+	// set on unix platforms.
+	ClientTOS int `json:"client_tos,omitempty"`
+
+	// ServerTOS sets the IP TOS byte (DSCP << 2) on connections to the
+	// backends. A value of 0 leaves the system default. It can only be set
+	// on unix platforms.
+	ServerTOS int `json:"server_tos,omitempty"`
+
+	// DNSFailTimeout is the time in milliseconds a backend's check address
+	// may fail to resolve before the backend is removed from the service. A
+	// value of 0 never removes backends.
+	DNSFailTimeout int `json:"dns_fail_timeout,omitempty"`
+
+	// KeepBackendStats is the time in milliseconds a removed backend's
+	// counters and health history are kept. A backend added back within it
+	// with the same name and address carries them over, as does one replaced
+	// with a changed config, rather than starting from zero. A value of 0
+	// keeps nothing.
+	KeepBackendStats int `json:"keep_backend_stats,omitempty"`
+
+	// NoBackendResponse is written to a TCP client before the connection is
+	// closed when no backend could be reached, e.g. an HTTP 503 or a
+	// protocol specific error.
+	NoBackendResponse string `json:"no_backend_response,omitempty"`
+
+	// AcceptProxy requires a PROXY protocol v1 or v2 header on every TCP
+	// connection, and uses the client address from the header.
+	AcceptProxy bool `json:"accept_proxy,omitempty"`
+
+	// SendProxy writes a PROXY protocol header with the client's address on
+	// every TCP connection to the backends. Valid values are "v1" and "v2".
+	SendProxy string `json:"send_proxy,omitempty"`
+
+	// Capture mirrors the raw bytes of a sample of TCP connections to a sink
+	// for protocol debugging.
+	Capture *CaptureConfig `json:"capture,omitempty"`
+
+	// ErrorCapture keeps the HTTP requests which end in a proxy error or a
+	// chosen status, along with their responses, for debugging.
+	ErrorCapture *ErrorCaptureConfig `json:"error_capture,omitempty"`
+
+	// JWT requires HTTP requests to the service's virtual hosts to carry a
+	// valid bearer token.
+	JWT *JWTConfig `json:"jwt,omitempty"`
+
+	// ErrorBudget marks the service degraded when too many connections or
+	// requests fail within a window of time.
+	ErrorBudget *ErrorBudgetConfig `json:"error_budget,omitempty"`
+
+	// CircuitBreaker stops sending HTTP requests to a backend for a while
+	// after it fails too many in a row.
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker,omitempty"`
+
+	// OutlierDetection ejects a backend from the rotation for a while when
+	// its rate of failed HTTP requests stands out from the other backends.
+	OutlierDetection *OutlierDetectionConfig `json:"outlier_detection,omitempty"`
+
+	// MaintenanceToken allows requests with a matching
+	// "X-Maintenance-Bypass" header through to the backends while the
+	// service is in maintenance mode. It may be given as "env:NAME" or
+	// "file:PATH" to read it from the environment or a file.
+	MaintenanceToken string `json:"maintenance_token,omitempty"`
+
+	// ClientCA is a PEM file of CA certificates. When set, HTTPS requests to
+	// the service's virtual hosts must present a client certificate signed
+	// by one of them, and the subject is passed to the backends in the
+	// X-Client-Cert-Subject header.
+	ClientCA string `json:"client_ca,omitempty"`
+
+	// MaintenanceAllow is a list of CIDR networks whose clients bypass
+	// maintenance mode.
+	MaintenanceAllow []string `json:"maintenance_allow,omitempty"`
+
+	// Maintenance customizes the response served in maintenance mode, and
+	// may schedule a window when the service is in maintenance without
+	// setting MaintenanceMode.
+	Maintenance *MaintenanceConfig `json:"maintenance,omitempty"`
+
+	// StripHeaders are removed from HTTP requests before they're proxied to
+	// the backends, such as internal headers a client shouldn't be able to
+	// set. Stripping X-Forwarded-For discards any addresses claimed by the
+	// client, so the backends only see the address shuttle was connected
+	// from.
+	StripHeaders []string `json:"strip_headers,omitempty"`
+
+	// SetHeaders are set on HTTP requests before they're proxied to the
+	// backends, replacing any value sent by the client. Values holding
+	// credentials may be given as "env:NAME" or "file:PATH".
+	SetHeaders map[string]string `json:"set_headers,omitempty"`
+
+	// HeaderRules add, set or remove headers on HTTP requests before they're
+	// proxied to the backends, after StripHeaders and SetHeaders, or on the
+	// responses returned to the client. They're applied in order.
+	HeaderRules []HeaderRule `json:"header_rules,omitempty"`
+
+	// HeaderRoutes limit the HTTP requests the service takes on its virtual
+	// hosts to those with matching headers, so services can share a virtual
+	// host split by tenant or client type. Every route must match. Services
+	// with matching routes take requests ahead of the services without any,
+	// which get the rest.
+	HeaderRoutes []HeaderRoute `json:"header_routes,omitempty"`
+
+	// LBHealth serves an HTTP health check for this service alone, for
+	// upstream load balancers.
+	LBHealth *LBHealthConfig `json:"lb_health,omitempty"`
+
+	// Rewrites change the request path before it's proxied, in order.
+	Rewrites []RewriteRule `json:"rewrites,omitempty"`
+
+	// Redirects answer matching requests with a redirect rather than
+	// proxying them. The first matching rule is used.
+	Redirects []RedirectRule `json:"redirects,omitempty"`
+
+	// Compress encodes backend responses with brotli, gzip or deflate for
+	// clients which accept it.
+	Compress *CompressConfig `json:"compress,omitempty"`
+
+	// SecurityHeaders add standard security headers to the HTTP responses
+	// which don't have them. An entry for the request's virtual host is used
+	// before one for all of them.
+	SecurityHeaders []SecurityHeadersConfig `json:"security_headers,omitempty"`
+
+	// Priority sheds low priority HTTP requests first as the service nears
+	// its connection limits.
+	Priority *PriorityConfig `json:"priority,omitempty"`
+
+	// HTTP2 proxies HTTP requests to the backends over cleartext HTTP/2
+	// (h2c) rather than HTTP/1.1, as needed for gRPC backends.
+	HTTP2 bool `json:"http2,omitempty"`
+
+	// ForceHTTP11 sends the requests to the backends as plain HTTP/1.1,
+	// ignoring HTTP2, and without passing on a client's Upgrade to another
+	// protocol, for backends which mishandle them.
+	ForceHTTP11 bool `json:"force_http11,omitempty"`
+
+	// NoChunked buffers HTTP request bodies of unknown length, up to the
+	// MaxRequestBody or 8MB, so they're sent to the backends with a
+	// Content-Length rather than chunked. Larger bodies get a 413.
+	NoChunked bool `json:"no_chunked,omitempty"`
+
+	// NormalizeConnection removes the headers a request or response names in
+	// its Connection header, and sends the backends an explicit
+	// "Connection: keep-alive", for backends from the HTTP/1.0 era.
+	NormalizeConnection bool `json:"normalize_connection,omitempty"`
+}
+
+// HeaderRule rewrites a request or response header.
+type HeaderRule struct {
+	// Action is "add", "set" or "remove".
+	Action string `json:"action"`
+
+	// Header is the name of the header.
+	Header string `json:"header"`
+
+	// Value is added or set, and ignored when removing the header.
+	Value string `json:"value,omitempty"`
+
+	// Response applies the rule to responses rather than requests.
+	Response bool `json:"response,omitempty"`
+}
+
+// RewriteRule rewrites the request path, stripping a prefix and then
+// substituting a regexp.
+type RewriteRule struct {
+	// VirtualHost limits the rule to one of the service's virtual hosts.
+	// Empty applies it to all of them.
+	VirtualHost string `json:"virtual_host,omitempty"`
+
+	// StripPrefix is removed from the start of the path.
+	StripPrefix string `json:"strip_prefix,omitempty"`
+
+	// Regexp matches the path, and each match is replaced by Replace, which
+	// may refer to submatches as $1 or ${name}.
+	Regexp  string `json:"regexp,omitempty"`
+	Replace string `json:"replace,omitempty"`
+}
+
+// RedirectRule redirects requests whose path matches Regexp.
+type RedirectRule struct {
+	// VirtualHost limits the rule to one of the service's virtual hosts.
+	// Empty applies it to all of them.
+	VirtualHost string `json:"virtual_host,omitempty"`
+
+	// Regexp must match the path. Empty matches every path.
+	Regexp string `json:"regexp,omitempty"`
+
+	// Target is the redirect location. It may refer to the regexp's
+	// submatches as $1 or ${name}, and to the request as {host} and {path}.
+	// The query is appended unless the target has its own.
+	Target string `json:"target"`
+
+	// Status is 301, 302, 307 or 308. Default is 301.
+	Status int `json:"status,omitempty"`
+}
+
+// SecurityHeadersConfig selects the security headers added to responses. Each
+// header defaults to the preset's value, and may be set to another, or to
+// "off" to leave it out.
+type SecurityHeadersConfig struct {
+	// VirtualHost limits the headers to one of the service's virtual hosts.
+	// Empty applies them to all of them.
+	VirtualHost string `json:"virtual_host,omitempty"`
+
+	// Preset is "basic" or "strict". Default is "basic".
+	Preset string `json:"preset,omitempty"`
+
+	// HSTS is the Strict-Transport-Security header, only sent on HTTPS
+	// requests.
+	HSTS string `json:"hsts,omitempty"`
+
+	// FrameOptions is the X-Frame-Options header.
+	FrameOptions string `json:"frame_options,omitempty"`
+
+	// ReferrerPolicy is the Referrer-Policy header.
+	ReferrerPolicy string `json:"referrer_policy,omitempty"`
+
+	// ContentTypeOptions is the X-Content-Type-Options header.
+	ContentTypeOptions string `json:"content_type_options,omitempty"`
+}
+
+// HeaderRoute matches a request header. With neither Value nor Regexp set,
+// the header only needs to be present.
+type HeaderRoute struct {
+	// Header is the name of the request header.
+	Header string `json:"header"`
+
+	// Value must equal one of the header's values, ignoring case.
+	Value string `json:"value,omitempty"`
+
+	// Regexp must match one of the header's values. It takes precedence over
+	// Value.
+	Regexp string `json:"regexp,omitempty"`
+}
+
+// CompressConfig selects the responses compressed on the fly.
+type CompressConfig struct {
+	// Types lists the Content-Type prefixes compressed. Default is text,
+	// json, javascript, xml and svg.
+	Types []string `json:"types,omitempty"`
+
+	// MinSize is the smallest Content-Length compressed. Responses of
+	// unknown length are always compressed. Default is 1024.
+	MinSize int `json:"min_size,omitempty"`
+
+	// VirtualHosts limits compression to some of the service's virtual
+	// hosts. Empty compresses all of them.
+	VirtualHosts []string `json:"virtual_hosts,omitempty"`
+}
+
+// PriorityConfig maps a request header to a priority. While the service's
+// concurrent requests pass ShedAt percent of max_connections, or of the global
+// max_connections, or while its error budget is spent, requests below the
+// highest priority get a 503, the lowest first.
+type PriorityConfig struct {
+	// Header holds the request's priority, such as "X-Priority".
+	Header string `json:"header"`
+
+	// Levels maps header values, ignoring case, to a priority where higher
+	// is more important. Requests without a mapped value get 0.
+	Levels map[string]int `json:"levels"`
+
+	// ShedAt is the load percentage at which the lowest priority is shed.
+	// Default is 80.
+	ShedAt int `json:"shed_at,omitempty"`
+}
+
+// LBHealthConfig defines the service's health responder. It answers 200 while
+// enough backends are available, and 503 otherwise.
+type LBHealthConfig struct {
+	// Addr is the tcp "ip:port" to listen on.
+	Addr string `json:"address"`
+
+	// Path is the URL path answered. Default is "/_lb-health".
+	Path string `json:"path,omitempty"`
+
+	// MinAvailable is the percentage of backends which must be available for
+	// the service to be healthy. Default is any one backend.
+	MinAvailable int `json:"min_available,omitempty"`
+}
+
+// CaptureConfig defines where and how much TCP traffic is captured for a
+// service. Either Addr or Dir must be set. Captures are in shuttle's own
+// format, not pcap: a frame for each chunk of data, of a direction byte, '>'
+// from the client or '<' from the backend, a 4 byte big endian length, and
+// the data.
+type CaptureConfig struct {
+	// Addr is a tcp "ip:port" where each captured connection is streamed.
+	Addr string `json:"address,omitempty"`
+
+	// Dir is a directory where each captured connection is written to its
+	// own .tap file.
+	Dir string `json:"dir,omitempty"`
+
+	// Sample captures 1 in every Sample connections. Default is 1.
+	Sample int `json:"sample,omitempty"`
+
+	// Rate is the maximum number of connections captured per minute. A value
+	// of 0 is unlimited.
+	Rate int `json:"rate,omitempty"`
+
+	// MaxBytes is the limit of bytes captured from each connection. Default
+	// is 1MB.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+
+	// MaxFiles is the number of capture files kept in Dir for the service.
+	// Older files are removed. A value of 0 keeps all files.
+	MaxFiles int `json:"max_files,omitempty"`
+}
+
+// ErrorCaptureConfig defines which HTTP requests are captured, headers and
+// bodies, with their responses, each to its own file in a ring kept in Dir.
+type ErrorCaptureConfig struct {
+	// Dir is the directory the captures are written to.
+	Dir string `json:"dir"`
+
+	// Status lists the backend response codes, such as 500 and 503,
+	// captured along with requests that end in a proxy error.
+	Status []int `json:"status,omitempty"`
+
+	// MaxBody is the limit of bytes captured from each body. Default is
+	// 64KB.
+	MaxBody int64 `json:"max_body,omitempty"`
+
+	// MaxFiles is the number of captures kept in Dir for the service. Older
+	// files are removed. Default is 100.
+	MaxFiles int `json:"max_files,omitempty"`
+}
+
+// JWTConfig defines how bearer tokens are verified. Requests without a
+// valid token get a 401, and the verified claims are passed to the backends
+// in headers.
+type JWTConfig struct {
+	// JWKSURL is fetched for the RSA and EC keys which may sign tokens. The
+	// keys are refreshed periodically, and when a token names an unknown key.
+	JWKSURL string `json:"jwks_url,omitempty"`
+
+	// Keys are PEM files of public keys which may sign tokens.
+	Keys []string `json:"keys,omitempty"`
+
+	// Secret is a shared key for HMAC signed tokens, or "env:NAME" or
+	// "file:PATH" to read it from the environment or a file.
+	Secret string `json:"secret,omitempty"`
+
+	// Issuer and Audience must match the token's "iss" and "aud" claims
+	// when set.
+	Issuer   string `json:"issuer,omitempty"`
+	Audience string `json:"audience,omitempty"`
+
+	// ClaimHeaders maps claim names to the request headers they're passed
+	// to the backends in. Default is "sub" in X-JWT-Subject.
+	ClaimHeaders map[string]string `json:"claim_headers,omitempty"`
+}
+
+// ErrorBudgetConfig defines the error rate which marks a service degraded.
+// Failed TCP connections, and HTTP requests with a proxy error or a 5xx
+// response, count as errors.
+type ErrorBudgetConfig struct {
+	// Threshold is the fraction of errors, from 0 to 1, above which the
+	// service is degraded.
+	Threshold float64 `json:"threshold"`
+
+	// Window is the time in milliseconds the error rate is measured over.
+	Window int `json:"window"`
+
+	// MinRequests is the number of connections or requests needed within
+	// the window before the service can be marked degraded. Default is 1.
+	MinRequests int `json:"min_requests,omitempty"`
+
+	// Webhook sends an event to the health webhook when the service becomes
+	// degraded, and again when it recovers.
+	Webhook bool `json:"webhook,omitempty"`
+
+	// Mitigation is applied while the service is degraded, either
+	// "maintenance" or "no_retry". Empty applies none.
+	Mitigation string `json:"mitigation,omitempty"`
+}
+
+// MaintenanceConfig defines the response to requests while a service is in
+// maintenance mode, and an optional scheduled maintenance window.
+type MaintenanceConfig struct {
+	// Status is the response code. Default is 503.
+	Status int `json:"status,omitempty"`
+
+	// RetryAfter is sent as the Retry-After header, in seconds. Within a
+	// scheduled window with an End it defaults to the time left until the
+	// End.
+	RetryAfter int `json:"retry_after,omitempty"`
+
+	// Body replaces the 503 error page. It's a Go template, given the
+	// request's .Service, .Host and .Path, and the .Start and .End of the
+	// window. An HTML body is an html/template, which escapes them.
+	Body string `json:"body,omitempty"`
+
+	// ContentType of the Body. Default is "text/html; charset=utf-8".
+	ContentType string `json:"content_type,omitempty"`
+
+	// Start and End schedule a maintenance window, as RFC 3339 times. A
+	// window without an End lasts until the config is changed, and one
+	// without a Start begins immediately.
+	Start *time.Time `json:"start,omitempty"`
+	End   *time.Time `json:"end,omitempty"`
+}
+
+// CircuitBreakerConfig defines when a backend's circuit breaker opens, and for
+// how long. A request fails if it gets no response or a 5xx status.
+type CircuitBreakerConfig struct {
+	// Errors is the number of consecutive failed requests which open the
+	// breaker.
+	Errors int `json:"errors"`
+
+	// Cooldown is the time in milliseconds the breaker stays open, sending
+	// requests to the other backends, before a trial request is let through.
+	// Default is 10000.
+	Cooldown int `json:"cooldown,omitempty"`
+}
+
+// OutlierDetectionConfig defines when a backend's rate of failed HTTP
+// requests makes it an outlier, and how long it's ejected for. A request
+// fails if it gets no response or a 5xx status.
+type OutlierDetectionConfig struct {
+	// Window is the time in milliseconds each backend's failure rate is
+	// measured over. Default is 30000.
+	Window int `json:"window,omitempty"`
+
+	// MinRequests is the number of requests a backend needs within the
+	// window to be ejected, or to be compared with. Default is 10.
+	MinRequests int `json:"min_requests,omitempty"`
+
+	// StdevFactor is how many standard deviations of the other backends'
+	// failure rates a backend's rate must be above their mean to be an
+	// outlier. Default is 1.9.
+	StdevFactor float64 `json:"stdev_factor,omitempty"`
+
+	// MinFailureRate is the lowest failure rate, from 0 to 1, of an outlier,
+	// so a backend isn't ejected for a few errors when the others have none.
+	// Default is 0.1.
+	MinFailureRate float64 `json:"min_failure_rate,omitempty"`
+
+	// EjectionTime is the time in milliseconds an outlier is ejected for.
+	// Default is 30000.
+	EjectionTime int `json:"ejection_time,omitempty"`
+
+	// MaxEjectionPercent limits the backends ejected at once, though one
+	// may always be. Default is 50.
+	MaxEjectionPercent int `json:"max_ejection_percent,omitempty"`
 }
 
 // Return a copy  of ServiceConfig with any unset fields to their default
@@ -250,6 +1046,10 @@ func (s ServiceConfig) Equal(other ServiceConfig) bool {
 	s.Backends = nil
 	other.Backends = nil
 
+	// the bound address is state rather than a setting
+	s.BoundAddr = ""
+	other.BoundAddr = ""
+
 	s = s.SetDefaults()
 	other = other.SetDefaults()
 
@@ -303,6 +1103,9 @@ func (s ServiceConfig) Merge(cfg ServiceConfig) ServiceConfig {
 	// let's try not to change the name
 	new.Name = cfg.Name
 
+	if cfg.Profile != "" {
+		new.Profile = cfg.Profile
+	}
 	if cfg.Addr != "" {
 		new.Addr = cfg.Addr
 	}
@@ -330,6 +1133,54 @@ func (s ServiceConfig) Merge(cfg ServiceConfig) ServiceConfig {
 	if cfg.DialTimeout != 0 {
 		new.DialTimeout = cfg.DialTimeout
 	}
+	if cfg.DNSFailTimeout != 0 {
+		new.DNSFailTimeout = cfg.DNSFailTimeout
+	}
+	if cfg.KeepBackendStats != 0 {
+		new.KeepBackendStats = cfg.KeepBackendStats
+	}
+	if cfg.RequestTimeout != 0 {
+		new.RequestTimeout = cfg.RequestTimeout
+	}
+	if cfg.ResponseHeaderTimeout != 0 {
+		new.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout
+	}
+	if cfg.IdleTimeout != 0 {
+		new.IdleTimeout = cfg.IdleTimeout
+	}
+	if cfg.FlushInterval != 0 {
+		new.FlushInterval = cfg.FlushInterval
+	}
+	if cfg.FlapCount != 0 {
+		new.FlapCount = cfg.FlapCount
+	}
+	if cfg.FlapWindow != 0 {
+		new.FlapWindow = cfg.FlapWindow
+	}
+	if cfg.FlapHoldDown != 0 {
+		new.FlapHoldDown = cfg.FlapHoldDown
+	}
+	if cfg.PanicThreshold != 0 {
+		new.PanicThreshold = cfg.PanicThreshold
+	}
+	if cfg.MaxConnections != 0 {
+		new.MaxConnections = cfg.MaxConnections
+	}
+	if cfg.MaxRequestBody != 0 {
+		new.MaxRequestBody = cfg.MaxRequestBody
+	}
+	if cfg.ReplayBody != 0 {
+		new.ReplayBody = cfg.ReplayBody
+	}
+	if cfg.BindRetry != 0 {
+		new.BindRetry = cfg.BindRetry
+	}
+	if cfg.ClientTOS != 0 {
+		new.ClientTOS = cfg.ClientTOS
+	}
+	if cfg.ServerTOS != 0 {
+		new.ServerTOS = cfg.ServerTOS
+	}
 
 	if cfg.VirtualHosts != nil {
 		new.VirtualHosts = cfg.VirtualHosts
@@ -339,12 +1190,184 @@ func (s ServiceConfig) Merge(cfg ServiceConfig) ServiceConfig {
 		new.ErrorPages = cfg.ErrorPages
 	}
 
+	if cfg.ErrorPagesIfEmpty != nil {
+		new.ErrorPagesIfEmpty = cfg.ErrorPagesIfEmpty
+	}
+
+	if cfg.ErrorPagesRefresh != 0 {
+		new.ErrorPagesRefresh = cfg.ErrorPagesRefresh
+	}
+
+	if cfg.RetryStatus != nil {
+		new.RetryStatus = cfg.RetryStatus
+	}
+	if cfg.AllowMethods != nil {
+		new.AllowMethods = cfg.AllowMethods
+	}
+
 	if cfg.Backends != nil {
 		new.Backends = cfg.Backends
 	}
 
+	if cfg.ErrorBudget != nil {
+		new.ErrorBudget = cfg.ErrorBudget
+	}
+
+	if cfg.CircuitBreaker != nil {
+		new.CircuitBreaker = cfg.CircuitBreaker
+	}
+	if cfg.OutlierDetection != nil {
+		new.OutlierDetection = cfg.OutlierDetection
+	}
+	if cfg.JWT != nil {
+		new.JWT = cfg.JWT
+	}
+	if cfg.Capture != nil {
+		new.Capture = cfg.Capture
+	}
+	if cfg.ErrorCapture != nil {
+		new.ErrorCapture = cfg.ErrorCapture
+	}
+
+	if cfg.NoBackendResponse != "" {
+		new.NoBackendResponse = cfg.NoBackendResponse
+	}
+
+	new.AcceptProxy = cfg.AcceptProxy
+	if cfg.SendProxy != "" {
+		new.SendProxy = cfg.SendProxy
+	}
+
+	if cfg.MaintenanceToken != "" {
+		new.MaintenanceToken = cfg.MaintenanceToken
+	}
+
+	if cfg.ClientCA != "" {
+		new.ClientCA = cfg.ClientCA
+	}
+
+	if cfg.MaintenanceAllow != nil {
+		new.MaintenanceAllow = cfg.MaintenanceAllow
+	}
+
+	if cfg.Maintenance != nil {
+		new.Maintenance = cfg.Maintenance
+	}
+
+	if cfg.StripHeaders != nil {
+		new.StripHeaders = cfg.StripHeaders
+	}
+
+	if cfg.SetHeaders != nil {
+		new.SetHeaders = cfg.SetHeaders
+	}
+
+	if cfg.HeaderRules != nil {
+		new.HeaderRules = cfg.HeaderRules
+	}
+
+	if cfg.HeaderRoutes != nil {
+		new.HeaderRoutes = cfg.HeaderRoutes
+	}
+
+	if cfg.HTTPSRedirectExcept != nil {
+		new.HTTPSRedirectExcept = cfg.HTTPSRedirectExcept
+	}
+
+	if cfg.Forwarded != "" {
+		new.Forwarded = cfg.Forwarded
+	}
+
+	if cfg.LBHealth != nil {
+		new.LBHealth = cfg.LBHealth
+	}
+
+	if cfg.Rewrites != nil {
+		new.Rewrites = cfg.Rewrites
+	}
+
+	if cfg.Redirects != nil {
+		new.Redirects = cfg.Redirects
+	}
+
+	if cfg.Priority != nil {
+		new.Priority = cfg.Priority
+	}
+
+	if cfg.Compress != nil {
+		new.Compress = cfg.Compress
+	}
+	if cfg.SecurityHeaders != nil {
+		new.SecurityHeaders = cfg.SecurityHeaders
+	}
+
 	new.HTTPSRedirect = cfg.HTTPSRedirect
 	new.MaintenanceMode = cfg.MaintenanceMode
+	new.LazyBind = cfg.LazyBind
+	new.FanOut = cfg.FanOut
+	if cfg.UDPResponseWindow != 0 {
+		new.UDPResponseWindow = cfg.UDPResponseWindow
+	}
+	if cfg.UDPPacketRate != 0 {
+		new.UDPPacketRate = cfg.UDPPacketRate
+	}
+	if cfg.UDPPacketBurst != 0 {
+		new.UDPPacketBurst = cfg.UDPPacketBurst
+	}
+	if cfg.UDPByteRate != 0 {
+		new.UDPByteRate = cfg.UDPByteRate
+	}
+	if cfg.UDPByteBurst != 0 {
+		new.UDPByteBurst = cfg.UDPByteBurst
+	}
+	if cfg.RateLimit != 0 {
+		new.RateLimit = cfg.RateLimit
+	}
+	if cfg.RateBurst != 0 {
+		new.RateBurst = cfg.RateBurst
+	}
+	if cfg.TraceSample != 0 {
+		new.TraceSample = cfg.TraceSample
+	}
+	new.SNIRouting = cfg.SNIRouting
+	new.HTTP2 = cfg.HTTP2
+	new.ForceHTTP11 = cfg.ForceHTTP11
+	new.NoChunked = cfg.NoChunked
+	new.NormalizeConnection = cfg.NormalizeConnection
+
+	return new
+}
+
+// Inherit returns the service config with each unset value taken from the
+// profile. As false is unset, a service can't turn off a flag its profile
+// sets.
+func (s ServiceConfig) Inherit(profile ServiceConfig) ServiceConfig {
+	new := s
+	v, p := reflect.ValueOf(&new).Elem(), reflect.ValueOf(profile)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).IsZero() {
+			v.Field(i).Set(p.Field(i))
+		}
+	}
+
+	new.Name = s.Name
+	new.Profile = s.Profile
+	return new
+}
+
+// Reprofile returns the service config with the values it inherited from the
+// old version of its profile replaced by those of the new one. A value the
+// service set the same as the old profile's is taken as inherited.
+func (s ServiceConfig) Reprofile(old, profile ServiceConfig) ServiceConfig {
+	new := s
+	v, o, p := reflect.ValueOf(&new).Elem(), reflect.ValueOf(old), reflect.ValueOf(profile)
+	for i := 0; i < v.NumField(); i++ {
+		if reflect.DeepEqual(v.Field(i).Interface(), o.Field(i).Interface()) {
+			v.Field(i).Set(p.Field(i))
+		}
+	}
 
+	new.Name = s.Name
+	new.Profile = s.Profile
 	return new
 }
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// ConfigVersion is the version of the config schema. It must be incremented,
+// with a migration added, whenever a change to the schema would leave an
+// older config unreadable, such as renaming a field.
+const ConfigVersion = 1
+
+// migrations[i] converts a raw json config from version i to version i+1.
+var migrations = []func(cfg map[string]interface{}) error{
+	// configs written before the schema was versioned are version 1
+	func(cfg map[string]interface{}) error { return nil },
+}
+
+// MigrateConfig upgrades a json config to ConfigVersion. It returns the
+// migrated json, and the version the config was written with.
+func MigrateConfig(data []byte) ([]byte, int, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, 0, err
+	}
+
+	version := 0
+	if v, ok := raw["version"].(float64); ok {
+		version = int(v)
+	}
+
+	if version > ConfigVersion {
+		return nil, version, fmt.Errorf("config version %d is newer than %d", version, ConfigVersion)
+	}
+
+	for v := version; v < ConfigVersion; v++ {
+		if err := migrations[v](raw); err != nil {
+			return nil, version, fmt.Errorf("migrating config from version %d: %s", v, err)
+		}
+	}
+	raw["version"] = ConfigVersion
+
+	migrated, err := json.Marshal(raw)
+	return migrated, version, err
+}
+
+// CheckFields returns an error naming a field in the json config that isn't
+// part of the current schema, and would be ignored.
+func CheckFields(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	var cfg Config
+	return dec.Decode(&cfg)
+}
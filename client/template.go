@@ -0,0 +1,128 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// ServiceTemplate is a service config expanded into a service for each set
+// of parameters when the config is loaded, such as one service for each
+// tenant's port. A string anywhere in the Service, including its backends,
+// may refer to a parameter as "{{name}}".
+type ServiceTemplate struct {
+	Service ServiceConfig `json:"service"`
+
+	// Params are the sets of parameters, each expanded into a service.
+	Params []map[string]string `json:"params,omitempty"`
+
+	// Range expands each set of Params once for every number in a range,
+	// or alone if there are no Params.
+	Range *TemplateRange `json:"range,omitempty"`
+}
+
+// TemplateRange sets the parameter Name to each number from From to To,
+// inclusive.
+type TemplateRange struct {
+	Name string `json:"name"`
+	From int    `json:"from"`
+	To   int    `json:"to"`
+}
+
+var templateParam = regexp.MustCompile(`{{\s*([^{}\s]+)\s*}}`)
+
+// Return every set of parameters the template is expanded with.
+func (t ServiceTemplate) params() []map[string]string {
+	params := t.Params
+	if t.Range == nil {
+		return params
+	}
+
+	if len(params) == 0 {
+		params = []map[string]string{{}}
+	}
+
+	var expanded []map[string]string
+	for _, p := range params {
+		for n := t.Range.From; n <= t.Range.To; n++ {
+			set := map[string]string{t.Range.Name: strconv.Itoa(n)}
+			for k, v := range p {
+				set[k] = v
+			}
+			expanded = append(expanded, set)
+		}
+	}
+	return expanded
+}
+
+// Expand returns a service for each set of the template's parameters.
+func (t ServiceTemplate) Expand() ([]ServiceConfig, error) {
+	if t.Range != nil && t.Range.Name == "" {
+		return nil, fmt.Errorf("template %s: range has no name", t.Service.Name)
+	}
+
+	js, err := json.Marshal(t.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	var services []ServiceConfig
+	for _, params := range t.params() {
+		var missing string
+		expanded := templateParam.ReplaceAllStringFunc(string(js), func(ref string) string {
+			name := templateParam.FindStringSubmatch(ref)[1]
+			val, ok := params[name]
+			if !ok {
+				missing = name
+				return ref
+			}
+
+			// the value goes inside a json string
+			quoted, _ := json.Marshal(val)
+			return string(quoted[1 : len(quoted)-1])
+		})
+		if missing != "" {
+			return nil, fmt.Errorf("template %s: no parameter %s", t.Service.Name, missing)
+		}
+
+		var svc ServiceConfig
+		if err := json.Unmarshal([]byte(expanded), &svc); err != nil {
+			return nil, err
+		}
+		services = append(services, svc)
+	}
+	return services, nil
+}
+
+// ExpandTemplates adds the services expanded from the config's Templates to
+// its Services, and removes the templates. Every service must end up with a
+// unique name.
+func (c *Config) ExpandTemplates() error {
+	if len(c.Templates) == 0 {
+		return nil
+	}
+
+	names := make(map[string]bool)
+	for _, svc := range c.Services {
+		names[svc.Name] = true
+	}
+
+	for _, t := range c.Templates {
+		services, err := t.Expand()
+		if err != nil {
+			return err
+		}
+
+		for _, svc := range services {
+			if names[svc.Name] {
+				return fmt.Errorf("template %s: duplicate service %s", t.Service.Name, svc.Name)
+			}
+			names[svc.Name] = true
+		}
+		c.Services = append(c.Services, services...)
+	}
+
+	c.Templates = nil
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Client certificate authentication for vhosts on the HTTPS listener. A
+// service with a ClientCA requires every request to present a certificate
+// signed by that CA, and the verified subject is passed to the backends.
+
+const ClientCertSubjectHeader = "X-Client-Cert-Subject"
+
+// Load a PEM bundle of CA certificates.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	pemData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// Return a GetConfigForClient func for the HTTPS listener, which requests a
+// client certificate for vhosts whose service has a ClientCA.
+func clientAuthConfig(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		svc := Registry.GetVHostService(strings.ToLower(hello.ServerName))
+		if svc == nil {
+			return nil, nil
+		}
+
+		pool := svc.ClientCAs()
+		if pool == nil {
+			return nil, nil
+		}
+
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = pool
+		return cfg, nil
+	}
+}
+
+// Verify the request's client certificate against the service's CAs, and
+// pass the subject to the backend. The handshake was verified for the SNI
+// server name, which may not be the service handling the Host header, so the
+// chain is always checked again here.
+func (s *Service) verifyClientCert(r *http.Request) bool {
+	// never trust the header from the client
+	r.Header.Del(ClientCertSubjectHeader)
+
+	pool := s.ClientCAs()
+	if pool == nil {
+		return true
+	}
+
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+
+	cert := r.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, ic := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(ic)
+	}
+
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return false
+	}
+
+	r.Header.Set(ClientCertSubjectHeader, cert.Subject.String())
+	return true
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"github.com/andybalholm/brotli"
+	"github.com/skyfii/shuttle/client"
+)
+
+// On-the-fly compression of backend responses, with brotli, gzip or deflate
+// as the client accepts them.
+
+const defaultCompressMinSize = 1024
+
+var defaultCompressTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+type compressor struct {
+	types   []string
+	minSize int64
+	vhosts  []string
+}
+
+// Return the compressor for a service, or nil if no compress config is set.
+func newCompressor(cfg *client.CompressConfig) *compressor {
+	if cfg == nil {
+		return nil
+	}
+
+	c := &compressor{
+		types:   cfg.Types,
+		minSize: int64(cfg.MinSize),
+		vhosts:  cfg.VirtualHosts,
+	}
+	if len(c.types) == 0 {
+		c.types = defaultCompressTypes
+	}
+	if c.minSize <= 0 {
+		c.minSize = defaultCompressMinSize
+	}
+	return c
+}
+
+// Choose the encoding for a response, or "" to send it as is.
+func (c *compressor) encoding(req *http.Request, res *http.Response) string {
+	if req.Method == "HEAD" || res.StatusCode < 200 || res.StatusCode == http.StatusNoContent ||
+		res.StatusCode == http.StatusNotModified || res.StatusCode == http.StatusPartialContent {
+		return ""
+	}
+
+	if res.Header.Get("Content-Encoding") != "" || res.Header.Get("Content-Range") != "" {
+		return ""
+	}
+
+	if res.ContentLength >= 0 && res.ContentLength < c.minSize {
+		return ""
+	}
+
+	if len(c.vhosts) > 0 {
+		host := requestHost(req)
+		found := false
+		for _, vhost := range c.vhosts {
+			if strings.EqualFold(vhost, host) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ""
+		}
+	}
+
+	ctype := strings.ToLower(res.Header.Get("Content-Type"))
+	matched := false
+	for _, t := range c.types {
+		if strings.HasPrefix(ctype, strings.ToLower(t)) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return ""
+	}
+
+	return acceptedEncoding(req.Header.Get("Accept-Encoding"))
+}
+
+// The encodings offered, preferred in this order between those the client
+// accepts equally.
+var compressEncodings = []string{"br", "gzip", "deflate"}
+
+// Return the encoding the client accepts with the highest q-value, or "" if
+// it accepts none of them. A "*" stands for gzip.
+func acceptedEncoding(accept string) string {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+
+		if name == "*" {
+			name = "gzip"
+			if _, ok := accepted[name]; ok {
+				continue
+			}
+		}
+		accepted[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range compressEncodings {
+		if q := accepted[encoding]; q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// A response body compressed as it's read.
+type compressBody struct {
+	*io.PipeReader
+	src io.ReadCloser
+}
+
+// Closing the body stops the compression, and closes the backend's body.
+func (b *compressBody) Close() error {
+	b.PipeReader.Close()
+	return b.src.Close()
+}
+
+// countWriter counts the bytes written through it.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// The writers of each encoding, which can flush what's been compressed so far.
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressFlushWriter flushes the compressor after every write, so a streamed
+// response isn't held back until enough of it has been compressed.
+type compressFlushWriter struct {
+	compressWriter
+}
+
+func (w compressFlushWriter) Write(p []byte) (int, error) {
+	n, err := w.compressWriter.Write(p)
+	if err == nil {
+		err = w.Flush()
+	}
+	return n, err
+}
+
+// Compress the response, if it and the client allow it, counting the bytes
+// saved once the body has been sent. A streamed response, such as server-sent
+// events, is flushed through the compressor as each part of it arrives.
+func (s *Service) compressResponse(pr *ProxyRequest) bool {
+	s.Lock()
+	c := s.compress
+	s.Unlock()
+
+	if c == nil || pr.ProxyError != nil {
+		return true
+	}
+
+	res := pr.Response
+	encoding := c.encoding(pr.Request, res)
+	if encoding == "" {
+		return true
+	}
+
+	header := pr.ResponseWriter.Header()
+	header.Set("Content-Encoding", encoding)
+	header.Del("Content-Length")
+	header.Add("Vary", "Accept-Encoding")
+
+	src := res.Body
+	streamed := streamedResponse(res)
+	pipeR, pipeW := io.Pipe()
+	out := &countWriter{w: pipeW}
+
+	var zw compressWriter
+	switch encoding {
+	case "br":
+		zw = brotli.NewWriter(out)
+	case "gzip":
+		zw = gzip.NewWriter(out)
+	default:
+		zw = zlib.NewWriter(out)
+	}
+
+	var dst io.Writer = zw
+	if streamed {
+		dst = compressFlushWriter{zw}
+	}
+
+	go func() {
+		in, err := io.Copy(dst, src)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+
+		// counted before the client can see the end of the body
+		if err == nil {
+			atomic.AddInt64(&s.Compressed, 1)
+			atomic.AddInt64(&s.CompressSaved, in-out.n)
+		}
+		pipeW.CloseWithError(err)
+	}()
+
+	res.Body = &compressBody{PipeReader: pipeR, src: src}
+	res.ContentLength = -1
+	return true
+}
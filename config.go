@@ -3,7 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"io/ioutil"
+	"os"
 	"sync"
 	"github.com/skyfii/shuttle/client"
 	"github.com/skyfii/shuttle/log"
@@ -15,14 +15,19 @@ func loadConfig() {
 			continue
 		}
 
-		cfgData, err := ioutil.ReadFile(cfgPath)
+		store, err := newConfigStore(cfgPath)
 		if err != nil {
 			log.Warnln("WARN: Reading config ", err)
 			continue
 		}
 
-		var cfg client.Config
-		err = json.Unmarshal(cfgData, &cfg)
+		cfgData, err := store.Read()
+		if err != nil {
+			log.Warnln("WARN: Reading config ", err)
+			continue
+		}
+
+		cfg, err := parseConfig(cfgPath, cfgData)
 		if err != nil {
 			log.Warnln("WARN: Config error:", err)
 			continue
@@ -35,7 +40,71 @@ func loadConfig() {
 	}
 }
 
-// protects the state config file
+// Migrate a json config to the current version, and warn about any fields
+// that would be ignored.
+func parseConfig(name string, data []byte) (client.Config, error) {
+	var cfg client.Config
+
+	data, version, err := client.MigrateConfig(data)
+	if err != nil {
+		return cfg, err
+	}
+	if version < client.ConfigVersion {
+		log.Printf("INFO: Migrated %s from config version %d to %d", name, version, client.ConfigVersion)
+	}
+
+	if err := client.CheckFields(data); err != nil {
+		log.Warnf("WARN: %s: %s", name, err)
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, err
+	}
+
+	err = cfg.ExpandTemplates()
+	return cfg, err
+}
+
+// Migrate the config at src to the current version, and write it to dst, or
+// to stdout if dst is empty.
+func migrateConfig(src, dst string) error {
+	store, err := newConfigStore(src)
+	if err != nil {
+		return err
+	}
+
+	data, err := store.Read()
+	if err != nil {
+		return err
+	}
+
+	migrated, version, err := client.MigrateConfig(data)
+	if err != nil {
+		return err
+	}
+	log.Printf("INFO: Migrated %s from config version %d to %d", src, version, client.ConfigVersion)
+
+	if err := client.CheckFields(migrated); err != nil {
+		log.Warnf("WARN: %s: %s", src, err)
+	}
+
+	var out bytes.Buffer
+	json.Indent(&out, migrated, "", "  ")
+	out.WriteByte('\n')
+
+	if dst == "" {
+		_, err = os.Stdout.Write(out.Bytes())
+		return err
+	}
+
+	store, err = newConfigStore(dst)
+	if err != nil {
+		return err
+	}
+	return store.Write(out.Bytes())
+}
+
+// protects the state config
 var configMutex sync.Mutex
 
 func writeStateConfig() {
@@ -47,19 +116,29 @@ func writeStateConfig() {
 		return
 	}
 
+	// the workers share the state, which the first one writes
+	if workerID > 1 {
+		return
+	}
+
 	cfg := marshal(Registry.Config())
 	if len(cfg) == 0 {
 		return
 	}
 
-	lastCfg, _ := ioutil.ReadFile(stateConfig)
+	store, err := newConfigStore(stateConfig)
+	if err != nil {
+		log.Errorln("ERROR: Can't save config state:", err)
+		return
+	}
+
+	lastCfg, _ := store.Read()
 	if bytes.Equal(cfg, lastCfg) {
 		log.Println("INFO: No change in config")
 		return
 	}
 
-	// We should probably write a temp file and mv for atomic update.
-	err := ioutil.WriteFile(stateConfig, cfg, 0644)
+	err = store.Write(cfg)
 	if err != nil {
 		log.Errorln("ERROR: Can't save config state:", err)
 	}
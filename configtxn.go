@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+	"github.com/skyfii/shuttle/client"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Configs pushed to the admin API are applied one at a time, in the order
+// they arrived, by a single apply queue, so concurrent pushes can't
+// interleave their service updates. Each push is a transaction with an ID,
+// returned in the X-Config-Txn header, and its status can be read from
+// /_config/txn/{id} while it's queued and after it's applied.
+
+const (
+	ConfigTxnHeader = "X-Config-Txn"
+
+	// finished transactions kept to be queried
+	configTxnHistory = 64
+
+	// pushes which may wait to be applied; another push is rejected
+	configTxnQueue = 256
+)
+
+var (
+	ErrNoConfigTxn     = errors.New("config transaction does not exist")
+	ErrConfigQueueFull = errors.New("too many config pushes are waiting to be applied")
+)
+
+// states of a config transaction
+const (
+	txnQueued   = "queued"
+	txnApplying = "applying"
+	txnApplied  = "applied"
+	txnFailed   = "failed"
+)
+
+// The json status of a config transaction, returned by /_config/txn/{id}.
+type ConfigTxnStatus struct {
+	ID       uint64       `json:"id"`
+	State    string       `json:"state"`
+	Queued   time.Time    `json:"queued"`
+	Finished *time.Time   `json:"finished,omitempty"`
+	Error    string       `json:"error,omitempty"`
+	Report   *ApplyReport `json:"report,omitempty"`
+}
+
+type configTxn struct {
+	status ConfigTxnStatus
+
+	cfg             client.Config
+	atomic, migrate bool
+
+	// closed once the config is applied
+	done chan struct{}
+}
+
+type configQueue struct {
+	sync.Mutex
+	nextID uint64
+	txns   map[uint64]*configTxn
+	// the IDs in the order they were queued
+	order []uint64
+
+	pending chan *configTxn
+	start   sync.Once
+}
+
+var configTxns = &configQueue{
+	txns:    make(map[uint64]*configTxn),
+	pending: make(chan *configTxn, configTxnQueue),
+}
+
+// Queue a config to be applied with Registry.ApplyConfig, returning its
+// transaction and its status when it was queued, or ErrConfigQueueFull if
+// the queue has no room for it.
+func (q *configQueue) Submit(cfg client.Config, atomic, migrate bool) (*configTxn, ConfigTxnStatus, error) {
+	q.start.Do(func() { go q.run() })
+
+	q.Lock()
+	defer q.Unlock()
+
+	txn := &configTxn{
+		status: ConfigTxnStatus{
+			ID:     q.nextID + 1,
+			State:  txnQueued,
+			Queued: time.Now(),
+		},
+		cfg:     cfg,
+		atomic:  atomic,
+		migrate: migrate,
+		done:    make(chan struct{}),
+	}
+
+	// sent under the lock to keep the queue in the order of the IDs, so it
+	// mustn't block, or run couldn't take the lock to finish the txn ahead
+	select {
+	case q.pending <- txn:
+	default:
+		return nil, ConfigTxnStatus{}, ErrConfigQueueFull
+	}
+
+	q.nextID++
+	q.txns[txn.status.ID] = txn
+	q.order = append(q.order, txn.status.ID)
+
+	// forget the oldest finished transactions
+	for len(q.order) > configTxnHistory {
+		oldest := q.txns[q.order[0]]
+		if oldest.status.Finished == nil {
+			break
+		}
+		delete(q.txns, q.order[0])
+		q.order = q.order[1:]
+	}
+	return txn, txn.status, nil
+}
+
+// Wait for the transaction to be applied, and return its final status.
+func (t *configTxn) Wait() ConfigTxnStatus {
+	<-t.done
+	// the status no longer changes
+	return t.status
+}
+
+// Return the status of a transaction.
+func (q *configQueue) Status(id uint64) (ConfigTxnStatus, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	txn, ok := q.txns[id]
+	if !ok {
+		return ConfigTxnStatus{}, ErrNoConfigTxn
+	}
+	return txn.status, nil
+}
+
+// Apply the queued configs in turn.
+func (q *configQueue) run() {
+	for txn := range q.pending {
+		q.Lock()
+		txn.status.State = txnApplying
+		q.Unlock()
+
+		report, err := Registry.ApplyConfig(txn.cfg, txn.atomic, txn.migrate)
+
+		q.Lock()
+		finished := time.Now()
+		txn.status.Finished = &finished
+		txn.status.Report = &report
+		txn.status.State = txnApplied
+		if err != nil {
+			txn.status.State = txnFailed
+			txn.status.Error = err.Error()
+		}
+		q.Unlock()
+
+		log.Debugf("DEBUG: Config transaction %d %s", txn.status.ID, txn.status.State)
+		close(txn.done)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The lifetimes of a service's proxied TCP connections, bucketed to show
+// whether they're short or long lived, along with the ages of those still
+// open, to spot connections which never close.
+
+// upper bounds of the buckets; the last bucket has none
+var connAgeBounds = [...]time.Duration{
+	time.Second,
+	10 * time.Second,
+	time.Minute,
+	10 * time.Minute,
+	time.Hour,
+}
+
+// A bucket of the connection age histogram, counting the connections which
+// closed, and which are still open, at an age under the bound.
+type AgeBucket struct {
+	Under  string `json:"under,omitempty"`
+	Closed int64  `json:"closed"`
+	Active int64  `json:"active"`
+}
+
+type connAges struct {
+	sync.Mutex
+	closed [len(connAgeBounds) + 1]int64
+
+	// start times of the open connections
+	open   map[uint64]time.Time
+	nextID uint64
+}
+
+func ageBucket(age time.Duration) int {
+	for i, bound := range connAgeBounds {
+		if age < bound {
+			return i
+		}
+	}
+	return len(connAgeBounds)
+}
+
+// Start tracking a connection, returning its ID for done.
+func (a *connAges) start() uint64 {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.open == nil {
+		a.open = make(map[uint64]time.Time)
+	}
+
+	a.nextID++
+	a.open[a.nextID] = time.Now()
+	return a.nextID
+}
+
+// Record the lifetime of a closed connection.
+func (a *connAges) done(id uint64) {
+	a.Lock()
+	defer a.Unlock()
+
+	started, ok := a.open[id]
+	if !ok {
+		return
+	}
+	delete(a.open, id)
+	a.closed[ageBucket(time.Since(started))]++
+}
+
+// Return the histogram, and the age of the oldest open connection.
+func (a *connAges) Stats() ([]AgeBucket, time.Duration) {
+	a.Lock()
+	defer a.Unlock()
+
+	buckets := make([]AgeBucket, len(connAgeBounds)+1)
+	for i := range buckets {
+		if i < len(connAgeBounds) {
+			buckets[i].Under = connAgeBounds[i].String()
+		}
+		buckets[i].Closed = a.closed[i]
+	}
+
+	var oldest time.Duration
+	now := time.Now()
+	for _, started := range a.open {
+		age := now.Sub(started)
+		buckets[ageBucket(age)].Active++
+		if age > oldest {
+			oldest = age
+		}
+	}
+	return buckets, oldest
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Resolve backend addresses through the Docker remote API, so that a backend
+// can reference a container by name and its exposed port, rather than the
+// host port docker happened to map it to.
+
+var dockerClient *http.Client
+
+// The base URL for API requests. A unix socket is always reached through
+// this placeholder host.
+var dockerURL = "http://docker"
+
+// Set up the client for the docker daemon at host, which is either a
+// unix:///path/to/socket or a tcp://host:port address.
+func setDockerHost(host string) error {
+	u, err := url.Parse(host)
+	if err != nil {
+		return err
+	}
+
+	dial := (&net.Dialer{Timeout: 2 * time.Second}).Dial
+	transport := &http.Transport{}
+
+	switch u.Scheme {
+	case "unix":
+		transport.Dial = func(_, _ string) (net.Conn, error) {
+			return dial("unix", u.Path)
+		}
+		dockerURL = "http://docker"
+	case "tcp", "http":
+		transport.Dial = dial
+		dockerURL = "http://" + u.Host
+	default:
+		return fmt.Errorf("invalid docker host '%s'", host)
+	}
+
+	dockerClient = &http.Client{
+		Transport: transport,
+		Timeout:   5 * time.Second,
+	}
+	return nil
+}
+
+// Look up the host address mapped to a container's port.
+// The container is given as "name:port", and the network is used to select
+// the tcp, udp or sctp mapping.
+func resolveContainer(container, network string) (string, error) {
+	if dockerClient == nil {
+		return "", fmt.Errorf("docker host not configured")
+	}
+
+	name, port, err := net.SplitHostPort(container)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := dockerClient.Get(dockerURL + "/containers/" + url.QueryEscape(name) + "/json")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("docker returned %s for container %s", resp.Status, name)
+	}
+
+	var info struct {
+		NetworkSettings struct {
+			Ports map[string][]struct {
+				HostIp   string
+				HostPort string
+			}
+		}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", err
+	}
+
+	proto := "tcp"
+	switch {
+	case strings.HasPrefix(network, "udp"):
+		proto = "udp"
+	case sctpNetwork(network):
+		proto = "sctp"
+	}
+
+	bindings := info.NetworkSettings.Ports[port+"/"+proto]
+	if len(bindings) == 0 {
+		return "", fmt.Errorf("container %s has no host mapping for %s/%s", name, port, proto)
+	}
+
+	ip := bindings[0].HostIp
+	if ip == "" || ip == "0.0.0.0" || ip == "::" {
+		ip = "127.0.0.1"
+	}
+
+	addr := net.JoinHostPort(ip, bindings[0].HostPort)
+	log.Debugf("DEBUG: Resolved container %s to %s", container, addr)
+	return addr, nil
+}
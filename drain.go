@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+	"github.com/skyfii/shuttle/log"
+)
+
+// A whole service is drained with a POST to /{service}/_drain. It stops
+// taking new work while its open connections and requests finish: the TCP
+// listener is closed, and HTTP requests are answered with a 503. A POST to
+// /{service}/_enable listens again on the address the service was bound to.
+// The drain isn't part of the config, so a service replaced or restarted
+// starts enabled.
+
+// The state of a draining service.
+type serviceDrain struct {
+	since time.Time
+	// connections and requests open when the drain started
+	initial int64
+	// the address the closed TCP listener was bound to
+	addr string
+
+	Rejected int64
+}
+
+// The progress of a service's drain, reported in its stats.
+type ServiceDrainStat struct {
+	Since    time.Time `json:"since"`
+	Initial  int64     `json:"initial"`
+	Open     int64     `json:"open"`
+	Rejected int64     `json:"rejected"`
+	Done     bool      `json:"done"`
+}
+
+func (d *serviceDrain) stat(open int64) *ServiceDrainStat {
+	if d == nil {
+		return nil
+	}
+	return &ServiceDrainStat{
+		Since:    d.since,
+		Initial:  d.initial,
+		Open:     open,
+		Rejected: atomic.LoadInt64(&d.Rejected),
+		Done:     open == 0,
+	}
+}
+
+// Stop accepting connections and requests for the service.
+func (s *Service) startDrain() {
+	open := openConns(s.Stats())
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.drain != nil {
+		return
+	}
+
+	log.Printf("INFO: Draining %s, with %d open connections and requests", s.Name, open)
+	s.drain = &serviceDrain{
+		since:   time.Now(),
+		initial: open,
+	}
+	if s.tcpListener != nil {
+		s.drain.addr = s.tcpListener.Addr().String()
+		s.tcpListener.Close()
+	}
+}
+
+// Accept connections and requests for a draining service again. The service
+// is still draining if it can't listen.
+func (s *Service) enable() error {
+	s.Lock()
+	defer s.Unlock()
+
+	d := s.drain
+	if d == nil {
+		return nil
+	}
+
+	if d.addr != "" {
+		tcp, _ := splitNetwork(s.Network)
+		l, err := newTimeoutListener(s.network, tcp, d.addr, s.ClientTimeout)
+		if err != nil {
+			log.Errorf("ERROR: Failed to listen again for %s on %s: %s", s.Name, d.addr, err)
+			return err
+		}
+		l.(*timeoutListener).tos = s.ClientTOS
+		s.tcpListener = l
+		go s.runTCP()
+	}
+
+	log.Printf("INFO: Enabled %s after draining for %s", s.Name, time.Since(d.since))
+	s.drain = nil
+	return nil
+}
+
+func (s *Service) Draining() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.drain != nil
+}
+
+// Count a connection or request rejected while draining, and return true if
+// the service is draining.
+func (s *Service) rejectDraining() bool {
+	s.Lock()
+	d := s.drain
+	s.Unlock()
+
+	if d == nil {
+		return false
+	}
+	atomic.AddInt64(&d.Rejected, 1)
+	return true
+}
+
+// Respond to a request while the service is draining, closing the client's
+// connection so it reconnects elsewhere.
+func drainingResponse(w http.ResponseWriter, r *http.Request) {
+	logRequest(r, http.StatusServiceUnavailable, backendAttempt{}, nil, 0)
+	w.Header().Set("Connection", "close")
+	http.Error(w, "service is draining", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+	"github.com/skyfii/shuttle/client"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Deploys drain a batch of backends with one POST to /_drain. The backends
+// are set admin down together, then watched until their open connections and
+// requests have finished or the shared deadline passes, when the final status
+// is posted to the request's callback. The backends stay down until they're
+// set up or auto again.
+
+const (
+	defaultDrainTimeout = 30 * time.Second
+
+	// finished drains kept to be queried
+	drainHistory = 16
+)
+
+var ErrNoDrain = errors.New("drain does not exist")
+
+// The state of one backend in a drain.
+type DrainBackendStat struct {
+	Service string `json:"service"`
+	Backend string `json:"backend"`
+	// Active is the backend's open connections and requests.
+	Active  int64 `json:"active"`
+	Drained bool  `json:"drained"`
+}
+
+// The json status of a drain, returned by /_drain/{id} and posted to the
+// callback once it's done.
+type DrainStatus struct {
+	ID       uint64             `json:"id"`
+	Deadline time.Time          `json:"deadline"`
+	Done     bool               `json:"done"`
+	TimedOut bool               `json:"timed_out"`
+	Backends []DrainBackendStat `json:"backends"`
+}
+
+type backendDrains struct {
+	sync.Mutex
+	nextID uint64
+	drains map[uint64]*DrainStatus
+	// the IDs in the order they were started
+	order []uint64
+
+	client *http.Client
+}
+
+var drains = &backendDrains{
+	drains: make(map[uint64]*DrainStatus),
+	client: &http.Client{Timeout: 5 * time.Second},
+}
+
+// Set the backends of the request down, and watch them drain in the
+// background.
+func (d *backendDrains) Start(req client.DrainRequest) (DrainStatus, error) {
+	if err := Registry.DrainBackends(req.Backends); err != nil {
+		return DrainStatus{}, err
+	}
+
+	timeout := time.Duration(req.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
+	}
+
+	d.Lock()
+	d.nextID++
+	status := &DrainStatus{
+		ID:       d.nextID,
+		Deadline: time.Now().Add(timeout),
+		Backends: make([]DrainBackendStat, len(req.Backends)),
+	}
+	for i, t := range req.Backends {
+		status.Backends[i] = DrainBackendStat{Service: t.Service, Backend: t.Backend}
+	}
+
+	d.drains[status.ID] = status
+	d.order = append(d.order, status.ID)
+	if len(d.order) > drainHistory {
+		delete(d.drains, d.order[0])
+		d.order = d.order[1:]
+	}
+	d.Unlock()
+
+	log.Printf("INFO: Draining %d backends until %s", len(req.Backends), status.Deadline.Format(time.RFC3339))
+
+	d.update(status)
+	go d.watch(status, req.Callback)
+	return d.Status(status.ID)
+}
+
+// Count the open connections of each backend, and mark the drain done once
+// they've all finished or the deadline has passed.
+func (d *backendDrains) update(status *DrainStatus) bool {
+	d.Lock()
+	targets := append([]DrainBackendStat(nil), status.Backends...)
+	d.Unlock()
+
+	done := true
+	for i, t := range targets {
+		stat, err := Registry.BackendStats(t.Service, t.Backend)
+		if err != nil {
+			// removed, so there's nothing left to drain
+			targets[i].Active = 0
+		} else {
+			targets[i].Active = stat.Active + stat.HTTPActive
+		}
+		targets[i].Drained = targets[i].Active == 0
+		done = done && targets[i].Drained
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	status.Backends = targets
+	if !done && time.Now().After(status.Deadline) {
+		status.TimedOut = true
+		done = true
+	}
+	status.Done = done
+	return done
+}
+
+func (d *backendDrains) watch(status *DrainStatus, callback string) {
+	for !d.update(status) {
+		time.Sleep(drainPoll)
+	}
+
+	final, _ := d.Status(status.ID)
+	if final.TimedOut {
+		log.Warnf("WARN: Drain %d timed out", final.ID)
+	} else {
+		log.Printf("INFO: Drain %d done", final.ID)
+	}
+
+	// Each worker drains its own connections, but only the first calls back,
+	// so with workers the callback reports the first worker's drain alone.
+	if callback != "" && workerID <= 1 {
+		d.post(callback, final)
+	}
+}
+
+func (d *backendDrains) post(url string, status DrainStatus) {
+	js, _ := json.Marshal(status)
+	resp, err := d.client.Post(url, "application/json", bytes.NewReader(js))
+	if err != nil {
+		log.Warnf("WARN: Drain callback to %s failed: %s", url, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Warnf("WARN: Drain callback to %s returned %d", url, resp.StatusCode)
+	}
+}
+
+// Return a copy of a drain's status.
+func (d *backendDrains) Status(id uint64) (DrainStatus, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	status, ok := d.drains[id]
+	if !ok {
+		return DrainStatus{}, ErrNoDrain
+	}
+
+	cp := *status
+	cp.Backends = append([]DrainBackendStat(nil), status.Backends...)
+	return cp, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+	"github.com/skyfii/shuttle/client"
+	"github.com/skyfii/shuttle/log"
+)
+
+// HTTP requests which end in a proxy error, or in a backend response with one
+// of the configured statuses, are kept along with their response for
+// debugging intermittent backend failures. Each is written to its own file in
+// the HTTP wire format, after a few comment lines naming the service, backend
+// and error, with the bodies cut at max_body. Only the newest max_files are
+// kept for each service.
+
+const (
+	// Default limits of bytes captured from each body, and files kept
+	defaultErrorCaptureBody  = 64 << 10
+	defaultErrorCaptureFiles = 100
+)
+
+type errorCapture struct {
+	sync.Mutex
+	cfg     client.ErrorCaptureConfig
+	service string
+	status  map[int]bool
+}
+
+func newErrorCapture(service string, cfg *client.ErrorCaptureConfig) *errorCapture {
+	if cfg == nil || cfg.Dir == "" {
+		return nil
+	}
+
+	e := &errorCapture{
+		cfg:     *cfg,
+		service: service,
+		status:  make(map[int]bool),
+	}
+	for _, code := range cfg.Status {
+		e.status[code] = true
+	}
+
+	if e.cfg.MaxBody <= 0 {
+		e.cfg.MaxBody = defaultErrorCaptureBody
+	}
+	if e.cfg.MaxFiles <= 0 {
+		e.cfg.MaxFiles = defaultErrorCaptureFiles
+	}
+	return e
+}
+
+// Report if the outcome of the request is captured.
+func (e *errorCapture) match(pr *ProxyRequest) bool {
+	switch pr.ProxyError {
+	case nil:
+		return e.status[pr.Response.StatusCode]
+	case ErrClientAborted, ErrBodyTooLarge:
+		// not a failure of the backend
+		return false
+	}
+	return true
+}
+
+// Write a capture of the request and its response.
+func (e *errorCapture) write(pr *ProxyRequest, reqBody, respBody []byte) {
+	req := pr.Request
+	resp := pr.Response
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# service %s at %s, request id %s\n", e.service,
+		pr.FinishTime.Format(time.RFC3339Nano), req.Header.Get(RequestIDHeader))
+	if pr.Backend.Addr != "" {
+		fmt.Fprintf(&buf, "# backend %s (%s), attempt %d\n", pr.Backend.Name, pr.Backend.Addr, pr.Backend.Attempt)
+	}
+	if pr.ProxyError != nil {
+		fmt.Fprintf(&buf, "# error %s\n", pr.ProxyError)
+	}
+
+	fmt.Fprintf(&buf, "\n%s %s %s\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Proto, req.Host)
+	req.Header.Write(&buf)
+	buf.WriteString("\r\n")
+	buf.Write(reqBody)
+
+	fmt.Fprintf(&buf, "\n\nHTTP/1.1 %03d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.Write(&buf)
+	buf.WriteString("\r\n")
+	buf.Write(respBody)
+
+	e.Lock()
+	defer e.Unlock()
+
+	name := fmt.Sprintf("%s-%d.http", e.service, time.Now().UnixNano())
+	path := filepath.Join(e.cfg.Dir, name)
+
+	// the headers may well hold credentials
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		log.Warnf("WARN: Unable to write error capture for %s: %s", e.service, err)
+		return
+	}
+	log.Debugf("DEBUG: Captured failed request %s for %s", req.Header.Get(RequestIDHeader), e.service)
+
+	pruneCaptures(filepath.Join(e.cfg.Dir, e.service+"-*.http"), e.cfg.MaxFiles)
+}
+
+// A request body which keeps the first bytes read from it.
+type capturedBody struct {
+	io.ReadCloser
+
+	sync.Mutex
+	buf bytes.Buffer
+	max int64
+}
+
+func (b *capturedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	b.Lock()
+	if room := b.max - int64(b.buf.Len()); n > 0 && room > 0 {
+		if int64(n) > room {
+			b.buf.Write(p[:room])
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	b.Unlock()
+	return n, err
+}
+
+func (b *capturedBody) Bytes() []byte {
+	b.Lock()
+	defer b.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// Keep the start of the request body, in case the request is captured.
+func (s *Service) tapRequestBody(pr *ProxyRequest) bool {
+	s.Lock()
+	capture := s.errCapture
+	s.Unlock()
+
+	if capture == nil || pr.Request.Body == nil || pr.Request.Body == http.NoBody {
+		return true
+	}
+	pr.Request.Body = &capturedBody{ReadCloser: pr.Request.Body, max: capture.cfg.MaxBody}
+	return true
+}
+
+// Capture a request which failed, with its response.
+func (s *Service) captureError(pr *ProxyRequest) bool {
+	s.Lock()
+	capture := s.errCapture
+	s.Unlock()
+
+	if capture == nil || !capture.match(pr) {
+		return true
+	}
+
+	var reqBody []byte
+	if body, ok := pr.Request.Body.(*capturedBody); ok {
+		reqBody = body.Bytes()
+	}
+
+	// read the start of the response body, which is still sent on in full
+	var respBody []byte
+	if pr.ProxyError == nil {
+		respBody, _ = ioutil.ReadAll(io.LimitReader(pr.Response.Body, capture.cfg.MaxBody))
+		pr.Response.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(respBody), pr.Response.Body), pr.Response.Body}
+	}
+
+	capture.write(pr, reqBody, respBody)
+	return true
+}
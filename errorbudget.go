@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"github.com/skyfii/shuttle/client"
+	"github.com/skyfii/shuttle/log"
+)
+
+// the window is divided into this many buckets, which expire in turn
+const budgetBuckets = 10
+
+// States reported to the health webhook for a service's error budget
+const (
+	budgetOK       = "ok"
+	budgetDegraded = "degraded"
+)
+
+// errorBudget tracks a service's error rate over a sliding window, and marks
+// the service degraded while the rate is over the threshold. A nil
+// *errorBudget is never degraded.
+type errorBudget struct {
+	sync.Mutex
+	cfg     client.ErrorBudgetConfig
+	service string
+
+	// length of each bucket
+	slot    time.Duration
+	buckets [budgetBuckets]budgetBucket
+
+	degraded bool
+	rate     float64
+}
+
+type budgetBucket struct {
+	start  time.Time
+	total  int64
+	errors int64
+}
+
+// Return the error budget for a service, or nil if none is configured.
+func newErrorBudget(service string, cfg *client.ErrorBudgetConfig) *errorBudget {
+	if cfg == nil || cfg.Threshold <= 0 || cfg.Window <= 0 {
+		return nil
+	}
+
+	b := &errorBudget{
+		cfg:     *cfg,
+		service: service,
+		slot:    time.Duration(cfg.Window) * time.Millisecond / budgetBuckets,
+	}
+
+	if b.cfg.MinRequests <= 0 {
+		b.cfg.MinRequests = 1
+	}
+	if b.slot <= 0 {
+		b.slot = time.Millisecond
+	}
+	return b
+}
+
+// Record the outcome of a connection or request.
+func (b *errorBudget) Record(failed bool) {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	start := now.Truncate(b.slot)
+	bucket := &b.buckets[(start.UnixNano()/int64(b.slot))%budgetBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = budgetBucket{start: start}
+	}
+
+	bucket.total++
+	if failed {
+		bucket.errors++
+	}
+
+	b.update(now)
+}
+
+// Degraded reports whether the error rate is over the threshold. The rate
+// is checked again, so a service with no traffic recovers once its errors
+// leave the window.
+func (b *errorBudget) Degraded() bool {
+	if b == nil {
+		return false
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.update(time.Now())
+	return b.degraded
+}
+
+// Mitigating reports whether the mitigation is being applied.
+func (b *errorBudget) Mitigating(mitigation string) bool {
+	return b != nil && b.cfg.Mitigation == mitigation && b.Degraded()
+}
+
+// The error rate over the window, for the stats.
+func (b *errorBudget) Rate() float64 {
+	if b == nil {
+		return 0
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.update(time.Now())
+	return b.rate
+}
+
+// Recalculate the error rate, and report any change in state.
+// errorBudget *must* be locked.
+func (b *errorBudget) update(now time.Time) {
+	var total, errors int64
+	oldest := now.Truncate(b.slot).Add(-b.slot * (budgetBuckets - 1))
+	for _, bucket := range b.buckets {
+		if !bucket.start.Before(oldest) {
+			total += bucket.total
+			errors += bucket.errors
+		}
+	}
+
+	b.rate = 0
+	if total > 0 {
+		b.rate = float64(errors) / float64(total)
+	}
+
+	degraded := total >= int64(b.cfg.MinRequests) && b.rate > b.cfg.Threshold
+	if degraded == b.degraded {
+		return
+	}
+	b.degraded = degraded
+
+	oldState, newState := budgetOK, budgetDegraded
+	if !degraded {
+		oldState, newState = newState, oldState
+		log.Printf("INFO: Error rate for %s is back under %g", b.service, b.cfg.Threshold)
+	} else {
+		log.Warnf("WARN: Error rate for %s is %.3f, over %g, marking it degraded", b.service, b.rate, b.cfg.Threshold)
+	}
+
+	if b.cfg.Webhook {
+		healthWebhook.Send(HealthEvent{
+			Service:  b.service,
+			OldState: oldState,
+			NewState: newState,
+			Reason:   fmt.Sprintf("error rate %.3f over %s", b.rate, time.Duration(b.cfg.Window)*time.Millisecond),
+			Time:     now,
+		})
+	}
+}
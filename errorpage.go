@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+	"github.com/skyfii/shuttle/log"
+)
+
+// An error page may be a Go template, given the status and the request it
+// answers, and may be read from a local file rather than fetched from a URL.
+// Pages are fetched again once they're older than the service's
+// error_pages_refresh, keeping the cached page if that fails.
+
+// The values available to an error page template.
+type errorPageData struct {
+	Status     int
+	StatusText string
+	RequestID  string
+	Service    string
+	Host       string
+	Time       time.Time
+}
+
+// Return the path of a page read from a file, given as "file:PATH" or an
+// absolute path.
+func errorPageFile(location string) (string, bool) {
+	switch {
+	case strings.HasPrefix(location, secretFilePrefix):
+		return location[len(secretFilePrefix):], true
+	case strings.HasPrefix(location, "/"):
+		return location, true
+	}
+	return "", false
+}
+
+// Read a page from a file. The Content-Type comes from its extension.
+func readErrorPage(page *ErrorPage, path string) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Warnf("WARN: Could not read error page %s: %s", path, err)
+		return
+	}
+	if len(body) == 0 {
+		log.Warnf("WARN: Empty error page %s", path)
+		return
+	}
+
+	header := make(http.Header)
+	if ctype := mime.TypeByExtension(filepath.Ext(path)); ctype != "" {
+		header.Set("Content-Type", ctype)
+	}
+	page.SetHeader(header)
+	page.SetBody(body)
+}
+
+// Parse a page as a template, if it looks like one. A page which doesn't
+// parse is served as it is.
+func parseErrorPage(location string, body []byte) *template.Template {
+	if !bytes.Contains(body, []byte("{{")) {
+		return nil
+	}
+
+	tmpl, err := template.New(location).Parse(string(body))
+	if err != nil {
+		log.Warnf("WARN: Error page %s is not a valid template, serving it as is: %s", location, err)
+		return nil
+	}
+	return tmpl
+}
+
+// Report if the page is due to be fetched again, and mark it as being
+// fetched so only one refresh runs at a time.
+func (e *ErrorPage) startRefresh(refresh time.Duration) bool {
+	e.Lock()
+	defer e.Unlock()
+
+	if refresh <= 0 || e.fetching || time.Since(e.fetched) < refresh {
+		return false
+	}
+	e.fetching = true
+	return true
+}
+
+// Record a fetch, whether or not it succeeded, so a failing page is only
+// tried again after another refresh interval.
+func (e *ErrorPage) endRefresh() {
+	e.Lock()
+	defer e.Unlock()
+	e.fetching = false
+	e.fetched = time.Now()
+}
+
+// Set how often the pages are fetched again. 0 never refreshes them.
+func (e *ErrorResponse) SetRefresh(d time.Duration) {
+	e.Lock()
+	defer e.Unlock()
+	e.refresh = d
+}
+
+// Return the page's body for a response to the request with this status,
+// rendering it if it's a template.
+func (e *ErrorResponse) Render(page *ErrorPage, req *http.Request, status int) []byte {
+	page.Lock()
+	body, tmpl := page.body, page.tmpl
+	page.Unlock()
+
+	if tmpl == nil {
+		return body
+	}
+
+	data := errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		RequestID:  req.Header.Get(RequestIDHeader),
+		Service:    e.service,
+		Host:       req.Host,
+		Time:       time.Now(),
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		log.Warnf("WARN: Unable to render error page %s: %s", page.Location, err)
+		return body
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Forwarding headers, so the backends see the real client rather than the
+// proxy. Values from upstream are kept only from a trusted peer, and
+// otherwise replaced with what shuttle saw of the connection.
+
+var forwardedHeaders = []string{
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"X-Real-Ip",
+	"Forwarded",
+}
+
+// Set the forwarding headers on the outgoing request header h for the
+// client request req, appending to the upstream values when trusted.
+func setForwardedHeaders(h http.Header, req *http.Request, trust bool) {
+	if !trust {
+		for _, key := range forwardedHeaders {
+			h.Del(key)
+		}
+	}
+
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	if h.Get("X-Real-Ip") == "" {
+		realIP := clientIP
+		if prior := h.Get("X-Forwarded-For"); prior != "" {
+			realIP = strings.TrimSpace(strings.Split(prior, ",")[0])
+		}
+		h.Set("X-Real-Ip", realIP)
+	}
+
+	// If we aren't the first proxy retain prior
+	// X-Forwarded-For information as a comma+space
+	// separated list and fold multiple headers into one.
+	xff := clientIP
+	if prior, ok := h["X-Forwarded-For"]; ok {
+		xff = strings.Join(prior, ", ") + ", " + clientIP
+	}
+	h.Set("X-Forwarded-For", xff)
+
+	if h.Get("X-Forwarded-Proto") == "" {
+		h.Set("X-Forwarded-Proto", proto)
+	}
+	if h.Get("X-Forwarded-Host") == "" {
+		h.Set("X-Forwarded-Host", req.Host)
+	}
+
+	// RFC 7239 elements are appended, one per proxy
+	elem := "for=" + forwardedNode(clientIP) + ";host=" + forwardedValue(req.Host) + ";proto=" + proto
+	if prior, ok := h["Forwarded"]; ok {
+		elem = strings.Join(prior, ", ") + ", " + elem
+	}
+	h.Set("Forwarded", elem)
+}
+
+// IPv6 nodes are bracketed and quoted.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// Quote a value which isn't a valid token, such as a host with a port.
+func forwardedValue(v string) string {
+	for _, r := range v {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r)) {
+			return `"` + strings.Replace(v, `"`, `\"`, -1) + `"`
+		}
+	}
+	return v
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// gRPC requests are proxied like any other HTTP/2 request, but a gRPC call
+// fails with the grpc-status in its trailers, or in the headers of a
+// trailers-only response, while the HTTP status is 200. So those statuses
+// are counted as HTTP errors when they're the server's fault, and the proxy's
+// own errors are returned to gRPC clients as a grpc-status they understand.
+
+// gRPC status codes returned by the proxy
+const (
+	grpcDeadlineExceeded = 4
+	grpcUnavailable      = 14
+)
+
+// Report if the request is a gRPC call.
+func isGRPC(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// Return the grpc-status of a response, from its trailers once the body has
+// been read, or its headers if it's trailers-only.
+func grpcStatus(res *http.Response) (int, bool) {
+	val := res.Trailer.Get("Grpc-Status")
+	if val == "" {
+		val = res.Header.Get("Grpc-Status")
+	}
+	if val == "" {
+		return 0, false
+	}
+
+	code, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, false
+	}
+	return code, true
+}
+
+// Report if a grpc-status is a server failure. These are the codes mapped to
+// a 5xx status by gRPC's HTTP mapping, while the others are the client's doing,
+// like a 4xx.
+func grpcServerError(code int) bool {
+	switch code {
+	case 2, // UNKNOWN
+		4,  // DEADLINE_EXCEEDED
+		12, // UNIMPLEMENTED
+		13, // INTERNAL
+		14, // UNAVAILABLE
+		15: // DATA_LOSS
+		return true
+	}
+	return false
+}
+
+// Return the trailers-only gRPC response for a proxy error which would have
+// been answered with the HTTP status.
+func grpcErrorResponse(status int) *http.Response {
+	code := grpcUnavailable
+	if status == http.StatusGatewayTimeout {
+		code = grpcDeadlineExceeded
+	}
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/grpc")
+	header.Set("Grpc-Status", strconv.Itoa(code))
+	header.Set("Grpc-Message", http.StatusText(status))
+
+	return &http.Response{
+		Header:     header,
+		StatusCode: http.StatusOK,
+		Status:     http.StatusText(http.StatusOK),
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+	}
+}
+
+// Count a gRPC call which the backend failed as an HTTP error.
+func (s *Service) grpcStats(pr *ProxyRequest, code int) {
+	if grpcServerError(code) {
+		atomic.AddInt64(&s.HTTPErrors, 1)
+	}
+}
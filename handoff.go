@@ -0,0 +1,156 @@
+package main
+
+import (
+	"github.com/skyfii/shuttle/client"
+	"github.com/skyfii/shuttle/log"
+	"sync/atomic"
+	"time"
+)
+
+// Handing off a backend's health state when a config push moves it from one
+// service to another. The backend is still replaced, but the new one starts
+// from the old one's checks and counters rather than marked up with none, so
+// reorganizing services doesn't open a window where a failing backend is
+// balanced again, or a flapping one is let out of its hold down.
+
+// A backend removed from a service by the config being applied.
+type movingBackend struct {
+	service string
+	backend *Backend
+}
+
+// Return the backends the config removes from services, by name, and all of
+// the backends in those services before it's applied.
+// ServiceRegistry *must* be locked.
+func (s *ServiceRegistry) movingBackends(cfg client.Config) (map[string]movingBackend, map[*Backend]bool) {
+	moving := make(map[string]movingBackend)
+	before := make(map[*Backend]bool)
+
+	for _, svcCfg := range cfg.Services {
+		service, ok := s.svcs[svcCfg.Name]
+		if !ok {
+			continue
+		}
+
+		keep := make(map[string]bool)
+		for _, b := range svcCfg.Backends {
+			keep[b.Name] = true
+		}
+
+		service.Lock()
+		for _, b := range service.Backends {
+			before[b] = true
+			if svcCfg.Backends != nil && !keep[b.Name] {
+				moving[b.Name] = movingBackend{service: service.Name, backend: b}
+			}
+		}
+		service.Unlock()
+	}
+	return moving, before
+}
+
+// Hand off the state of each moving backend to the backend added to another
+// service with the same name and address.
+// ServiceRegistry *must* be locked.
+func (s *ServiceRegistry) handOff(cfg client.Config, moving map[string]movingBackend, before map[*Backend]bool) {
+	for name, m := range moving {
+		// the old service may not have been applied
+		if src, ok := s.svcs[m.service]; ok && src.get(name) == m.backend {
+			continue
+		}
+
+		for _, svcCfg := range cfg.Services {
+			service, ok := s.svcs[svcCfg.Name]
+			if !ok || service.Name == m.service {
+				continue
+			}
+
+			b := service.get(name)
+			if b == nil || before[b] || b.Addr != m.backend.Addr {
+				continue
+			}
+
+			b.adopt(m.backend)
+			log.Printf("INFO: Moved backend %s from %s to %s with its health state", name, m.service, service.Name)
+			break
+		}
+	}
+}
+
+// Take over the health state and traffic counters of the backend this one
+// replaces.
+func (b *Backend) adopt(old *Backend) {
+	old.Lock()
+	up := old.up
+	riseCount, checkOK := old.riseCount, old.checkOK
+	fallCount, checkFail := old.fallCount, old.checkFail
+	lastCheck, lastChange, lastError := old.lastCheck, old.lastChange, old.lastError
+	flaps := append([]time.Time(nil), old.flaps...)
+	dampenLevel, holdUntil := old.dampenLevel, old.holdUntil
+	load, loadTime := old.load, old.loadTime
+	old.Unlock()
+
+	b.Lock()
+	b.up = up
+	b.riseCount, b.checkOK = riseCount, checkOK
+	b.fallCount, b.checkFail = fallCount, checkFail
+	b.lastCheck, b.lastChange, b.lastError = lastCheck, lastChange, lastError
+	b.flaps = flaps
+	b.dampenLevel, b.holdUntil = dampenLevel, holdUntil
+	b.load, b.loadTime = load, loadTime
+	b.Unlock()
+
+	atomic.AddInt64(&b.Sent, atomic.LoadInt64(&old.Sent))
+	atomic.AddInt64(&b.Rcvd, atomic.LoadInt64(&old.Rcvd))
+	atomic.AddInt64(&b.Errors, atomic.LoadInt64(&old.Errors))
+	atomic.AddInt64(&b.Conns, atomic.LoadInt64(&old.Conns))
+	b.latency.merge(&old.latency)
+}
+
+// With keep_backend_stats, a service keeps the backends removed from it for a
+// while, and one added back with the same name and address takes over their
+// counters and health history, so dashboards don't see every deploy reset
+// the counters.
+
+// A backend removed from a service, and when.
+type retiredBackend struct {
+	backend *Backend
+	removed time.Time
+}
+
+// Keep a removed backend, and forget those kept too long.
+// Service *must* be locked.
+func (s *Service) retire(b *Backend) {
+	if s.KeepBackendStats <= 0 {
+		s.retired = nil
+		return
+	}
+
+	now := time.Now()
+	for name, r := range s.retired {
+		if now.Sub(r.removed) > s.KeepBackendStats {
+			delete(s.retired, name)
+		}
+	}
+
+	if s.retired == nil {
+		s.retired = make(map[string]retiredBackend)
+	}
+	s.retired[b.Name] = retiredBackend{backend: b, removed: now}
+}
+
+// Return the kept backend a new one with the same name and address replaces,
+// or nil if there's none.
+// Service *must* be locked.
+func (s *Service) unretire(b *Backend) *Backend {
+	r, ok := s.retired[b.Name]
+	if !ok {
+		return nil
+	}
+	delete(s.retired, b.Name)
+
+	if s.KeepBackendStats <= 0 || r.backend.Addr != b.Addr || time.Since(r.removed) > s.KeepBackendStats {
+		return nil
+	}
+	return r.backend
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"github.com/skyfii/shuttle/client"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Declarative header rewriting. A service's rules add, set or remove headers
+// on requests before they're proxied, and on responses before they're
+// returned to the client.
+
+// Return the valid rules, logging and skipping the rest.
+func newHeaderRules(service string, cfg []client.HeaderRule) []client.HeaderRule {
+	var rules []client.HeaderRule
+	for _, rule := range cfg {
+		switch rule.Action {
+		case client.HeaderAdd, client.HeaderSet, client.HeaderRemove:
+		default:
+			log.Errorf("ERROR: Invalid header rule action '%s' for %s", rule.Action, service)
+			continue
+		}
+
+		if rule.Header == "" {
+			log.Errorf("ERROR: Header rule for %s has no header name", service)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// Apply the request or response rules, in order.
+func applyHeaderRules(h http.Header, rules []client.HeaderRule, response bool) {
+	for _, rule := range rules {
+		if rule.Response != response {
+			continue
+		}
+
+		switch rule.Action {
+		case client.HeaderAdd:
+			h.Add(rule.Header, rule.Value)
+		case client.HeaderSet:
+			h.Set(rule.Header, rule.Value)
+		case client.HeaderRemove:
+			h.Del(rule.Header)
+		}
+	}
+}
+
+func (s *Service) rewriteRequest(pr *ProxyRequest) bool {
+	s.Lock()
+	rules := s.headerRules
+	s.Unlock()
+
+	applyHeaderRules(pr.Request.Header, rules, false)
+	return true
+}
+
+func (s *Service) rewriteResponse(pr *ProxyRequest) bool {
+	s.Lock()
+	rules := s.headerRules
+	s.Unlock()
+
+	applyHeaderRules(pr.ResponseWriter.Header(), rules, true)
+	return true
+}
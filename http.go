@@ -1,20 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 	"github.com/skyfii/shuttle/log"
 )
 
 var (
-	httpRouter *HostRouter
+	httpRouter  *HostRouter
+	httpsRouter *HostRouter
 )
 
 // This works along with the ServiceRegistry, and the individual Services to
@@ -33,21 +38,125 @@ type HostRouter struct {
 
 	// track our listener so we can kill the server
 	listener net.Listener
+
+	// MaxIdleConns limits the number of idle keep-alive client connections.
+	// MaxRequests is the number of requests served on a client connection
+	// before it is closed. A value of 0 is unlimited for either.
+	MaxIdleConns int
+	MaxRequests  int
+
+	// AcceptProxy reads a PROXY protocol header from every client connection.
+	AcceptProxy bool
+
+	// state of client connections, keyed by remote address
+	connMu   sync.Mutex
+	requests map[string]int
+	// the idle connections, with a timer to close those whose last request's
+	// service has an IdleTimeout
+	idle         map[net.Conn]*time.Timer
+	idleTimeouts map[string]time.Duration
 }
 
 func NewHostRouter(httpServer *http.Server) *HostRouter {
 	r := &HostRouter{
-		Scheme: "http",
+		Scheme:       "http",
+		requests:     make(map[string]int),
+		idle:         make(map[net.Conn]*time.Timer),
+		idleTimeouts: make(map[string]time.Duration),
 	}
 	httpServer.Handler = r
+	httpServer.ConnState = r.connState
 	r.server = httpServer
 	return r
 }
 
+// Track client connections to enforce the keep-alive limits.
+func (r *HostRouter) connState(conn net.Conn, state http.ConnState) {
+	// New connections are reported from the Accept loop, where RemoteAddr
+	// would block reading a PROXY header.
+	if state == http.StateNew {
+		return
+	}
+
+	r.connMu.Lock()
+	defer r.connMu.Unlock()
+
+	addr := conn.RemoteAddr().String()
+
+	switch state {
+	case http.StateActive:
+		r.requests[addr]++
+		r.stopIdle(conn)
+	case http.StateIdle:
+		if r.MaxIdleConns > 0 && len(r.idle) >= r.MaxIdleConns {
+			log.Debugf("DEBUG: Closing idle connection from %s, %d idle", addr, len(r.idle))
+			conn.Close()
+			return
+		}
+
+		var timer *time.Timer
+		if d := r.idleTimeouts[addr]; d > 0 {
+			timer = time.AfterFunc(d, func() {
+				r.connMu.Lock()
+				expired := r.idle[conn] == timer
+				r.connMu.Unlock()
+				if expired {
+					log.Debugf("DEBUG: Closing connection from %s idle for %s", addr, d)
+					conn.Close()
+				}
+			})
+		}
+		r.idle[conn] = timer
+	case http.StateHijacked, http.StateClosed:
+		delete(r.requests, addr)
+		delete(r.idleTimeouts, addr)
+		r.stopIdle(conn)
+	}
+}
+
+// Mark the connection no longer idle.
+// connMu *must* be locked.
+func (r *HostRouter) stopIdle(conn net.Conn) {
+	if timer := r.idle[conn]; timer != nil {
+		timer.Stop()
+	}
+	delete(r.idle, conn)
+}
+
+// Set the idle timeout of the client connection, from the service serving
+// its latest request.
+func (r *HostRouter) setIdleTimeout(req *http.Request, d time.Duration) {
+	r.connMu.Lock()
+	defer r.connMu.Unlock()
+
+	if d > 0 {
+		r.idleTimeouts[req.RemoteAddr] = d
+	} else {
+		delete(r.idleTimeouts, req.RemoteAddr)
+	}
+}
+
+// Check if this is the last request allowed on the client connection.
+func (r *HostRouter) lastRequest(req *http.Request) bool {
+	if r.MaxRequests <= 0 {
+		return false
+	}
+
+	r.connMu.Lock()
+	defer r.connMu.Unlock()
+	return r.requests[req.RemoteAddr] >= r.MaxRequests
+}
+
 func (r *HostRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	reqId := genId()
-	req.Header.Set("X-Request-Id", reqId)
-	w.Header().Add("X-Request-Id", reqId)
+	if r.lastRequest(req) {
+		w.Header().Set("Connection", "close")
+	}
+
+	if acmeChallenge(w, req) {
+		return
+	}
+
+	setRequestID(w, req)
 
 	var err error
 	host := req.Host
@@ -59,9 +168,14 @@ func (r *HostRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	svc := Registry.GetVHostService(host)
+	svc := Registry.RouteVHost(host, req.Header)
 
 	if svc != nil && svc.httpProxy != nil {
+		svc.Lock()
+		idleTimeout := svc.IdleTimeout
+		svc.Unlock()
+		r.setIdleTimeout(req, idleTimeout)
+
 		// The vhost has a service registered, give it to the proxy
 		svc.ServeHTTP(w, req)
 		return
@@ -84,7 +198,7 @@ func (r *HostRouter) Start(ready chan bool) {
 	//FIXME: poor locking strategy
 	r.Lock()
 	var err error
-	r.listener, err = newTimeoutListener("tcp", r.server.Addr, 300*time.Second)
+	r.listener, err = newTimeoutListener(socketNetwork{}, "tcp", r.server.Addr, 300*time.Second)
 	if err != nil {
 		log.Errorf("ERROR: %s", err)
 		r.Unlock()
@@ -92,6 +206,9 @@ func (r *HostRouter) Start(ready chan bool) {
 	}
 
 	listener := r.listener
+	if r.AcceptProxy {
+		listener = proxyListener{listener}
+	}
 	if r.Scheme == "https" {
 		listener = tls.NewListener(listener, r.server.TLSConfig)
 	}
@@ -109,7 +226,13 @@ func (r *HostRouter) Start(ready chan bool) {
 }
 
 func (r *HostRouter) Stop() {
-	r.listener.Close()
+	r.Lock()
+	defer r.Unlock()
+
+	// the listener is nil if the router failed to start
+	if r.listener != nil {
+		r.listener.Close()
+	}
 }
 
 func startHTTPServer(wg *sync.WaitGroup) {
@@ -117,13 +240,22 @@ func startHTTPServer(wg *sync.WaitGroup) {
 
 	//TODO: configure these timeouts somewhere
 	httpServer := &http.Server{
-		Addr:           httpAddr,
-		ReadTimeout:    10 * time.Minute,
-		WriteTimeout:   10 * time.Minute,
-		MaxHeaderBytes: 1 << 20,
+		Addr:              httpAddr,
+		ReadTimeout:       10 * time.Minute,
+		WriteTimeout:      10 * time.Minute,
+		IdleTimeout:       httpIdleTimeout,
+		ReadHeaderTimeout: httpHeaderTimeout,
+		MaxHeaderBytes:    1 << 20,
 	}
 
 	httpRouter = NewHostRouter(httpServer)
+	httpRouter.MaxIdleConns = httpMaxIdle
+	httpRouter.MaxRequests = httpMaxRequests
+	httpRouter.AcceptProxy = httpAcceptProxy
+
+	if h2cEnabled {
+		configureH2C(httpServer)
+	}
 
 	httpRouter.Start(nil)
 }
@@ -193,25 +325,47 @@ func loadCerts(certDir string) (*tls.Config, error) {
 func startHTTPSServer(wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	tlsCfg, err := loadCerts(certDir)
-	if err != nil {
+	// all certificates can come from ACME
+	if err := httpsCerts.Load(certDir); err != nil && acmeManager == nil {
 		log.Error(err)
 		return
 	}
 
+	if certReload > 0 {
+		go httpsCerts.Watch(certReload)
+	}
+
+	tlsCfg := &tls.Config{
+		GetCertificate: httpsCerts.GetCertificate,
+	}
+	serverTLS.apply(tlsCfg)
+	tlsCfg.GetConfigForClient = clientAuthConfig(tlsCfg)
+
 	//TODO: configure these timeouts somewhere
 	httpsServer := &http.Server{
-		Addr:           httpsAddr,
-		ReadTimeout:    10 * time.Minute,
-		WriteTimeout:   10 * time.Minute,
-		MaxHeaderBytes: 1 << 20,
-		TLSConfig:      tlsCfg,
+		Addr:              httpsAddr,
+		ReadTimeout:       10 * time.Minute,
+		WriteTimeout:      10 * time.Minute,
+		IdleTimeout:       httpIdleTimeout,
+		ReadHeaderTimeout: httpHeaderTimeout,
+		MaxHeaderBytes:    1 << 20,
+		TLSConfig:         tlsCfg,
 	}
 
-	httpRouter = NewHostRouter(httpsServer)
-	httpRouter.Scheme = "https"
+	httpsRouter = NewHostRouter(httpsServer)
+	httpsRouter.Scheme = "https"
+	httpsRouter.MaxIdleConns = httpMaxIdle
+	httpsRouter.MaxRequests = httpMaxRequests
+	httpsRouter.AcceptProxy = httpAcceptProxy
 
-	httpRouter.Start(nil)
+	if http2Enabled {
+		if err := configureHTTP2(httpsServer); err != nil {
+			log.Errorf("ERROR: Unable to serve HTTP/2: %s", err)
+			return
+		}
+	}
+
+	httpsRouter.Start(nil)
 }
 
 type ErrorPage struct {
@@ -224,8 +378,14 @@ type ErrorPage struct {
 
 	// body contains the cached error page
 	body []byte
+	// the body parsed as a template, or nil if it isn't one
+	tmpl *template.Template
 	// important headers
 	header http.Header
+
+	// when the page was last fetched, and if a refresh is running
+	fetched  time.Time
+	fetching bool
 }
 
 func (e *ErrorPage) Body() []byte {
@@ -235,9 +395,12 @@ func (e *ErrorPage) Body() []byte {
 }
 
 func (e *ErrorPage) SetBody(b []byte) {
+	tmpl := parseErrorPage(e.Location, b)
+
 	e.Lock()
 	defer e.Unlock()
 	e.body = b
+	e.tmpl = tmpl
 }
 
 func (e *ErrorPage) Header() http.Header {
@@ -270,13 +433,21 @@ type ErrorResponse struct {
 	// map them by status for responses
 	pages map[int]*ErrorPage
 
+	// status codes only replaced when the response has no body
+	ifEmpty map[int]bool
+
+	// the service named in the pages, and how often they're fetched again
+	service string
+	refresh time.Duration
+
 	// keep this handy to refresh the pages
 	client *http.Client
 }
 
-func NewErrorResponse(pages map[string][]int) *ErrorResponse {
+func NewErrorResponse(service string, pages map[string][]int) *ErrorResponse {
 	errors := &ErrorResponse{
-		pages: make(map[int]*ErrorPage),
+		pages:   make(map[int]*ErrorPage),
+		service: service,
 	}
 
 	// aggressively timeout connections
@@ -297,10 +468,12 @@ func NewErrorResponse(pages map[string][]int) *ErrorResponse {
 }
 
 // Get the ErrorPage, returning nil if the page was incomplete.
-// We permanently cache error pages and headers once we've seen them.
+// We cache error pages and headers once we've seen them, and fetch them again
+// in the background once they're older than the refresh interval.
 func (e *ErrorResponse) Get(code int) *ErrorPage {
 	e.Lock()
 	page, ok := e.pages[code]
+	refresh := e.refresh
 	e.Unlock()
 
 	if !ok {
@@ -310,6 +483,9 @@ func (e *ErrorResponse) Get(code int) *ErrorPage {
 
 	body := page.Body()
 	if body != nil {
+		if page.startRefresh(refresh) {
+			go e.fetch(page)
+		}
 		return page
 	}
 
@@ -319,6 +495,13 @@ func (e *ErrorResponse) Get(code int) *ErrorPage {
 }
 
 func (e *ErrorResponse) fetch(page *ErrorPage) {
+	defer page.endRefresh()
+
+	if path, ok := errorPageFile(page.Location); ok {
+		readErrorPage(page, path)
+		return
+	}
+
 	log.Debugf("DEBUG: Fetching error page from %s", page.Location)
 	resp, err := e.client.Get(page.Location)
 	if err != nil {
@@ -362,6 +545,25 @@ func (e *ErrorResponse) fetch(page *ErrorPage) {
 	log.Warnf("WARN: Empty response from %s", page.Location)
 }
 
+// Set the status codes where only a response without a body is replaced by
+// the ErrorPage.
+func (e *ErrorResponse) SetIfEmpty(codes []int) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.ifEmpty = make(map[int]bool)
+	for _, code := range codes {
+		e.ifEmpty[code] = true
+	}
+}
+
+// Check if we should only replace an empty response for this status code.
+func (e *ErrorResponse) onlyIfEmpty(code int) bool {
+	e.Lock()
+	defer e.Unlock()
+	return e.ifEmpty[code]
+}
+
 // This replaces all existing ErrorPages
 func (e *ErrorResponse) Update(pages map[string][]int) {
 	e.Lock()
@@ -383,6 +585,9 @@ func (e *ErrorResponse) Update(pages map[string][]int) {
 }
 
 func (e *ErrorResponse) CheckResponse(pr *ProxyRequest) bool {
+	if e.onlyIfEmpty(pr.Response.StatusCode) && hasBody(pr.Response) {
+		return true
+	}
 
 	errPage := e.Get(pr.Response.StatusCode)
 	if errPage != nil {
@@ -392,28 +597,66 @@ func (e *ErrorResponse) CheckResponse(pr *ProxyRequest) bool {
 			header[key] = val
 		}
 
+		// the backend's length doesn't apply to the page
+		body := e.Render(errPage, pr.Request, pr.Response.StatusCode)
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+
 		pr.ResponseWriter.WriteHeader(pr.Response.StatusCode)
-		pr.ResponseWriter.Write(errPage.Body())
+		pr.ResponseWriter.Write(body)
 		return false
 	}
 
 	return true
 }
 
-func logRequest(req *http.Request, statusCode int, backend string, proxyError error, duration time.Duration) {
-	id := req.Header.Get("X-Request-Id")
+// Check if a response has a body, peeking at the first byte when the length
+// is unknown. The body remains intact for the client.
+func hasBody(resp *http.Response) bool {
+	if resp.ContentLength >= 0 {
+		return resp.ContentLength > 0
+	}
+
+	b := make([]byte, 1)
+	n, _ := io.ReadFull(resp.Body, b)
+	if n == 0 {
+		return false
+	}
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b[:n]), resp.Body), resp.Body}
+	return true
+}
+
+func logRequest(req *http.Request, statusCode int, backend backendAttempt, proxyError error, duration time.Duration) {
+	logAccess(&accessEntry{
+		req:      req,
+		status:   statusCode,
+		backend:  backend,
+		err:      proxyError,
+		duration: duration,
+		bytes:    -1,
+	})
+}
+
+func logAccess(e *accessEntry) {
+	if accessLog != nil {
+		accessLog.log(e)
+		return
+	}
+
+	req := e.req
+	id := req.Header.Get(RequestIDHeader)
 	method := req.Method
 	url := req.Host + req.RequestURI
 	agent := req.UserAgent()
 
-	clientIP := req.Header.Get("X-Forwarded-For")
-	if clientIP == "" {
-		clientIP = req.RemoteAddr
-	}
+	clientIP := clientAddr(req)
 
-	errStr := fmt.Sprintf("%v", proxyError)
-	fmtStr := "id=%s method=%s client-ip=%s url=%s backend=%s status=%d duration=%s agent=%s, err=%s"
-	log.Printf(fmtStr, id, method, clientIP, url, backend, statusCode, duration, agent, errStr)
+	errStr := fmt.Sprintf("%v", e.err)
+	fmtStr := "id=%s method=%s client-ip=%s url=%s backend=%s backend-name=%s attempt=%d status=%d duration=%s agent=%s, err=%s"
+	log.Printf(fmtStr, id, method, clientIP, url, e.backend.Addr, e.backend.Name, e.backend.Attempt, e.status, e.duration, agent, errStr)
 }
 
 func logProxyRequest(pr *ProxyRequest) bool {
@@ -422,13 +665,13 @@ func logProxyRequest(pr *ProxyRequest) bool {
 		return true
 	}
 
-	duration := pr.FinishTime.Sub(pr.StartTime)
-
-	var backend string
-	if pr.Response != nil && pr.Response.Request != nil && pr.Response.Request.URL != nil {
-		backend = pr.Response.Request.URL.Host
-	}
-
-	logRequest(pr.Request, pr.Response.StatusCode, backend, pr.ProxyError, duration)
+	logAccess(&accessEntry{
+		req:      pr.Request,
+		status:   pr.Response.StatusCode,
+		backend:  pr.Backend,
+		err:      pr.ProxyError,
+		duration: pr.FinishTime.Sub(pr.StartTime),
+		bytes:    pr.Response.ContentLength,
+	})
 	return true
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"time"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// HTTP/2 on the frontends, and to the backends of services with HTTP2 set,
+// so gRPC and other multiplexed traffic can be routed by virtual host.
+
+// Serve HTTP/2 to TLS clients which negotiate "h2" with ALPN.
+func configureHTTP2(server *http.Server) error {
+	// the protocol is chosen in the server's order, so h2 must come first
+	cfg := server.TLSConfig
+	protos := []string{http2.NextProtoTLS}
+	for _, p := range cfg.NextProtos {
+		if p != http2.NextProtoTLS {
+			protos = append(protos, p)
+		}
+	}
+	cfg.NextProtos = protos
+
+	return http2.ConfigureServer(server, &http2.Server{IdleTimeout: server.IdleTimeout})
+}
+
+// Serve cleartext HTTP/2 to clients with prior knowledge, or which ask to
+// upgrade an HTTP/1.1 request with h2c.
+func configureH2C(server *http.Server) {
+	server.Handler = h2c.NewHandler(server.Handler, &http2.Server{IdleTimeout: server.IdleTimeout})
+}
+
+// backendTransport sends a service's requests over HTTP/1.1, or over
+// cleartext HTTP/2 while the service has HTTP2 set. Both dial through the
+// service, so the backend stats and timeouts apply to either.
+type backendTransport struct {
+	svc   *Service
+	http1 *http.Transport
+	http2 *http2.Transport
+}
+
+func newBackendTransport(s *Service) *backendTransport {
+	return &backendTransport{
+		svc: s,
+		http1: &http.Transport{
+			DialContext:         s.DialContext,
+			MaxIdleConnsPerHost: 10,
+		},
+		http2: &http2.Transport{
+			AllowHTTP: true,
+			// the backends are plain HTTP, so this is only named for TLS
+			DialTLSContext: func(ctx context.Context, nw, addr string, _ *tls.Config) (net.Conn, error) {
+				return s.DialContext(ctx, nw, addr)
+			},
+		},
+	}
+}
+
+func (t *backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.svc.Lock()
+	useHTTP2 := t.svc.HTTP2 && !t.svc.ForceHTTP11
+	headerTimeout := t.svc.ResponseHeaderTimeout
+	t.svc.Unlock()
+
+	roundTrip := t.http1.RoundTrip
+	if useHTTP2 {
+		roundTrip = t.http2.RoundTrip
+	}
+
+	if headerTimeout <= 0 {
+		return roundTrip(req)
+	}
+	return roundTripTimeout(roundTrip, req, headerTimeout)
+}
+
+// Send the request, failing with ErrResponseTimeout if the response headers
+// don't arrive within d. The body may take as long as it needs.
+func roundTripTimeout(roundTrip func(*http.Request) (*http.Response, error), req *http.Request, d time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(d, cancel)
+
+	resp, err := roundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, ErrResponseTimeout
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// A response body which releases its request's context once it's closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Options for older HTTP/1.x backends, such as appliances behind the vhost
+// router, which mishandle protocol upgrades, chunked request bodies, or
+// headers a client names in its Connection header.
+
+// Default limit of a request body buffered to send it with a Content-Length,
+// when the service has no MaxRequestBody.
+const defaultCompatBody = 8 << 20
+
+type httpCompat struct {
+	// send plain HTTP/1.1, without passing on an Upgrade
+	ForceHTTP11 bool
+
+	// send request bodies with a Content-Length rather than chunked, up to
+	// MaxBody bytes
+	NoChunked bool
+	MaxBody   int64
+
+	// remove the headers named in the Connection header, and send the
+	// backends an explicit keep-alive
+	NormalizeConnection bool
+}
+
+// Set the proxy's options for the service's backends.
+func (s *Service) setHTTPCompat() {
+	compat := httpCompat{
+		ForceHTTP11:         s.ForceHTTP11,
+		NoChunked:           s.NoChunked,
+		MaxBody:             s.MaxRequestBody,
+		NormalizeConnection: s.NormalizeConnection,
+	}
+	if compat.MaxBody <= 0 {
+		compat.MaxBody = defaultCompatBody
+	}
+	s.httpProxy.SetCompat(compat)
+}
+
+// Remove the headers named in the Connection header of conn from h, other
+// than the Upgrade header of a protocol upgrade.
+func removeConnectionHeaders(h, conn http.Header, upgrade bool) {
+	for _, v := range conn["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" || (upgrade && strings.EqualFold(name, "upgrade")) {
+				continue
+			}
+			h.Del(name)
+		}
+	}
+}
+
+// Read a body of unknown length, so the request is sent with a
+// Content-Length. The body may be sent again, as when it's replayed.
+func bufferContentLength(r *http.Request, max int64) error {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength >= 0 {
+		return nil
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	switch {
+	case errors.Is(err, ErrBodyTooLarge), err == nil && int64(len(buf)) > max:
+		return ErrBodyTooLarge
+	case err != nil:
+		return ErrClientAborted
+	}
+
+	r.ContentLength = int64(len(buf))
+	r.TransferEncoding = nil
+	if len(buf) == 0 {
+		r.Body = http.NoBody
+		return nil
+	}
+
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Services left with no backends and no traffic, such as those automation
+// forgot to remove, are flagged as idle once they've been that way for the
+// global idle_service_ttl, and removed as well with reap_idle_services, so a
+// long running instance doesn't accumulate dead listeners. Each change is
+// sent to the health webhooks.
+//
+// Workers only flag idle services. Each sees just its share of the traffic,
+// so removing them would leave the workers, and the state config written by
+// the first, with different services.
+
+// how often the services are checked
+var idleCheckInterval = 10 * time.Second
+
+// health event states of an idle service
+const (
+	idleActive  = "active"
+	idleIdle    = "idle"
+	idleRemoved = "removed"
+)
+
+type idleReaper struct {
+	sync.Mutex
+	ttl    time.Duration
+	remove bool
+
+	seen map[*Service]idleState
+
+	start sync.Once
+
+	// warn once that workers don't remove services
+	workerWarn sync.Once
+}
+
+// A service's traffic when it was last seen, and since when it's had none.
+type idleState struct {
+	traffic int64
+	since   time.Time
+	flagged bool
+}
+
+var idleServices = &idleReaper{}
+
+// Set the time a service may be idle, and if it's removed after that. The
+// services are checked once a ttl is set.
+func (r *idleReaper) Set(ttl time.Duration, remove bool) {
+	if remove && workerID > 0 {
+		r.workerWarn.Do(func() {
+			log.Warnf("WARN: Idle services are not removed with workers, only flagged")
+		})
+		remove = false
+	}
+
+	r.Lock()
+	r.ttl = ttl
+	r.remove = remove
+	if ttl <= 0 {
+		r.seen = nil
+	}
+	r.Unlock()
+
+	if ttl > 0 {
+		r.start.Do(func() {
+			go func() {
+				t := time.NewTicker(idleCheckInterval)
+				defer t.Stop()
+				for now := range t.C {
+					r.check(now)
+				}
+			}()
+		})
+	}
+}
+
+// Report if the service has been flagged as idle.
+func (r *idleReaper) Idle(svc *Service) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.seen[svc].flagged
+}
+
+// Flag the services which have been idle for the ttl, and remove them if
+// configured to.
+func (r *idleReaper) check(now time.Time) {
+	r.Lock()
+	ttl, remove := r.ttl, r.remove
+	r.Unlock()
+	if ttl <= 0 {
+		return
+	}
+
+	Registry.Lock()
+	svcs := make([]*Service, 0, len(Registry.svcs))
+	for _, svc := range Registry.svcs {
+		svcs = append(svcs, svc)
+	}
+	Registry.Unlock()
+
+	type change struct {
+		svc      *Service
+		old, new string
+	}
+	var changes []change
+
+	// the stats are read first, since they report if a service is idle
+	stats := make([]ServiceStat, len(svcs))
+	for i, svc := range svcs {
+		stats[i] = svc.Stats()
+	}
+
+	r.Lock()
+	seen := make(map[*Service]idleState, len(svcs))
+	for i, svc := range svcs {
+		stat := stats[i]
+		traffic := stat.Conns + stat.HTTPConns + stat.NoBackend + stat.Rcvd
+
+		st, ok := r.seen[svc]
+		switch {
+		case !ok || len(stat.Backends) > 0 || traffic != st.traffic:
+			if st.flagged {
+				changes = append(changes, change{svc, idleIdle, idleActive})
+			}
+			st = idleState{traffic: traffic, since: now}
+		case now.Sub(st.since) < ttl:
+		case remove:
+			old := idleActive
+			if st.flagged {
+				old = idleIdle
+			}
+			changes = append(changes, change{svc, old, idleRemoved})
+			continue
+		case !st.flagged:
+			st.flagged = true
+			changes = append(changes, change{svc, idleActive, idleIdle})
+		}
+		seen[svc] = st
+	}
+	r.seen = seen
+	r.Unlock()
+
+	removed := false
+	for _, c := range changes {
+		reason := fmt.Sprintf("no backends or traffic for %s", ttl)
+
+		switch c.new {
+		case idleActive:
+			log.Printf("INFO: Service %s is active again", c.svc.Name)
+			reason = ""
+		case idleIdle:
+			log.Warnf("WARN: Service %s has had no backends or traffic for %s", c.svc.Name, ttl)
+		case idleRemoved:
+			// the service may have been replaced since it was checked
+			Registry.Lock()
+			current := Registry.svcs[c.svc.Name] == c.svc
+			if current {
+				Registry.removeService(c.svc.Name)
+			}
+			Registry.Unlock()
+			if !current {
+				continue
+			}
+			log.Warnf("WARN: Removed service %s, which had no backends or traffic for %s", c.svc.Name, ttl)
+			removed = true
+		}
+
+		// the workers share one config, reported by the first
+		if workerID > 1 {
+			continue
+		}
+		healthWebhook.Send(HealthEvent{
+			Service:  c.svc.Name,
+			Addr:     c.svc.Addr,
+			OldState: c.old,
+			NewState: c.new,
+			Reason:   reason,
+			Time:     now,
+		})
+	}
+
+	if removed {
+		go writeStateConfig()
+	}
+}
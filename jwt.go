@@ -0,0 +1,428 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"github.com/skyfii/shuttle/client"
+	"github.com/skyfii/shuttle/log"
+)
+
+// JWT bearer token verification for vhosts. A service with a JWT config
+// rejects requests without a valid token, and passes the verified claims to
+// the backends in headers.
+
+const (
+	JWTSubjectHeader = "X-JWT-Subject"
+
+	// how often the JWKS is fetched again
+	jwksRefresh = 5 * time.Minute
+
+	// shortest time between fetches for a token with an unknown key ID
+	jwksRetry = 10 * time.Second
+
+	// allowed clock skew for the exp and nbf claims
+	jwtLeeway = time.Minute
+)
+
+var (
+	errNoToken      = errors.New("no bearer token")
+	errInvalidToken = errors.New("invalid token")
+	errNoKey        = errors.New("no key verified the token")
+
+	jwksClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+type jwtVerifier struct {
+	sync.Mutex
+	cfg     client.JWTConfig
+	service string
+	headers map[string]string
+	static  []crypto.PublicKey
+
+	// keys from the JWKS URL, by key ID
+	jwks    map[string]crypto.PublicKey
+	fetched time.Time
+	// closed when the fetch in flight finishes, or nil if there's none
+	fetching chan struct{}
+
+	// a key that couldn't be loaded rejects every token, rather than
+	// accepting tokens it should have rejected
+	err error
+}
+
+// Return the verifier for a service, or nil if no JWT config is set.
+func newJWTVerifier(service string, cfg *client.JWTConfig) *jwtVerifier {
+	if cfg == nil {
+		return nil
+	}
+
+	v := &jwtVerifier{
+		cfg:     *cfg,
+		service: service,
+		headers: cfg.ClaimHeaders,
+	}
+
+	secret, err := resolveSecret(cfg.Secret)
+	if err != nil {
+		log.Errorf("ERROR: Unable to resolve JWT secret for %s: %s", service, err)
+		v.err = err
+	}
+	v.cfg.Secret = secret
+
+	if len(v.headers) == 0 {
+		v.headers = map[string]string{"sub": JWTSubjectHeader}
+	}
+
+	for _, path := range cfg.Keys {
+		key, err := loadPublicKey(path)
+		if err != nil {
+			log.Errorf("ERROR: Unable to load JWT key for %s: %s", service, err)
+			v.err = err
+			continue
+		}
+		v.static = append(v.static, key)
+	}
+
+	if cfg.JWKSURL == "" && len(cfg.Keys) == 0 && cfg.Secret == "" {
+		log.Errorf("ERROR: No JWT keys for %s", service)
+		v.err = errNoKey
+	}
+	return v
+}
+
+// Load a public key, or the key of a certificate, from a PEM file.
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	pemData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// Check the request's token, and replace the claim headers with the
+// verified claims. Returns false if the request must be rejected.
+func (s *Service) verifyJWT(r *http.Request) bool {
+	s.Lock()
+	v := s.jwt
+	s.Unlock()
+
+	if v == nil {
+		return true
+	}
+
+	// never trust the headers from the client
+	for _, header := range v.headers {
+		r.Header.Del(header)
+	}
+
+	claims, err := v.Verify(r)
+	if err != nil {
+		log.Debugf("DEBUG: Rejected token from %s for %s: %s", r.RemoteAddr, s.Name, err)
+		return false
+	}
+
+	for claim, header := range v.headers {
+		switch val := claims[claim].(type) {
+		case nil:
+		case string:
+			r.Header.Set(header, val)
+		default:
+			js, _ := json.Marshal(val)
+			r.Header.Set(header, string(js))
+		}
+	}
+	return true
+}
+
+// Verify the request's bearer token, and return its claims.
+func (v *jwtVerifier) Verify(r *http.Request) (map[string]interface{}, error) {
+	if v.err != nil {
+		return nil, v.err
+	}
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return nil, errNoToken
+	}
+	return v.verifyToken(strings.TrimSpace(auth[7:]), time.Now())
+}
+
+func (v *jwtVerifier) verifyToken(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	if err := v.verifySignature(hdr.Alg, hdr.Kid, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if err := v.checkClaims(claims, now); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errInvalidToken
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errInvalidToken
+	}
+	return nil
+}
+
+var jwtHashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+func (v *jwtVerifier) verifySignature(alg, kid string, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm '%s'", alg)
+	}
+
+	hash, ok := jwtHashes[alg[2:]]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm '%s'", alg)
+	}
+
+	if alg[:2] == "HS" {
+		if v.cfg.Secret == "" {
+			return errNoKey
+		}
+		mac := hmac.New(hash.New, []byte(v.cfg.Secret))
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errNoKey
+		}
+		return nil
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	for _, key := range v.keys(kid) {
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			if alg[:2] == "RS" && rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if alg[:2] != "ES" || len(sig) != 2*size {
+				continue
+			}
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return nil
+			}
+		}
+	}
+	return errNoKey
+}
+
+func (v *jwtVerifier) checkClaims(claims map[string]interface{}, now time.Time) error {
+	if exp, ok := claims["exp"].(float64); ok && now.Add(-jwtLeeway).Unix() >= int64(exp) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Unix() < int64(nbf) {
+		return errors.New("token not valid yet")
+	}
+
+	if v.cfg.Issuer != "" && claims["iss"] != v.cfg.Issuer {
+		return errors.New("wrong issuer")
+	}
+
+	if v.cfg.Audience == "" {
+		return nil
+	}
+
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud == v.cfg.Audience {
+			return nil
+		}
+	case []interface{}:
+		for _, a := range aud {
+			if a == v.cfg.Audience {
+				return nil
+			}
+		}
+	}
+	return errors.New("wrong audience")
+}
+
+// Return the keys which may have signed a token with the key ID.
+func (v *jwtVerifier) keys(kid string) []crypto.PublicKey {
+	keys := v.static
+	if v.cfg.JWKSURL == "" {
+		return keys
+	}
+
+	v.Lock()
+	_, known := v.jwks[kid]
+	since := time.Since(v.fetched)
+	stale := since > jwksRefresh || (kid != "" && !known && since > jwksRetry)
+
+	switch {
+	case stale && v.fetching == nil:
+		// fetch without the lock, so other requests use the cached keys
+		done := make(chan struct{})
+		v.fetching = done
+		v.Unlock()
+
+		jwks, err := fetchJWKS(v.cfg.JWKSURL)
+
+		v.Lock()
+		if err != nil {
+			log.Warnf("WARN: Unable to fetch JWKS for %s: %s", v.service, err)
+		} else {
+			v.jwks = jwks
+		}
+		v.fetched = time.Now()
+		v.fetching = nil
+		close(done)
+
+	case v.fetching != nil && (v.jwks == nil || (kid != "" && !known)):
+		// no cached key can verify the token, so wait for the fetch
+		done := v.fetching
+		v.Unlock()
+		<-done
+		v.Lock()
+	}
+
+	// the map is replaced rather than changed, so it can be read unlocked
+	jwks := v.jwks
+	v.Unlock()
+
+	if key, ok := jwks[kid]; ok {
+		return append(keys[:len(keys):len(keys)], key)
+	}
+
+	for _, key := range jwks {
+		keys = append(keys[:len(keys):len(keys)], key)
+	}
+	return keys
+}
+
+// Fetch the RSA and EC keys from a JWKS URL.
+func fetchJWKS(url string) (map[string]crypto.PublicKey, error) {
+	resp, err := jwksClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{
+				Curve: curve,
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+	return keys, nil
+}
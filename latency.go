@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Histograms of the time HTTP requests take to get the response headers from
+// a backend, for each service, each of its virtual hosts and each backend, so
+// a latency regression can be traced to the backends causing it. Like the
+// other counters, the buckets are only updated atomically.
+
+// upper bounds of the latency buckets; the last bucket has none
+var latencyBounds = [...]time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// The latency of the requests counted, in milliseconds. The percentiles are
+// estimated from the histogram buckets.
+type LatencyStat struct {
+	Count int64   `json:"count"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+}
+
+type latencyHist struct {
+	buckets [len(latencyBounds) + 1]int64
+	count   int64
+	// total nanoseconds
+	sum int64
+}
+
+func (h *latencyHist) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBounds) && d >= latencyBounds[i] {
+		i++
+	}
+	atomic.AddInt64(&h.buckets[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+	atomic.AddInt64(&h.count, 1)
+}
+
+// Add the counts of another histogram to this one.
+func (h *latencyHist) merge(other *latencyHist) {
+	for i := range h.buckets {
+		atomic.AddInt64(&h.buckets[i], atomic.LoadInt64(&other.buckets[i]))
+	}
+	atomic.AddInt64(&h.sum, atomic.LoadInt64(&other.sum))
+	atomic.AddInt64(&h.count, atomic.LoadInt64(&other.count))
+}
+
+// Return the stats, or nil if no requests have been counted.
+func (h *latencyHist) Stats() *LatencyStat {
+	var buckets [len(latencyBounds) + 1]int64
+	var count int64
+	for i := range buckets {
+		buckets[i] = atomic.LoadInt64(&h.buckets[i])
+		count += buckets[i]
+	}
+	if count == 0 {
+		return nil
+	}
+
+	return &LatencyStat{
+		Count: count,
+		Mean:  ms(time.Duration(atomic.LoadInt64(&h.sum) / atomic.LoadInt64(&h.count))),
+		P50:   percentile(buckets[:], count, 0.50),
+		P95:   percentile(buckets[:], count, 0.95),
+		P99:   percentile(buckets[:], count, 0.99),
+	}
+}
+
+// Estimate a percentile in milliseconds, interpolating within its bucket.
+// Those in the last bucket are reported at its lower bound.
+func percentile(buckets []int64, count int64, q float64) float64 {
+	rank := q * float64(count)
+
+	var seen int64
+	for i, n := range buckets {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+
+		var lower time.Duration
+		if i > 0 {
+			lower = latencyBounds[i-1]
+		}
+		if i == len(latencyBounds) {
+			return ms(lower)
+		}
+
+		frac := (rank - float64(seen)) / float64(n)
+		return ms(lower + time.Duration(frac*float64(latencyBounds[i]-lower)))
+	}
+	return ms(latencyBounds[len(latencyBounds)-1])
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// The histograms of a service's virtual hosts.
+type vhostLatency struct {
+	sync.Mutex
+	hists map[string]*latencyHist
+}
+
+func (v *vhostLatency) observe(vhost string, d time.Duration) {
+	v.Lock()
+	if v.hists == nil {
+		v.hists = make(map[string]*latencyHist)
+	}
+	h := v.hists[vhost]
+	if h == nil {
+		h = &latencyHist{}
+		v.hists[vhost] = h
+	}
+	v.Unlock()
+
+	h.observe(d)
+}
+
+func (v *vhostLatency) Stats() map[string]LatencyStat {
+	v.Lock()
+	defer v.Unlock()
+
+	if len(v.hists) == 0 {
+		return nil
+	}
+
+	stats := make(map[string]LatencyStat, len(v.hists))
+	for vhost, h := range v.hists {
+		if st := h.Stats(); st != nil {
+			stats[vhost] = *st
+		}
+	}
+	return stats
+}
+
+// Record the latency of a request answered by a backend, for the service, the
+// request's virtual host if the service has it, and the backend.
+func (s *Service) recordLatency(pr *ProxyRequest) bool {
+	if pr.ProxyError != nil {
+		return true
+	}
+	latency := pr.FinishTime.Sub(pr.StartTime)
+
+	host := pr.Request.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	s.Lock()
+	var backend *Backend
+	for _, b := range s.Backends {
+		if b.Addr == pr.Backend.Addr {
+			backend = b
+			break
+		}
+	}
+
+	vhost := ""
+	for _, name := range s.VirtualHosts {
+		if name == host {
+			vhost = name
+			break
+		}
+	}
+	s.Unlock()
+
+	s.latency.observe(latency)
+	if vhost != "" {
+		s.vhostLatency.observe(vhost, latency)
+	}
+	if backend != nil {
+		backend.latency.observe(latency)
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"github.com/skyfii/shuttle/client"
+	"github.com/skyfii/shuttle/log"
+)
+
+// A per-service health responder for upstream load balancers, which can then
+// check each service shuttle proxies rather than only the process.
+
+const defaultLBHealthPath = "/_lb-health"
+
+// The json body of an LB health response
+type LBHealthStat struct {
+	Service   string `json:"service"`
+	Available int    `json:"available"`
+	Backends  int    `json:"backends"`
+	// Weight is the percentage of the service's backends available.
+	Weight int `json:"weight"`
+}
+
+type lbHealth struct {
+	cfg     client.LBHealthConfig
+	service *Service
+	server  *http.Server
+}
+
+// Return the responder for a service, or nil if no LB health config is set.
+func newLBHealth(s *Service, cfg *client.LBHealthConfig) *lbHealth {
+	if cfg == nil || cfg.Addr == "" {
+		return nil
+	}
+
+	h := &lbHealth{
+		cfg:     *cfg,
+		service: s,
+	}
+
+	if h.cfg.Path == "" {
+		h.cfg.Path = defaultLBHealthPath
+	}
+
+	h.server = &http.Server{Handler: h}
+	return h
+}
+
+// Start listening. A responder that can't listen is logged, leaving the
+// upstream load balancer to mark the service down.
+func (h *lbHealth) start() {
+	if h == nil {
+		return
+	}
+
+	l, err := listenTCP("tcp", h.cfg.Addr)
+	if err != nil {
+		log.Errorf("ERROR: Unable to start LB health responder for %s on %s: %s", h.service.Name, h.cfg.Addr, err)
+		return
+	}
+
+	log.Printf("INFO: Starting LB health responder for %s on %s%s", h.service.Name, h.cfg.Addr, h.cfg.Path)
+	go h.server.Serve(l)
+}
+
+func (h *lbHealth) stop() {
+	if h == nil {
+		return
+	}
+
+	if err := h.server.Close(); err != nil {
+		log.Errorf("ERROR: Unable to close LB health responder for %s: %s", h.service.Name, err)
+	}
+}
+
+// Respond 200 while the service is listening, not draining, and enough of its
+// backends are available, and 503 otherwise, with the percentage available as
+// the weight.
+func (h *lbHealth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != h.cfg.Path {
+		http.NotFound(w, r)
+		return
+	}
+
+	s := h.service
+	s.Lock()
+	stat := LBHealthStat{
+		Service:  s.Name,
+		Backends: len(s.Backends),
+	}
+	bound := s.bindState == bindBound && s.drain == nil
+	s.Unlock()
+
+	// Available is 0 while the service is in maintenance mode
+	stat.Available = s.Available()
+	if stat.Backends > 0 {
+		stat.Weight = stat.Available * 100 / stat.Backends
+	}
+
+	status := http.StatusOK
+	if !bound || stat.Available == 0 || stat.Weight < h.cfg.MinAvailable {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-LB-Weight", strconv.Itoa(stat.Weight))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(stat)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Backend-reported load, polled from a lightweight endpoint such as a
+// sidecar, for the COST balancing of heterogeneous or autoscaling pools.
+
+// A reported load is ignored once this many check intervals have passed
+// without a new one.
+const loadStaleChecks = 3
+
+// largest load response read
+const maxLoadBody = 1024
+
+var loadClient = &http.Client{
+	Transport: &http.Transport{
+		Dial: (&net.Dialer{
+			Timeout: 2 * time.Second,
+		}).Dial,
+	},
+	Timeout: 2 * time.Second,
+}
+
+// Poll the backend's LoadURL, and record the load it reports.
+func (b *Backend) pollLoad() {
+	b.Lock()
+	url := b.LoadURL
+	b.Unlock()
+
+	if url == "" {
+		return
+	}
+
+	load, err := fetchLoad(url)
+	if err != nil {
+		log.Warnf("WARN: Unable to poll load for backend %s: %s", b.Name, err)
+		return
+	}
+
+	b.Lock()
+	b.load = load
+	b.loadTime = time.Now()
+	b.Unlock()
+}
+
+// Fetch a load, returned as a bare number or a json object with a "load"
+// field.
+func fetchLoad(url string) (float64, error) {
+	resp, err := loadClient.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxLoadBody))
+	if err != nil {
+		return 0, err
+	}
+
+	text := strings.TrimSpace(string(body))
+	if load, err := strconv.ParseFloat(text, 64); err == nil {
+		return load, nil
+	}
+
+	var report struct {
+		Load *float64 `json:"load"`
+	}
+	if err := json.Unmarshal(body, &report); err != nil || report.Load == nil {
+		return 0, fmt.Errorf("invalid load %q", text)
+	}
+	return *report.Load, nil
+}
+
+// Return the last load the backend reported, and whether it's recent enough
+// to use.
+func (b *Backend) reportedLoad() (float64, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.loadTime.IsZero() || time.Since(b.loadTime) > loadStaleChecks*b.checkInterval {
+		return 0, false
+	}
+	return b.load, true
+}
@@ -41,6 +41,15 @@ func New(out io.Writer, prefix string, level int) *Logger {
 
 var DefaultLogger = New(os.Stderr, "", INFO)
 
+// SetOutput sets the output of the DefaultLogger, and returns the previous
+// one. It's safe while other goroutines are logging, unlike replacing the
+// DefaultLogger.
+func SetOutput(w io.Writer) io.Writer {
+	prev := DefaultLogger.Writer()
+	DefaultLogger.Logger.SetOutput(w)
+	return prev
+}
+
 func (l *Logger) Debug(v ...interface{}) {
 	if l.Level < DEBUG {
 		return
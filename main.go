@@ -2,7 +2,10 @@ package main
 
 import (
 	"flag"
+	"net/http"
+	"os"
 	"sync"
+	"time"
 	"github.com/skyfii/shuttle/log"
 )
 
@@ -15,6 +18,9 @@ var (
 	// The default config is loaded if this file does not exist.
 	stateConfig string
 
+	// Key to encrypt the configs at rest
+	stateKey string
+
 	// Listen addressed for the http servers.
 	httpAddr  string
 	httpsAddr string
@@ -22,17 +28,91 @@ var (
 	// Listen address for the http server.
 	adminListenAddr string
 
+	// Listen address for the read-only mirror of the admin server.
+	statsListenAddr string
+
 	// Debug logging
 	debug bool
 
+	// Keep-alive limits for http client connections
+	httpIdleTimeout time.Duration
+	httpMaxIdle     int
+	httpMaxRequests int
+
+	// Time to read the headers of an http request, before its service is
+	// known
+	httpHeaderTimeout time.Duration
+
+	// Read PROXY protocol headers on the http servers
+	httpAcceptProxy bool
+
+	// Serve HTTP/2 on the https server, and cleartext HTTP/2 on the http
+	// server
+	http2Enabled bool
+	h2cEnabled   bool
+
 	// Redirect to HTTPS endpoint
 	httpsRedirect bool
 
 	// version flags
-	version      bool
+	version bool
 
 	// SSL Certificate directory
 	certDir string
+
+	// Interval to check certDir for changes
+	certReload time.Duration
+
+	// TLS policy for the https and admin servers
+	tlsMinVersion string
+	tlsCiphers    string
+	tlsCurves     string
+	tlsALPN       string
+
+	// Certificate and key to serve the admin server over https, and the CAs
+	// required to sign admin client certificates
+	adminCert     string
+	adminKey      string
+	adminClientCA string
+
+	// Tokens required for read-write and read-only admin requests
+	adminToken     string
+	adminReadToken string
+
+	// ACME certificate cache, account email, and directory URL
+	acmeDir       string
+	acmeEmail     string
+	acmeDirectory string
+
+	// Docker daemon for resolving container backends
+	dockerHost string
+
+	// Maximum concurrent health checks
+	maxChecks int
+
+	// Maximum concurrent connections across all services
+	maxConnections int
+
+	// Soft limits on the process's RSS in megabytes and CPU percentage
+	maxRSS int
+	maxCPU int
+
+	// Hooks run when the process becomes ready or not ready
+	readyHook    string
+	readyHookURL string
+
+	// Time to drain connections on shutdown, and where to write the report
+	shutdownTimeout time.Duration
+	shutdownReport  string
+
+	// Format of the access log, and the file it's written to
+	accessLogFormat string
+	accessLogFile   string
+
+	// Go runtime tuning
+	gogc        int
+	memoryLimit int
+	gomaxprocs  int
 )
 
 var buildVersion = "undefined"
@@ -40,10 +120,47 @@ var buildVersion = "undefined"
 func init() {
 	flag.StringVar(&httpAddr, "http", "", "http server address")
 	flag.StringVar(&httpsAddr, "https", "", "https server address")
+	flag.DurationVar(&httpIdleTimeout, "http-idle-timeout", 0, "close idle http client connections after this duration")
+	flag.DurationVar(&httpHeaderTimeout, "http-header-timeout", 0, "time allowed to read http request headers, 0 for the read timeout")
+	flag.IntVar(&httpMaxIdle, "http-max-idle", 0, "maximum idle http client connections, 0 for unlimited")
+	flag.IntVar(&httpMaxRequests, "http-max-requests", 0, "maximum requests per http client connection, 0 for unlimited")
+	flag.BoolVar(&httpAcceptProxy, "http-accept-proxy", false, "require PROXY protocol headers on http and https client connections")
+	flag.BoolVar(&http2Enabled, "http2", false, "serve HTTP/2 to https clients which negotiate it")
+	flag.BoolVar(&h2cEnabled, "h2c", false, "serve cleartext HTTP/2 to http clients, by prior knowledge or h2c upgrade")
 	flag.StringVar(&adminListenAddr, "admin", "127.0.0.1:9090", "admin http server address")
-	flag.StringVar(&defaultConfig, "config", "", "default config file")
-	flag.StringVar(&stateConfig, "state", "", "updated config which reflects the internal state")
+	flag.StringVar(&statsListenAddr, "stats", "", "address of a read-only admin server, serving only the stats and config")
+	flag.StringVar(&adminCert, "admin-cert", "", "certificate file to serve the admin server over https")
+	flag.StringVar(&adminKey, "admin-key", "", "key file for -admin-cert")
+	flag.StringVar(&adminClientCA, "admin-client-ca", "", "PEM file of CAs required to sign admin client certificates, with -admin-cert")
+	flag.StringVar(&adminToken, "admin-token", "", "token required for admin requests, as a bearer token or basic auth password, or env:NAME or file:PATH to read it")
+	flag.StringVar(&adminReadToken, "admin-read-token", "", "token allowing read-only admin requests, or env:NAME or file:PATH to read it")
+	flag.StringVar(&defaultConfig, "config", "", "default config file or store URL")
+	flag.StringVar(&stateConfig, "state", "", "updated config which reflects the internal state, as a file or store URL (consul://, etcd://, s3://)")
+	flag.StringVar(&stateKey, "state-key", "", "key to encrypt the state config at rest, as env:NAME or file:PATH")
 	flag.StringVar(&certDir, "certs", "./", "directory containing SSL Certficates and Keys")
+	flag.DurationVar(&certReload, "cert-reload", 0, "interval to check the certs directory for changes, 0 disables")
+	flag.StringVar(&tlsMinVersion, "tls-min-version", "", "minimum TLS version: 1.0, 1.1, 1.2, or 1.3")
+	flag.StringVar(&tlsCiphers, "tls-ciphers", "", "comma separated TLS 1.0-1.2 cipher suites, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	flag.StringVar(&tlsCurves, "tls-curves", "", "comma separated curve preferences: X25519, P256, P384, P521")
+	flag.StringVar(&tlsALPN, "tls-alpn", "http/1.1", "comma separated ALPN protocols")
+	flag.StringVar(&acmeDir, "acme-dir", "", "directory to cache ACME certificates, enables automatic certificates for virtual hosts")
+	flag.StringVar(&acmeEmail, "acme-email", "", "contact email for the ACME account")
+	flag.StringVar(&acmeDirectory, "acme-directory", "", "ACME directory URL, defaults to Let's Encrypt")
+	flag.StringVar(&dockerHost, "docker", "", "docker daemon address for resolving container backends, e.g. unix:///var/run/docker.sock")
+	flag.IntVar(&maxChecks, "max-checks", 0, "maximum concurrent health checks, 0 for unlimited")
+	flag.IntVar(&maxConnections, "max-connections", 0, "maximum concurrent connections across all services, 0 for unlimited")
+	flag.IntVar(&maxRSS, "max-rss", 0, "soft limit on resident memory in MB, over which new connections are refused, 0 for unlimited")
+	flag.IntVar(&maxCPU, "max-cpu", 0, "soft limit on CPU use as a percentage of one core, over which new connections are refused, 0 for unlimited")
+	flag.IntVar(&gogc, "gogc", 0, "Go GC target percentage, negative to turn the GC off, 0 for the GOGC environment or default")
+	flag.IntVar(&memoryLimit, "memory-limit", 0, "Go runtime soft memory limit in MB, 0 for none")
+	flag.IntVar(&gomaxprocs, "gomaxprocs", 0, "threads running Go code, 0 to follow the container CPU quota")
+	flag.StringVar(&readyHook, "ready-hook", "", "script run with 'ready' or 'not-ready' when shuttle's readiness changes, e.g. for keepalived")
+	flag.StringVar(&readyHookURL, "ready-hook-url", "", "URL which receives a json POST when shuttle's readiness changes")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 0, "time to let open connections finish on SIGINT or SIGTERM before exiting")
+	flag.StringVar(&shutdownReport, "shutdown-report", "", "file to write the json shutdown report to, as well as the log")
+	flag.IntVar(&workers, "workers", 0, "number of worker processes sharing the listeners, under a supervisor which restarts them. 0 serves from a single process")
+	flag.StringVar(&accessLogFormat, "access-log-format", "", "access log format: common, combined, or Apache style directives, e.g. '%h %t \"%r\" %>s %D'. Default is shuttle's key=value format")
+	flag.StringVar(&accessLogFile, "access-log", "", "file to write the access log to with -access-log-format, instead of stderr")
 	flag.BoolVar(&debug, "debug", false, "verbose logging")
 	flag.BoolVar(&version, "v", false, "display version")
 
@@ -63,13 +180,92 @@ func main() {
 		return
 	}
 
+	// the state key is resolved first, so migrate-config can read and write
+	// encrypted configs
+	key, err := resolveSecret(stateKey)
+	if err != nil {
+		log.Fatalf("FATAL: state-key: %s", err)
+	}
+	setConfigKey(key)
+
+	if flag.Arg(0) == "migrate-config" {
+		if flag.NArg() < 2 {
+			log.Fatal("FATAL: usage: shuttle migrate-config src [dst]")
+		}
+		if err := migrateConfig(flag.Arg(1), flag.Arg(2)); err != nil {
+			log.Fatalf("FATAL: %s", err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "replay" {
+		if flag.NArg() < 3 {
+			log.Fatal("FATAL: usage: shuttle replay config access-log|capture-dir [host]")
+		}
+		// the sandbox must not overwrite the state
+		stateConfig = ""
+		if err := replayConfig(flag.Arg(1), flag.Arg(2), flag.Arg(3)); err != nil {
+			log.Fatalf("FATAL: %s", err)
+		}
+		return
+	}
+
 	log.Printf("INFO: Starting shuttle %s", buildVersion)
+
+	checkLimit.SetLimit(maxChecks)
+	connLimit.SetLimit(maxConnections)
+	selfLimit.SetLimits(maxRSS, maxCPU)
+	autoMaxProcs()
+	tuneRuntime(gogc, memoryLimit, gomaxprocs)
+
+	if err := setAccessLog(accessLogFormat, accessLogFile); err != nil {
+		log.Fatalf("FATAL: access-log-format: %s", err)
+	}
+
+	policy, err := parseTLSPolicy(tlsMinVersion, tlsCiphers, tlsCurves, tlsALPN)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err)
+	}
+	serverTLS = policy
+
+	if workers > 0 && !reusePortSupported {
+		log.Fatalf("FATAL: -workers isn't supported on this platform, which can't share listeners with SO_REUSEPORT")
+	}
+	if workers > 0 && os.Getenv(workerEnv) == "" {
+		runSupervisor(workers)
+		return
+	}
+	initWorker()
+
+	// the admin tokens may refer to a secret, rather than show it in the
+	// process arguments
+	if adminToken, err = resolveSecret(adminToken); err != nil {
+		log.Fatalf("FATAL: admin-token: %s", err)
+	}
+	if adminReadToken, err = resolveSecret(adminReadToken); err != nil {
+		log.Fatalf("FATAL: admin-read-token: %s", err)
+	}
+
+	if dockerHost != "" {
+		if err := setDockerHost(dockerHost); err != nil {
+			log.Fatalf("FATAL: %s", err)
+		}
+	}
+
+	if acmeDir != "" {
+		setupACME(acmeDir, acmeEmail, acmeDirectory)
+	}
+
 	loadConfig()
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go startAdminHTTPServer(&wg)
 
+	if statsListenAddr != "" {
+		go serveStatsMirror(http.DefaultServeMux)
+	}
+
 	if httpAddr != "" {
 		wg.Add(1)
 		go startHTTPServer(&wg)
@@ -79,5 +275,7 @@ func main() {
 		wg.Add(1)
 		go startHTTPSServer(&wg)
 	}
+	readyState.Start(readyHook, readyHookURL)
+	go waitForShutdown(shutdownTimeout, shutdownReport)
 	wg.Wait()
 }
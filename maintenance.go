@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+	"github.com/skyfii/shuttle/client"
+	"github.com/skyfii/shuttle/log"
+)
+
+// A service's maintenance response can be customized with its own status,
+// Retry-After header and templated body, and maintenance can be scheduled for
+// a window of time, so a planned outage needs no config change when it
+// starts or ends.
+
+const defaultMaintenanceType = "text/html; charset=utf-8"
+
+type maintenanceResponse struct {
+	cfg  client.MaintenanceConfig
+	body maintenanceTemplate
+}
+
+// Either an html/template, which escapes the request's values for an HTML
+// body, or a text/template for any other content type.
+type maintenanceTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// The values available to the body template.
+type maintenanceData struct {
+	Service   string
+	Host      string
+	Path      string
+	RequestID string
+	Start     *time.Time
+	End       *time.Time
+}
+
+// Return the maintenance response for the config, or nil if it has none. A
+// body that doesn't parse is logged, and the error page served instead.
+func newMaintenanceResponse(service string, cfg *client.MaintenanceConfig) *maintenanceResponse {
+	if cfg == nil {
+		return nil
+	}
+
+	m := &maintenanceResponse{cfg: *cfg}
+	if m.cfg.Status == 0 {
+		m.cfg.Status = http.StatusServiceUnavailable
+	}
+	if m.cfg.ContentType == "" {
+		m.cfg.ContentType = defaultMaintenanceType
+	}
+
+	if cfg.Body != "" {
+		tmpl, err := parseMaintenanceBody(service, cfg.Body, m.cfg.ContentType)
+		if err != nil {
+			log.Errorf("ERROR: Invalid maintenance body for %s: %s", service, err)
+		} else {
+			m.body = tmpl
+		}
+	}
+	return m
+}
+
+// The Host and Path come from the request, so an HTML body must escape them.
+func parseMaintenanceBody(service, body, contentType string) (maintenanceTemplate, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/html", "application/xhtml+xml":
+		return htmltemplate.New(service).Parse(body)
+	}
+	return template.New(service).Parse(body)
+}
+
+// Report if now is within the scheduled window. Without a Start or an End
+// there's no window.
+func (m *maintenanceResponse) scheduled(now time.Time) bool {
+	if m == nil || (m.cfg.Start == nil && m.cfg.End == nil) {
+		return false
+	}
+	if m.cfg.Start != nil && now.Before(*m.cfg.Start) {
+		return false
+	}
+	if m.cfg.End != nil && !now.Before(*m.cfg.End) {
+		return false
+	}
+	return true
+}
+
+// Return the Retry-After seconds, or 0 to send none.
+func (m *maintenanceResponse) retryAfter(now time.Time) int {
+	if m.cfg.RetryAfter > 0 {
+		return m.cfg.RetryAfter
+	}
+	if m.cfg.End != nil && m.scheduled(now) {
+		return int(math.Ceil(m.cfg.End.Sub(now).Seconds()))
+	}
+	return 0
+}
+
+// Respond to a request in maintenance, using the service's error page when no
+// body is configured.
+func (s *Service) serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	m := s.maintenance
+	s.Unlock()
+
+	if m == nil {
+		s.serveUnavailable(w, r)
+		return
+	}
+
+	if secs := m.retryAfter(time.Now()); secs > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+	logRequest(r, m.cfg.Status, backendAttempt{}, nil, 0)
+
+	if m.body == nil {
+		errPage := s.errorPages.Get(m.cfg.Status)
+		if errPage == nil {
+			errPage = s.errorPages.Get(http.StatusServiceUnavailable)
+		}
+		if errPage != nil {
+			for key, val := range errPage.Header() {
+				w.Header()[key] = val
+			}
+		}
+		w.WriteHeader(m.cfg.Status)
+		if errPage != nil {
+			w.Write(s.errorPages.Render(errPage, r, m.cfg.Status))
+		}
+		return
+	}
+
+	data := maintenanceData{
+		Service:   s.Name,
+		Host:      r.Host,
+		Path:      r.URL.Path,
+		RequestID: r.Header.Get(RequestIDHeader),
+		Start:     m.cfg.Start,
+		End:       m.cfg.End,
+	}
+
+	var body bytes.Buffer
+	if err := m.body.Execute(&body, data); err != nil {
+		log.Errorf("ERROR: Unable to render maintenance body for %s: %s", s.Name, err)
+	}
+
+	w.Header().Set("Content-Type", m.cfg.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.WriteHeader(m.cfg.Status)
+	w.Write(body.Bytes())
+}
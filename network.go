@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// A Network opens the TCP listeners services accept their connections on.
+// The default binds sockets, shared with the other workers when running as
+// one. An embedder may set another with Registry.SetNetwork, such as one
+// returning TLS or transparent proxy listeners, and a MemNetwork runs
+// services without binding ports at all. UDP services always use sockets.
+type Network interface {
+	Listen(network, addr string) (net.Listener, error)
+}
+
+// The Network of sockets.
+type socketNetwork struct{}
+
+func (socketNetwork) Listen(network, addr string) (net.Listener, error) {
+	if sctpNetwork(network) {
+		return listenSCTP(network, addr)
+	}
+
+	l, err := listenTCP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// first port given to listeners on port 0 of a MemNetwork
+const memEphemeralPort = 49152
+
+// A MemNetwork connects Dial to its listeners in memory, through net.Pipe.
+type MemNetwork struct {
+	sync.Mutex
+	listeners map[string]*memListener
+	nextPort  int
+}
+
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{
+		listeners: make(map[string]*memListener),
+		nextPort:  memEphemeralPort,
+	}
+}
+
+func (n *MemNetwork) Listen(network, addr string) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	if port == "0" {
+		port = strconv.Itoa(n.nextPort)
+		n.nextPort++
+	}
+	addr = net.JoinHostPort(host, port)
+
+	if _, ok := n.listeners[addr]; ok {
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: memAddr(addr), Err: syscall.EADDRINUSE}
+	}
+
+	l := &memListener{
+		net:    n,
+		addr:   memAddr(addr),
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+// Connect to the listener on addr.
+func (n *MemNetwork) Dial(addr string) (net.Conn, error) {
+	n.Lock()
+	l := n.listeners[addr]
+	port := n.nextPort
+	n.nextPort++
+	n.Unlock()
+
+	if l == nil {
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: memAddr(addr), Err: syscall.ECONNREFUSED}
+	}
+
+	cli, srv := net.Pipe()
+	cliAddr := memAddr(net.JoinHostPort("mem", strconv.Itoa(port)))
+
+	select {
+	case l.conns <- &memConn{Conn: srv, local: l.addr, remote: cliAddr}:
+	case <-l.closed:
+		cli.Close()
+		srv.Close()
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: l.addr, Err: syscall.ECONNREFUSED}
+	}
+	return &memConn{Conn: cli, local: cliAddr, remote: l.addr}, nil
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memListener struct {
+	net    *MemNetwork
+	addr   memAddr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "accept", Net: "mem", Addr: l.addr, Err: net.ErrClosed}
+	}
+}
+
+func (l *memListener) Close() error {
+	err := errors.New("listener already closed")
+	l.once.Do(func() {
+		close(l.closed)
+		err = nil
+		// the listener of a service's virtual backends has no network
+		if l.net == nil {
+			return
+		}
+		l.net.Lock()
+		delete(l.net.listeners, string(l.addr))
+		l.net.Unlock()
+	})
+	return err
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+// One end of an in-memory connection, with the addresses of its listener.
+type memConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+// A pipe can't be half closed, but the proxy only closes the read side once
+// the other side of the connection is finished.
+func (c *memConn) CloseRead() error {
+	return c.Conn.Close()
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+	"github.com/skyfii/shuttle/client"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Defaults for outlier detection
+const (
+	defaultOutlierWindow       = 30 * time.Second
+	defaultOutlierMinRequests  = 10
+	defaultOutlierStdevFactor  = 1.9
+	defaultOutlierMinRate      = 0.1
+	defaultOutlierEjectionTime = 30 * time.Second
+	defaultOutlierMaxEjection  = 50
+)
+
+// outlierDetector tracks the failure rate of each of a service's backends
+// over a sliding window, and ejects a backend for a while when its rate is
+// more than StdevFactor standard deviations above the mean rate of the
+// others. A nil *outlierDetector ejects nothing.
+type outlierDetector struct {
+	sync.Mutex
+	cfg      client.OutlierDetectionConfig
+	service  string
+	ejection time.Duration
+
+	// length of each bucket
+	slot     time.Duration
+	backends map[string]*outlierStats
+}
+
+// The requests to one backend, by its address.
+type outlierStats struct {
+	buckets      [budgetBuckets]budgetBucket
+	ejectedUntil time.Time
+}
+
+// Return the outlier detector for a service, or nil if none is configured.
+func newOutlierDetector(service string, cfg *client.OutlierDetectionConfig) *outlierDetector {
+	if cfg == nil {
+		return nil
+	}
+
+	d := &outlierDetector{
+		cfg:      *cfg,
+		service:  service,
+		ejection: time.Duration(cfg.EjectionTime) * time.Millisecond,
+		backends: make(map[string]*outlierStats),
+	}
+
+	window := time.Duration(cfg.Window) * time.Millisecond
+	if window <= 0 {
+		window = defaultOutlierWindow
+	}
+	d.slot = window / budgetBuckets
+
+	if d.ejection <= 0 {
+		d.ejection = defaultOutlierEjectionTime
+	}
+	if d.cfg.MinRequests <= 0 {
+		d.cfg.MinRequests = defaultOutlierMinRequests
+	}
+	if d.cfg.StdevFactor <= 0 {
+		d.cfg.StdevFactor = defaultOutlierStdevFactor
+	}
+	if d.cfg.MinFailureRate <= 0 {
+		d.cfg.MinFailureRate = defaultOutlierMinRate
+	}
+	if d.cfg.MaxEjectionPercent <= 0 {
+		d.cfg.MaxEjectionPercent = defaultOutlierMaxEjection
+	}
+	return d
+}
+
+// Record the outcome of a request to the backend at addr, one of count
+// backends, and return when the backend is ejected until if the failure
+// makes it an outlier.
+func (d *outlierDetector) Record(addr string, failed bool, count int, now time.Time) (time.Time, bool) {
+	if d == nil {
+		return time.Time{}, false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	st := d.backends[addr]
+	if st == nil {
+		st = &outlierStats{}
+		d.backends[addr] = st
+	}
+
+	start := now.Truncate(d.slot)
+	bucket := &st.buckets[(start.UnixNano()/int64(d.slot))%budgetBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = budgetBucket{start: start}
+	}
+	bucket.total++
+	if !failed {
+		return time.Time{}, false
+	}
+	bucket.errors++
+
+	if now.Before(st.ejectedUntil) {
+		return time.Time{}, false
+	}
+
+	rate, ok := d.rate(st, now)
+	if !ok || rate < d.cfg.MinFailureRate {
+		return time.Time{}, false
+	}
+
+	// compare with the other backends which have had enough requests
+	var others []float64
+	ejected := 0
+	for other, ost := range d.backends {
+		if now.Before(ost.ejectedUntil) {
+			ejected++
+		}
+		if other == addr {
+			continue
+		}
+		if r, ok := d.rate(ost, now); ok {
+			others = append(others, r)
+		}
+	}
+	if len(others) == 0 {
+		return time.Time{}, false
+	}
+
+	if ejected > 0 && ejected >= count*d.cfg.MaxEjectionPercent/100 {
+		return time.Time{}, false
+	}
+
+	mean, stdev := meanStdev(others)
+	if rate <= mean+d.cfg.StdevFactor*stdev {
+		return time.Time{}, false
+	}
+
+	log.Warnf("WARN: Ejecting backend %s of %s for %s, with a failure rate of %.3f against %.3f for the others",
+		addr, d.service, d.ejection, rate, mean)
+
+	// the backend starts again with a clean window
+	st.buckets = [budgetBuckets]budgetBucket{}
+	st.ejectedUntil = now.Add(d.ejection)
+	return st.ejectedUntil, true
+}
+
+// Forget the requests to a backend which was removed.
+func (d *outlierDetector) Forget(addr string) {
+	if d == nil {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	delete(d.backends, addr)
+}
+
+// The failure rate of a backend over the window, if it had enough requests.
+// outlierDetector *must* be locked.
+func (d *outlierDetector) rate(st *outlierStats, now time.Time) (float64, bool) {
+	var total, errors int64
+	oldest := now.Truncate(d.slot).Add(-d.slot * (budgetBuckets - 1))
+	for _, bucket := range st.buckets {
+		if !bucket.start.Before(oldest) {
+			total += bucket.total
+			errors += bucket.errors
+		}
+	}
+
+	if total == 0 || total < int64(d.cfg.MinRequests) {
+		return 0, false
+	}
+	return float64(errors) / float64(total), true
+}
+
+func meanStdev(vals []float64) (mean, stdev float64) {
+	for _, v := range vals {
+		mean += v
+	}
+	mean /= float64(len(vals))
+
+	for _, v := range vals {
+		stdev += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(stdev / float64(len(vals)))
+}
+
+// Record the outcome of a request for the service's outlier detection, and
+// eject the backend if it's become an outlier.
+func (s *Service) recordOutlier(addr string, failed bool) {
+	s.Lock()
+	detector := s.outliers
+	count := len(s.Backends)
+	s.Unlock()
+
+	until, eject := detector.Record(addr, failed, count, time.Now())
+	if !eject {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for _, b := range s.Backends {
+		if b.Addr == addr {
+			b.eject(until)
+		}
+	}
+}
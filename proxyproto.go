@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol support, so a client's original address survives a load
+// balancer in front of shuttle, and can be passed on to the backends.
+// See https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+
+const (
+	ProxyV1 = "v1"
+	ProxyV2 = "v2"
+
+	// time allowed for a client to send the PROXY header
+	proxyHeaderTimeout = 5 * time.Second
+
+	// longest possible v1 header, including the CRLF
+	proxyV1MaxLen = 107
+)
+
+var (
+	proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+// A client conn which reads a PROXY protocol header before any data, and
+// reports the addresses from the header. The header is read on the first
+// call to Read, RemoteAddr, or LocalAddr, so a slow client doesn't block the
+// Accept loop.
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once     sync.Once
+	err      error
+	src, dst net.Addr
+}
+
+func newProxyConn(conn net.Conn) *proxyConn {
+	return &proxyConn{
+		Conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+}
+
+// Read the PROXY header from conn, and return a conn that must be used in
+// its place.
+func readProxyHeader(conn net.Conn) (*proxyConn, error) {
+	c := newProxyConn(conn)
+	c.init()
+	return c, c.err
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.err = c.readHeader()
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.init()
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyConn) CloseRead() error {
+	return c.Conn.(closeReader).CloseRead()
+}
+
+func (c *proxyConn) readHeader() error {
+	sig, err := c.r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(sig, proxyV2Sig) {
+		return c.readV2()
+	}
+	return c.readV1()
+}
+
+// Read the text header, "PROXY TCP4 src dst sport dport\r\n".
+func (c *proxyConn) readV1() error {
+	line := make([]byte, 0, proxyV1MaxLen)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1MaxLen {
+			return errProxyHeader
+		}
+
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return errProxyHeader
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		// keep the connection's own addresses
+		return nil
+	case "TCP4", "TCP6":
+	default:
+		return errProxyHeader
+	}
+
+	if len(fields) != 6 {
+		return errProxyHeader
+	}
+
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+
+	c.src, c.dst = src, dst
+	return nil
+}
+
+func parseProxyAddr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil {
+		return nil, errProxyHeader
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+// Read the binary header. Only TCP addresses are used; any other family, or
+// a LOCAL command, keeps the connection's own addresses.
+func (c *proxyConn) readV2() error {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, hdr); err != nil {
+		return err
+	}
+
+	verCmd, family := hdr[12], hdr[13]
+	if verCmd>>4 != 2 {
+		return errProxyHeader
+	}
+
+	addrs := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(c.r, addrs); err != nil {
+		return err
+	}
+
+	if verCmd&0xf == 0 {
+		// LOCAL, e.g. a health check from the load balancer itself
+		return nil
+	}
+
+	ipLen := 0
+	switch family {
+	case 0x11:
+		ipLen = net.IPv4len
+	case 0x21:
+		ipLen = net.IPv6len
+	default:
+		return nil
+	}
+
+	if len(addrs) < 2*ipLen+4 {
+		return errProxyHeader
+	}
+
+	c.src = &net.TCPAddr{
+		IP:   net.IP(addrs[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(addrs[2*ipLen:])),
+	}
+	c.dst = &net.TCPAddr{
+		IP:   net.IP(addrs[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(addrs[2*ipLen+2:])),
+	}
+	return nil
+}
+
+// A listener that reads a PROXY header from every connection.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newProxyConn(conn), nil
+}
+
+// Build a PROXY header for a connection from src to dst.
+func proxyHeader(version string, src, dst net.Addr) ([]byte, error) {
+	srcAddr, srcOK := src.(*net.TCPAddr)
+	dstAddr, dstOK := dst.(*net.TCPAddr)
+	tcp := srcOK && dstOK
+	ipv4 := tcp && srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil
+
+	switch version {
+	case ProxyV1:
+		switch {
+		case ipv4:
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcAddr.IP, dstAddr.IP, srcAddr.Port, dstAddr.Port)), nil
+		case tcp && srcAddr.IP.To4() == nil && dstAddr.IP.To4() == nil:
+			return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", srcAddr.IP, dstAddr.IP, srcAddr.Port, dstAddr.Port)), nil
+		}
+		return []byte("PROXY UNKNOWN\r\n"), nil
+
+	case ProxyV2:
+		buf := bytes.NewBuffer(append([]byte{}, proxyV2Sig...))
+		switch {
+		case ipv4:
+			buf.Write([]byte{0x21, 0x11, 0, 12})
+			buf.Write(srcAddr.IP.To4())
+			buf.Write(dstAddr.IP.To4())
+		case tcp:
+			buf.Write([]byte{0x21, 0x21, 0, 36})
+			buf.Write(srcAddr.IP.To16())
+			buf.Write(dstAddr.IP.To16())
+		default:
+			// LOCAL, with no addresses
+			buf.Write([]byte{0x20, 0x00, 0, 0})
+			return buf.Bytes(), nil
+		}
+		binary.Write(buf, binary.BigEndian, uint16(srcAddr.Port))
+		binary.Write(buf, binary.BigEndian, uint16(dstAddr.Port))
+		return buf.Bytes(), nil
+	}
+
+	return nil, fmt.Errorf("unknown PROXY protocol version '%s'", version)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how often idle buckets are removed
+const rateSweepInterval = time.Minute
+
+// A token bucket rate limiter for each client IP. A nil *rateLimiter allows
+// everything.
+type rateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Return a limiter allowing rate events per second from each client IP, with
+// bursts of up to burst events. A burst of 0 allows one second's worth of
+// events. Returns nil if rate is 0.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	b := float64(burst)
+	if burst <= 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+
+	return &rateLimiter{
+		rate:      rate,
+		burst:     b,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow reports whether another event from the client at addr is allowed,
+// and takes a token from its bucket if it is.
+func (l *rateLimiter) Allow(addr string) bool {
+	return l.AllowN(addr, 1)
+}
+
+// AllowN is Allow for an event costing n tokens, such as a datagram of n
+// bytes.
+func (l *rateLimiter) AllowN(addr string, n float64) bool {
+	if l == nil {
+		return true
+	}
+
+	ip := addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		ip = host
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > rateSweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Remove the buckets which have refilled, since they're the same as a new
+// bucket. Limiter *must* be locked.
+func (l *rateLimiter) sweep(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for ip, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, ip)
+		}
+	}
+	l.lastSweep = now
+}
+
+// connLimiter caps the number of concurrent connections. A limit of 0 is
+// unlimited.
+type connLimiter struct {
+	limit  int64
+	active int64
+}
+
+// All services share a single limit, on top of their own.
+var connLimit = &connLimiter{}
+
+// Set the limit, where n <= 0 is unlimited. Connections over a lowered limit
+// are left to finish.
+func (l *connLimiter) SetLimit(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt64(&l.limit, int64(n))
+}
+
+// Take a slot for a new connection, returning false if the limit is reached.
+func (l *connLimiter) acquire() bool {
+	active := atomic.AddInt64(&l.active, 1)
+	limit := atomic.LoadInt64(&l.limit)
+	if limit > 0 && active > limit {
+		atomic.AddInt64(&l.active, -1)
+		return false
+	}
+	return true
+}
+
+func (l *connLimiter) release() {
+	atomic.AddInt64(&l.active, -1)
+}
+
+// Return the active connections as a percentage of the limit, or 0 when
+// unlimited.
+func (l *connLimiter) load() int {
+	limit := atomic.LoadInt64(&l.limit)
+	if limit <= 0 {
+		return 0
+	}
+	return int(atomic.LoadInt64(&l.active) * 100 / limit)
+}
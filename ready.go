@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Readiness of the whole process, for an active-standby pair sharing a
+// floating IP. Shuttle is ready once it's serving its config, while every
+// service with backends has one available, and it's not over its soft limits
+// or shutting down. Each change runs the -ready-hook script and posts to the
+// -ready-hook-url, so keepalived or another VRRP manager can move the IP to
+// a healthy instance. Only the first worker runs the hooks.
+
+const readyInterval = time.Second
+
+// The json readiness state, returned by /_ready and posted to the hook URL.
+type ReadyStat struct {
+	Ready  bool      `json:"ready"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+type readiness struct {
+	sync.Mutex
+	started  bool
+	stopping bool
+
+	// the last state checked, and if it's been reported
+	ready    bool
+	reason   string
+	since    time.Time
+	reported bool
+
+	script string
+	url    string
+	client *http.Client
+
+	start sync.Once
+}
+
+var readyState = &readiness{
+	reason: "starting",
+	since:  time.Now(),
+	client: &http.Client{Timeout: 5 * time.Second},
+}
+
+// Set the hooks run on each change, and start checking readiness once the
+// config is being served.
+func (r *readiness) Start(script, url string) {
+	r.Lock()
+	r.script = script
+	r.url = url
+	r.started = true
+	r.Unlock()
+
+	r.start.Do(func() {
+		go func() {
+			for {
+				r.update()
+				time.Sleep(readyInterval)
+			}
+		}()
+	})
+}
+
+// Mark the process not ready to shut down, running the hooks before the
+// listeners close so the floating IP can move first.
+func (r *readiness) Stop() {
+	r.Lock()
+	r.stopping = true
+	r.Unlock()
+	r.update()
+}
+
+// Return the reason the process isn't ready, or "" if it is.
+func (r *readiness) check() string {
+	r.Lock()
+	started, stopping := r.started, r.stopping
+	r.Unlock()
+
+	switch {
+	case stopping:
+		return "shutting down"
+	case !started:
+		return "starting"
+	case selfLimit.Shedding():
+		return "over process limits"
+	}
+
+	var down []string
+	Registry.Lock()
+	for _, svc := range Registry.svcs {
+		svc.Lock()
+		backends := len(svc.Backends)
+		svc.Unlock()
+
+		if backends > 0 && svc.Available() == 0 {
+			down = append(down, svc.Name)
+		}
+	}
+	Registry.Unlock()
+
+	if len(down) > 0 {
+		sort.Strings(down)
+		return "no backends available for " + strings.Join(down, ", ")
+	}
+	return ""
+}
+
+// Check the readiness, and run the hooks if it changed.
+func (r *readiness) update() {
+	reason := r.check()
+	ready := reason == ""
+
+	r.Lock()
+	if r.reported && ready == r.ready {
+		r.reason = reason
+		r.Unlock()
+		return
+	}
+	r.ready = ready
+	r.reason = reason
+	r.since = time.Now()
+	r.reported = true
+	stat := ReadyStat{Ready: r.ready, Reason: r.reason, Since: r.since}
+	script, url := r.script, r.url
+	r.Unlock()
+
+	if ready {
+		log.Println("INFO: Shuttle is ready")
+	} else {
+		log.Warnf("WARN: Shuttle is not ready: %s", reason)
+	}
+
+	// the workers share one readiness, reported by the first
+	if workerID > 1 {
+		return
+	}
+	if script != "" {
+		runReadyScript(script, stat)
+	}
+	if url != "" {
+		r.post(url, stat)
+	}
+}
+
+func (r *readiness) Stats() ReadyStat {
+	r.Lock()
+	defer r.Unlock()
+	return ReadyStat{Ready: r.ready, Reason: r.reason, Since: r.since}
+}
+
+// Run the hook script with "ready" or "not-ready" as its argument, and the
+// reason in SHUTTLE_READY_REASON.
+func runReadyScript(script string, stat ReadyStat) {
+	state := "ready"
+	if !stat.Ready {
+		state = "not-ready"
+	}
+
+	cmd := exec.Command(script, state)
+	cmd.Env = append(os.Environ(), "SHUTTLE_READY_REASON="+stat.Reason)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Warnf("WARN: Ready hook %s %s failed: %s: %s", script, state, err, bytes.TrimSpace(out))
+	}
+}
+
+func (r *readiness) post(url string, stat ReadyStat) {
+	js, _ := json.Marshal(stat)
+	resp, err := r.client.Post(url, "application/json", bytes.NewReader(js))
+	if err != nil {
+		log.Warnf("WARN: Ready hook to %s failed: %s", url, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Warnf("WARN: Ready hook to %s returned %d", url, resp.StatusCode)
+	}
+}
+
+// Return the readiness, with a 503 when not ready, for health checks.
+func getReady(w http.ResponseWriter, r *http.Request) {
+	stat := readyState.Stats()
+	if !stat.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(marshal(stat))
+}
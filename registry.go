@@ -2,19 +2,22 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"reflect"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 	"github.com/skyfii/shuttle/client"
 	"github.com/skyfii/shuttle/log"
 )
 
 var (
-	ErrNoService        = fmt.Errorf("service does not exist")
-	ErrNoBackend        = fmt.Errorf("backend does not exist")
-	ErrDuplicateService = fmt.Errorf("service already exists")
-	ErrDuplicateBackend = fmt.Errorf("backend already exists")
+	ErrNoService         = fmt.Errorf("service does not exist")
+	ErrNoBackend         = fmt.Errorf("backend does not exist")
+	ErrDuplicateService  = fmt.Errorf("service already exists")
+	ErrDuplicateBackend  = fmt.Errorf("backend already exists")
+	ErrInvalidAdminState = fmt.Errorf("invalid admin state")
 )
 
 type multiError struct {
@@ -104,8 +107,10 @@ func (v *VirtualHost) Remove(svc *Service) {
 	v.services = append(v.services[:found], v.services[found+1:]...)
 }
 
-// Return a *Service for this VirtualHost
-func (v *VirtualHost) Service() *Service {
+// Return a *Service for this VirtualHost, for a request with these headers.
+// Services whose header routes match take the request ahead of those without
+// routes. A nil header only matches services without routes.
+func (v *VirtualHost) Service(header http.Header) *Service {
 	v.Lock()
 	defer v.Unlock()
 
@@ -114,12 +119,31 @@ func (v *VirtualHost) Service() *Service {
 		return nil
 	}
 
-	// start cycling through the services in case one has no backends available
-	for i := 1; i <= len(v.services); i++ {
-		idx := (v.last + i) % len(v.services)
-		if v.services[idx].Available() > 0 {
-			v.last = idx
-			return v.services[idx]
+	for _, routed := range []bool{true, false} {
+		var matched *Service
+
+		// start cycling through the services in case one has no backends available
+		for i := 1; i <= len(v.services); i++ {
+			idx := (v.last + i) % len(v.services)
+			svc := v.services[idx]
+
+			match, hasRoutes := svc.matchRoutes(header)
+			if !match || hasRoutes != routed {
+				continue
+			}
+
+			if svc.Available() > 0 {
+				v.last = idx
+				return svc
+			}
+			if matched == nil {
+				matched = svc
+			}
+		}
+
+		// the routed service handles the request, even without a backend
+		if matched != nil && routed {
+			return matched
 		}
 	}
 
@@ -128,7 +152,7 @@ func (v *VirtualHost) Service() *Service {
 	return v.services[v.last]
 }
 
-//TODO: notify or prevent vhost name conflicts between services.
+// TODO: notify or prevent vhost name conflicts between services.
 // ServiceRegistry is a global container for all configured services.
 type ServiceRegistry struct {
 	sync.Mutex
@@ -138,14 +162,275 @@ type ServiceRegistry struct {
 
 	// Global config to apply to new services.
 	cfg client.Config
+
+	// the last consistent stats snapshot
+	snapshot statsSnapshot
+
+	// recent snapshots for the stats deltas
+	history statsHistory
+
+	// opens the listeners of new services, when not the default sockets
+	network Network
+}
+
+// Set the Network the listeners of services added from now on are opened
+// with, or nil for the default of sockets.
+func (s *ServiceRegistry) SetNetwork(n Network) {
+	s.Lock()
+	defer s.Unlock()
+	s.network = n
 }
 
 // Update the global config state, including services and backends.
 // This does not remove any Services, but will add or update any provided in
 // the config.
+// ApplyReport lists which services of a config were applied, and why the
+// others were rejected.
+type ApplyReport struct {
+	Applied  []string          `json:"applied"`
+	Rejected map[string]string `json:"rejected,omitempty"`
+}
+
+func (r *ApplyReport) reject(name string, err error) {
+	if r.Rejected == nil {
+		r.Rejected = make(map[string]string)
+	}
+	r.Rejected[name] = err.Error()
+}
+
+// Apply a config, adding new services and updating existing ones. Services
+// which fail are skipped, and the rest applied.
 func (s *ServiceRegistry) UpdateConfig(cfg client.Config) error {
+	_, err := s.ApplyConfig(cfg, false, false)
+	return err
+}
+
+// ApplyConfig applies a config like UpdateConfig, and reports which services
+// were applied. In atomic mode every service is validated first, and nothing
+// is applied if any is rejected. A service which still fails to start rolls
+// back the services applied before it, and the globals. With migrate, a
+// backend moved from one service to another keeps its health state and
+// counters.
+func (s *ServiceRegistry) ApplyConfig(cfg client.Config, atomic, migrate bool) (ApplyReport, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	report := ApplyReport{Applied: []string{}}
+	errors := &multiError{}
+
+	profiles := s.cfg.Profiles
+	if cfg.Profiles != nil {
+		profiles = cfg.Profiles
+	}
+
+	// the complete config each service is applied with
+	resolved := make([]client.ServiceConfig, len(cfg.Services))
+	for i, svc := range cfg.Services {
+		full, err := s.resolveService(svc, profiles)
+		if err == nil {
+			err = s.validateService(full)
+		}
+		if err != nil {
+			log.Errorf("ERROR: Invalid service %s - %s", svc.Name, err)
+			report.reject(svc.Name, err)
+			errors.Add(err)
+		}
+		resolved[i] = full
+	}
+
+	if atomic && errors.Len() > 0 {
+		return report, errors
+	}
+
+	// the globals to restore if the services are rolled back
+	oldGlobals := s.cfg
+	oldProfiles := s.cfg.Profiles
+	s.updateGlobals(cfg)
+
+	var moving map[string]movingBackend
+	var before map[*Backend]bool
+	if migrate {
+		moving, before = s.movingBackends(cfg)
+	}
+
+	// the services as they were before being applied, or nil if added
+	var previous []*client.ServiceConfig
+
+	for _, svc := range resolved {
+		if _, ok := report.Rejected[svc.Name]; ok {
+			continue
+		}
+
+		var prev *client.ServiceConfig
+		var err error
+
+		// Add a new service, or update an existing one.
+		if service, ok := s.svcs[svc.Name]; !ok {
+			if err = s.addService(svc); err != nil {
+				log.Errorf("ERROR: Unable to add service %s - %s", svc.Name, err.Error())
+			}
+		} else {
+			current := service.Config()
+			prev = &current
+			if err = s.updateService(service, svc); err != nil {
+				log.Errorf("ERROR: Unable to update service %s - %s", svc.Name, err.Error())
+			}
+		}
 
-	// Set globals
+		if err != nil {
+			report.reject(svc.Name, err)
+			errors.Add(err)
+			if atomic {
+				s.rollback(report.Applied, previous)
+				s.cfg = oldGlobals
+				report.Applied = []string{}
+				return report, errors
+			}
+			continue
+		}
+
+		report.Applied = append(report.Applied, svc.Name)
+		previous = append(previous, prev)
+	}
+
+	s.applyGlobals(cfg)
+
+	if len(moving) > 0 {
+		s.handOff(cfg, moving, before)
+	}
+
+	// services left out of the config still follow changes to their profile
+	s.updateProfiles(cfg, oldProfiles, &report, errors)
+
+	go writeStateConfig()
+
+	if errors.Len() == 0 {
+		return report, nil
+	}
+	return report, errors
+}
+
+// Return the complete config a service is applied with: merged with its
+// current config if it's running, and with its unset values inherited from
+// its profile. A running service whose profile has changed first takes the
+// new values of the profile.
+// ServiceRegistry *must* be locked.
+func (s *ServiceRegistry) resolveService(svcCfg client.ServiceConfig, profiles map[string]client.ServiceConfig) (client.ServiceConfig, error) {
+	if service, ok := s.svcs[svcCfg.Name]; ok {
+		current := service.Config()
+		if profileChanged(current.Profile, s.cfg.Profiles, profiles) {
+			current = s.reprofile(current, s.cfg.Profiles[current.Profile], profiles[current.Profile])
+		}
+		svcCfg = current.Merge(svcCfg)
+	}
+
+	if svcCfg.Profile == "" {
+		return svcCfg, nil
+	}
+	profile, ok := profiles[svcCfg.Profile]
+	if !ok {
+		return svcCfg, fmt.Errorf("unknown profile %s", svcCfg.Profile)
+	}
+	return svcCfg.Inherit(profile), nil
+}
+
+// Report if a profile differs between the old and new profiles, ignoring
+// those added or removed.
+func profileChanged(name string, old, profiles map[string]client.ServiceConfig) bool {
+	prev, ok := old[name]
+	profile, found := profiles[name]
+	return name != "" && ok && found && !reflect.DeepEqual(prev, profile)
+}
+
+// Return a running service's config, with the values it inherited from the
+// old version of its profile replaced by those of the new one.
+// ServiceRegistry *must* be locked.
+func (s *ServiceRegistry) reprofile(svcCfg, old, profile client.ServiceConfig) client.ServiceConfig {
+	// compare with the old profile as it was applied, with the defaults
+	s.setServiceDefaults(&old)
+	old = old.SetDefaults()
+
+	svcCfg = svcCfg.Reprofile(old, profile)
+	s.setServiceDefaults(&svcCfg)
+	return svcCfg.SetDefaults()
+}
+
+// Update the running services which weren't in the config, but whose profile
+// it changed, adding them to the report.
+// ServiceRegistry *must* be locked.
+func (s *ServiceRegistry) updateProfiles(cfg client.Config, old map[string]client.ServiceConfig, report *ApplyReport, errors *multiError) {
+	applied := make(map[string]bool)
+	for _, svc := range cfg.Services {
+		applied[svc.Name] = true
+	}
+
+	for name, service := range s.svcs {
+		current := service.Config()
+		if applied[name] || !profileChanged(current.Profile, old, s.cfg.Profiles) {
+			continue
+		}
+
+		log.Printf("INFO: Updating service %s from profile %s", name, current.Profile)
+		newCfg := s.reprofile(current, old[current.Profile], s.cfg.Profiles[current.Profile])
+		if err := s.updateService(service, newCfg); err != nil {
+			log.Errorf("ERROR: Unable to update service %s - %s", name, err)
+			report.reject(name, err)
+			errors.Add(err)
+			continue
+		}
+		report.Applied = append(report.Applied, name)
+	}
+}
+
+// Check a complete service config can be applied.
+// ServiceRegistry *must* be locked.
+func (s *ServiceRegistry) validateService(svcCfg client.ServiceConfig) error {
+	if err := checkServiceName(svcCfg.Name); err != nil {
+		return err
+	}
+
+	invalidPorts := []string{
+		// FIXME: lookup bound addresses some other way.  We may have multiple
+		//        http listeners, as well as all listening Services.
+		// listenAddr[strings.Index(listenAddr, ":")+1:],
+		adminListenAddr[strings.Index(adminListenAddr, ":")+1:],
+	}
+
+	for _, port := range invalidPorts {
+		if strings.HasSuffix(svcCfg.Addr, port) {
+			// TODO: report conflicts between service listeners
+			return fmt.Errorf("Port conflict: %s port %s already bound by shuttle", svcCfg.Name, port)
+		}
+	}
+
+	if service, ok := s.svcs[svcCfg.Name]; ok {
+		return service.checkUpdate(svcCfg)
+	}
+	return nil
+}
+
+// Return the services applied so far to their previous configs, removing
+// those which were added.
+// ServiceRegistry *must* be locked.
+func (s *ServiceRegistry) rollback(applied []string, previous []*client.ServiceConfig) {
+	for i := len(applied) - 1; i >= 0; i-- {
+		name := applied[i]
+		log.Warnf("WARN: Rolling back service %s", name)
+
+		if previous[i] == nil {
+			s.removeService(name)
+			continue
+		}
+
+		if err := s.updateService(s.svcs[name], *previous[i]); err != nil {
+			log.Errorf("ERROR: Unable to roll back service %s - %s", name, err)
+		}
+	}
+}
+
+// Set the global defaults from a config.
+// ServiceRegistry *must* be locked.
+func (s *ServiceRegistry) updateGlobals(cfg client.Config) {
 	// TODO: we might need to unset something
 	// TODO: this should remove services and backends to match the submitted config
 
@@ -170,50 +455,83 @@ func (s *ServiceRegistry) UpdateConfig(cfg client.Config) error {
 	if cfg.DialTimeout != 0 {
 		s.cfg.DialTimeout = cfg.DialTimeout
 	}
+	if cfg.MaxChecks != 0 {
+		s.cfg.MaxChecks = cfg.MaxChecks
+	}
+	if cfg.MaxConnections != 0 {
+		s.cfg.MaxConnections = cfg.MaxConnections
+	}
+	if cfg.MaxRSS != 0 {
+		s.cfg.MaxRSS = cfg.MaxRSS
+	}
+	if cfg.MaxCPU != 0 {
+		s.cfg.MaxCPU = cfg.MaxCPU
+	}
+	if cfg.GOGC != 0 {
+		s.cfg.GOGC = cfg.GOGC
+	}
+	if cfg.MemoryLimit != 0 {
+		s.cfg.MemoryLimit = cfg.MemoryLimit
+	}
+	if cfg.GOMAXPROCS != 0 {
+		s.cfg.GOMAXPROCS = cfg.GOMAXPROCS
+	}
+	if cfg.HealthWebhook != "" {
+		s.cfg.HealthWebhook = cfg.HealthWebhook
+	}
+	if cfg.HealthWebhooks != nil {
+		s.cfg.HealthWebhooks = cfg.HealthWebhooks
+	}
+	if cfg.TrustedProxies != nil {
+		s.cfg.TrustedProxies = cfg.TrustedProxies
+	}
+	if cfg.IdleServiceTTL != 0 {
+		s.cfg.IdleServiceTTL = cfg.IdleServiceTTL
+		s.cfg.ReapIdleServices = cfg.ReapIdleServices
+	}
+	if cfg.Profiles != nil {
+		s.cfg.Profiles = cfg.Profiles
+	}
 
 	// apply the https rediect flag
 	if httpsRedirect {
 		s.cfg.HTTPSRedirect = true
 	}
+}
 
-	invalidPorts := []string{
-		// FIXME: lookup bound addresses some other way.  We may have multiple
-		//        http listeners, as well as all listening Services.
-		// listenAddr[strings.Index(listenAddr, ":")+1:],
-		adminListenAddr[strings.Index(adminListenAddr, ":")+1:],
+// Apply the process wide settings from a config, once its services have been
+// applied, since they can't be rolled back.
+// ServiceRegistry *must* be locked.
+func (s *ServiceRegistry) applyGlobals(cfg client.Config) {
+	if cfg.MaxChecks != 0 {
+		checkLimit.SetLimit(cfg.MaxChecks)
 	}
-
-	errors := &multiError{}
-
-	for _, svc := range cfg.Services {
-		for _, port := range invalidPorts {
-			if strings.HasSuffix(svc.Addr, port) {
-				// TODO: report conflicts between service listeners
-				errors.Add(fmt.Errorf("Port conflict: %s port %s already bound by shuttle", svc.Name, port))
-				continue
-			}
-		}
-
-		// Add a new service, or update an existing one.
-		if Registry.GetService(svc.Name) == nil {
-			if err := Registry.AddService(svc); err != nil {
-				log.Errorf("ERROR: Unable to add service %s - %s", svc.Name, err.Error())
-				errors.Add(err)
-				continue
-			}
-		} else if err := Registry.UpdateService(svc); err != nil {
-			log.Errorf("ERROR: Unable to update service %s - %s", svc.Name, err.Error())
-			errors.Add(err)
-			continue
+	if cfg.MaxConnections != 0 {
+		connLimit.SetLimit(cfg.MaxConnections)
+	}
+	if cfg.MaxRSS != 0 || cfg.MaxCPU != 0 {
+		selfLimit.SetLimits(s.cfg.MaxRSS, s.cfg.MaxCPU)
+	}
+	if cfg.GOGC != 0 || cfg.MemoryLimit != 0 || cfg.GOMAXPROCS != 0 {
+		tuneRuntime(cfg.GOGC, cfg.MemoryLimit, cfg.GOMAXPROCS)
+	}
+	if cfg.HealthWebhook != "" {
+		// the URL may hold credentials
+		url, err := resolveSecret(cfg.HealthWebhook)
+		if err != nil {
+			log.Errorf("ERROR: Unable to resolve health_webhook: %s", err)
 		}
+		healthWebhook.SetURL(url)
 	}
-
-	go writeStateConfig()
-
-	if errors.Len() == 0 {
-		return nil
+	if cfg.HealthWebhooks != nil {
+		healthWebhook.SetTargets(cfg.HealthWebhooks)
+	}
+	if cfg.TrustedProxies != nil {
+		trustedProxies.Set(cfg.TrustedProxies)
+	}
+	if cfg.IdleServiceTTL != 0 {
+		idleServices.Set(time.Duration(cfg.IdleServiceTTL)*time.Millisecond, cfg.ReapIdleServices)
 	}
-	return errors
 }
 
 // Return a service by name.
@@ -225,11 +543,17 @@ func (s *ServiceRegistry) GetService(name string) *Service {
 
 // Return a service that handles a particular vhost by name.
 func (s *ServiceRegistry) GetVHostService(name string) *Service {
+	return s.RouteVHost(name, nil)
+}
+
+// Return the service for a request to a vhost, using the request headers to
+// choose between services with header routes.
+func (s *ServiceRegistry) RouteVHost(name string, header http.Header) *Service {
 	s.Lock()
 	defer s.Unlock()
 
 	if vhost := s.vhosts[name]; vhost != nil {
-		return vhost.Service()
+		return vhost.Service(header)
 	}
 	return nil
 }
@@ -252,10 +576,59 @@ func (s *ServiceRegistry) AddService(svcCfg client.ServiceConfig) error {
 		return ErrDuplicateService
 	}
 
+	svcCfg, err := s.resolveService(svcCfg, s.cfg.Profiles)
+	if err != nil {
+		return err
+	}
+	return s.addService(svcCfg)
+}
+
+// ReplaceService adds a service like AddService, but if a service with the
+// same name and address exists, it's replaced in place with the new config.
+// Unlike UpdateService the config isn't merged with the current one, and
+// unlike removing and adding the service, the listener stays open.
+// A service with the same name on another address is still a duplicate.
+func (s *ServiceRegistry) ReplaceService(svcCfg client.ServiceConfig) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if profile, ok := s.cfg.Profiles[svcCfg.Profile]; ok {
+		svcCfg = svcCfg.Inherit(profile)
+	} else if svcCfg.Profile != "" {
+		return fmt.Errorf("unknown profile %s", svcCfg.Profile)
+	}
+
+	s.setServiceDefaults(&svcCfg)
+	svcCfg = svcCfg.SetDefaults()
+
+	service, ok := s.svcs[svcCfg.Name]
+	if !ok {
+		return s.addService(svcCfg)
+	}
+
+	if service.Addr != svcCfg.Addr {
+		log.Debug("DEBUG: Service already exists on another address:", svcCfg.Name)
+		return ErrDuplicateService
+	}
+
+	log.Printf("INFO: Replacing service %s", svcCfg.Name)
+	return s.updateService(service, svcCfg)
+}
+
+// Start a new service and register its vhosts.
+// ServiceRegistry *must* be locked.
+func (s *ServiceRegistry) addService(svcCfg client.ServiceConfig) error {
+	if err := checkServiceName(svcCfg.Name); err != nil {
+		return err
+	}
+
 	s.setServiceDefaults(&svcCfg)
 	svcCfg = svcCfg.SetDefaults()
 
 	service := NewService(svcCfg)
+	if s.network != nil {
+		service.network = s.network
+	}
 	err := service.start()
 	if err != nil {
 		log.Errorf("ERROR: Unable to start service '%s'", svcCfg.Name)
@@ -292,8 +665,17 @@ func (s *ServiceRegistry) UpdateService(newCfg client.ServiceConfig) error {
 		return ErrNoService
 	}
 
+	newCfg, err := s.resolveService(newCfg, s.cfg.Profiles)
+	if err != nil {
+		return err
+	}
+	return s.updateService(service, newCfg)
+}
+
+// Apply a complete config to a running service.
+// ServiceRegistry *must* be locked.
+func (s *ServiceRegistry) updateService(service *Service, newCfg client.ServiceConfig) error {
 	currentCfg := service.Config()
-	newCfg = currentCfg.Merge(newCfg)
 
 	if err := service.UpdateConfig(newCfg); err != nil {
 		return err
@@ -353,7 +735,7 @@ func (s *ServiceRegistry) UpdateService(newCfg client.ServiceConfig) error {
 }
 
 // update the VirtualHost entries for this service
-// only to be called from UpdateService.
+// only to be called from updateService.
 func (s *ServiceRegistry) updateVHosts(service *Service, newHosts []string) {
 	// We could just clear the vhosts and the new list since we're doing
 	// this all while the registry is locked, but because we want sane log
@@ -420,7 +802,12 @@ func (s *ServiceRegistry) updateVHosts(service *Service, newHosts []string) {
 func (s *ServiceRegistry) RemoveService(name string) error {
 	s.Lock()
 	defer s.Unlock()
+	return s.removeService(name)
+}
 
+// Stop a service and remove its vhosts.
+// ServiceRegistry *must* be locked.
+func (s *ServiceRegistry) removeService(name string) error {
 	svc, ok := s.svcs[name]
 	if ok {
 		log.Debugf("DEBUG: Removing Service %s", svc.Name)
@@ -524,6 +911,106 @@ func (s *ServiceRegistry) RemoveBackend(svcName, backendName string) error {
 	return nil
 }
 
+// Start the listener for a LazyBind service once a backend is healthy.
+func (s *ServiceRegistry) bindService(svcName string) {
+	s.Lock()
+	defer s.Unlock()
+
+	service, ok := s.svcs[svcName]
+	if !ok {
+		return
+	}
+
+	if err := service.bind(); err != nil {
+		log.Errorf("ERROR: Unable to start service '%s': %s", svcName, err)
+	}
+}
+
+// Set the administrative state for a Backend on an existing Service.
+func (s *ServiceRegistry) SetBackendState(svcName, backendName, state string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	service, ok := s.svcs[svcName]
+	if !ok {
+		return ErrNoService
+	}
+
+	backend := service.get(backendName)
+	if backend == nil {
+		return ErrNoBackend
+	}
+
+	log.Printf("INFO: Setting admin state for backend %s/%s to '%s'", svcName, backendName, state)
+	return backend.SetAdminState(state)
+}
+
+// Set a batch of backends admin down to drain them. Nothing is changed if
+// any of them doesn't exist.
+func (s *ServiceRegistry) DrainBackends(targets []client.DrainTarget) error {
+	s.Lock()
+	defer s.Unlock()
+
+	backends := make([]*Backend, len(targets))
+	for i, t := range targets {
+		service, ok := s.svcs[t.Service]
+		if !ok {
+			return ErrNoService
+		}
+		if backends[i] = service.get(t.Backend); backends[i] == nil {
+			return ErrNoBackend
+		}
+	}
+
+	for i, b := range backends {
+		log.Printf("INFO: Draining backend %s/%s", targets[i].Service, targets[i].Backend)
+		b.SetAdminState(client.AdminDown)
+	}
+	return nil
+}
+
+// Set the fraction of a service's HTTP requests which are traced.
+func (s *ServiceRegistry) SetTraceSample(svcName string, sample float64) error {
+	if sample < 0 || sample > 1 {
+		return fmt.Errorf("trace sample %g is not between 0 and 1", sample)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	service, ok := s.svcs[svcName]
+	if !ok {
+		return ErrNoService
+	}
+
+	log.Printf("INFO: Tracing %g of requests for %s", sample, svcName)
+	service.Lock()
+	service.TraceSample = sample
+	service.Unlock()
+	return nil
+}
+
+// Drain a service, so it takes no new connections or requests.
+func (s *ServiceRegistry) DrainService(svcName string) error {
+	service := s.GetService(svcName)
+	if service == nil {
+		return ErrNoService
+	}
+
+	service.startDrain()
+	return nil
+}
+
+// Accept connections and requests again for a drained service.
+func (s *ServiceRegistry) EnableService(svcName string) error {
+	service := s.GetService(svcName)
+	if service == nil {
+		return ErrNoService
+	}
+
+	return service.enable()
+}
+
 func (s *ServiceRegistry) Stats() []ServiceStat {
 	s.Lock()
 	defer s.Unlock()
@@ -544,6 +1031,7 @@ func (s *ServiceRegistry) Config() client.Config {
 	s.cfg.Services = nil
 
 	cfg := s.cfg
+	cfg.Version = client.ConfigVersion
 	for _, service := range s.svcs {
 		cfg.Services = append(cfg.Services, service.Config())
 	}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/skyfii/shuttle/client"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Replay runs recorded traffic against a candidate config in a sandbox, to
+// check its routing before it's deployed:
+//
+//	shuttle replay config.json access.log [host]
+//	shuttle replay config.json capture-dir
+//
+// The services listen on ephemeral local ports, and every backend is replaced
+// by a stub which answers for it, so no traffic reaches the real backends.
+// Each request is reported with the service and backend it was routed to, and
+// the status it got, followed by the error rates of each service.
+//
+// HTTP requests are read from an access log in the common or combined log
+// format. The virtual host is taken from an absolute request URI, a leading
+// vhost field as in Apache's vhost_combined format, or else the host
+// argument. TCP connections are replayed from the files of a capture dir,
+// sending what the client sent to the service named in each file name.
+
+const replayBackendHeader = "X-Shuttle-Replay-Backend"
+
+// A stub standing in for a backend of the candidate config.
+type replayBackend struct {
+	service string
+	name    string
+	server  *httptest.Server
+	conns   int64
+}
+
+// The outcome of one replayed request or connection.
+type replayResult struct {
+	Request string
+	Service string
+	Backend string
+	Status  int
+	Err     error
+}
+
+// Counts of the replayed traffic for a service, with "" for traffic no
+// service accepted.
+type replayStat struct {
+	Requests int
+	Errors   int
+	Codes    map[int]int
+}
+
+type replaySandbox struct {
+	backends []*replayBackend
+	router   *httptest.Server
+	services []string
+}
+
+// Start the services of cfg in the sandbox, with stub backends.
+func newReplaySandbox(cfg client.Config) (*replaySandbox, error) {
+	sb := &replaySandbox{}
+
+	// nothing in the sandbox should reach outside it
+	cfg.HealthWebhook = ""
+	cfg.HealthWebhooks = nil
+
+	var services []client.ServiceConfig
+	for _, svc := range cfg.Services {
+		if tcp, _ := splitNetwork(svc.Network); svc.Network != "" && tcp == "" {
+			log.Warnf("WARN: Not replaying %s, only TCP services are replayed", svc.Name)
+			continue
+		}
+
+		svc.Addr = "127.0.0.1:0"
+		svc.Network = ""
+		svc.LazyBind = false
+		svc.BindRetry = 0
+		svc.Capture = nil
+		svc.ErrorCapture = nil
+		svc.LBHealth = nil
+		svc.SendProxy = ""
+
+		backends := make([]client.BackendConfig, len(svc.Backends))
+		for i, b := range svc.Backends {
+			stub := sb.addBackend(svc.Name, b.Name)
+			b.Addr = stub.server.Listener.Addr().String()
+			b.FallbackAddrs = nil
+			b.Network = ""
+			b.CheckAddr = ""
+			b.Container = ""
+			b.LoadURL = ""
+			b.Schedule = nil
+			b.SendProxy = ""
+			// without health checks, only an admin down backend is down
+			if b.AdminState != client.AdminDown {
+				b.AdminState = client.AdminUp
+			}
+			backends[i] = b
+		}
+		svc.Backends = backends
+
+		services = append(services, svc)
+		sb.services = append(sb.services, svc.Name)
+	}
+	cfg.Services = services
+
+	if err := Registry.UpdateConfig(cfg); err != nil {
+		sb.Close()
+		return nil, err
+	}
+
+	sb.router = httptest.NewServer(NewHostRouter(&http.Server{}))
+	return sb, nil
+}
+
+func (sb *replaySandbox) addBackend(service, name string) *replayBackend {
+	b := &replayBackend{
+		service: service,
+		name:    name,
+	}
+
+	b.server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.Header().Set(replayBackendHeader, b.name)
+	}))
+	b.server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&b.conns, 1)
+		}
+	}
+	b.server.Start()
+
+	sb.backends = append(sb.backends, b)
+	return b
+}
+
+// Remove the sandbox services, and stop the stubs.
+func (sb *replaySandbox) Close() {
+	for _, name := range sb.services {
+		Registry.RemoveService(name)
+	}
+	if sb.router != nil {
+		sb.router.Close()
+	}
+	for _, b := range sb.backends {
+		b.server.Close()
+	}
+}
+
+// Replay an HTTP request for the host and request URI.
+func (sb *replaySandbox) replayHTTP(method, host, uri string) replayResult {
+	res := replayResult{Request: method + " " + host + uri}
+
+	req, err := http.NewRequest(method, sb.router.URL+uri, nil)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	req.Host = host
+
+	if svc := Registry.RouteVHost(host, req.Header); svc != nil {
+		res.Service = svc.Name
+	}
+
+	resp, err := replayClient.Do(req)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	res.Status = resp.StatusCode
+	res.Backend = resp.Header.Get(replayBackendHeader)
+	return res
+}
+
+// Replay the client side of a captured TCP connection to a service.
+func (sb *replaySandbox) replayTCP(service string, capture io.Reader) replayResult {
+	res := replayResult{Request: "TCP " + service, Service: service}
+
+	svc := Registry.GetService(service)
+	if svc == nil {
+		res.Service = ""
+		res.Err = ErrNoService
+		return res
+	}
+
+	svc.Lock()
+	listener := svc.tcpListener
+	svc.Unlock()
+	if listener == nil {
+		res.Err = fmt.Errorf("service %s is not listening", service)
+		return res
+	}
+
+	before := sb.conns(service)
+
+	conn, err := net.DialTimeout("tcp", listener.Addr().String(), time.Second)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	defer conn.Close()
+
+	if err := replayCapture(conn, capture); err != nil {
+		res.Err = err
+		return res
+	}
+	if c, ok := conn.(*net.TCPConn); ok {
+		c.CloseWrite()
+	}
+
+	conn.SetReadDeadline(time.Now().Add(replayTimeout))
+	io.Copy(ioutil.Discard, conn)
+
+	for name, n := range sb.conns(service) {
+		if n > before[name] {
+			res.Backend = name
+		}
+	}
+	if res.Backend == "" {
+		res.Err = fmt.Errorf("no backend connection")
+	}
+	return res
+}
+
+// Return the connections each stub backend of a service has accepted.
+func (sb *replaySandbox) conns(service string) map[string]int64 {
+	conns := make(map[string]int64)
+	for _, b := range sb.backends {
+		if b.service == service {
+			conns[b.name] = atomic.LoadInt64(&b.conns)
+		}
+	}
+	return conns
+}
+
+const replayTimeout = 2 * time.Second
+
+var replayClient = &http.Client{
+	Timeout: replayTimeout,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Write the frames sent by the client in a capture to w.
+func replayCapture(w io.Writer, capture io.Reader) error {
+	hdr := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(capture, hdr); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		n := int64(binary.BigEndian.Uint32(hdr[1:]))
+		if hdr[0] != captureFromClient {
+			if _, err := io.CopyN(ioutil.Discard, capture, n); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := io.CopyN(w, capture, n); err != nil {
+			return err
+		}
+	}
+}
+
+// Parse the method, host and request URI of an access log line in the common
+// or combined log format, or return ok false if it has no request.
+func parseAccessLog(line, defaultHost string) (method, host, uri string, ok bool) {
+	start := strings.IndexByte(line, '"')
+	if start < 0 {
+		return "", "", "", false
+	}
+	end := strings.IndexByte(line[start+1:], '"')
+	if end < 0 {
+		return "", "", "", false
+	}
+
+	parts := strings.Fields(line[start+1 : start+1+end])
+	if len(parts) < 2 {
+		return "", "", "", false
+	}
+	method, uri = parts[0], parts[1]
+	host = defaultHost
+
+	// a vhost_combined line has the vhost before the 3 common fields
+	if date := strings.IndexByte(line, '['); date > 0 {
+		if fields := strings.Fields(line[:date]); len(fields) == 4 {
+			host = fields[0]
+		}
+	}
+
+	if u, err := url.Parse(uri); err == nil && u.Host != "" {
+		host = u.Host
+		uri = u.RequestURI()
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return method, host, uri, true
+}
+
+// Replay an access log, or the capture files in a directory, against cfg,
+// reporting each result and the stats for every service to out.
+func runReplay(cfg client.Config, input, defaultHost string, out io.Writer) (map[string]*replayStat, error) {
+	fi, err := os.Stat(input)
+	if err != nil {
+		return nil, err
+	}
+
+	sb, err := newReplaySandbox(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer sb.Close()
+
+	stats := make(map[string]*replayStat)
+	var mu sync.Mutex
+	record := func(res replayResult) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		st := stats[res.Service]
+		if st == nil {
+			st = &replayStat{Codes: make(map[int]int)}
+			stats[res.Service] = st
+		}
+		st.Requests++
+
+		service, backend := res.Service, res.Backend
+		if service == "" {
+			service = "-"
+		}
+		if backend == "" {
+			backend = "-"
+		}
+
+		switch {
+		case res.Err != nil:
+			st.Errors++
+			fmt.Fprintf(out, "%s -> %s/%s error=%s\n", res.Request, service, backend, res.Err)
+		default:
+			st.Codes[res.Status]++
+			if res.Status >= 500 || res.Service == "" {
+				st.Errors++
+			}
+			fmt.Fprintf(out, "%s -> %s/%s status=%d\n", res.Request, service, backend, res.Status)
+		}
+	}
+
+	if fi.IsDir() {
+		files, err := filepath.Glob(filepath.Join(input, "*"+captureExt))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+
+		for _, path := range files {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, err
+			}
+			record(sb.replayTCP(captureService(path), f))
+			f.Close()
+		}
+	} else {
+		f, err := os.Open(input)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			method, host, uri, ok := parseAccessLog(scanner.Text(), defaultHost)
+			if !ok {
+				continue
+			}
+			record(sb.replayHTTP(method, host, uri))
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	writeReplayStats(out, stats)
+	return stats, nil
+}
+
+// The service of a capture file, named service-timestamp-client.tap
+func captureService(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), captureExt)
+	for i := 0; i < 2; i++ {
+		if dash := strings.LastIndexByte(name, '-'); dash > 0 {
+			name = name[:dash]
+		}
+	}
+	return name
+}
+
+func writeReplayStats(out io.Writer, stats map[string]*replayStat) {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(out)
+	for _, name := range names {
+		st := stats[name]
+		label := name
+		if label == "" {
+			label = "(no service)"
+		}
+
+		codes := make([]int, 0, len(st.Codes))
+		for code := range st.Codes {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+
+		var counts []string
+		for _, code := range codes {
+			counts = append(counts, fmt.Sprintf("%d:%d", code, st.Codes[code]))
+		}
+
+		fmt.Fprintf(out, "%s requests=%d errors=%d error_rate=%.2f%% status=%s\n",
+			label, st.Requests, st.Errors, 100*float64(st.Errors)/float64(st.Requests), strings.Join(counts, ","))
+	}
+}
+
+// Replay the traffic at input against the config at cfgPath.
+func replayConfig(cfgPath, input, defaultHost string) error {
+	store, err := newConfigStore(cfgPath)
+	if err != nil {
+		return err
+	}
+
+	data, err := store.Read()
+	if err != nil {
+		return err
+	}
+
+	cfg, err := parseConfig(cfgPath, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = runReplay(cfg, input, defaultHost, os.Stdout)
+	return err
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Every HTTP request gets an ID, which is logged with the request, passed to
+// the backends and returned to the client in the X-Request-Id header, and
+// can be shown on error pages, so a user's report of an error can be found in
+// the logs. An ID from a trusted proxy is kept, so a request can be followed
+// through each proxy it passes.
+
+const RequestIDHeader = "X-Request-Id"
+
+// the longest incoming ID kept
+const maxRequestIDLen = 128
+
+// Set the request's ID, keeping a valid one from a trusted proxy, and return
+// it to the client.
+func setRequestID(w http.ResponseWriter, req *http.Request) string {
+	id := req.Header.Get(RequestIDHeader)
+	if !validRequestID(id) || !trustedProxies.Trusted(req.RemoteAddr) {
+		id = genId()
+	}
+
+	req.Header.Set(RequestIDHeader, id)
+	w.Header().Set(RequestIDHeader, id)
+	return id
+}
+
+// Only printable ascii without spaces is accepted, so an ID can't inject
+// anything into the logs or a page.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' || id[i] == '<' || id[i] == '>' || id[i] == '"' || id[i] == '&' || id[i] == '\'' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,7 @@
+//go:build unix && !linux
+// +build unix,!linux
+
+package main
+
+// SO_REUSEPORT on darwin and the BSDs
+const soReusePort = 0x200
@@ -0,0 +1,4 @@
+package main
+
+// SO_REUSEPORT, which the syscall package doesn't define for linux
+const soReusePort = 0xf
@@ -0,0 +1,19 @@
+//go:build !unix
+// +build !unix
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// there's no SO_REUSEPORT to share the listeners between workers, so
+// -workers is refused at startup
+const reusePortSupported = false
+
+var errReusePortUnsupported = errors.New("SO_REUSEPORT isn't supported on this platform")
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errReusePortUnsupported
+}
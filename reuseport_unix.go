@@ -0,0 +1,23 @@
+//go:build unix
+// +build unix
+
+package main
+
+import (
+	"syscall"
+)
+
+// listeners can be shared between workers
+const reusePortSupported = true
+
+// Set SO_REUSEPORT on a socket before it's bound.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
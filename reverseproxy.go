@@ -5,11 +5,14 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -29,11 +32,39 @@ type DialError struct {
 	error
 }
 
+// ErrClientAborted is the ProxyError when the client went away before a
+// backend responded. No more backends are tried.
+var ErrClientAborted = errors.New("client aborted")
+
+// ErrBodyTooLarge is the ProxyError when the request body ran past the
+// service's MaxRequestBody while being sent to a backend.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// ErrRequestTimeout is the ProxyError when the request ran past the
+// service's RequestTimeout, and ErrResponseTimeout when a backend didn't send
+// its response headers within the ResponseHeaderTimeout.
+var (
+	ErrRequestTimeout  = errors.New("request timeout")
+	ErrResponseTimeout = errors.New("backend response header timeout")
+)
+
+// Return the ProxyError for a request whose context is done.
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrRequestTimeout
+	}
+	return ErrClientAborted
+}
+
+// The status logged for a request the client aborted, as used by nginx. It's
+// never written to the client.
+const StatusClientAborted = 499
+
 // ReverseProxy is an HTTP Handler that takes an incoming request and
 // sends it to another server, proxying the response back to the
 // client.
 type ReverseProxy struct {
-	// we need to protect our ErrorPage cache
+	// we need to protect our ErrorPage cache, and the FlushInterval
 	sync.Mutex
 
 	// Director must be a function which modifies
@@ -49,9 +80,53 @@ type ReverseProxy struct {
 	// FlushInterval specifies the flush interval
 	// to flush to the client while copying the
 	// response body.
-	// If zero, no periodic flushing is done.
+	// If zero, no periodic flushing is done, and if
+	// negative the client is flushed after every write.
 	FlushInterval time.Duration
 
+	// BackendName returns the name of the backend at an address, for the
+	// access log and debug headers.
+	BackendName func(addr string) string
+
+	// Dial connects to a backend for Upgrade requests, which take over the
+	// connection rather than going through the Transport. Upgrade requests
+	// aren't supported without it.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// RetryStatus reports if a backend's response status is a failure of
+	// the backend. Idempotent requests without a body are retried on the
+	// next backend, and the failure is passed to BackendFailed.
+	RetryStatus   func(code int) bool
+	BackendFailed func(addr, reason string)
+
+	// ReplayBody is the largest request body buffered so an idempotent
+	// request can be replayed on the next backend when it fails after
+	// being sent, or gets a RetryStatus. 0 buffers none.
+	ReplayBody int64
+
+	// Compat holds the options for older HTTP/1.x backends.
+	Compat httpCompat
+
+	// CircuitAllow reports if a request may be sent to the backend at addr,
+	// and CircuitRecord records if an attempt to it failed, for the backend's
+	// circuit breaker and the service's outlier detection. Either may be nil.
+	CircuitAllow  func(addr string) bool
+	CircuitRecord func(addr string, failed bool)
+
+	// GRPCStatus is called with the grpc-status of a gRPC response from a
+	// backend, once its trailers have been read. It may be nil.
+	GRPCStatus func(pr *ProxyRequest, code int)
+
+	// TrustForwarded reports if the forwarding headers of a client request
+	// are kept and appended to, rather than replaced. All are trusted if
+	// it's nil.
+	TrustForwarded func(req *http.Request) bool
+
+	// Count of connections upgraded to another protocol, and those still
+	// open, updated atomically.
+	Upgrades      int64
+	UpgradeActive int64
+
 	// These are called in order on before any request is made to the backend server.
 	// Each Callback must return true to continue processing.
 	OnRequest []ProxyCallback
@@ -66,7 +141,7 @@ type ReverseProxy struct {
 
 // Create a new ReverseProxy
 // This will still need to have a Director and Transport assigned.
-func NewReverseProxy(t *http.Transport) *ReverseProxy {
+func NewReverseProxy(t http.RoundTripper) *ReverseProxy {
 	p := &ReverseProxy{
 		Transport:     t,
 		FlushInterval: 1109 * time.Millisecond,
@@ -130,26 +205,75 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request, addr
 	pr.ProxyError = err
 	pr.FinishTime = time.Now()
 
-	if err != nil {
+	p.Lock()
+	compat := p.Compat
+	p.Unlock()
+
+	// the hop-by-hop headers are removed below, so keep the protocol the
+	// backend switched to
+	var upgrade string
+	if err == nil && res.StatusCode == http.StatusSwitchingProtocols {
+		upgrade = res.Header.Get("Upgrade")
+	}
+
+	if err == ErrClientAborted {
+		log.Printf("INFO: id=%s client went away", req.Header.Get(RequestIDHeader))
+
+		res = &http.Response{
+			Header:     make(map[string][]string),
+			StatusCode: StatusClientAborted,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		pr.Response = res
+	} else if err == ErrBodyTooLarge {
+		log.Printf("INFO: id=%s request body too large", req.Header.Get(RequestIDHeader))
+
+		res = &http.Response{
+			Header:     make(map[string][]string),
+			StatusCode: http.StatusRequestEntityTooLarge,
+			Status:     http.StatusText(http.StatusRequestEntityTooLarge),
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		pr.Response = res
+	} else if err != nil {
 		log.Errorf("ERROR: HTTP proxy error - %v", err)
 
+		status := http.StatusBadGateway
+		if err == ErrRequestTimeout || err == ErrResponseTimeout {
+			status = http.StatusGatewayTimeout
+		}
+
 		// We want to ensure that we have a non-nil response even on error for
 		// the OnResponse callbacks. If the Callback chain completes, this will
 		// be written to the client.
 		res = &http.Response{
 			Header:     make(map[string][]string),
-			StatusCode: http.StatusBadGateway,
-			Status:     http.StatusText(http.StatusBadGateway),
+			StatusCode: status,
+			Status:     http.StatusText(status),
 			// this ensures Body isn't nil
 			Body: ioutil.NopCloser(bytes.NewReader(nil)),
 		}
+		// gRPC clients expect a grpc-status rather than an HTTP error
+		if isGRPC(req) {
+			res = grpcErrorResponse(status)
+		}
 		pr.Response = res
 	}
 
+	if compat.NormalizeConnection {
+		removeConnectionHeaders(res.Header, res.Header, upgrade != "")
+	}
 	for _, h := range hopHeaders {
 		res.Header.Del(h)
 	}
 
+	// debug headers naming the backend which answered, or failed last
+	if pr.Backend.Addr != "" {
+		rw.Header().Set("X-Backend", pr.Backend.Addr)
+		rw.Header().Set("X-Backend-Name", pr.Backend.Name)
+		rw.Header().Set("X-Backend-Attempt", strconv.Itoa(pr.Backend.Attempt))
+	}
+
 	copyHeader(rw.Header(), res.Header)
 
 	for _, f := range p.OnResponse {
@@ -159,13 +283,52 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request, addr
 		}
 	}
 
+	if err == ErrClientAborted {
+		// there's no one to write the response to
+		return
+	}
+
+	if upgrade != "" {
+		p.serveUpgrade(rw, req, res, upgrade)
+		return
+	}
+
 	// calls all completed with true, write the Response back to the client.
 	defer res.Body.Close()
 	rw.WriteHeader(res.StatusCode)
-	_, err = p.copyResponse(rw, res.Body)
+	_, err = p.copyResponse(rw, res)
 	if err != nil {
-		log.Warnf("WARN: id=%s transfer error: %s", req.Header.Get("X-Request-Id"), err)
+		log.Warnf("WARN: id=%s transfer error: %s", req.Header.Get(RequestIDHeader), err)
+	}
+
+	// the trailers are only known once the body has been read, so they're
+	// sent without being announced
+	for key, vals := range res.Trailer {
+		for _, val := range vals {
+			rw.Header().Add(http.TrailerPrefix+key, val)
+		}
+	}
+
+	if p.GRPCStatus != nil && pr.ProxyError == nil && isGRPC(req) {
+		if code, ok := grpcStatus(res); ok {
+			p.GRPCStatus(pr, code)
+		}
+	}
+}
+
+// Report if a request may be sent more than once.
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
 	}
+	return false
+}
+
+// Only idempotent requests without a body can be sent to another backend
+// after a response, unless the body was buffered.
+func canRetry(req *http.Request) bool {
+	return idempotent(req.Method) && (req.Body == nil || req.Body == http.NoBody)
 }
 
 func (p *ReverseProxy) doRequest(pr *ProxyRequest) (*http.Response, error) {
@@ -201,25 +364,110 @@ func (p *ReverseProxy) doRequest(pr *ProxyRequest) (*http.Response, error) {
 		}
 	}
 
-	if clientIP, _, err := net.SplitHostPort(pr.Request.RemoteAddr); err == nil {
-		// If we aren't the first proxy retain prior
-		// X-Forwarded-For information as a comma+space
-		// separated list and fold multiple headers into one.
-		if prior, ok := outreq.Header["X-Forwarded-For"]; ok {
-			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+	// the forwarding headers are always rewritten, so don't touch the
+	// client's
+	if !copiedHeaders {
+		outreq.Header = make(http.Header)
+		copyHeader(outreq.Header, pr.Request.Header)
+	}
+
+	// gRPC backends need to know that the client accepts trailers
+	if strings.Contains(strings.ToLower(pr.Request.Header.Get("Te")), "trailers") {
+		outreq.Header.Set("Te", "trailers")
+	}
+
+	p.Lock()
+	replayBody := p.ReplayBody
+	compat := p.Compat
+	p.Unlock()
+
+	// an Upgrade is passed on over a connection of its own, unless the
+	// backends only get plain HTTP/1.1
+	roundTrip := transport.RoundTrip
+	upgrade := upgradeType(pr.Request.Header)
+	if compat.ForceHTTP11 {
+		upgrade = ""
+		outreq.Header.Del("Http2-Settings")
+	}
+
+	if compat.NormalizeConnection {
+		removeConnectionHeaders(outreq.Header, pr.Request.Header, upgrade != "")
+		outreq.Header.Set("Connection", "keep-alive")
+	}
+
+	if upgrade != "" && p.Dial != nil {
+		outreq.Header.Set("Connection", "Upgrade")
+		outreq.Header.Set("Upgrade", upgrade)
+		roundTrip = p.dialUpgrade
+	}
+
+	if compat.NoChunked && upgrade == "" {
+		if err := bufferContentLength(outreq, compat.MaxBody); err != nil {
+			return nil, err
+		}
+	}
+
+	replay := false
+	if upgrade == "" && len(pr.Backends) > 1 {
+		var err error
+		if replay, err = bufferRequestBody(outreq, replayBody); err != nil {
+			return nil, err
 		}
-		outreq.Header.Set("X-Forwarded-For", clientIP)
 	}
 
+	trust := p.TrustForwarded == nil || p.TrustForwarded(pr.Request)
+	setForwardedHeaders(outreq.Header, pr.Request, trust)
+
 	var err error
 	var resp *http.Response
 
-	for _, addr := range pr.Backends {
+	ctx := pr.Request.Context()
+	for i, addr := range pr.Backends {
+		if ctx.Err() != nil {
+			return nil, contextError(ctx)
+		}
+
+		// fail fast to the next backend while its breaker is open
+		if p.CircuitAllow != nil && !p.CircuitAllow(addr) {
+			err = DialError{ErrBreakerOpen}
+			continue
+		}
+
+		pr.Backend.Addr = addr
+		pr.Backend.Attempt++
+		if p.BackendName != nil {
+			pr.Backend.Name = p.BackendName(addr)
+		}
+
+		// each attempt sends the buffered body from the start
+		if replay && outreq.GetBody != nil {
+			outreq.Body, _ = outreq.GetBody()
+		}
+
 		outreq.URL.Host = addr
-		resp, err = transport.RoundTrip(outreq)
+		resp, err = roundTrip(outreq)
+		if err != nil && ctx.Err() != nil {
+			return nil, contextError(ctx)
+		}
+		if err != nil && errors.Is(err, ErrBodyTooLarge) {
+			return nil, ErrBodyTooLarge
+		}
+
+		if p.CircuitRecord != nil {
+			p.CircuitRecord(addr, err != nil || resp.StatusCode >= 500)
+		}
+
+		if err == nil && p.RetryStatus != nil && p.RetryStatus(resp.StatusCode) {
+			if p.BackendFailed != nil {
+				p.BackendFailed(addr, "HTTP "+resp.Status)
+			}
+			if i < len(pr.Backends)-1 && (replay || canRetry(outreq)) {
+				resp.Body.Close()
+				continue
+			}
+		}
 
 		if err == nil {
-			pr.ResponseWriter.Header().Set("X-Backend", addr)
 			return resp, nil
 		}
 
@@ -228,6 +476,16 @@ func (p *ReverseProxy) doRequest(pr *ProxyRequest) (*http.Response, error) {
 			continue
 		}
 
+		// the whole request can be sent again to the next backend
+		if replay && i < len(pr.Backends)-1 {
+			log.Warnf("WARN: id=%s replaying request after %s failed: %s",
+				pr.Request.Header.Get(RequestIDHeader), addr, err)
+			if p.BackendFailed != nil {
+				p.BackendFailed(addr, err.Error())
+			}
+			continue
+		}
+
 		// not a DialError, so make this terminal.
 		return nil, err
 	}
@@ -241,21 +499,77 @@ func (p *ReverseProxy) doRequest(pr *ProxyRequest) (*http.Response, error) {
 	return nil, fmt.Errorf("no http backends available")
 }
 
-func (p *ReverseProxy) copyResponse(dst io.Writer, src io.Reader) (int64, error) {
-	if p.FlushInterval != 0 {
-		if wf, ok := dst.(writeFlusher); ok {
-			mlw := &maxLatencyWriter{
-				dst:     wf,
-				latency: p.FlushInterval,
-				done:    make(chan bool),
-			}
-			go mlw.flushLoop()
-			defer mlw.stop()
-			dst = mlw
-		}
+// Copy the response body to the client, flushing at the FlushInterval.
+func (p *ReverseProxy) copyResponse(dst io.Writer, res *http.Response) (int64, error) {
+	src := res.Body
+
+	interval := p.flushInterval(res)
+	if interval == 0 {
+		return io.Copy(dst, src)
 	}
 
-	return io.Copy(dst, src)
+	wf, ok := dst.(writeFlusher)
+	if !ok {
+		return io.Copy(dst, src)
+	}
+
+	if interval < 0 {
+		return io.Copy(flushWriter{wf}, src)
+	}
+
+	mlw := &maxLatencyWriter{
+		dst:     wf,
+		latency: interval,
+		done:    make(chan bool),
+	}
+	go mlw.flushLoop()
+	defer mlw.stop()
+
+	return io.Copy(mlw, src)
+}
+
+// Return the interval to flush a response at, or a negative interval to flush
+// every write. Server-sent events, and a streamed HTTP/2 response like a gRPC
+// stream, are flushed on every write.
+func (p *ReverseProxy) flushInterval(res *http.Response) time.Duration {
+	if streamedResponse(res) {
+		return -1
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	return p.FlushInterval
+}
+
+// Report if a response is streamed, and so flushed on every write.
+func streamedResponse(res *http.Response) bool {
+	if res.ProtoMajor == 2 && res.ContentLength == -1 {
+		return true
+	}
+
+	mediaType := strings.TrimSpace(strings.SplitN(res.Header.Get("Content-Type"), ";", 2)[0])
+	return strings.EqualFold(mediaType, "text/event-stream")
+}
+
+// Set the FlushInterval of a running proxy.
+func (p *ReverseProxy) SetFlushInterval(d time.Duration) {
+	p.Lock()
+	p.FlushInterval = d
+	p.Unlock()
+}
+
+// Set the largest request body buffered for a replay.
+func (p *ReverseProxy) SetReplayBody(max int64) {
+	p.Lock()
+	p.ReplayBody = max
+	p.Unlock()
+}
+
+// Set the options for older HTTP/1.x backends.
+func (p *ReverseProxy) SetCompat(compat httpCompat) {
+	p.Lock()
+	p.Compat = compat
+	p.Unlock()
 }
 
 type writeFlusher interface {
@@ -263,6 +577,17 @@ type writeFlusher interface {
 	http.Flusher
 }
 
+// flushWriter flushes after every write.
+type flushWriter struct {
+	writeFlusher
+}
+
+func (w flushWriter) Write(p []byte) (int, error) {
+	n, err := w.writeFlusher.Write(p)
+	w.Flush()
+	return n, err
+}
+
 type maxLatencyWriter struct {
 	dst     writeFlusher
 	latency time.Duration
@@ -318,4 +643,18 @@ type ProxyRequest struct {
 	// Duration of the backend request
 	StartTime  time.Time
 	FinishTime time.Time
+
+	// The trace span, if the request was sampled
+	Trace *traceSpan
+
+	// The backend the request was last sent to, and which attempt that was,
+	// counting from 1
+	Backend backendAttempt
+}
+
+// The backend a request was sent to, and on which attempt.
+type backendAttempt struct {
+	Addr    string
+	Name    string
+	Attempt int
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"github.com/skyfii/shuttle/client"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Path rewrites and redirects for virtual hosts, so that simple routing
+// changes don't need any backend code.
+
+type rewriteRule struct {
+	vhost   string
+	prefix  string
+	re      *regexp.Regexp
+	replace string
+}
+
+type redirectRule struct {
+	vhost  string
+	re     *regexp.Regexp
+	target string
+	code   int
+}
+
+// Compile the rewrite rules for a service. Rules which can't be compiled are
+// logged and skipped.
+func newRewriteRules(service string, cfg []client.RewriteRule) []rewriteRule {
+	var rules []rewriteRule
+	for _, rc := range cfg {
+		rule := rewriteRule{
+			vhost:   rc.VirtualHost,
+			prefix:  rc.StripPrefix,
+			replace: rc.Replace,
+		}
+
+		if rc.Regexp != "" {
+			re, err := regexp.Compile(rc.Regexp)
+			if err != nil {
+				log.Errorf("ERROR: Invalid rewrite regexp for %s: %s", service, err)
+				continue
+			}
+			rule.re = re
+		}
+
+		if rule.prefix == "" && rule.re == nil {
+			log.Errorf("ERROR: Rewrite rule for %s has no strip_prefix or regexp", service)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// Compile the redirect rules for a service. Rules which can't be compiled, or
+// have an unsupported status, are logged and skipped rather than redirecting
+// requests they weren't meant for.
+func newRedirectRules(service string, cfg []client.RedirectRule) []redirectRule {
+	var rules []redirectRule
+	for _, rc := range cfg {
+		rule := redirectRule{
+			vhost:  rc.VirtualHost,
+			target: rc.Target,
+			code:   rc.Status,
+		}
+
+		switch rule.code {
+		case 0:
+			rule.code = http.StatusMovedPermanently
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			log.Errorf("ERROR: Invalid redirect status %d for %s", rc.Status, service)
+			continue
+		}
+
+		if rule.target == "" {
+			log.Errorf("ERROR: Redirect rule for %s has no target", service)
+			continue
+		}
+
+		if rc.Regexp != "" {
+			re, err := regexp.Compile(rc.Regexp)
+			if err != nil {
+				log.Errorf("ERROR: Invalid redirect regexp for %s: %s", service, err)
+				continue
+			}
+			rule.re = re
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// Return the request's host without a port.
+func requestHost(r *http.Request) string {
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		return h
+	}
+	return r.Host
+}
+
+// Report if a rule for vhost applies to host. Rules without a vhost apply to
+// all of the service's virtual hosts.
+func vhostMatch(vhost, host string) bool {
+	return vhost == "" || strings.EqualFold(vhost, host)
+}
+
+// Rewrite the request path with each matching rule in turn.
+func rewritePath(r *http.Request, rules []rewriteRule) {
+	if len(rules) == 0 {
+		return
+	}
+
+	host := requestHost(r)
+	path := r.URL.Path
+	for _, rule := range rules {
+		if !vhostMatch(rule.vhost, host) {
+			continue
+		}
+
+		if rule.prefix != "" && strings.HasPrefix(path, rule.prefix) {
+			path = strings.TrimPrefix(path, rule.prefix)
+			if !strings.HasPrefix(path, "/") {
+				path = "/" + path
+			}
+		}
+		if rule.re != nil {
+			path = rule.re.ReplaceAllString(path, rule.replace)
+		}
+	}
+
+	if path != r.URL.Path {
+		r.URL.Path = path
+		r.URL.RawPath = ""
+	}
+}
+
+// Return the target and status of the first matching redirect rule. The
+// target is expanded with the regexp's submatches, {host} and {path}, and
+// the request's query is appended unless the target has one of its own.
+func redirectTarget(r *http.Request, rules []redirectRule) (string, int, bool) {
+	if len(rules) == 0 {
+		return "", 0, false
+	}
+
+	host := requestHost(r)
+	path := r.URL.Path
+	for _, rule := range rules {
+		if !vhostMatch(rule.vhost, host) {
+			continue
+		}
+
+		target := rule.target
+		if rule.re != nil {
+			match := rule.re.FindStringSubmatchIndex(path)
+			if match == nil {
+				continue
+			}
+			target = string(rule.re.ExpandString(nil, target, path, match))
+		}
+
+		target = strings.NewReplacer("{host}", host, "{path}", path).Replace(target)
+		if r.URL.RawQuery != "" && !strings.Contains(target, "?") {
+			target += "?" + r.URL.RawQuery
+		}
+		return target, rule.code, true
+	}
+	return "", 0, false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"github.com/skyfii/shuttle/client"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Header routing for vhosts. Services sharing a virtual host can take only
+// the requests whose headers match their routes, such as a tenant ID or a
+// mobile User-Agent, ahead of the services without routes.
+
+type headerRoute struct {
+	name  string
+	value string
+	re    *regexp.Regexp
+
+	// a route that couldn't be compiled never matches, rather than taking
+	// requests meant for another service
+	invalid bool
+}
+
+// Compile the header routes for a service.
+func newHeaderRoutes(service string, cfg []client.HeaderRoute) []headerRoute {
+	var routes []headerRoute
+	for _, rc := range cfg {
+		route := headerRoute{
+			name:  http.CanonicalHeaderKey(rc.Header),
+			value: rc.Value,
+		}
+
+		if rc.Header == "" {
+			log.Errorf("ERROR: Header route for %s has no header name", service)
+			route.invalid = true
+		} else if rc.Regexp != "" {
+			re, err := regexp.Compile(rc.Regexp)
+			if err != nil {
+				log.Errorf("ERROR: Invalid header route regexp for %s: %s", service, err)
+				route.invalid = true
+			}
+			route.re = re
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// Check any of the values of the header against the route.
+func (r headerRoute) match(header http.Header) bool {
+	if r.invalid {
+		return false
+	}
+
+	for _, v := range header[r.name] {
+		switch {
+		case r.re != nil:
+			if r.re.MatchString(v) {
+				return true
+			}
+		case r.value != "":
+			if strings.EqualFold(v, r.value) {
+				return true
+			}
+		default:
+			// present with any value
+			return true
+		}
+	}
+	return false
+}
+
+// Report if the service has header routes, and if they all match.
+func (s *Service) matchRoutes(header http.Header) (match, routed bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.routes) == 0 {
+		return true, false
+	}
+
+	for _, r := range s.routes {
+		if !r.match(header) {
+			return false, true
+		}
+	}
+	return true, true
+}
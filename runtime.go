@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"runtime"
+	rtdebug "runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Go runtime tuning. Proxy latency is sensitive to GC pauses and to the
+// scheduler using more threads than the container's CPU quota allows, so the
+// GC target, the soft memory limit and GOMAXPROCS can be set in the config,
+// and GOMAXPROCS follows the cgroup CPU quota by default.
+
+// The json stats of the runtime and its effective settings
+type RuntimeStat struct {
+	GoVersion  string  `json:"go_version"`
+	GOMAXPROCS int     `json:"gomaxprocs"`
+	NumCPU     int     `json:"num_cpu"`
+	CPUQuota   float64 `json:"cpu_quota,omitempty"`
+	GOGC       int     `json:"gogc"`
+	// MemoryLimit is the soft memory limit in bytes, or 0 without one.
+	MemoryLimit int64 `json:"memory_limit"`
+
+	Goroutines int    `json:"goroutines"`
+	HeapAlloc  uint64 `json:"heap_alloc"`
+	HeapSys    uint64 `json:"heap_sys"`
+	NumGC      uint32 `json:"num_gc"`
+	// GC pause times in microseconds
+	PauseTotal uint64 `json:"gc_pause_total_us"`
+	LastPause  uint64 `json:"gc_last_pause_us"`
+}
+
+var runtimeTuning = struct {
+	sync.Mutex
+	// the GOGC set, or -2 if it's still the environment's
+	gogc int
+	// the CPU quota found in the cgroup, 0 if there's none
+	quota float64
+}{gogc: -2}
+
+// Apply the runtime settings. A GOGC below 0 turns the GC off, and 0 leaves
+// it unchanged. The memory limit is in megabytes, and 0 leaves it unchanged.
+// A GOMAXPROCS of 0 leaves it unchanged.
+func tuneRuntime(gogc, memoryLimit, maxProcs int) {
+	runtimeTuning.Lock()
+	defer runtimeTuning.Unlock()
+
+	if gogc != 0 {
+		if gogc < 0 {
+			gogc = -1
+		}
+		rtdebug.SetGCPercent(gogc)
+		runtimeTuning.gogc = gogc
+		log.Printf("INFO: Set GOGC to %d", gogc)
+	}
+
+	if memoryLimit > 0 {
+		rtdebug.SetMemoryLimit(int64(memoryLimit) << 20)
+		log.Printf("INFO: Set the soft memory limit to %dMB", memoryLimit)
+	}
+
+	if maxProcs > 0 && maxProcs != runtime.GOMAXPROCS(0) {
+		runtime.GOMAXPROCS(maxProcs)
+		log.Printf("INFO: Set GOMAXPROCS to %d", maxProcs)
+	}
+}
+
+// Set GOMAXPROCS from the cgroup CPU quota, rounded up, unless it was set in
+// the environment.
+func autoMaxProcs() {
+	quota := cgroupCPUQuota()
+
+	runtimeTuning.Lock()
+	runtimeTuning.quota = quota
+	runtimeTuning.Unlock()
+
+	if quota <= 0 || os.Getenv("GOMAXPROCS") != "" {
+		return
+	}
+
+	procs := int(math.Ceil(quota))
+	if procs > runtime.NumCPU() {
+		procs = runtime.NumCPU()
+	}
+	if procs != runtime.GOMAXPROCS(0) {
+		runtime.GOMAXPROCS(procs)
+		log.Printf("INFO: Set GOMAXPROCS to %d for a CPU quota of %.2f", procs, quota)
+	}
+}
+
+// Return the CPU quota of the process's cgroup in cores, from cgroup v2 or
+// v1, or 0 if it's unlimited or unknown.
+func cgroupCPUQuota() float64 {
+	if data, err := ioutil.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		return parseCPUMax(string(data))
+	}
+
+	quota, err := ioutil.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	if err != nil {
+		return 0
+	}
+	period, err := ioutil.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err != nil {
+		return 0
+	}
+	return parseCPUMax(strings.TrimSpace(string(quota)) + " " + string(period))
+}
+
+// Parse a cgroup v2 cpu.max of "quota period", where the quota may be "max".
+func parseCPUMax(s string) float64 {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return 0
+	}
+
+	quota, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil || quota <= 0 {
+		return 0
+	}
+	period, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || period <= 0 {
+		return 0
+	}
+	return quota / period
+}
+
+// Return the GOGC in effect, from the config or the environment.
+func currentGOGC() int {
+	runtimeTuning.Lock()
+	gogc := runtimeTuning.gogc
+	runtimeTuning.Unlock()
+
+	if gogc != -2 {
+		return gogc
+	}
+
+	env := os.Getenv("GOGC")
+	if env == "off" {
+		return -1
+	}
+	if n, err := strconv.Atoi(env); err == nil {
+		return n
+	}
+	return 100
+}
+
+func runtimeStats() RuntimeStat {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	runtimeTuning.Lock()
+	quota := runtimeTuning.quota
+	runtimeTuning.Unlock()
+
+	stats := RuntimeStat{
+		GoVersion:  runtime.Version(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		NumCPU:     runtime.NumCPU(),
+		CPUQuota:   quota,
+		GOGC:       currentGOGC(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  m.HeapAlloc,
+		HeapSys:    m.HeapSys,
+		NumGC:      m.NumGC,
+		PauseTotal: m.PauseTotalNs / uint64(time.Microsecond),
+	}
+
+	// a negative value reads the limit without changing it
+	if limit := rtdebug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		stats.MemoryLimit = limit
+	}
+	if m.NumGC > 0 {
+		stats.LastPause = m.PauseNs[(m.NumGC+255)%256] / uint64(time.Microsecond)
+	}
+	return stats
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"github.com/skyfii/shuttle/client"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Backends can change their weight on a daily schedule, such as sending
+// traffic to a batch cluster only off-peak. The schedule is evaluated as the
+// backends are balanced, so there's no config to push when a window opens
+// or closes.
+
+var scheduleDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+type scheduleWindow struct {
+	days [7]bool
+	// minutes after midnight
+	start, end int
+	loc        *time.Location
+	weight     int
+}
+
+// Parse a backend's schedule. A window that can't be parsed is left out,
+// and the backend keeps its weight through that time.
+func newSchedule(backend string, cfg []client.ScheduleWindow) []scheduleWindow {
+	var windows []scheduleWindow
+	for _, wc := range cfg {
+		w, err := parseScheduleWindow(wc)
+		if err != nil {
+			log.Errorf("ERROR: Invalid schedule window for backend %s: %s", backend, err)
+			continue
+		}
+		windows = append(windows, w)
+	}
+	return windows
+}
+
+func parseScheduleWindow(cfg client.ScheduleWindow) (scheduleWindow, error) {
+	w := scheduleWindow{
+		loc:    time.Local,
+		weight: cfg.Weight,
+	}
+
+	if w.weight < 0 {
+		return w, fmt.Errorf("negative weight %d", w.weight)
+	}
+
+	var err error
+	if w.start, err = parseClock(cfg.Start); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(cfg.End); err != nil {
+		return w, err
+	}
+
+	if cfg.Timezone != "" {
+		if w.loc, err = time.LoadLocation(cfg.Timezone); err != nil {
+			return w, err
+		}
+	}
+
+	if len(cfg.Days) == 0 {
+		for i := range w.days {
+			w.days[i] = true
+		}
+	}
+	for _, d := range cfg.Days {
+		day, ok := scheduleDays[strings.ToLower(d)]
+		if !ok {
+			return w, fmt.Errorf("unknown day %q", d)
+		}
+		w.days[day] = true
+	}
+	return w, nil
+}
+
+// Return the minutes after midnight of a time of day, as "15:04".
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Report if the window contains t.
+func (w scheduleWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	min := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+
+	switch {
+	case w.start == w.end:
+		return w.days[day]
+	case w.start < w.end:
+		return w.days[day] && min >= w.start && min < w.end
+	case min >= w.start:
+		return w.days[day]
+	case min < w.end:
+		// the part of the window past midnight started the day before
+		return w.days[(day+6)%7]
+	}
+	return false
+}
+
+// The backend's weight at the time, from the first window of its schedule
+// containing it.
+func (b *Backend) weightAt(t time.Time) int {
+	for _, w := range b.schedule {
+		if w.contains(t) {
+			return w.weight
+		}
+	}
+	return b.Weight
+}
+
+// The backend's weight right now.
+func (b *Backend) currentWeight() int {
+	if len(b.schedule) == 0 {
+		return b.Weight
+	}
+	return b.weightAt(time.Now())
+}
@@ -0,0 +1,166 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SCTP services and backends use one-to-one style sockets, which the net
+// package can wrap as TCP ones once they're open, so they're proxied like
+// TCP. The data is proxied as a stream, so the boundaries between messages,
+// and the stream they were sent on, aren't kept.
+
+// Return the socket address of an sctp, sctp4 or sctp6 address.
+func sctpSockaddr(network, addr string) (*net.TCPAddr, int, syscall.Sockaddr, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp"+strings.TrimPrefix(network, "sctp"), addr)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	if ip4 := tcpAddr.IP.To4(); network != "sctp6" && (tcpAddr.IP == nil || ip4 != nil) {
+		sa := &syscall.SockaddrInet4{Port: tcpAddr.Port}
+		copy(sa.Addr[:], ip4)
+		return tcpAddr, syscall.AF_INET, sa, nil
+	}
+
+	sa := &syscall.SockaddrInet6{Port: tcpAddr.Port}
+	copy(sa.Addr[:], tcpAddr.IP.To16())
+	return tcpAddr, syscall.AF_INET6, sa, nil
+}
+
+func sctpSocket(family int) (int, error) {
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, syscall.IPPROTO_SCTP)
+	if err != nil {
+		return -1, os.NewSyscallError("socket", err)
+	}
+	return fd, nil
+}
+
+// Listen on an SCTP address, shared with the other workers when running as
+// one.
+func listenSCTP(network, addr string) (net.Listener, error) {
+	tcpAddr, family, sa, err := sctpSockaddr(network, addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+
+	fd, err := sctpSocket(family)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: tcpAddr, Err: err}
+	}
+
+	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	if err == nil && reusePort {
+		err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soReusePort, 1)
+	}
+	if err != nil {
+		err = os.NewSyscallError("setsockopt", err)
+	} else if err = syscall.Bind(fd, sa); err != nil {
+		err = os.NewSyscallError("bind", err)
+	} else if err = syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		err = os.NewSyscallError("listen", err)
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: tcpAddr, Err: err}
+	}
+
+	// the listener takes a copy of the socket
+	f := os.NewFile(uintptr(fd), network+":"+addr)
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// Connect to an SCTP address, within the dialer's timeout.
+func dialSCTP(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	tcpAddr, family, sa, err := sctpSockaddr(network, addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	fd, err := sctpSocket(family)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: tcpAddr, Err: err}
+	}
+
+	err = syscall.Connect(fd, sa)
+	if err != nil && err != syscall.EINPROGRESS {
+		syscall.Close(fd)
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: tcpAddr, Err: os.NewSyscallError("connect", err)}
+	}
+
+	// the non-blocking socket is added to the poller, to wait for the
+	// connection without holding a thread
+	f := os.NewFile(uintptr(fd), network+":"+addr)
+	defer f.Close()
+
+	if err == syscall.EINPROGRESS {
+		deadline, _ := ctx.Deadline()
+		if dialer.Timeout > 0 {
+			if d := time.Now().Add(dialer.Timeout); deadline.IsZero() || d.Before(deadline) {
+				deadline = d
+			}
+		}
+		if !deadline.IsZero() {
+			f.SetWriteDeadline(deadline)
+		}
+		stop := context.AfterFunc(ctx, func() {
+			f.SetWriteDeadline(time.Unix(1, 0))
+		})
+		defer stop()
+
+		if err := waitConnect(f); err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return nil, &net.OpError{Op: "dial", Net: network, Addr: tcpAddr, Err: err}
+		}
+	}
+
+	return net.FileConn(f)
+}
+
+// Wait for a non-blocking connect to finish.
+func waitConnect(f *os.File) error {
+	raw, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var connErr error
+	err = raw.Write(func(fd uintptr) bool {
+		n, err := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ERROR)
+		if err != nil {
+			connErr = os.NewSyscallError("getsockopt", err)
+			return true
+		}
+		switch e := syscall.Errno(n); e {
+		case 0:
+			// the socket can be writable before it's connected
+			_, err := syscall.Getpeername(int(fd))
+			if err == syscall.ENOTCONN {
+				return false
+			}
+			if err != nil {
+				connErr = os.NewSyscallError("getpeername", err)
+			}
+			return true
+		case syscall.EINPROGRESS, syscall.EALREADY, syscall.EINTR:
+			return false
+		default:
+			connErr = os.NewSyscallError("connect", e)
+			return true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return connErr
+}
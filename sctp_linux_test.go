@@ -0,0 +1,69 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+	"github.com/skyfii/shuttle/client"
+	. "gopkg.in/check.v1"
+)
+
+// Proxy an SCTP service to an SCTP backend.
+func (s *BasicSuite) TestSCTPProxy(c *C) {
+	backend, err := listenSCTP("sctp", "127.0.0.1:0")
+	if errors.Is(err, syscall.EPROTONOSUPPORT) {
+		c.Skip("sctp isn't supported by the kernel")
+	}
+	c.Assert(err, IsNil)
+	defer backend.Close()
+
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	svcCfg := client.ServiceConfig{
+		Name:    "SCTPService",
+		Addr:    "127.0.0.1:0",
+		Network: "sctp",
+		Backends: []client.BackendConfig{
+			{Name: "echo", Addr: backend.Addr().String(), Network: "sctp"},
+		},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	bound := Registry.GetService(svcCfg.Name).Stats().BoundAddr
+	conn, err := dialSCTP(context.Background(), &net.Dialer{Timeout: time.Second}, "sctp", bound)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("hello"))
+	c.Assert(err, IsNil)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	c.Assert(err, IsNil)
+	c.Assert(string(buf), Equals, "hello")
+
+	// nothing listens on the closed backend's address
+	addr := backend.Addr().String()
+	backend.Close()
+	_, err = dialSCTP(context.Background(), &net.Dialer{Timeout: time.Second}, "sctp", addr)
+	c.Assert(err, NotNil)
+}
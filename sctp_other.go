@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var errSCTPUnsupported = errors.New("sctp isn't supported on this platform")
+
+func listenSCTP(network, addr string) (net.Listener, error) {
+	return nil, &net.OpError{Op: "listen", Net: network, Err: errSCTPUnsupported}
+}
+
+func dialSCTP(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	return nil, &net.OpError{Op: "dial", Net: network, Err: errSCTPUnsupported}
+}
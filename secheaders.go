@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+	"github.com/skyfii/shuttle/client"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Standard security headers added to a service's responses, so each backend
+// doesn't have to send them. A header the backend sent is left as it is.
+
+// the value which leaves a header out
+const securityHeaderOff = "off"
+
+// The headers of each preset. HSTS is only sent over HTTPS.
+var securityPresets = map[string]map[string]string{
+	client.SecurityBasic: {
+		"Strict-Transport-Security": "max-age=31536000",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "SAMEORIGIN",
+		"Referrer-Policy":           "strict-origin-when-cross-origin",
+	},
+	client.SecurityStrict: {
+		"Strict-Transport-Security": "max-age=63072000; includeSubDomains; preload",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "DENY",
+		"Referrer-Policy":           "no-referrer",
+	},
+}
+
+type securityHeaders struct {
+	vhost   string
+	headers map[string]string
+}
+
+// Resolve the security headers for a service. Entries with an unknown preset
+// are logged and skipped.
+func newSecurityHeaders(service string, cfg []client.SecurityHeadersConfig) []securityHeaders {
+	var all []securityHeaders
+	for _, sc := range cfg {
+		name := sc.Preset
+		if name == "" {
+			name = client.SecurityBasic
+		}
+		preset, ok := securityPresets[name]
+		if !ok {
+			log.Errorf("ERROR: Unknown security headers preset %q for %s", sc.Preset, service)
+			continue
+		}
+
+		sh := securityHeaders{
+			vhost:   sc.VirtualHost,
+			headers: make(map[string]string),
+		}
+		for key, val := range preset {
+			sh.headers[key] = val
+		}
+
+		for key, val := range map[string]string{
+			"Strict-Transport-Security": sc.HSTS,
+			"X-Content-Type-Options":    sc.ContentTypeOptions,
+			"X-Frame-Options":           sc.FrameOptions,
+			"Referrer-Policy":           sc.ReferrerPolicy,
+		} {
+			switch {
+			case strings.EqualFold(val, securityHeaderOff):
+				delete(sh.headers, key)
+			case val != "":
+				sh.headers[key] = val
+			}
+		}
+		all = append(all, sh)
+	}
+	return all
+}
+
+// Add the security headers for the request's virtual host to the response.
+func (s *Service) addSecurityHeaders(pr *ProxyRequest) bool {
+	s.Lock()
+	all := s.securityHeaders
+	s.Unlock()
+
+	if len(all) == 0 {
+		return true
+	}
+
+	host := requestHost(pr.Request)
+	var match *securityHeaders
+	for i := range all {
+		if all[i].vhost == "" {
+			if match == nil {
+				match = &all[i]
+			}
+		} else if strings.EqualFold(all[i].vhost, host) {
+			match = &all[i]
+			break
+		}
+	}
+	if match == nil {
+		return true
+	}
+
+	https := pr.Request.TLS != nil || forwardedProto(pr.Request) == "https"
+
+	h := pr.ResponseWriter.Header()
+	for key, val := range match.headers {
+		if key == "Strict-Transport-Security" && !https {
+			continue
+		}
+		if h.Get(key) == "" {
+			h.Set(key, val)
+		}
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Secrets in the config, such as tokens and credentials, may refer to an
+// environment variable or a file rather than being set inline:
+//
+//	"env:NAME"   the value of the environment variable NAME
+//	"file:PATH"  the contents of the file at PATH, less a trailing newline
+//
+// Only the reference is kept in the config, so the secret itself is never
+// written to the state config file. References are resolved when the config
+// setting them is applied.
+
+const (
+	secretEnvPrefix  = "env:"
+	secretFilePrefix = "file:"
+)
+
+// Return the secret a config value refers to, or the value itself if it
+// isn't a reference.
+func resolveSecret(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, secretEnvPrefix):
+		name := v[len(secretEnvPrefix):]
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, nil
+
+	case strings.HasPrefix(v, secretFilePrefix):
+		data, err := ioutil.ReadFile(v[len(secretFilePrefix):])
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return v, nil
+}
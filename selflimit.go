@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Soft limits on the process's own memory and CPU. Past either one, new
+// connections and requests are refused until usage falls back below 90% of
+// the limits, so shuttle degrades rather than being OOM-killed mid-traffic.
+
+const selfLimitInterval = time.Second
+
+// usage must fall below this percentage of the limits to stop shedding
+const selfLimitResume = 90
+
+// The json stats of the process and its limits
+type ProcessStat struct {
+	RSS      int64   `json:"rss"`
+	CPU      float64 `json:"cpu_percent"`
+	MaxRSS   int64   `json:"max_rss"`
+	MaxCPU   int     `json:"max_cpu_percent"`
+	Shedding bool    `json:"shedding"`
+	Reason   string  `json:"reason,omitempty"`
+	// ShedSince is when the current shedding started.
+	ShedSince time.Time `json:"shed_since"`
+	// Shed counts the connections and requests refused over the limits.
+	Shed int64 `json:"shed"`
+}
+
+type selfLimiter struct {
+	sync.Mutex
+	maxRSS int64
+	maxCPU int
+
+	rss    int64
+	cpu    float64
+	reason string
+	since  time.Time
+
+	// the CPU time used as of the last sample
+	lastCPU    time.Duration
+	lastSample time.Time
+
+	start sync.Once
+
+	// read on the data path without the lock
+	shedding int32
+	shed     int64
+}
+
+var selfLimit = &selfLimiter{}
+
+// Set the limits, with the RSS in megabytes and the CPU as a percentage of
+// one core. A value <= 0 is unlimited. The usage is sampled once there's a
+// limit.
+func (l *selfLimiter) SetLimits(maxRSS, maxCPU int) {
+	if maxCPU > 0 && !cpuSampling {
+		log.Warnf("WARN: The CPU usage can't be sampled on this platform, so max-cpu is disabled")
+		maxCPU = 0
+	}
+
+	l.Lock()
+	if maxRSS < 0 {
+		maxRSS = 0
+	}
+	if maxCPU < 0 {
+		maxCPU = 0
+	}
+	l.maxRSS = int64(maxRSS) << 20
+	l.maxCPU = maxCPU
+	l.Unlock()
+
+	if maxRSS > 0 || maxCPU > 0 {
+		l.start.Do(func() {
+			log.Printf("INFO: Limiting the process to %dMB RSS and %d%% CPU", maxRSS, maxCPU)
+			go l.monitor()
+		})
+	}
+}
+
+// Report whether new connections are being shed. This is counted as a
+// connection shed, so it's only called for new connections.
+func (l *selfLimiter) Shedding() bool {
+	if atomic.LoadInt32(&l.shedding) == 0 {
+		return false
+	}
+	atomic.AddInt64(&l.shed, 1)
+	return true
+}
+
+func (l *selfLimiter) Stats() ProcessStat {
+	l.Lock()
+	defer l.Unlock()
+
+	stats := ProcessStat{
+		RSS:      l.rss,
+		CPU:      l.cpu,
+		MaxRSS:   l.maxRSS,
+		MaxCPU:   l.maxCPU,
+		Shedding: atomic.LoadInt32(&l.shedding) == 1,
+		Shed:     atomic.LoadInt64(&l.shed),
+	}
+	if stats.Shedding {
+		stats.Reason = l.reason
+		stats.ShedSince = l.since
+	}
+	return stats
+}
+
+func (l *selfLimiter) monitor() {
+	t := time.NewTicker(selfLimitInterval)
+	defer t.Stop()
+	for now := range t.C {
+		rss := readRSS()
+		cpu := l.sampleCPU(now)
+		l.update(now, rss, cpu)
+	}
+}
+
+// Return the CPU used since the last sample, as a percentage of one core.
+func (l *selfLimiter) sampleCPU(now time.Time) float64 {
+	used, err := processCPUTime()
+	if err != nil {
+		return 0
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	cpu := 0.0
+	if !l.lastSample.IsZero() {
+		if elapsed := now.Sub(l.lastSample); elapsed > 0 {
+			cpu = float64(used-l.lastCPU) * 100 / float64(elapsed)
+		}
+	}
+	l.lastCPU = used
+	l.lastSample = now
+	return cpu
+}
+
+// Record the usage, and start or stop shedding.
+func (l *selfLimiter) update(now time.Time, rss int64, cpu float64) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.rss = rss
+	l.cpu = cpu
+
+	reason := ""
+	switch {
+	case l.maxRSS > 0 && rss > l.maxRSS:
+		reason = fmt.Sprintf("RSS %dMB over %dMB", rss>>20, l.maxRSS>>20)
+	case l.maxCPU > 0 && cpu > float64(l.maxCPU):
+		reason = fmt.Sprintf("CPU %.0f%% over %d%%", cpu, l.maxCPU)
+	}
+
+	shedding := atomic.LoadInt32(&l.shedding) == 1
+	if reason != "" {
+		if !shedding {
+			log.Warnf("WARN: Shedding new connections: %s", reason)
+			l.since = now
+			atomic.StoreInt32(&l.shedding, 1)
+		}
+		l.reason = reason
+		return
+	}
+
+	if !shedding {
+		return
+	}
+
+	rssOK := l.maxRSS <= 0 || rss*100 < l.maxRSS*selfLimitResume
+	cpuOK := l.maxCPU <= 0 || cpu*100 < float64(l.maxCPU*selfLimitResume)
+	if rssOK && cpuOK {
+		log.Printf("INFO: Stopped shedding new connections after %s", now.Sub(l.since))
+		atomic.StoreInt32(&l.shedding, 0)
+		l.reason = ""
+	}
+}
+
+// Return the resident set size of the process, or the memory obtained from
+// the OS by the Go runtime where /proc isn't available.
+func readRSS() int64 {
+	if data, err := ioutil.ReadFile("/proc/self/statm"); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) > 1 {
+			if pages, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				return pages * int64(os.Getpagesize())
+			}
+		}
+	}
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return int64(m.Sys)
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+// +build !unix
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// there's no getrusage to sample the CPU time, so -max-cpu is disabled
+const cpuSampling = false
+
+func processCPUTime() (time.Duration, error) {
+	return 0, errors.New("the process CPU time isn't available on this platform")
+}
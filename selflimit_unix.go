@@ -0,0 +1,21 @@
+//go:build unix
+// +build unix
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// the CPU time of the process can be sampled for -max-cpu
+const cpuSampling = true
+
+// Return the user and system CPU time used by the process.
+func processCPUTime() (time.Duration, error) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, err
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), nil
+}
@@ -170,11 +170,18 @@ func (s *testHTTPServer) addrHandler(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, s.addr)
 }
 
+// respond with the value of the named request header
+func (s *testHTTPServer) headerHandler(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, r.Header.Get(r.FormValue("name")))
+}
+
 func (s *testHTTPServer) errorHandler(w http.ResponseWriter, r *http.Request) {
 	code, _ := strconv.Atoi(r.FormValue("code"))
 	if code > 0 {
 		w.WriteHeader(code)
-		io.WriteString(w, s.addr)
+		if r.FormValue("empty") == "" {
+			io.WriteString(w, s.addr)
+		}
 		return
 	}
 
@@ -204,6 +211,7 @@ func NewHTTPTestServer(addr string, c fataler) (*testHTTPServer, error) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/addr", s.addrHandler)
 	mux.HandleFunc("/error", s.errorHandler)
+	mux.HandleFunc("/header", s.headerHandler)
 
 	s.Config.Handler = mux
 	s.Start()
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
 	"encoding/binary"
 	"fmt"
 	"net"
 	"net/http"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -23,6 +27,10 @@ var (
 	ErrInvalidServiceUpdate = fmt.Errorf("configuration requires a new service")
 )
 
+// Requests with this header set to the service's MaintenanceToken bypass
+// maintenance mode.
+const MaintenanceBypassHeader = "X-Maintenance-Bypass"
+
 type Service struct {
 	sync.Mutex
 	Name            string
@@ -43,19 +51,125 @@ type Service struct {
 	HTTPConns       int64
 	HTTPErrors      int64
 	HTTPActive      int64
+	NoBackend       int64
+	ClientAborted   int64
 	Network         string
 	MaintenanceMode bool
+	LazyBind        bool
+	SNIRouting      bool
+	HTTP2           bool
+	FanOut          bool
+	AcceptProxy     bool
+	SendProxy       string
+	BindRetry       time.Duration
+	DNSFailTimeout  time.Duration
+
+	// options for older HTTP/1.x backends
+	ForceHTTP11         bool
+	NoChunked           bool
+	NormalizeConnection bool
+
+	// how long removed backends are kept, to carry over their stats if
+	// they're added back
+	KeepBackendStats time.Duration
+	retired          map[string]retiredBackend
+
+	// HTTP timeouts for the whole request, the backend's response headers,
+	// and idle client connections after a request
+	RequestTimeout        time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleTimeout           time.Duration
+
+	// Interval to flush HTTP responses to the client, as configured
+	FlushInterval time.Duration
+
+	ClientTOS      int
+	ServerTOS      int
+	PanicThreshold int
+	FlapCount      int
+	FlapWindow     time.Duration
+	FlapHoldDown   time.Duration
+
+	// the profile the config inherited from
+	Profile string
+
+	// UDP backends must reply to a new session within this window
+	UDPResponseWindow time.Duration
+
+	// per client IP limit on TCP connections and HTTP requests
+	RateLimit   float64
+	RateBurst   int
+	RateLimited int64
+	limiter     *rateLimiter
+
+	// per source limits on UDP datagrams
+	UDPPacketRate  float64
+	UDPPacketBurst int
+	UDPByteRate    float64
+	UDPByteBurst   int
+	UDPDropped     int64
+	UDPDropBytes   int64
+	packetLimiter  *rateLimiter
+	byteLimiter    *rateLimiter
+
+	// fraction of HTTP requests traced
+	TraceSample float64
+
+	// cap on concurrent TCP connections and HTTP requests
+	MaxConnections int
+	ConnLimited    int64
+	conns          connLimiter
+
+	// connections and requests refused over the process's own limits
+	Overloaded int64
+
+	// largest HTTP request body sent to the backends, 0 for no limit
+	MaxRequestBody int64
+	TooLarge       int64
+
+	// HTTP requests refused for a method not in AllowMethods
+	BadMethod int64
+
+	// largest HTTP request body buffered to be replayed on another backend
+	ReplayBody int64
+
+	// requests turned away by priority under load
+	Shed       int64
+	shedder    *loadShedder
+	shedderCfg *client.PriorityConfig
+
+	// state of the listener
+	bindState string
+
+	// written to TCP clients when no backend could be reached
+	noBackendResponse []byte
+
+	// set while fewer than PanicThreshold percent of backends are up
+	panicMode bool
 
 	// Next returns the backends in priority order.
 	next func() []*Backend
 
+	// cost orders the backends for COST balancing. It defaults to
+	// backendCost, and may be replaced to weigh in other load signals.
+	cost func(*Backend) float64
+
 	// the last backend we used and the number of times we used it
 	lastBackend int
 	lastCount   int
 
 	// Each Service owns it's own netowrk listener
-	tcpListener net.Listener
-	udpListener *net.UDPConn
+	tcpListener  net.Listener
+	udpListeners []*udpPort
+
+	// opens the TCP listener
+	network Network
+
+	// serves HTTP to the virtual backends of other services
+	localHTTP *memListener
+
+	// set while the service is drained through the admin API
+	drain *serviceDrain
 
 	// reverse proxy for vhost routing
 	httpProxy *ReverseProxy
@@ -66,14 +180,125 @@ type Service struct {
 	// the original map of errors as loaded in by a config
 	errPagesCfg map[string][]int
 
+	// codes where only empty responses get the error page
+	errPagesIfEmpty []int
+
+	// how often the error pages are fetched again
+	errPagesRefresh time.Duration
+
+	// backend response codes which are retried
+	retryStatus []int
+
+	// paths and vhosts served without the HTTPSRedirect
+	httpsRedirectExcept []string
+
+	// HTTP methods passed on to the backends, or nil for all
+	allowMethods []string
+
+	// handling of the client's forwarding headers
+	forwarded string
+
 	// net.Dialer so we don't need to allocate one every time
 	dialer *net.Dialer
+
+	// tap for sampled TCP connections
+	capture    *capture
+	captureCfg *client.CaptureConfig
+
+	// requests kept when they fail
+	errCapture    *errorCapture
+	errCaptureCfg *client.ErrorCaptureConfig
+
+	// error rate alarm
+	budget    *errorBudget
+	budgetCfg *client.ErrorBudgetConfig
+
+	// settings for each backend's circuit breaker
+	breakerCfg *client.CircuitBreakerConfig
+
+	// ejects backends failing more than the others
+	outliers    *outlierDetector
+	outliersCfg *client.OutlierDetectionConfig
+
+	// bearer token verification
+	jwt    *jwtVerifier
+	jwtCfg *client.JWTConfig
+
+	// CAs for required client certificates
+	clientCA  string
+	clientCAs *x509.CertPool
+
+	// clients which bypass maintenance mode
+	maintenanceToken string
+	maintenanceAllow []string
+	maintenanceNets  []*net.IPNet
+
+	// custom maintenance response and schedule
+	maintenance    *maintenanceResponse
+	maintenanceCfg *client.MaintenanceConfig
+
+	// request headers removed or replaced before proxying
+	stripHeaders []string
+	setHeaders   map[string]string
+
+	// request and response headers rewritten by the proxy
+	headerRules    []client.HeaderRule
+	headerRulesCfg []client.HeaderRule
+
+	// the config values of secrets, which may only refer to the secret
+	maintenanceTokenCfg string
+	setHeadersCfg       map[string]string
+
+	// lifetimes of the proxied TCP connections
+	ages connAges
+
+	// time to the response headers of the HTTP requests, for the service and
+	// each virtual host
+	latency      latencyHist
+	vhostLatency vhostLatency
+
+	// requests taken on shared virtual hosts
+	routes    []headerRoute
+	routesCfg []client.HeaderRoute
+
+	// compressed responses, and the bytes saved
+	Compressed    int64
+	CompressSaved int64
+	compress      *compressor
+	compressCfg   *client.CompressConfig
+
+	// path rewrites and redirects
+	rewrites     []rewriteRule
+	rewritesCfg  []client.RewriteRule
+	redirects    []redirectRule
+	redirectsCfg []client.RedirectRule
+
+	// headers added to the responses, by virtual host
+	securityHeaders    []securityHeaders
+	securityHeadersCfg []client.SecurityHeadersConfig
+
+	// health checks from upstream load balancers
+	lbHealth    *lbHealth
+	lbHealthCfg *client.LBHealthConfig
 }
 
+// Listener states reported in the ServiceStat
+const (
+	bindWaiting  = "waiting"
+	bindRetrying = "retrying"
+	bindBound    = "bound"
+	bindFailed   = "failed"
+	bindStopped  = "stopped"
+)
+
+// Longest delay between attempts to bind an address in use
+const maxBindDelay = 5 * time.Second
+
 // Stats returned about a service
 type ServiceStat struct {
 	Name          string        `json:"name"`
 	Addr          string        `json:"address"`
+	BoundAddr     string        `json:"bound_address,omitempty"`
 	VirtualHosts  []string      `json:"virtual_hosts"`
 	Backends      []BackendStat `json:"backends"`
 	Balance       string        `json:"balance"`
@@ -91,6 +316,63 @@ type ServiceStat struct {
 	HTTPActive    int64         `json:"http_active"`
 	HTTPConns     int64         `json:"http_connections"`
 	HTTPErrors    int64         `json:"http_errors"`
+	Upgrades      int64         `json:"upgrades"`
+	UpgradeActive int64         `json:"upgrade_active"`
+	NoBackend     int64         `json:"no_backend"`
+	ClientAborted int64         `json:"client_aborted"`
+	RateLimited   int64         `json:"rate_limited"`
+	ConnLimited   int64         `json:"conn_limited"`
+	Shed          int64         `json:"shed"`
+	Overloaded    int64         `json:"overloaded"`
+	TooLarge      int64         `json:"too_large"`
+	BadMethod     int64         `json:"bad_method"`
+	Compressed    int64         `json:"compressed"`
+	CompressSaved int64         `json:"compress_saved_bytes"`
+	UDPDropped    int64         `json:"udp_dropped"`
+	UDPDropBytes  int64         `json:"udp_dropped_bytes"`
+	Binding       string        `json:"binding"`
+	Sessions      int64         `json:"sessions"`
+	Ports         []PortStat    `json:"ports,omitempty"`
+	Panic         bool          `json:"panic"`
+	Features      []string      `json:"features"`
+	Degraded      bool          `json:"degraded"`
+	ErrorRate     float64       `json:"error_rate"`
+	Idle          bool          `json:"idle,omitempty"`
+
+	// ConnAges is a histogram of the lifetimes of closed TCP connections,
+	// and the ages of the open ones. OldestConn is the age of the oldest
+	// open connection in milliseconds.
+	ConnAges   []AgeBucket `json:"connection_ages"`
+	OldestConn int         `json:"oldest_connection"`
+
+	// Drain is the progress of a drain through the admin API, while the
+	// service is draining.
+	Drain *ServiceDrainStat `json:"drain,omitempty"`
+
+	// Latency is the time to the response headers of the service's HTTP
+	// requests in milliseconds, and VHostLatency the same for each of its
+	// virtual hosts.
+	Latency      *LatencyStat           `json:"latency,omitempty"`
+	VHostLatency map[string]LatencyStat `json:"vhost_latency,omitempty"`
+}
+
+// A UDP listener for one port of the service's address range
+type udpPort struct {
+	conn *net.UDPConn
+	// from the first port of the range
+	offset int
+
+	Rcvd     int64
+	Sent     int64
+	Sessions int64
+}
+
+// Stats for each port of a UDP port range
+type PortStat struct {
+	Port     int   `json:"port"`
+	Rcvd     int64 `json:"received"`
+	Sent     int64 `json:"sent"`
+	Sessions int64 `json:"sessions"`
 }
 
 // Create a Service from a config struct
@@ -107,12 +389,85 @@ func NewService(cfg client.ServiceConfig) *Service {
 		ClientTimeout:   time.Duration(cfg.ClientTimeout) * time.Millisecond,
 		ServerTimeout:   time.Duration(cfg.ServerTimeout) * time.Millisecond,
 		DialTimeout:     time.Duration(cfg.DialTimeout) * time.Millisecond,
-		errorPages:      NewErrorResponse(cfg.ErrorPages),
+		errorPages:      NewErrorResponse(cfg.Name, cfg.ErrorPages),
 		errPagesCfg:     cfg.ErrorPages,
+		errPagesIfEmpty: cfg.ErrorPagesIfEmpty,
 		Network:         cfg.Network,
+		network:         socketNetwork{},
 		MaintenanceMode: cfg.MaintenanceMode,
+		LazyBind:        cfg.LazyBind,
+		FanOut:          cfg.FanOut,
+		AcceptProxy:     cfg.AcceptProxy,
+		SendProxy:       cfg.SendProxy,
+		SNIRouting:      cfg.SNIRouting,
+		HTTP2:           cfg.HTTP2,
+		BindRetry:       time.Duration(cfg.BindRetry) * time.Millisecond,
+		DNSFailTimeout:  time.Duration(cfg.DNSFailTimeout) * time.Millisecond,
+		RequestTimeout:  time.Duration(cfg.RequestTimeout) * time.Millisecond,
+		IdleTimeout:     time.Duration(cfg.IdleTimeout) * time.Millisecond,
+		ClientTOS:       cfg.ClientTOS,
+		ServerTOS:       cfg.ServerTOS,
+		PanicThreshold:  cfg.PanicThreshold,
+		FlapCount:       cfg.FlapCount,
+		FlapWindow:      time.Duration(cfg.FlapWindow) * time.Millisecond,
+		FlapHoldDown:    time.Duration(cfg.FlapHoldDown) * time.Millisecond,
+		Profile:         cfg.Profile,
 	}
 
+	s.UDPResponseWindow = time.Duration(cfg.UDPResponseWindow) * time.Millisecond
+	s.ResponseHeaderTimeout = time.Duration(cfg.ResponseHeaderTimeout) * time.Millisecond
+	s.FlushInterval = time.Duration(cfg.FlushInterval) * time.Millisecond
+	s.KeepBackendStats = time.Duration(cfg.KeepBackendStats) * time.Millisecond
+	s.setRateLimit(cfg.RateLimit, cfg.RateBurst)
+	s.setUDPRateLimit(cfg)
+	s.setMaxConnections(cfg.MaxConnections)
+	s.MaxRequestBody = cfg.MaxRequestBody
+	s.ReplayBody = cfg.ReplayBody
+	s.ForceHTTP11 = cfg.ForceHTTP11
+	s.NoChunked = cfg.NoChunked
+	s.NormalizeConnection = cfg.NormalizeConnection
+	s.TraceSample = cfg.TraceSample
+	s.setHeaderPolicy(cfg.StripHeaders, cfg.SetHeaders)
+	s.setMaintenanceBypass(cfg.MaintenanceToken, cfg.MaintenanceAllow)
+	s.maintenanceCfg = cfg.Maintenance
+	s.maintenance = newMaintenanceResponse(s.Name, cfg.Maintenance)
+	s.setClientCA(cfg.ClientCA)
+	s.errorPages.SetIfEmpty(cfg.ErrorPagesIfEmpty)
+	s.errPagesRefresh = time.Duration(cfg.ErrorPagesRefresh) * time.Millisecond
+	s.errorPages.SetRefresh(s.errPagesRefresh)
+	s.retryStatus = cfg.RetryStatus
+	s.httpsRedirectExcept = cfg.HTTPSRedirectExcept
+	s.allowMethods = cfg.AllowMethods
+	s.setForwarded(cfg.Forwarded)
+	s.headerRulesCfg = cfg.HeaderRules
+	s.headerRules = newHeaderRules(s.Name, cfg.HeaderRules)
+	s.noBackendResponse = []byte(cfg.NoBackendResponse)
+	s.captureCfg = cfg.Capture
+	s.capture = newCapture(s.Name, cfg.Capture)
+	s.errCaptureCfg = cfg.ErrorCapture
+	s.errCapture = newErrorCapture(s.Name, cfg.ErrorCapture)
+	s.budgetCfg = cfg.ErrorBudget
+	s.budget = newErrorBudget(s.Name, cfg.ErrorBudget)
+	s.breakerCfg = cfg.CircuitBreaker
+	s.outliersCfg = cfg.OutlierDetection
+	s.outliers = newOutlierDetector(s.Name, cfg.OutlierDetection)
+	s.jwtCfg = cfg.JWT
+	s.jwt = newJWTVerifier(s.Name, cfg.JWT)
+	s.routesCfg = cfg.HeaderRoutes
+	s.routes = newHeaderRoutes(s.Name, cfg.HeaderRoutes)
+	s.lbHealthCfg = cfg.LBHealth
+	s.lbHealth = newLBHealth(s, cfg.LBHealth)
+	s.shedderCfg = cfg.Priority
+	s.shedder = newLoadShedder(s.Name, cfg.Priority)
+	s.rewritesCfg = cfg.Rewrites
+	s.rewrites = newRewriteRules(s.Name, cfg.Rewrites)
+	s.compressCfg = cfg.Compress
+	s.compress = newCompressor(cfg.Compress)
+	s.redirectsCfg = cfg.Redirects
+	s.redirects = newRedirectRules(s.Name, cfg.Redirects)
+	s.securityHeadersCfg = cfg.SecurityHeaders
+	s.securityHeaders = newSecurityHeaders(s.Name, cfg.SecurityHeaders)
+
 	// TODO: insert this into the backends too
 	s.dialer = &net.Dialer{
 		Timeout:   s.DialTimeout,
@@ -120,17 +475,24 @@ func NewService(cfg client.ServiceConfig) *Service {
 	}
 
 	// create our reverse proxy, using our load-balancing Dial method
-	proxyTransport := &http.Transport{
-		Dial:                s.Dial,
-		MaxIdleConnsPerHost: 10,
-	}
-	s.httpProxy = NewReverseProxy(proxyTransport)
-	s.httpProxy.FlushInterval = time.Second
+	s.httpProxy = NewReverseProxy(newBackendTransport(s))
+	s.httpProxy.FlushInterval = httpFlushInterval(s.FlushInterval)
 	s.httpProxy.Director = func(req *http.Request) {
 		req.URL.Scheme = "http"
 	}
-
-	s.httpProxy.OnResponse = []ProxyCallback{logProxyRequest, s.errStats, s.errorPages.CheckResponse}
+	s.httpProxy.BackendName = s.backendName
+	s.httpProxy.Dial = s.DialContext
+	s.httpProxy.RetryStatus = s.isRetryStatus
+	s.httpProxy.BackendFailed = s.backendFailed
+	s.httpProxy.ReplayBody = s.ReplayBody
+	s.setHTTPCompat()
+	s.httpProxy.TrustForwarded = s.trustForwarded
+	s.httpProxy.CircuitAllow = s.circuitAllow
+	s.httpProxy.CircuitRecord = s.circuitRecord
+	s.httpProxy.GRPCStatus = s.grpcStats
+
+	s.httpProxy.OnRequest = []ProxyCallback{s.filterHeaders, s.rewriteRequest, s.startTrace, s.tapRequestBody}
+	s.httpProxy.OnResponse = []ProxyCallback{logProxyRequest, s.finishTrace, s.errStats, s.recordLatency, s.captureError, s.addSecurityHeaders, s.rewriteResponse, s.errorPages.CheckResponse, s.compressResponse}
 
 	if s.CheckInterval == 0 {
 		s.CheckInterval = client.DefaultCheckInterval
@@ -155,12 +517,15 @@ func NewService(cfg client.ServiceConfig) *Service {
 		s.next = s.roundRobin
 	case client.LeastConn:
 		s.next = s.leastConn
+	case client.LeastCost:
+		s.next = s.leastCost
 	default:
 		if cfg.Balance != "" {
 			log.Warnf("WARN: Invalid balancing algorithm '%s'", cfg.Balance)
 		}
 		s.next = s.roundRobin
 	}
+	s.cost = backendCost
 
 	return s
 }
@@ -170,12 +535,8 @@ func (s *Service) UpdateConfig(cfg client.ServiceConfig) error {
 	s.Lock()
 	defer s.Unlock()
 
-	if s.ClientTimeout != time.Duration(cfg.ClientTimeout)*time.Millisecond {
-		return ErrInvalidServiceUpdate
-	}
-
-	if s.Addr != "" && s.Addr != cfg.Addr {
-		return ErrInvalidServiceUpdate
+	if err := s.validUpdate(cfg); err != nil {
+		return err
 	}
 
 	s.CheckInterval = cfg.CheckInterval
@@ -183,8 +544,141 @@ func (s *Service) UpdateConfig(cfg client.ServiceConfig) error {
 	s.Rise = cfg.Rise
 	s.ServerTimeout = time.Duration(cfg.ServerTimeout) * time.Millisecond
 	s.DialTimeout = time.Duration(cfg.DialTimeout) * time.Millisecond
+	s.DNSFailTimeout = time.Duration(cfg.DNSFailTimeout) * time.Millisecond
+	s.KeepBackendStats = time.Duration(cfg.KeepBackendStats) * time.Millisecond
+	s.RequestTimeout = time.Duration(cfg.RequestTimeout) * time.Millisecond
+	s.ResponseHeaderTimeout = time.Duration(cfg.ResponseHeaderTimeout) * time.Millisecond
+	s.IdleTimeout = time.Duration(cfg.IdleTimeout) * time.Millisecond
+	s.FlushInterval = time.Duration(cfg.FlushInterval) * time.Millisecond
+	s.httpProxy.SetFlushInterval(httpFlushInterval(s.FlushInterval))
+	s.ServerTOS = cfg.ServerTOS
+	s.PanicThreshold = cfg.PanicThreshold
+	s.FlapCount = cfg.FlapCount
+	s.FlapWindow = time.Duration(cfg.FlapWindow) * time.Millisecond
+	s.FlapHoldDown = time.Duration(cfg.FlapHoldDown) * time.Millisecond
+	s.Profile = cfg.Profile
 	s.HTTPSRedirect = cfg.HTTPSRedirect
+	s.httpsRedirectExcept = cfg.HTTPSRedirectExcept
+	s.allowMethods = cfg.AllowMethods
+	s.setForwarded(cfg.Forwarded)
 	s.MaintenanceMode = cfg.MaintenanceMode
+	s.LazyBind = cfg.LazyBind
+	s.FanOut = cfg.FanOut
+	s.UDPResponseWindow = time.Duration(cfg.UDPResponseWindow) * time.Millisecond
+	s.setRateLimit(cfg.RateLimit, cfg.RateBurst)
+	s.setUDPRateLimit(cfg)
+	s.setMaxConnections(cfg.MaxConnections)
+	s.MaxRequestBody = cfg.MaxRequestBody
+	s.ReplayBody = cfg.ReplayBody
+	s.httpProxy.SetReplayBody(s.ReplayBody)
+	s.ForceHTTP11 = cfg.ForceHTTP11
+	s.NoChunked = cfg.NoChunked
+	s.NormalizeConnection = cfg.NormalizeConnection
+	s.setHTTPCompat()
+	s.TraceSample = cfg.TraceSample
+	s.setHeaderPolicy(cfg.StripHeaders, cfg.SetHeaders)
+	s.AcceptProxy = cfg.AcceptProxy
+	s.SendProxy = cfg.SendProxy
+	s.SNIRouting = cfg.SNIRouting
+	s.HTTP2 = cfg.HTTP2
+	s.BindRetry = time.Duration(cfg.BindRetry) * time.Millisecond
+	s.setMaintenanceBypass(cfg.MaintenanceToken, cfg.MaintenanceAllow)
+
+	if s.clientCA != cfg.ClientCA {
+		s.setClientCA(cfg.ClientCA)
+	}
+
+	s.errPagesIfEmpty = cfg.ErrorPagesIfEmpty
+	s.errorPages.SetIfEmpty(cfg.ErrorPagesIfEmpty)
+	s.errPagesRefresh = time.Duration(cfg.ErrorPagesRefresh) * time.Millisecond
+	s.errorPages.SetRefresh(s.errPagesRefresh)
+	s.retryStatus = cfg.RetryStatus
+	s.noBackendResponse = []byte(cfg.NoBackendResponse)
+
+	if !reflect.DeepEqual(s.captureCfg, cfg.Capture) {
+		s.captureCfg = cfg.Capture
+		s.capture = newCapture(s.Name, cfg.Capture)
+	}
+
+	if !reflect.DeepEqual(s.errCaptureCfg, cfg.ErrorCapture) {
+		s.errCaptureCfg = cfg.ErrorCapture
+		s.errCapture = newErrorCapture(s.Name, cfg.ErrorCapture)
+	}
+
+	if !reflect.DeepEqual(s.budgetCfg, cfg.ErrorBudget) {
+		s.budgetCfg = cfg.ErrorBudget
+		s.budget = newErrorBudget(s.Name, cfg.ErrorBudget)
+	}
+
+	if !reflect.DeepEqual(s.maintenanceCfg, cfg.Maintenance) {
+		s.maintenanceCfg = cfg.Maintenance
+		s.maintenance = newMaintenanceResponse(s.Name, cfg.Maintenance)
+	}
+
+	if !reflect.DeepEqual(s.breakerCfg, cfg.CircuitBreaker) {
+		s.breakerCfg = cfg.CircuitBreaker
+		for _, b := range s.Backends {
+			b.Lock()
+			b.breaker = newCircuitBreaker(cfg.CircuitBreaker)
+			b.Unlock()
+		}
+	}
+
+	if !reflect.DeepEqual(s.outliersCfg, cfg.OutlierDetection) {
+		s.outliersCfg = cfg.OutlierDetection
+		s.outliers = newOutlierDetector(s.Name, cfg.OutlierDetection)
+		// the new detector starts with no backends ejected
+		for _, b := range s.Backends {
+			b.eject(time.Time{})
+		}
+	}
+
+	if !reflect.DeepEqual(s.jwtCfg, cfg.JWT) {
+		s.jwtCfg = cfg.JWT
+		s.jwt = newJWTVerifier(s.Name, cfg.JWT)
+	}
+
+	if !reflect.DeepEqual(s.headerRulesCfg, cfg.HeaderRules) {
+		s.headerRulesCfg = cfg.HeaderRules
+		s.headerRules = newHeaderRules(s.Name, cfg.HeaderRules)
+	}
+
+	if !reflect.DeepEqual(s.routesCfg, cfg.HeaderRoutes) {
+		s.routesCfg = cfg.HeaderRoutes
+		s.routes = newHeaderRoutes(s.Name, cfg.HeaderRoutes)
+	}
+
+	if !reflect.DeepEqual(s.lbHealthCfg, cfg.LBHealth) {
+		s.lbHealth.stop()
+		s.lbHealthCfg = cfg.LBHealth
+		s.lbHealth = newLBHealth(s, cfg.LBHealth)
+		s.lbHealth.start()
+	}
+
+	if !reflect.DeepEqual(s.shedderCfg, cfg.Priority) {
+		s.shedderCfg = cfg.Priority
+		s.shedder = newLoadShedder(s.Name, cfg.Priority)
+	}
+
+	if !reflect.DeepEqual(s.compressCfg, cfg.Compress) {
+		s.compressCfg = cfg.Compress
+		s.compress = newCompressor(cfg.Compress)
+	}
+
+	if !reflect.DeepEqual(s.securityHeadersCfg, cfg.SecurityHeaders) {
+		s.securityHeadersCfg = cfg.SecurityHeaders
+		s.securityHeaders = newSecurityHeaders(s.Name, cfg.SecurityHeaders)
+	}
+
+	if !reflect.DeepEqual(s.rewritesCfg, cfg.Rewrites) {
+		s.rewritesCfg = cfg.Rewrites
+		s.rewrites = newRewriteRules(s.Name, cfg.Rewrites)
+	}
+
+	if !reflect.DeepEqual(s.redirectsCfg, cfg.Redirects) {
+		s.redirectsCfg = cfg.Redirects
+		s.redirects = newRedirectRules(s.Name, cfg.Redirects)
+	}
 
 	if s.Balance != cfg.Balance {
 		s.Balance = cfg.Balance
@@ -193,6 +687,8 @@ func (s *Service) UpdateConfig(cfg client.ServiceConfig) error {
 			s.next = s.roundRobin
 		case client.LeastConn:
 			s.next = s.leastConn
+		case client.LeastCost:
+			s.next = s.leastCost
 		default:
 			if cfg.Balance != "" {
 				log.Warnf("WARN: Invalid balancing algorithm '%s'", cfg.Balance)
@@ -204,38 +700,34 @@ func (s *Service) UpdateConfig(cfg client.ServiceConfig) error {
 	return nil
 }
 
-func (s *Service) Stats() ServiceStat {
+// Check the config can be applied to the running service.
+func (s *Service) checkUpdate(cfg client.ServiceConfig) error {
 	s.Lock()
 	defer s.Unlock()
+	return s.validUpdate(cfg)
+}
 
-	stats := ServiceStat{
-		Name:          s.Name,
-		Addr:          s.Addr,
-		VirtualHosts:  s.VirtualHosts,
-		Balance:       s.Balance,
-		CheckInterval: s.CheckInterval,
-		Fall:          s.Fall,
-		Rise:          s.Rise,
-		ClientTimeout: int(s.ClientTimeout / time.Millisecond),
-		ServerTimeout: int(s.ServerTimeout / time.Millisecond),
-		DialTimeout:   int(s.DialTimeout / time.Millisecond),
-		HTTPConns:     s.HTTPConns,
-		HTTPErrors:    s.HTTPErrors,
-		HTTPActive:    atomic.LoadInt64(&s.HTTPActive),
-		Rcvd:          atomic.LoadInt64(&s.Rcvd),
-		Sent:          atomic.LoadInt64(&s.Sent),
+// Check for changes to the config which require a new listener.
+// Service *must* be locked.
+func (s *Service) validUpdate(cfg client.ServiceConfig) error {
+	if s.ClientTimeout != time.Duration(cfg.ClientTimeout)*time.Millisecond {
+		return ErrInvalidServiceUpdate
 	}
 
-	for _, b := range s.Backends {
-		stats.Backends = append(stats.Backends, b.Stats())
-		stats.Sent += b.Sent
-		stats.Rcvd += b.Rcvd
-		stats.Errors += b.Errors
-		stats.Conns += b.Conns
-		stats.Active += b.Active
+	if s.Addr != "" && s.Addr != cfg.Addr {
+		return ErrInvalidServiceUpdate
+	}
+
+	if s.ClientTOS != cfg.ClientTOS {
+		return ErrInvalidServiceUpdate
 	}
+	return nil
+}
 
-	return stats
+func (s *Service) Stats() ServiceStat {
+	r := s.statsReader()
+	r.count()
+	return r.stats
 }
 
 func (s *Service) Config() client.ServiceConfig {
@@ -247,21 +739,84 @@ func (s *Service) Config() client.ServiceConfig {
 func (s *Service) config() client.ServiceConfig {
 
 	config := client.ServiceConfig{
-		Name:            s.Name,
-		Addr:            s.Addr,
-		VirtualHosts:    s.VirtualHosts,
-		HTTPSRedirect:   s.HTTPSRedirect,
-		Balance:         s.Balance,
-		CheckInterval:   s.CheckInterval,
-		Fall:            s.Fall,
-		Rise:            s.Rise,
-		ClientTimeout:   int(s.ClientTimeout / time.Millisecond),
-		ServerTimeout:   int(s.ServerTimeout / time.Millisecond),
-		DialTimeout:     int(s.DialTimeout / time.Millisecond),
-		ErrorPages:      s.errPagesCfg,
-		Network:         s.Network,
-		MaintenanceMode: s.MaintenanceMode,
+		Name:              s.Name,
+		Profile:           s.Profile,
+		Addr:              s.Addr,
+		VirtualHosts:      s.VirtualHosts,
+		HTTPSRedirect:     s.HTTPSRedirect,
+		Balance:           s.Balance,
+		CheckInterval:     s.CheckInterval,
+		Fall:              s.Fall,
+		Rise:              s.Rise,
+		ClientTimeout:     int(s.ClientTimeout / time.Millisecond),
+		ServerTimeout:     int(s.ServerTimeout / time.Millisecond),
+		DialTimeout:       int(s.DialTimeout / time.Millisecond),
+		DNSFailTimeout:    int(s.DNSFailTimeout / time.Millisecond),
+		KeepBackendStats:  int(s.KeepBackendStats / time.Millisecond),
+		RequestTimeout:    int(s.RequestTimeout / time.Millisecond),
+		IdleTimeout:       int(s.IdleTimeout / time.Millisecond),
+		ClientTOS:         s.ClientTOS,
+		ServerTOS:         s.ServerTOS,
+		PanicThreshold:    s.PanicThreshold,
+		FlapCount:         s.FlapCount,
+		FlapWindow:        int(s.FlapWindow / time.Millisecond),
+		FlapHoldDown:      int(s.FlapHoldDown / time.Millisecond),
+		NoBackendResponse: string(s.noBackendResponse),
+		Capture:           s.captureCfg,
+		ErrorCapture:      s.errCaptureCfg,
+		ErrorBudget:       s.budgetCfg,
+		CircuitBreaker:    s.breakerCfg,
+		JWT:               s.jwtCfg,
+		ErrorPages:        s.errPagesCfg,
+		ErrorPagesIfEmpty: s.errPagesIfEmpty,
+		ErrorPagesRefresh: int(s.errPagesRefresh / time.Millisecond),
+		RetryStatus:       s.retryStatus,
+		Network:           s.Network,
+		MaintenanceMode:   s.MaintenanceMode,
+		LazyBind:          s.LazyBind,
+		FanOut:            s.FanOut,
+		UDPResponseWindow: int(s.UDPResponseWindow / time.Millisecond),
+		RateLimit:         s.RateLimit,
+		RateBurst:         s.RateBurst,
+		UDPPacketRate:     s.UDPPacketRate,
+		UDPPacketBurst:    s.UDPPacketBurst,
+		UDPByteRate:       s.UDPByteRate,
+		UDPByteBurst:      s.UDPByteBurst,
+		MaxConnections:    s.MaxConnections,
+		MaxRequestBody:    s.MaxRequestBody,
+		ReplayBody:        s.ReplayBody,
+		TraceSample:       s.TraceSample,
+		StripHeaders:      s.stripHeaders,
+		SetHeaders:        s.setHeadersCfg,
+		HeaderRules:       s.headerRulesCfg,
+		HeaderRoutes:      s.routesCfg,
+		LBHealth:          s.lbHealthCfg,
+		Priority:          s.shedderCfg,
+		Forwarded:         s.forwarded,
+		Compress:          s.compressCfg,
+		Rewrites:          s.rewritesCfg,
+		Redirects:         s.redirectsCfg,
+		AcceptProxy:       s.AcceptProxy,
+		SendProxy:         s.SendProxy,
+		SNIRouting:        s.SNIRouting,
+		HTTP2:             s.HTTP2,
+		BindRetry:         int(s.BindRetry / time.Millisecond),
+		MaintenanceToken:  s.maintenanceTokenCfg,
+		ClientCA:          s.clientCA,
+		MaintenanceAllow:  s.maintenanceAllow,
+		Maintenance:       s.maintenanceCfg,
 	}
+	config.HTTPSRedirectExcept = s.httpsRedirectExcept
+	config.AllowMethods = s.allowMethods
+	config.ResponseHeaderTimeout = int(s.ResponseHeaderTimeout / time.Millisecond)
+	config.FlushInterval = int(s.FlushInterval / time.Millisecond)
+	config.ForceHTTP11 = s.ForceHTTP11
+	config.NoChunked = s.NoChunked
+	config.NormalizeConnection = s.NormalizeConnection
+	config.BoundAddr = s.boundAddr()
+	config.OutlierDetection = s.outliersCfg
+	config.SecurityHeaders = s.securityHeadersCfg
+
 	for _, b := range s.Backends {
 		config.Backends = append(config.Backends, b.Config())
 	}
@@ -273,6 +828,137 @@ func (s *Service) String() string {
 	return string(marshal(s.Config()))
 }
 
+// Return the name of the backend at addr.
+func (s *Service) backendName(addr string) string {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, b := range s.Backends {
+		if b.Addr == addr {
+			return b.Name
+		}
+	}
+	return ""
+}
+
+// Report if the request is an exception to the HTTPSRedirect, by its path
+// prefix or its virtual host.
+func (s *Service) redirectExempt(r *http.Request) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for _, except := range s.httpsRedirectExcept {
+		if strings.HasPrefix(except, "/") {
+			if strings.HasPrefix(r.URL.Path, except) {
+				return true
+			}
+		} else if strings.EqualFold(except, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Report if the request's method may be passed on to the backends.
+func (s *Service) methodAllowed(r *http.Request) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.allowMethods == nil {
+		return true
+	}
+	for _, method := range s.allowMethods {
+		if strings.ToUpper(method) == r.Method {
+			return true
+		}
+	}
+	return false
+}
+
+// Set the handling of the client's forwarding headers. An unknown setting
+// is logged, and replaces them.
+// Service *must* be locked, or not yet running.
+func (s *Service) setForwarded(forwarded string) {
+	switch forwarded {
+	case "", client.ForwardedTrust, client.ForwardedOverride:
+	default:
+		log.Errorf("ERROR: Invalid forwarded setting %q for %s", forwarded, s.Name)
+	}
+	s.forwarded = forwarded
+}
+
+// Report if the client's forwarding headers should be kept.
+func (s *Service) trustForwarded(r *http.Request) bool {
+	s.Lock()
+	forwarded := s.forwarded
+	s.Unlock()
+
+	switch forwarded {
+	case "":
+		return fromLocalService(r) || trustedProxies.Trusted(r.RemoteAddr)
+	case client.ForwardedTrust:
+		return true
+	}
+	return false
+}
+
+// Report if a backend response code should be retried.
+func (s *Service) isRetryStatus(code int) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, c := range s.retryStatus {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the circuit breaker of the backend at addr, if it has one.
+func (s *Service) circuitBreaker(addr string) *circuitBreaker {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, b := range s.Backends {
+		if b.Addr == addr {
+			b.Lock()
+			defer b.Unlock()
+			return b.breaker
+		}
+	}
+	return nil
+}
+
+// Report if the circuit breaker of the backend at addr lets a request
+// through.
+func (s *Service) circuitAllow(addr string) bool {
+	return s.circuitBreaker(addr).Allow()
+}
+
+func (s *Service) circuitRecord(addr string, failed bool) {
+	s.circuitBreaker(addr).Record(s.backendName(addr), failed)
+	s.recordOutlier(addr, failed)
+}
+
+// Count a failed response against the health of the backend at addr.
+func (s *Service) backendFailed(addr, reason string) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, b := range s.Backends {
+		if b.Addr == addr {
+			b.passiveFail(reason)
+			return
+		}
+	}
+}
+
 func (s *Service) get(name string) *Backend {
 	s.Lock()
 	defer s.Unlock()
@@ -292,9 +978,32 @@ func (s *Service) add(backend *Backend) {
 
 	log.Printf("INFO: Adding %s backend %s{%s} for %s at %s", backend.Network, backend.Name, backend.Addr, s.Name, s.Addr)
 	backend.up = true
+	backend.lastChange = time.Now()
+	backend.service = s.Name
 	backend.rwTimeout = s.ServerTimeout
 	backend.dialTimeout = s.DialTimeout
 	backend.checkInterval = time.Duration(s.CheckInterval) * time.Millisecond
+	backend.dnsFailTimeout = s.DNSFailTimeout
+	backend.flapCount = s.FlapCount
+	backend.flapWindow = s.FlapWindow
+	backend.flapHoldDown = s.FlapHoldDown
+	backend.lazyBind = s.LazyBind
+	backend.breaker = newCircuitBreaker(s.breakerCfg)
+
+	// a service on both networks shares its backends between them
+	if tcp, udp := splitNetwork(s.Network); tcp != "" && udp != "" && backend.Network != s.Network {
+		backend.Network = s.Network
+		udpAddr, udpPorts, err := resolveUDPRange(udp, backend.Addr)
+		if err != nil {
+			log.Errorf("ERROR: %s", err.Error())
+		}
+		backend.udpAddr = udpAddr
+		backend.udpPorts = udpPorts
+	}
+
+	if _, _, count, err := splitPortRange(s.Addr); err == nil && backend.udpPorts > 1 && backend.udpPorts != count {
+		log.Errorf("ERROR: backend %s port range doesn't match %s", backend.Name, s.Addr)
+	}
 
 	// We may add some allowed protocol bridging in the future, but for now just fail
 	if s.Network[:3] != backend.Network[:3] {
@@ -305,12 +1014,20 @@ func (s *Service) add(backend *Backend) {
 	for i, b := range s.Backends {
 		if b.Name == backend.Name {
 			b.Stop()
+			if s.KeepBackendStats > 0 && b.Addr == backend.Addr {
+				backend.adopt(b)
+			}
 			s.Backends[i] = backend
 			backend.Start()
 			return
 		}
 	}
 
+	if old := s.unretire(backend); old != nil {
+		log.Printf("INFO: Backend %s{%s} for %s carries over its stats", backend.Name, backend.Addr, s.Name)
+		backend.adopt(old)
+	}
+
 	s.Backends = append(s.Backends, backend)
 
 	backend.Start()
@@ -329,6 +1046,8 @@ func (s *Service) remove(name string) bool {
 			s.Backends[i], s.Backends[last] = s.Backends[last], nil
 			s.Backends = s.Backends[:last]
 			deleted.Stop()
+			s.retire(deleted)
+			s.outliers.Forget(deleted.Addr)
 			return true
 		}
 	}
@@ -344,35 +1063,200 @@ func (s *Service) start() (err error) {
 		s.Backends = make([]*Backend, 0)
 	}
 
-	switch s.Network {
-	case "tcp", "tcp4", "tcp6":
-		log.Printf("INFO: Starting TCP listener for %s on %s", s.Name, s.Addr)
+	// report the service down until it's bound and has a backend
+	s.lbHealth.start()
 
-		s.tcpListener, err = newTimeoutListener(s.Network, s.Addr, s.ClientTimeout)
-		if err != nil {
-			return err
+	if s.LazyBind && !s.checkedOK() {
+		log.Printf("INFO: Delaying listener for %s on %s until a backend is healthy", s.Name, s.Addr)
+		s.bindState = bindWaiting
+		return nil
+	}
+
+	if err := s.listen(); err != nil {
+		return s.listenFailed(err)
+	}
+	return nil
+}
+
+// Start the listener for a LazyBind service, if it isn't already listening.
+func (s *Service) bind() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.bindState != bindWaiting {
+		return nil
+	}
+
+	if err := s.listen(); err != nil {
+		return s.listenFailed(err)
+	}
+	return nil
+}
+
+// Handle a failed listen, retrying an address in use for up to BindRetry.
+// Service *must* be locked.
+func (s *Service) listenFailed(err error) error {
+	if s.BindRetry <= 0 || !isAddrInUse(err) {
+		s.bindState = bindFailed
+		return err
+	}
+
+	log.Warnf("WARN: Address %s for %s in use, retrying for %s", s.Addr, s.Name, s.BindRetry)
+	s.bindState = bindRetrying
+	go s.retryBind(time.Now().Add(s.BindRetry))
+	return nil
+}
+
+// Retry the listener with backoff until it binds, the deadline passes, or
+// the service is stopped.
+func (s *Service) retryBind(deadline time.Time) {
+	delay := 100 * time.Millisecond
+	for {
+		time.Sleep(delay)
+
+		s.Lock()
+		if s.bindState != bindRetrying {
+			s.Unlock()
+			return
 		}
 
-		go s.runTCP()
-	case "udp", "udp4", "udp6":
-		log.Printf("INFO: Starting UDP listener for %s on %s", s.Name, s.Addr)
+		err := s.listen()
+		if err == nil {
+			s.Unlock()
+			return
+		}
+
+		if !isAddrInUse(err) || time.Now().After(deadline) {
+			log.Errorf("ERROR: Unable to start service '%s': %s", s.Name, err)
+			s.bindState = bindFailed
+			s.Unlock()
+			return
+		}
+		s.Unlock()
+
+		delay *= 2
+		if delay > maxBindDelay {
+			delay = maxBindDelay
+		}
+	}
+}
 
-		laddr, err := net.ResolveUDPAddr(s.Network, s.Addr)
+// Check if any backend has passed a health check.
+// Service *must* be locked.
+func (s *Service) checkedOK() bool {
+	for _, b := range s.Backends {
+		b.Lock()
+		ok := b.checkOK > 0
+		b.Unlock()
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Open the listener and start accepting connections.
+// Service *must* be locked.
+func (s *Service) listen() (err error) {
+	tcp, udp := splitNetwork(s.Network)
+	if tcp == "" && udp == "" {
+		return fmt.Errorf("ERROR: unknown network '%s'", s.Network)
+	}
+
+	if tcp != "" {
+		if _, _, count, err := splitPortRange(s.Addr); err == nil && count > 1 {
+			return fmt.Errorf("ERROR: port ranges are only supported for udp")
+		}
+
+		proto := "TCP"
+		if sctpNetwork(tcp) {
+			proto = "SCTP"
+		}
+		log.Printf("INFO: Starting %s listener for %s on %s", proto, s.Name, s.Addr)
+
+		s.tcpListener, err = newTimeoutListener(s.network, tcp, s.Addr, s.ClientTimeout)
 		if err != nil {
-			log.Errorf("ERROR: Failed to resolve address with '%s'", err.Error())
+			s.tcpListener = nil
 			return err
 		}
-		s.udpListener, err = net.ListenUDP(s.Network, laddr)
-		if err != nil {
+		s.tcpListener.(*timeoutListener).tos = s.ClientTOS
+	}
+
+	if udp != "" {
+		addr := s.Addr
+		// a dual network service listens on the same port picked for TCP
+		if s.tcpListener != nil && ephemeralPort(addr) {
+			if tcpAddr, ok := s.tcpListener.Addr().(*net.TCPAddr); ok {
+				addr = tcpAddr.String()
+			}
+		}
+
+		log.Printf("INFO: Starting UDP listener for %s on %s", s.Name, addr)
+
+		if err := s.listenUDP(udp, addr); err != nil {
 			log.Errorf("ERROR: Failed to listen on given port with '%s'", err.Error())
+			// don't leave half of a dual network service listening
+			if s.tcpListener != nil {
+				s.tcpListener.Close()
+				s.tcpListener = nil
+			}
 			return err
 		}
+	}
 
-		go s.runUDP()
-	default:
-		return fmt.Errorf("ERROR: unknown network '%s'", s.Network)
+	if s.tcpListener != nil {
+		go s.runTCP()
 	}
+	for _, p := range s.udpListeners {
+		go s.runUDP(p)
+	}
+
+	s.bindState = bindBound
 
+	// the state config records the port the system picked
+	if ephemeralPort(s.Addr) {
+		log.Printf("INFO: Service %s is listening on %s", s.Name, s.boundAddr())
+		go writeStateConfig()
+	}
+	return nil
+}
+
+// The address the service is listening on, which differs from its Addr when
+// that has port 0 for the system to pick one.
+// Service *must* be locked.
+func (s *Service) boundAddr() string {
+	switch {
+	case s.bindState != bindBound:
+		return ""
+	case s.tcpListener != nil:
+		return s.tcpListener.Addr().String()
+	case len(s.udpListeners) > 0:
+		return s.udpListeners[0].conn.LocalAddr().String()
+	}
+	return ""
+}
+
+// Listen on every port in the address range.
+// Service *must* be locked.
+func (s *Service) listenUDP(network, addr string) error {
+	host, port, count, err := splitPortRange(addr)
+	if err != nil {
+		return err
+	}
+
+	var ports []*udpPort
+	for i := 0; i < count; i++ {
+		conn, err := listenUDPConn(network, net.JoinHostPort(host, strconv.Itoa(port+i)))
+		if err != nil {
+			for _, p := range ports {
+				p.conn.Close()
+			}
+			return err
+		}
+		ports = append(ports, &udpPort{conn: conn, offset: i})
+	}
+
+	s.udpListeners = ports
 	return nil
 }
 
@@ -431,6 +1315,15 @@ type UDPProxy struct {
 	backendAddr    *net.UDPAddr
 	connTrackTable connTrackMap
 	connTrackLock  sync.Mutex
+
+	// the listener's port for stats
+	port *udpPort
+
+	// the backend must reply within responseWindow, if set, or it's suspect
+	// for suspectHold
+	backend        *Backend
+	responseWindow time.Duration
+	suspectHold    time.Duration
 }
 
 func (s *Service) replyLoop(proxy *UDPProxy, proxyConn *net.UDPConn, clientAddr *net.UDPAddr, clientKey *connTrackKey) {
@@ -442,8 +1335,13 @@ func (s *Service) replyLoop(proxy *UDPProxy, proxyConn *net.UDPConn, clientAddr
 	}()
 
 	readBuf := make([]byte, UDPBufSize)
+	replied := false
 	for {
-		proxyConn.SetReadDeadline(time.Now().Add(UDPConnTrackTimeout))
+		timeout := UDPConnTrackTimeout
+		if !replied && proxy.responseWindow > 0 {
+			timeout = proxy.responseWindow
+		}
+		proxyConn.SetReadDeadline(time.Now().Add(timeout))
 		again:
 		read, err := proxyConn.Read(readBuf)
 		if err != nil {
@@ -455,8 +1353,17 @@ func (s *Service) replyLoop(proxy *UDPProxy, proxyConn *net.UDPConn, clientAddr
 				// expires:
 				goto again
 			}
+			if !replied && proxy.responseWindow > 0 {
+				log.Warnf("WARN: No response from %s/%s for %s within %s", s.Name, proxy.backend.Name, clientAddr, proxy.responseWindow)
+				proxy.backend.setSuspect(proxy.suspectHold)
+			}
 			return
 		}
+
+		if !replied {
+			replied = true
+			proxy.backend.clearSuspect()
+		}
 		for i := 0; i != read; {
 			n, err := proxy.listener.WriteToUDP(readBuf[i:read], clientAddr)
 			if err != nil {
@@ -465,6 +1372,7 @@ func (s *Service) replyLoop(proxy *UDPProxy, proxyConn *net.UDPConn, clientAddr
 				return
 			} else {
 				atomic.AddInt64(&s.Sent, int64(n))
+				atomic.AddInt64(&proxy.port.Sent, int64(n))
 				return
 			}
 		}
@@ -491,9 +1399,9 @@ func isClosedError(err error) bool {
 	return strings.HasSuffix(err.Error(), "use of closed network connection")
 }
 
-func (s *Service) runUDP() {
+func (s *Service) runUDP(port *udpPort) {
 	buff := make([]byte, UDPBufSize)
-	conn := s.udpListener
+	conn := port.conn
 
 	// for UDP, we can proxy the data right here.
 	for {
@@ -513,9 +1421,11 @@ func (s *Service) runUDP() {
 			//		return
 			//	}
 			if !isClosedError(err) {
-				log.Errorf("ERROR: Use of closed network. Given error: %s", err.Error())
-				break
+				log.Errorf("ERROR: %s", err.Error())
+				atomic.AddInt64(&s.Errors, 1)
 			}
+			// the listener is closed when the service stops
+			return
 		}
 
 		if read == 0 {
@@ -523,47 +1433,73 @@ func (s *Service) runUDP() {
 		}
 
 		atomic.AddInt64(&s.Rcvd, int64(read))
+		atomic.AddInt64(&port.Rcvd, int64(read))
+
+		if !s.allowUDP(from, read) {
+			atomic.AddInt64(&s.UDPDropped, 1)
+			atomic.AddInt64(&s.UDPDropBytes, int64(read))
+			continue
+		}
 
-		backend := s.udpRoundRobin()
-		if backend == nil {
+		backends := s.udpBackends()
+		if len(backends) == 0 {
 			// this could produce a lot of message
 			// TODO: log some %, or max rate of messages
 			log.Warnf("WARN: No backends configured for service '%s'", s.Name)
 			continue
 		}
 
-		proxy := &UDPProxy{
-			listener:       conn,
-			frontendAddr:   conn.LocalAddr().(*net.UDPAddr),
-			backendAddr:    backend.udpAddr,
-			connTrackTable: make(connTrackMap),
+		for _, backend := range backends {
+			s.sendUDP(port, backend, from, buff[:read])
 		}
+	}
+}
 
-		fromKey := newConnTrackKey(from)
-		proxy.connTrackLock.Lock()
-		proxyConn, hit := proxy.connTrackTable[*fromKey]
-		if !hit {
-			proxyConn, err = net.DialUDP("udp", nil, proxy.backendAddr)
-			if err != nil {
-				log.Warnf("WARN: %s", err.Error())
-				proxy.connTrackLock.Unlock()
-				continue
-			}
-			proxy.connTrackTable[*fromKey] = proxyConn
-			go s.replyLoop(proxy, proxyConn, from, fromKey)
-		}
-		proxy.connTrackLock.Unlock()
+// Proxy a datagram from a client to a backend, tracking the client so replies
+// are returned through the same port.
+func (s *Service) sendUDP(port *udpPort, backend *Backend, from *net.UDPAddr, data []byte) {
+	s.Lock()
+	window := s.UDPResponseWindow
+	hold := time.Duration(s.CheckInterval) * time.Millisecond
+	s.Unlock()
 
-		n, err := proxyConn.Write(buff[:read])
+	proxy := &UDPProxy{
+		listener:       port.conn,
+		frontendAddr:   port.conn.LocalAddr().(*net.UDPAddr),
+		backendAddr:    backend.UDPAddr(port.offset),
+		connTrackTable: make(connTrackMap),
+		port:           port,
+		backend:        backend,
+		responseWindow: window,
+		suspectHold:    hold,
+	}
+
+	fromKey := newConnTrackKey(from)
+	proxy.connTrackLock.Lock()
+	proxyConn, hit := proxy.connTrackTable[*fromKey]
+	if !hit {
+		var err error
+		proxyConn, err = net.DialUDP("udp", nil, proxy.backendAddr)
 		if err != nil {
-			log.Errorf("ERROR: %s", err.Error())
-			atomic.AddInt64(&s.Errors, 1)
-			break
-		} else {
-			atomic.AddInt64(&s.Sent, int64(n))
+			log.Warnf("WARN: %s", err.Error())
+			proxy.connTrackLock.Unlock()
+			return
 		}
+		proxy.connTrackTable[*fromKey] = proxyConn
+		atomic.AddInt64(&port.Sessions, 1)
+		go s.replyLoop(proxy, proxyConn, from, fromKey)
+	}
+	proxy.connTrackLock.Unlock()
 
+	n, err := proxyConn.Write(data)
+	if err != nil {
+		log.Errorf("ERROR: %s", err.Error())
+		atomic.AddInt64(&s.Errors, 1)
+		return
 	}
+
+	atomic.AddInt64(&s.Sent, int64(n))
+	atomic.AddInt64(&port.Sent, int64(n))
 }
 
 // Return the addresses of the current backends in the order they would be balanced
@@ -582,26 +1518,56 @@ func (s *Service) Available() int {
 	s.Lock()
 	defer s.Unlock()
 
-	if s.MaintenanceMode {
+	if s.MaintenanceMode || s.maintenance.scheduled(time.Now()) {
 		return 0
 	}
 
+	ignoreHealth := s.checkPanic()
+
 	available := 0
 	for _, b := range s.Backends {
-		if b.Up() {
+		if b.Usable(ignoreHealth) {
 			available++
 		}
 	}
 	return available
 }
 
+// Check if too few backends are up, and we should ignore the health checks.
+// Service *must* be locked.
+func (s *Service) checkPanic() bool {
+	panicMode := false
+	if s.PanicThreshold > 0 && len(s.Backends) > 0 {
+		up := 0
+		for _, b := range s.Backends {
+			if b.Up() {
+				up++
+			}
+		}
+		panicMode = up*100 < s.PanicThreshold*len(s.Backends)
+	}
+
+	if panicMode != s.panicMode {
+		if panicMode {
+			log.Warnf("WARN: Fewer than %d%% of backends up for %s, ignoring health checks", s.PanicThreshold, s.Name)
+		} else {
+			log.Printf("INFO: Leaving panic mode for %s", s.Name)
+		}
+		s.panicMode = panicMode
+	}
+	return panicMode
+}
+
 // Dial a backend by address.
 // This way we can wrap the connection to provide our timeout settings, as well
 // as hook it into the backend stats.
 // We return an error if we don't have a backend which matches.
 // If Dial returns an error, we wrap it in DialError, so that a ReverseProxy
-// can determine if it's safe to call RoundTrip again on a new host.
-func (s *Service) Dial(nw, addr string) (net.Conn, error) {
+// can determine if it's safe to call RoundTrip again on a new host. The dial
+// is abandoned if the client goes away, without counting against the backend.
+func (s *Service) DialContext(ctx context.Context, nw, addr string) (net.Conn, error) {
+	addr = backendDialAddr(addr)
+
 	s.Lock()
 
 	var backend *Backend
@@ -617,15 +1583,19 @@ func (s *Service) Dial(nw, addr string) (net.Conn, error) {
 		return nil, DialError{fmt.Errorf("ERROR: No backend matching %s", addr)}
 	}
 
-	srvConn, err := s.dialer.Dial(nw, backend.Addr)
+	srvConn, err := backend.dial(ctx, s.dialer, nw)
+	if err != nil && ctx.Err() != nil {
+		return nil, contextError(ctx)
+	}
 	if err != nil {
 		log.Errorf("ERROR: connecting to backend %s/%s: %s", s.Name, backend.Name, err)
 		atomic.AddInt64(&backend.Errors, 1)
 		return nil, DialError{err}
 	}
+	s.setServerTOS(srvConn)
 
 	conn := &shuttleConn{
-		TCPConn:   srvConn.(*net.TCPConn),
+		Conn:      srvConn,
 		rwTimeout: s.ServerTimeout,
 		written:   &backend.Sent,
 		read:      &backend.Rcvd,
@@ -642,26 +1612,133 @@ func (s *Service) Dial(nw, addr string) (net.Conn, error) {
 }
 
 func (s *Service) connectTCP(cliConn net.Conn) {
+	// a connection accepted just before a drain, or from a virtual backend
+	if s.rejectDraining() {
+		cliConn.Close()
+		return
+	}
+
 	backends := s.next()
 
+	s.Lock()
+	capture := s.capture
+	noBackendResponse := s.noBackendResponse
+	sniRouting := s.SNIRouting
+	acceptProxy := s.AcceptProxy
+	sendProxy := s.SendProxy
+	limiter := s.limiter
+	budget := s.budget
+	s.Unlock()
+
+	if acceptProxy {
+		pConn, err := readProxyHeader(cliConn)
+		if err != nil {
+			log.Warnf("WARN: No PROXY header from %s for %s: %s", cliConn.RemoteAddr(), s.Name, err)
+			atomic.AddInt64(&s.Errors, 1)
+			cliConn.Close()
+			return
+		}
+		cliConn = pConn
+	}
+
+	if !limiter.Allow(cliConn.RemoteAddr().String()) {
+		log.Debugf("DEBUG: Rate limited %s for %s", cliConn.RemoteAddr(), s.Name)
+		atomic.AddInt64(&s.RateLimited, 1)
+		resetConn(cliConn)
+		return
+	}
+
+	if selfLimit.Shedding() {
+		log.Debugf("DEBUG: Process over its limits, rejecting %s for %s", cliConn.RemoteAddr(), s.Name)
+		atomic.AddInt64(&s.Overloaded, 1)
+		resetConn(cliConn)
+		return
+	}
+
+	if !s.acquireConn() {
+		log.Debugf("DEBUG: Connection limit reached, rejecting %s for %s", cliConn.RemoteAddr(), s.Name)
+		atomic.AddInt64(&s.ConnLimited, 1)
+		resetConn(cliConn)
+		return
+	}
+	defer s.releaseConn()
+
+	cliConn = capture.Tap(cliConn)
+
+	if sniRouting {
+		cliConn, backends = s.routeSNI(cliConn, backends)
+	}
+
+	if len(backends) > 1 && budget.Mitigating(client.MitigateNoRetry) {
+		backends = backends[:1]
+	}
+
 	// Try the first backend given, but if that fails, cycle through them all
 	// to make a best effort to connect the client.
 	for _, b := range backends {
-		srvConn, err := s.dialer.Dial(b.Network, b.Addr)
+		network, _ := splitNetwork(b.Network)
+		srvConn, err := b.dial(context.Background(), s.dialer, network)
 		if err != nil {
 			log.Errorf("ERROR: connecting to backend %s/%s: %s", s.Name, b.Name, err)
 			atomic.AddInt64(&b.Errors, 1)
 			continue
 		}
+		s.setServerTOS(srvConn)
+
+		if err := b.sendProxyHeader(srvConn, cliConn, sendProxy); err != nil {
+			log.Errorf("ERROR: sending PROXY header to backend %s/%s: %s", s.Name, b.Name, err)
+			atomic.AddInt64(&b.Errors, 1)
+			srvConn.Close()
+			continue
+		}
 
+		budget.Record(false)
+		age := s.ages.start()
 		b.Proxy(srvConn, cliConn)
+		s.ages.done(age)
 		return
 	}
 
 	log.Errorf("ERROR: no backend for %s", s.Name)
+	atomic.AddInt64(&s.NoBackend, 1)
+	budget.Record(true)
+
+	if len(noBackendResponse) > 0 {
+		cliConn.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := cliConn.Write(noBackendResponse); err != nil {
+			log.Debugf("DEBUG: writing no backend response for %s: %s", s.Name, err)
+		}
+	}
 	cliConn.Close()
 }
 
+// Mark a backend connection with the service's ServerTOS
+func (s *Service) setServerTOS(conn net.Conn) {
+	s.Lock()
+	tos := s.ServerTOS
+	s.Unlock()
+
+	// a virtual backend has no socket to mark
+	tcpConn, ok := conn.(*net.TCPConn)
+	if tos == 0 || !ok {
+		return
+	}
+
+	if err := setTOS(tcpConn, tos); err != nil {
+		log.Warnf("WARN: Unable to set TOS for %s: %s", s.Name, err)
+	}
+}
+
+// Close the TCP listener, leaving the open connections to finish.
+func (s *Service) stopAccepting() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.tcpListener != nil {
+		s.tcpListener.Close()
+	}
+}
+
 // Stop the Service's Accept loop by closing the Listener,
 // and stop all backends for this service.
 func (s *Service) stop() {
@@ -669,42 +1746,57 @@ func (s *Service) stop() {
 	defer s.Unlock()
 
 	log.Printf("INFO: Stopping Listener for %s on %s:%s", s.Name, s.Network, s.Addr)
+	s.bindState = bindStopped
 	for _, backend := range s.Backends {
 		backend.Stop()
 	}
+	s.lbHealth.stop()
 
-	switch s.Network {
-	case "tcp", "tcp4", "tcp6":
-		// the service may have been bad, and the listener failed
-		if s.tcpListener == nil {
-			return
-		}
-
+	// the service may have been bad, and the listener failed
+	if s.tcpListener != nil {
 		err := s.tcpListener.Close()
 		if err != nil {
 			log.Errorln("ERROR: Unable to close TCP listener %s", err)
 		}
+	}
 
-	case "udp", "udp4", "udp6":
-		if s.udpListener == nil {
-			return
-		}
-		err := s.udpListener.Close()
+	for _, p := range s.udpListeners {
+		err := p.conn.Close()
 		if err != nil {
 			log.Errorln("ERROR: Unable to close UDP listener %s", err)
 		}
 	}
 
+	if s.localHTTP != nil {
+		s.localHTTP.Close()
+	}
+}
+
+// Return the proxy's FlushInterval for a configured interval, where 0 is the
+// default of one second, and a negative interval flushes every write.
+func httpFlushInterval(d time.Duration) time.Duration {
+	switch {
+	case d == 0:
+		return time.Second
+	case d < 0:
+		return -1
+	}
+	return d
 }
 
 // Provide a ServeHTTP method for out ReverseProxy
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.rejectDraining() {
+		drainingResponse(w, r)
+		return
+	}
+
 	atomic.AddInt64(&s.HTTPConns, 1)
 	atomic.AddInt64(&s.HTTPActive, 1)
 	defer atomic.AddInt64(&s.HTTPActive, -1)
 
-	if s.HTTPSRedirect {
-		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") != "https" {
+	if s.HTTPSRedirect && !s.redirectExempt(r) {
+		if r.TLS != nil || forwardedProto(r) != "https" {
 			//TODO: verify RequestURI
 			redirLoc := "https://" + r.Host + r.RequestURI
 			http.Redirect(w, r, redirLoc, http.StatusMovedPermanently)
@@ -712,73 +1804,450 @@ func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if s.MaintenanceMode {
+	if !s.methodAllowed(r) {
+		atomic.AddInt64(&s.BadMethod, 1)
+		logRequest(r, http.StatusMethodNotAllowed, backendAttempt{}, nil, 0)
+		s.Lock()
+		w.Header().Set("Allow", strings.ToUpper(strings.Join(s.allowMethods, ", ")))
+		s.Unlock()
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.Lock()
+	limiter := s.limiter
+	budget := s.budget
+	shedder := s.shedder
+	rewrites := s.rewrites
+	redirects := s.redirects
+	maxBody := s.MaxRequestBody
+	timeout := s.RequestTimeout
+	s.Unlock()
+
+	if target, code, ok := redirectTarget(r, redirects); ok {
+		http.Redirect(w, r, target, code)
+		return
+	}
+
+	if !limiter.Allow(r.RemoteAddr) {
+		atomic.AddInt64(&s.RateLimited, 1)
+		logRequest(r, http.StatusTooManyRequests, backendAttempt{}, nil, 0)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	if !s.verifyClientCert(r) {
+		logRequest(r, http.StatusForbidden, backendAttempt{}, nil, 0)
+		http.Error(w, "client certificate required", http.StatusForbidden)
+		return
+	}
+
+	if !s.verifyJWT(r) {
+		logRequest(r, http.StatusUnauthorized, backendAttempt{}, nil, 0)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+
+	if !limitRequestBody(r, maxBody) {
+		atomic.AddInt64(&s.TooLarge, 1)
+		logRequest(r, http.StatusRequestEntityTooLarge, backendAttempt{}, nil, 0)
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if s.inMaintenance(r) {
 		// TODO: Should we increment HTTPErrors here as well?
-		logRequest(r, http.StatusServiceUnavailable, "", nil, 0)
-		errPage := s.errorPages.Get(http.StatusServiceUnavailable)
-		if errPage != nil {
-			headers := w.Header()
-			for key, val := range errPage.Header() {
-				headers[key] = val
-			}
+		s.serveMaintenance(w, r)
+		return
+	}
+
+	if selfLimit.Shedding() {
+		atomic.AddInt64(&s.Overloaded, 1)
+		s.serveUnavailable(w, r)
+		return
+	}
+
+	if shedder.shed(r, s.load(budget)) {
+		atomic.AddInt64(&s.Shed, 1)
+		s.serveUnavailable(w, r)
+		return
+	}
+
+	if !s.acquireConn() {
+		atomic.AddInt64(&s.ConnLimited, 1)
+		s.serveUnavailable(w, r)
+		return
+	}
+	defer s.releaseConn()
+
+	// don't leak the bypass token to the backends
+	r.Header.Del(MaintenanceBypassHeader)
+
+	rewritePath(r, rewrites)
+
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	addrs := s.NextAddrs()
+	if len(addrs) > 1 && budget.Mitigating(client.MitigateNoRetry) {
+		addrs = addrs[:1]
+	}
+
+	s.httpProxy.ServeHTTP(w, r, addrs)
+}
+
+// Set the headers to strip and replace. Headers whose secret values can't be
+// resolved are logged and skipped.
+// Service *must* be locked, or not yet running.
+func (s *Service) setHeaderPolicy(strip []string, set map[string]string) {
+	s.stripHeaders = strip
+	s.setHeadersCfg = set
+	s.setHeaders = nil
+
+	for key, val := range set {
+		secret, err := resolveSecret(val)
+		if err != nil {
+			log.Errorf("ERROR: Unable to resolve the %s header for %s: %s", key, s.Name, err)
+			continue
+		}
+		if s.setHeaders == nil {
+			s.setHeaders = make(map[string]string)
+		}
+		s.setHeaders[key] = secret
+	}
+}
+
+// Strip and replace the request headers configured for the service.
+func (s *Service) filterHeaders(pr *ProxyRequest) bool {
+	s.Lock()
+	strip := s.stripHeaders
+	set := s.setHeaders
+	s.Unlock()
+
+	for _, key := range strip {
+		pr.Request.Header.Del(key)
+	}
+	for key, val := range set {
+		pr.Request.Header.Set(key, val)
+	}
+	return true
+}
+
+// Respond with a 503, using the service's error page if it has one.
+func (s *Service) serveUnavailable(w http.ResponseWriter, r *http.Request) {
+	logRequest(r, http.StatusServiceUnavailable, backendAttempt{}, nil, 0)
+	errPage := s.errorPages.Get(http.StatusServiceUnavailable)
+	if errPage != nil {
+		headers := w.Header()
+		for key, val := range errPage.Header() {
+			headers[key] = val
 		}
-		w.WriteHeader(http.StatusServiceUnavailable)
-		if errPage != nil {
-			w.Write(errPage.Body())
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if errPage != nil {
+		w.Write(s.errorPages.Render(errPage, r, http.StatusServiceUnavailable))
+	}
+}
+
+// Reset a client connection rather than closing it cleanly, so a rejected
+// client sees the refusal immediately.
+func resetConn(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// Set the service's concurrent connection limit.
+// Service *must* be locked, or not yet running.
+func (s *Service) setMaxConnections(n int) {
+	s.MaxConnections = n
+	s.conns.SetLimit(n)
+}
+
+// Take a slot for a new connection from both the service and global limits,
+// returning false if either is full.
+func (s *Service) acquireConn() bool {
+	if !connLimit.acquire() {
+		return false
+	}
+	if !s.conns.acquire() {
+		connLimit.release()
+		return false
+	}
+	return true
+}
+
+func (s *Service) releaseConn() {
+	s.conns.release()
+	connLimit.release()
+}
+
+// Replace the UDP limiters if their limits changed.
+// Service *must* be locked, or not yet running.
+func (s *Service) setUDPRateLimit(cfg client.ServiceConfig) {
+	if s.packetLimiter == nil || cfg.UDPPacketRate != s.UDPPacketRate || cfg.UDPPacketBurst != s.UDPPacketBurst {
+		s.UDPPacketRate = cfg.UDPPacketRate
+		s.UDPPacketBurst = cfg.UDPPacketBurst
+		s.packetLimiter = newRateLimiter(cfg.UDPPacketRate, cfg.UDPPacketBurst)
+	}
+
+	if s.byteLimiter == nil || cfg.UDPByteRate != s.UDPByteRate || cfg.UDPByteBurst != s.UDPByteBurst {
+		s.UDPByteRate = cfg.UDPByteRate
+		s.UDPByteBurst = cfg.UDPByteBurst
+		s.byteLimiter = newRateLimiter(cfg.UDPByteRate, cfg.UDPByteBurst)
+	}
+}
+
+// Check a datagram of size bytes from a source against the UDP limits.
+func (s *Service) allowUDP(from *net.UDPAddr, size int) bool {
+	s.Lock()
+	packetLimiter := s.packetLimiter
+	byteLimiter := s.byteLimiter
+	s.Unlock()
+
+	addr := from.IP.String()
+	return packetLimiter.Allow(addr) && byteLimiter.AllowN(addr, float64(size))
+}
+
+// Replace the rate limiter if the limits changed, so a config update doesn't
+// refill every client's bucket.
+// Service *must* be locked, or not yet running.
+func (s *Service) setRateLimit(rate float64, burst int) {
+	if s.limiter != nil && rate == s.RateLimit && burst == s.RateBurst {
+		return
+	}
+
+	s.RateLimit = rate
+	s.RateBurst = burst
+	s.limiter = newRateLimiter(rate, burst)
+}
+
+// Return the names of the optional features active on the service, so they
+// can be audited from the stats alone.
+// Service *must* be locked.
+func (s *Service) features() []string {
+	features := []string{}
+	add := func(name string, active bool) {
+		if active {
+			features = append(features, name)
 		}
+	}
+
+	sendProxy := s.SendProxy != ""
+	for _, b := range s.Backends {
+		sendProxy = sendProxy || b.SendProxy != ""
+	}
+
+	add("https_redirect", s.HTTPSRedirect)
+	add("client_cert", s.clientCA != "")
+	add("sni_routing", s.SNIRouting)
+	add("accept_proxy", s.AcceptProxy)
+	add("send_proxy", sendProxy)
+	add("rate_limit", s.limiter != nil)
+	add("udp_rate_limit", s.packetLimiter != nil || s.byteLimiter != nil)
+	add("max_connections", s.MaxConnections > 0)
+	add("max_request_body", s.MaxRequestBody > 0)
+	add("allow_methods", s.allowMethods != nil)
+	add("replay_body", s.ReplayBody > 0)
+	add("http_timeouts", s.RequestTimeout > 0 || s.ResponseHeaderTimeout > 0 || s.IdleTimeout > 0)
+	add("flush_interval", s.FlushInterval != 0)
+	add("tracing", s.TraceSample > 0)
+	add("header_policy", len(s.stripHeaders) > 0 || len(s.setHeaders) > 0)
+	add("header_rules", len(s.headerRules) > 0)
+	add("error_budget", s.budget != nil)
+	add("circuit_breaker", s.breakerCfg != nil)
+	add("outlier_detection", s.outliers != nil)
+	add("jwt", s.jwt != nil)
+	add("header_routes", len(s.routes) > 0)
+	add("retry_status", len(s.retryStatus) > 0)
+	add("lb_health", s.lbHealth != nil)
+	add("priority", s.shedder != nil)
+	add("rewrites", len(s.rewrites) > 0)
+	add("redirects", len(s.redirects) > 0)
+	add("compress", s.compress != nil)
+	add("security_headers", len(s.securityHeaders) > 0)
+	add("lazy_bind", s.LazyBind)
+	add("fan_out", s.FanOut)
+	add("capture", s.capture != nil)
+	add("error_capture", s.errCapture != nil)
+	add("maintenance_bypass", s.maintenanceToken != "" || len(s.maintenanceNets) > 0)
+	add("maintenance_schedule", s.maintenanceCfg != nil && (s.maintenanceCfg.Start != nil || s.maintenanceCfg.End != nil))
+	add("panic_threshold", s.PanicThreshold > 0)
+	add("flap_damping", s.FlapCount > 0)
+	add("http2", s.HTTP2)
+	add("force_http11", s.ForceHTTP11)
+	add("no_chunked", s.NoChunked)
+	add("normalize_connection", s.NormalizeConnection)
+	return features
+}
+
+// Load the CAs which must sign client certificates. A CA which can't be
+// loaded rejects all clients, rather than allowing them all.
+// Service *must* be locked, or not yet running.
+func (s *Service) setClientCA(path string) {
+	s.clientCA = path
+	s.clientCAs = nil
+	if path == "" {
 		return
 	}
 
-	s.httpProxy.ServeHTTP(w, r, s.NextAddrs())
+	pool, err := loadClientCAs(path)
+	if err != nil {
+		log.Errorf("ERROR: Unable to load client CA for %s: %s", s.Name, err)
+		pool = x509.NewCertPool()
+	}
+	s.clientCAs = pool
+}
+
+// Return the CAs required for client certificates, or nil if none are
+// required.
+func (s *Service) ClientCAs() *x509.CertPool {
+	s.Lock()
+	defer s.Unlock()
+	return s.clientCAs
+}
+
+// Set the token and networks allowed to bypass maintenance mode.
+// Invalid CIDRs, and a token that can't be resolved, are logged and skipped.
+// Service *must* be locked, or not yet running.
+func (s *Service) setMaintenanceBypass(token string, allow []string) {
+	secret, err := resolveSecret(token)
+	if err != nil {
+		log.Errorf("ERROR: Unable to resolve maintenance_token for %s: %s", s.Name, err)
+	}
+
+	s.maintenanceTokenCfg = token
+	s.maintenanceToken = secret
+	s.maintenanceAllow = allow
+	s.maintenanceNets = nil
+
+	for _, cidr := range allow {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Errorf("ERROR: Invalid maintenance_allow network for %s: %s", s.Name, err)
+			continue
+		}
+		s.maintenanceNets = append(s.maintenanceNets, ipNet)
+	}
+}
+
+// Check if this request should get the maintenance response, in maintenance
+// mode or a scheduled window. Requests carrying the bypass token, or from an
+// allowed network, are let through.
+func (s *Service) inMaintenance(r *http.Request) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.MaintenanceMode && !s.maintenance.scheduled(time.Now()) && !s.budget.Mitigating(client.MitigateMaintenance) {
+		return false
+	}
+
+	if s.maintenanceToken != "" && r.Header.Get(MaintenanceBypassHeader) == s.maintenanceToken {
+		return false
+	}
+
+	if len(s.maintenanceNets) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return true
+	}
+
+	for _, ipNet := range s.maintenanceNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
 }
 
 func (s *Service) errStats(pr *ProxyRequest) bool {
+	if pr.ProxyError == ErrClientAborted {
+		// not the backend's fault
+		atomic.AddInt64(&s.ClientAborted, 1)
+		return true
+	}
+
+	if pr.ProxyError == ErrBodyTooLarge {
+		// nor is this
+		atomic.AddInt64(&s.TooLarge, 1)
+		return true
+	}
+
 	if pr.ProxyError != nil {
 		atomic.AddInt64(&s.HTTPErrors, 1)
 	}
+
+	s.Lock()
+	budget := s.budget
+	s.Unlock()
+	budget.Record(pr.ProxyError != nil || pr.Response.StatusCode >= 500)
 	return true
 }
 
 // A net.Listener that provides a read/write timeout
 type timeoutListener struct {
-	*net.TCPListener
+	net.Listener
 	rwTimeout time.Duration
 
+	// IP TOS to set on accepted connections
+	tos int
+
 	// these aren't reported yet, but our new counting connections need to
 	// update something
 	read    int64
 	written int64
 }
 
-func newTimeoutListener(netw, addr string, timeout time.Duration) (net.Listener, error) {
-	lAddr, err := net.ResolveTCPAddr(netw, addr)
-	if err != nil {
-		return nil, err
-	}
-
-	l, err := net.ListenTCP(netw, lAddr)
+func newTimeoutListener(n Network, netw, addr string, timeout time.Duration) (net.Listener, error) {
+	l, err := n.Listen(netw, addr)
 	if err != nil {
 		return nil, err
 	}
 
 	tl := &timeoutListener{
-		TCPListener: l,
-		rwTimeout:   timeout,
+		Listener:  l,
+		rwTimeout: timeout,
 	}
 	return tl, nil
 }
 
 func (l *timeoutListener) Accept() (net.Conn, error) {
-	conn, err := l.TCPListener.AcceptTCP()
+	c, err := l.Listener.Accept()
 	if err != nil {
 		return nil, err
 	}
 
+	// connections from another Network are passed on as they are
+	conn, ok := c.(*net.TCPConn)
+	if !ok {
+		return c, nil
+	}
+
 	conn.SetKeepAlive(true)
 	conn.SetKeepAlivePeriod(3 * time.Minute)
 
+	if l.tos != 0 {
+		if err := setTOS(conn, l.tos); err != nil {
+			log.Warnf("WARN: Unable to set TOS: %s", err)
+		}
+	}
+
 	sc := &shuttleConn{
-		TCPConn:   conn,
+		Conn:      conn,
 		rwTimeout: l.rwTimeout,
 		read:      &l.read,
 		written:   &l.written,
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/skyfii/shuttle/client"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Load shedding by request priority. As a service nears its connection
+// limits, or while its error budget is spent, lower priority requests are
+// turned away first, leaving the remaining capacity to the important ones.
+
+const defaultShedAt = 80
+
+type loadShedder struct {
+	header string
+	levels map[string]int
+	// the highest configured priority, which is never shed
+	top    int
+	shedAt int
+}
+
+// Return the shedder for a service, or nil if no priority config is set.
+func newLoadShedder(service string, cfg *client.PriorityConfig) *loadShedder {
+	if cfg == nil || cfg.Header == "" {
+		return nil
+	}
+
+	l := &loadShedder{
+		header: cfg.Header,
+		levels: make(map[string]int),
+		shedAt: cfg.ShedAt,
+	}
+
+	for val, p := range cfg.Levels {
+		if p < 0 {
+			log.Errorf("ERROR: Invalid priority %d for %s=%s on %s", p, cfg.Header, val, service)
+			continue
+		}
+		l.levels[strings.ToLower(val)] = p
+		if p > l.top {
+			l.top = p
+		}
+	}
+
+	if l.shedAt <= 0 || l.shedAt >= 100 {
+		if l.shedAt != 0 {
+			log.Errorf("ERROR: Invalid shed_at %d on %s, using %d", l.shedAt, service, defaultShedAt)
+		}
+		l.shedAt = defaultShedAt
+	}
+
+	return l
+}
+
+// Return the request's priority. Requests without a mapped value get 0.
+func (l *loadShedder) priority(r *http.Request) int {
+	return l.levels[strings.ToLower(r.Header.Get(l.header))]
+}
+
+// Report whether the request should be shed at the given load, a percentage
+// of capacity. The lowest priority is shed from shedAt, and each level above
+// it at a proportionally higher load, up to the top level which is only
+// turned away by the hard limits.
+func (l *loadShedder) shed(r *http.Request, load int) bool {
+	if l == nil || load < l.shedAt {
+		return false
+	}
+
+	p := l.priority(r)
+	if p >= l.top {
+		return false
+	}
+
+	return load >= l.shedAt+(100-l.shedAt)*p/l.top
+}
+
+// Return the service's load as a percentage, the highest of its own and the
+// global connection limits, or 100 while its error budget is spent.
+func (s *Service) load(budget *errorBudget) int {
+	if budget.Degraded() {
+		return 100
+	}
+
+	load := s.conns.load()
+	if global := connLimit.load(); global > load {
+		load = global
+	}
+	return load
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+	"github.com/skyfii/shuttle/log"
+)
+
+// On SIGINT or SIGTERM shuttle stops accepting connections, waits up to the
+// -shutdown-timeout for those open to finish, and exits with a report of what
+// was drained and what was cut off, so a restart can be checked for dropped
+// traffic afterwards.
+
+// how often the open connections are counted while draining
+const drainPoll = 100 * time.Millisecond
+
+var startTime = time.Now()
+
+// The json report written on shutdown.
+type ShutdownReport struct {
+	Signal string    `json:"signal"`
+	Time   time.Time `json:"time"`
+	// Uptime is the time in seconds since the process started.
+	Uptime float64 `json:"uptime"`
+	Worker int     `json:"worker,omitempty"`
+
+	// Drained counts the connections and requests open at the signal which
+	// finished within the shutdown timeout, and Killed those still open when
+	// the process exited.
+	Drained  int64  `json:"drained"`
+	Killed   int64  `json:"killed"`
+	DrainFor string `json:"drain_time"`
+
+	Services []ServiceShutdownStat `json:"services"`
+}
+
+// The totals of a service over the life of the process.
+type ServiceShutdownStat struct {
+	Name       string `json:"name"`
+	Conns      int64  `json:"connections"`
+	HTTPConns  int64  `json:"http_connections"`
+	Errors     int64  `json:"errors"`
+	HTTPErrors int64  `json:"http_errors"`
+	Sent       int64  `json:"sent"`
+	Rcvd       int64  `json:"received"`
+	Drained    int64  `json:"drained"`
+	Killed     int64  `json:"killed"`
+}
+
+// Wait for a signal to shut down, then drain the connections, report, and
+// exit.
+func waitForShutdown(timeout time.Duration, reportPath string) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sig
+
+	report := drain(s.String(), timeout)
+	if err := writeShutdownReport(report, reportPath); err != nil {
+		log.Errorf("ERROR: Unable to write shutdown report: %s", err)
+	}
+	os.Exit(0)
+}
+
+// The connections and requests open in a service.
+func openConns(stat ServiceStat) int64 {
+	return stat.Active + stat.HTTPActive
+}
+
+// Stop accepting new connections, and wait up to timeout for the open ones to
+// finish.
+func drain(signal string, timeout time.Duration) ShutdownReport {
+	log.Printf("INFO: Shutting down on %s, draining connections for up to %s", signal, timeout)
+	start := time.Now()
+	readyState.Stop()
+
+	Registry.Lock()
+	for _, svc := range Registry.svcs {
+		svc.stopAccepting()
+	}
+	Registry.Unlock()
+
+	for _, r := range []*HostRouter{httpRouter, httpsRouter} {
+		if r != nil {
+			r.server.SetKeepAlivesEnabled(false)
+			r.Stop()
+		}
+	}
+
+	atSignal := make(map[string]int64)
+	for _, stat := range Registry.Stats() {
+		atSignal[stat.Name] = openConns(stat)
+	}
+
+	deadline := start.Add(timeout)
+	var stats []ServiceStat
+	for {
+		stats = Registry.Stats()
+
+		var open int64
+		for _, stat := range stats {
+			open += openConns(stat)
+		}
+		if open == 0 || !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(drainPoll)
+	}
+
+	report := ShutdownReport{
+		Signal:   signal,
+		Time:     time.Now(),
+		Uptime:   time.Since(startTime).Seconds(),
+		Worker:   workerID,
+		DrainFor: time.Since(start).String(),
+		Services: []ServiceShutdownStat{},
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	for _, stat := range stats {
+		killed := openConns(stat)
+		drained := atSignal[stat.Name] - killed
+		if drained < 0 {
+			drained = 0
+		}
+
+		report.Drained += drained
+		report.Killed += killed
+		report.Services = append(report.Services, ServiceShutdownStat{
+			Name:       stat.Name,
+			Conns:      stat.Conns,
+			HTTPConns:  stat.HTTPConns,
+			Errors:     stat.Errors,
+			HTTPErrors: stat.HTTPErrors,
+			Sent:       stat.Sent,
+			Rcvd:       stat.Rcvd,
+			Drained:    drained,
+			Killed:     killed,
+		})
+	}
+	return report
+}
+
+// Log the report, and write it to path if it's set. Each worker writes its
+// own file, suffixed with its number.
+func writeShutdownReport(report ShutdownReport, path string) error {
+	js, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	log.Printf("INFO: Shutdown report: %s", js)
+
+	if path == "" {
+		return nil
+	}
+	if workerID > 0 {
+		path = fmt.Sprintf("%s.%d", path, workerID)
+	}
+	return ioutil.WriteFile(path, append(js, '\n'), 0644)
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"strconv"
@@ -12,28 +15,43 @@ import (
 )
 
 var (
-	shuttleAddr string
-	configData  string
-	configFile  string
+	shuttleAddr  string
+	shuttleToken string
+
+	// verify an https admin server, and authenticate to it
+	tlsCA      string
+	tlsCert    string
+	tlsKey     string
+	configData string
+	configFile string
 
 	buildVersion = "0.1.0"
 
 	client *shuttle.Client
 
-	cfg      = &shuttle.Config{}
-	configFS = flag.NewFlagSet("config", flag.ExitOnError)
+	cfg        = &shuttle.Config{}
+	configFS   = flag.NewFlagSet("config", flag.ExitOnError)
+	trustProxy = stringSlice{}
 
 	serviceCfg = &shuttle.ServiceConfig{}
 	serviceFS  = flag.NewFlagSet("service", flag.ExitOnError)
 	vhosts     = stringSlice{}
 	errorPages = stringSlice{}
-
-	backendCfg = &shuttle.BackendConfig{}
-	backendFS  = flag.NewFlagSet("backend", flag.ExitOnError)
+	mntAllow   = stringSlice{}
+	stripHdrs  = stringSlice{}
+	setHdrs    = stringSlice{}
+	hdrRoutes  = stringSlice{}
+	redirExcpt = stringSlice{}
+	allowMeths = stringSlice{}
+	replaceSvc bool
+
+	backendCfg    = &shuttle.BackendConfig{}
+	backendFS     = flag.NewFlagSet("backend", flag.ExitOnError)
+	fallbackAddrs = stringSlice{}
 )
 
 func init() {
-	configFS.StringVar(&cfg.Balance, "balance", "", "balance algorithm, {RR|LC}")
+	configFS.StringVar(&cfg.Balance, "balance", "", "balance algorithm, {RR|LC|COST}")
 	configFS.IntVar(&cfg.CheckInterval, "check-interval", 0, "interval between health checks in milliseconds")
 	configFS.IntVar(&cfg.Fall, "fall", 0, "number of failed healthchecks before a backend is marked down")
 	configFS.IntVar(&cfg.Rise, "rise", 0, "number of successful health checks before a down service is marked up")
@@ -41,29 +59,87 @@ func init() {
 	configFS.IntVar(&cfg.ServerTimeout, "server-timeout", 0, "innactivity timeout for server connections")
 	configFS.IntVar(&cfg.DialTimeout, "dial-timeout", 0, "timeout for dialing new connections connections")
 	configFS.BoolVar(&cfg.HTTPSRedirect, "https-redirect", false, "rediect all http requests to https")
+	configFS.IntVar(&cfg.MaxChecks, "max-checks", 0, "maximum concurrent health checks")
+	configFS.IntVar(&cfg.MaxConnections, "max-connections", 0, "maximum concurrent connections across all services")
+	configFS.IntVar(&cfg.MaxRSS, "max-rss", 0, "soft limit on resident memory in MB, over which new connections are refused")
+	configFS.IntVar(&cfg.MaxCPU, "max-cpu", 0, "soft limit on CPU use as a percentage of one core, over which new connections are refused")
+	configFS.IntVar(&cfg.GOGC, "gogc", 0, "Go GC target percentage, negative to turn the GC off")
+	configFS.IntVar(&cfg.MemoryLimit, "memory-limit", 0, "Go runtime soft memory limit in MB")
+	configFS.IntVar(&cfg.GOMAXPROCS, "gomaxprocs", 0, "threads running Go code")
+	configFS.StringVar(&cfg.HealthWebhook, "health-webhook", "", "url to notify when a backend is marked up or down")
+	configFS.Var(&trustProxy, "trusted-proxy", "CIDR of an upstream proxy whose X-Forwarded headers are trusted. may be set multiple times")
 
 	serviceFS.StringVar(&serviceCfg.Addr, "address", "", "service listening address")
 	serviceFS.StringVar(&serviceCfg.Network, "network", "", "service network type")
-	serviceFS.StringVar(&serviceCfg.Balance, "balance", "", "balancing algorithm, {RR|LC}")
+	serviceFS.StringVar(&serviceCfg.Profile, "profile", "", "name of the profile the service inherits unset values from")
+	serviceFS.StringVar(&serviceCfg.Balance, "balance", "", "balancing algorithm, {RR|LC|COST}")
 	serviceFS.IntVar(&serviceCfg.CheckInterval, "check-interval", 0, "interval between health checks in milliseconds")
 	serviceFS.IntVar(&serviceCfg.Fall, "fall", 0, "number of failed healthchecks before a backend is marked down")
 	serviceFS.IntVar(&serviceCfg.Rise, "rise", 0, "number of successful health checks before a down service is marked up")
 	serviceFS.IntVar(&serviceCfg.ClientTimeout, "client-timeout", 0, "innactivity timeout for client connections")
 	serviceFS.IntVar(&serviceCfg.ServerTimeout, "server-timeout", 0, "innactivity timeout for server connections")
+	serviceFS.IntVar(&serviceCfg.RequestTimeout, "request-timeout", 0, "total time in milliseconds for an http request")
+	serviceFS.IntVar(&serviceCfg.ResponseHeaderTimeout, "response-header-timeout", 0, "time in milliseconds for a backend to send http response headers")
+	serviceFS.IntVar(&serviceCfg.IdleTimeout, "idle-timeout", 0, "close idle http client connections after this many milliseconds")
+	serviceFS.IntVar(&serviceCfg.FlushInterval, "flush-interval", 0, "milliseconds between flushes of http responses, -1 to flush every write")
 	serviceFS.IntVar(&serviceCfg.DialTimeout, "dial-timeout", 0, "timeout for dialing new connections connections")
 	serviceFS.BoolVar(&serviceCfg.HTTPSRedirect, "https-redirect", false, "rediect all http requests to https")
+	serviceFS.BoolVar(&serviceCfg.LazyBind, "lazy-bind", false, "don't listen until a backend passes a health check")
+	serviceFS.BoolVar(&serviceCfg.FanOut, "fan-out", false, "send every UDP datagram to all healthy backends")
+	serviceFS.IntVar(&serviceCfg.UDPResponseWindow, "udp-response-window", 0, "milliseconds for a UDP backend to reply to a new session before it's suspect")
+	serviceFS.Float64Var(&serviceCfg.UDPPacketRate, "udp-packet-rate", 0, "UDP datagrams per second accepted from each source IP")
+	serviceFS.IntVar(&serviceCfg.UDPPacketBurst, "udp-packet-burst", 0, "burst of UDP datagrams allowed over the packet rate")
+	serviceFS.Float64Var(&serviceCfg.UDPByteRate, "udp-byte-rate", 0, "UDP bytes per second accepted from each source IP")
+	serviceFS.IntVar(&serviceCfg.UDPByteBurst, "udp-byte-burst", 0, "burst of UDP bytes allowed over the byte rate")
+	serviceFS.Float64Var(&serviceCfg.RateLimit, "rate-limit", 0, "TCP connections or HTTP requests per second allowed from each client IP")
+	serviceFS.Int64Var(&serviceCfg.MaxRequestBody, "max-request-body", 0, "largest HTTP request body in bytes, 0 for no limit")
+	serviceFS.Int64Var(&serviceCfg.ReplayBody, "replay-body", 0, "largest HTTP request body in bytes buffered to replay idempotent requests on another backend")
+	serviceFS.IntVar(&serviceCfg.RateBurst, "rate-burst", 0, "burst of connections or requests allowed over the rate limit")
+	serviceFS.IntVar(&serviceCfg.MaxConnections, "max-connections", 0, "maximum concurrent connections to the service")
+	serviceFS.BoolVar(&serviceCfg.SNIRouting, "sni-routing", false, "route TLS connections to the service matching the SNI server name")
+	serviceFS.BoolVar(&serviceCfg.HTTP2, "http2", false, "proxy http requests to the backends over cleartext HTTP/2, as for gRPC")
+	serviceFS.BoolVar(&serviceCfg.ForceHTTP11, "force-http11", false, "proxy http requests to the backends as plain HTTP/1.1, without upgrades")
+	serviceFS.BoolVar(&serviceCfg.NoChunked, "no-chunked", false, "send request bodies to the backends with a Content-Length rather than chunked")
+	serviceFS.BoolVar(&serviceCfg.NormalizeConnection, "normalize-connection", false, "remove headers named in Connection, and send the backends keep-alive")
+	serviceFS.IntVar(&serviceCfg.BindRetry, "bind-retry", 0, "milliseconds to retry binding an address in use")
+	serviceFS.IntVar(&serviceCfg.FlapCount, "flap-count", 0, "number of state changes within the flap window that hold a backend down")
+	serviceFS.IntVar(&serviceCfg.FlapWindow, "flap-window", 0, "flap detection window in milliseconds")
+	serviceFS.IntVar(&serviceCfg.FlapHoldDown, "flap-hold-down", 0, "initial hold down in milliseconds for a flapping backend")
+	serviceFS.IntVar(&serviceCfg.PanicThreshold, "panic-threshold", 0, "percent of healthy backends below which health checks are ignored")
+	serviceFS.IntVar(&serviceCfg.ClientTOS, "client-tos", 0, "IP TOS byte for client connections")
+	serviceFS.IntVar(&serviceCfg.ServerTOS, "server-tos", 0, "IP TOS byte for backend connections")
+	serviceFS.IntVar(&serviceCfg.DNSFailTimeout, "dns-fail-timeout", 0, "remove backends whose check address hasn't resolved for this many milliseconds")
+	serviceFS.IntVar(&serviceCfg.KeepBackendStats, "keep-backend-stats", 0, "milliseconds to keep a removed backend's stats, carried over if it's added back")
+	serviceFS.StringVar(&serviceCfg.NoBackendResponse, "no-backend-response", "", "data written to TCP clients when no backend is available")
+	serviceFS.BoolVar(&serviceCfg.AcceptProxy, "accept-proxy", false, "require a PROXY protocol header on TCP client connections")
+	serviceFS.StringVar(&serviceCfg.SendProxy, "send-proxy", "", "send a PROXY protocol header to backends, {v1|v2}")
 	serviceFS.Var(&vhosts, "vhost", "virtual host name. may be set multiple times")
-	serviceFS.Var(&errorPages, "error-page", "location for http error code formatted as 'http://example.com/|500,503'. may be set multiple times")
+	serviceFS.StringVar(&serviceCfg.MaintenanceToken, "maintenance-token", "", "X-Maintenance-Bypass header value which bypasses maintenance mode")
+	serviceFS.Var(&mntAllow, "maintenance-allow", "CIDR network which bypasses maintenance mode. may be set multiple times")
+	serviceFS.BoolVar(&replaceSvc, "replace", false, "replace the whole service config in place, rather than merging it")
+	serviceFS.Var(&stripHdrs, "strip-header", "request header removed before proxying. may be set multiple times")
+	serviceFS.Var(&setHdrs, "set-header", "request header set before proxying, as 'Name: value'. may be set multiple times")
+	serviceFS.StringVar(&serviceCfg.ClientCA, "client-ca", "", "PEM file of CAs required to sign client certificates")
+	serviceFS.Var(&redirExcpt, "https-redirect-except", "path prefix starting with '/', or vhost, served without the https redirect. may be set multiple times")
+	serviceFS.Var(&allowMeths, "allow-method", "HTTP method passed on to the backends, others get a 405. may be set multiple times")
+	serviceFS.StringVar(&serviceCfg.Forwarded, "forwarded", "", "upstream forwarding headers are kept from trusted proxies, or {trust|override}")
+	serviceFS.Var(&hdrRoutes, "header-route", "only take requests on shared vhosts with a matching header, as 'Name=value', 'Name~regexp' or 'Name'. may be set multiple times")
+	serviceFS.Var(&errorPages, "error-page", "location for http error code formatted as 'http://example.com/|500,503', or a file path in place of the URL. may be set multiple times")
+	serviceFS.IntVar(&serviceCfg.ErrorPagesRefresh, "error-pages-refresh", 0, "fetch the error pages again after this many milliseconds")
 
 	backendFS.StringVar(&backendCfg.Addr, "address", "", "service listening address")
+	backendFS.Var(&fallbackAddrs, "fallback-address", "address tried when the backend address can't be dialed, such as its IPv6 address. may be set multiple times")
 	backendFS.StringVar(&backendCfg.Network, "network", "", "backend network type")
 	backendFS.StringVar(&backendCfg.CheckAddr, "check-address", "", "health check address")
 	backendFS.IntVar(&backendCfg.Weight, "weight", 0, "balance weight")
+	backendFS.StringVar(&backendCfg.Container, "container", "", "docker container as 'name:port' to resolve the address")
+	backendFS.StringVar(&backendCfg.SendProxy, "send-proxy", "", "send a PROXY protocol header to this backend, {v1|v2}")
+	backendFS.StringVar(&backendCfg.LoadURL, "load-url", "", "url polled for the backend's load, for COST balancing")
 }
 
 func usage() {
 	flag.PrintDefaults()
-	fmt.Println(`shuttle-cli {config|update|remove} [options]
+	fmt.Println(`shuttle-cli {config|update|remove|trace} [options]
 
 config [options]
          set or print global config
@@ -91,7 +167,12 @@ options:`)
 	fmt.Println(`
 remove: remove services or backends
         remove service
-        remove service/backend`)
+        remove service/backend
+
+trace service sample
+         set the fraction of a service's HTTP requests which are traced
+example: trace every request to "servicename"
+         $ shuttle-cli trace servicename 1`)
 
 	os.Exit(1)
 }
@@ -100,7 +181,11 @@ func main() {
 	log.SetPrefix("")
 	log.SetFlags(0)
 
-	flag.StringVar(&shuttleAddr, "addr", "127.0.0.1:9090", "shuttle admin address")
+	flag.StringVar(&shuttleAddr, "addr", "127.0.0.1:9090", "shuttle admin address, or https://host:port")
+	flag.StringVar(&shuttleToken, "token", "", "shuttle admin token")
+	flag.StringVar(&tlsCA, "ca", "", "PEM file of CAs to verify an https admin server")
+	flag.StringVar(&tlsCert, "cert", "", "client certificate file for an https admin server")
+	flag.StringVar(&tlsKey, "key", "", "client key file for -cert")
 	flag.Usage = usage
 
 	flag.Parse()
@@ -111,6 +196,17 @@ func main() {
 	}
 
 	client = shuttle.NewClient(shuttleAddr)
+	if shuttleToken != "" {
+		client.SetToken(shuttleToken)
+	}
+
+	if tlsCA != "" || tlsCert != "" {
+		tlsCfg, err := loadTLSConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		client.SetTLSConfig(tlsCfg)
+	}
 
 	switch flag.Args()[0] {
 	case "version":
@@ -122,6 +218,8 @@ func main() {
 		update(flag.Args()[1:])
 	case "remove":
 		remove(flag.Args()[1:])
+	case "trace":
+		trace(flag.Args()[1:])
 	default:
 		usage()
 	}
@@ -146,12 +244,43 @@ func config(args []string) {
 
 	configFS.Parse(args)
 
+	if len(trustProxy) > 0 {
+		cfg.TrustedProxies = trustProxy
+	}
+
 	err := client.UpdateConfig(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// Load the CA and client certificate for an https admin server.
+func loadTLSConfig() (*tls.Config, error) {
+	tlsCfg := &tls.Config{}
+
+	if tlsCA != "" {
+		pemData, err := ioutil.ReadFile(tlsCA)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in %s", tlsCA)
+		}
+	}
+
+	if tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsCfg, nil
+}
+
 // slice for multiple string flags
 type stringSlice []string
 
@@ -185,18 +314,67 @@ func updateService(service string, args []string) {
 		serviceCfg.VirtualHosts = vhosts
 	}
 
+	if len(mntAllow) > 0 {
+		serviceCfg.MaintenanceAllow = mntAllow
+	}
+
+	if len(stripHdrs) > 0 {
+		serviceCfg.StripHeaders = stripHdrs
+	}
+
+	if len(setHdrs) > 0 {
+		serviceCfg.SetHeaders = make(map[string]string)
+		for _, hdr := range setHdrs {
+			parts := strings.SplitN(hdr, ":", 2)
+			if len(parts) != 2 {
+				log.Fatalf("invalid set-header %s", hdr)
+			}
+			serviceCfg.SetHeaders[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	if len(redirExcpt) > 0 {
+		serviceCfg.HTTPSRedirectExcept = redirExcpt
+	}
+
+	if len(allowMeths) > 0 {
+		serviceCfg.AllowMethods = allowMeths
+	}
+
+	for _, route := range hdrRoutes {
+		serviceCfg.HeaderRoutes = append(serviceCfg.HeaderRoutes, parseHeaderRoute(route))
+	}
+
 	if len(errorPages) > 1 {
 		serviceCfg.ErrorPages = parseErrorPages(errorPages)
 	}
 
 	serviceCfg.Name = service
 
-	err := client.UpdateService(serviceCfg)
+	update := client.UpdateService
+	if replaceSvc {
+		update = client.ReplaceService
+	}
+
+	err := update(serviceCfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+func parseHeaderRoute(route string) shuttle.HeaderRoute {
+	i := strings.IndexAny(route, "=~")
+	switch {
+	case route == "" || i == 0:
+		log.Fatalf("invalid header-route %s", route)
+	case i < 0:
+		return shuttle.HeaderRoute{Header: route}
+	case route[i] == '~':
+		return shuttle.HeaderRoute{Header: route[:i], Regexp: route[i+1:]}
+	}
+	return shuttle.HeaderRoute{Header: route[:i], Value: route[i+1:]}
+}
+
 func parseErrorPages(pages []string) map[string][]int {
 	ep := make(map[string][]int)
 	for _, p := range pages {
@@ -222,6 +400,10 @@ func parseErrorPages(pages []string) map[string][]int {
 func updateBackend(service, backend string, args []string) {
 	backendFS.Parse(args)
 
+	if len(fallbackAddrs) > 0 {
+		backendCfg.FallbackAddrs = fallbackAddrs
+	}
+
 	backendCfg.Name = backend
 	err := client.UpdateBackend(service, backendCfg)
 	if err != nil {
@@ -249,3 +431,19 @@ func remove(args []string) {
 	}
 
 }
+
+func trace(args []string) {
+	if len(args) != 2 {
+		usage()
+	}
+
+	sample, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		log.Fatalf("invalid sample %s, %s", args[1], err.Error())
+	}
+
+	err = client.SetTraceSample(args[0], sample)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
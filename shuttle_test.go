@@ -1,12 +1,22 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 	"github.com/skyfii/shuttle/client"
@@ -86,6 +96,7 @@ func myTearDown(s *BasicSuite, t Tester) {
 	Registry.cfg.ClientTimeout = 0
 	Registry.cfg.ServerTimeout = 0
 	Registry.cfg.DialTimeout = 0
+	Registry.cfg.Profiles = nil
 
 	err := Registry.RemoveService(s.service.Name)
 	if err != nil {
@@ -250,6 +261,9 @@ func (s *BasicSuite) TestFailedCheck(c *C) {
 	stats = s.service.Stats()
 	c.Assert(stats.Backends[0].Up, Equals, false)
 	c.Assert(stats.Backends[0].CheckFail, Equals, 1)
+	c.Assert(stats.Backends[0].FailCount, Equals, 1)
+	c.Assert(stats.Backends[0].LastError != "", Equals, true)
+	c.Assert(stats.Backends[0].LastChange, Equals, stats.Backends[0].LastCheck)
 
 	// now try and connect to the service
 	conn, err := net.Dial("tcp", s.service.Addr)
@@ -274,6 +288,1045 @@ func (s *BasicSuite) TestFailedCheck(c *C) {
 	time.Sleep(800 * time.Millisecond)
 	stats = s.service.Stats()
 	c.Assert(stats.Backends[0].Up, Equals, true)
+	c.Assert(stats.Backends[0].FailCount, Equals, 0)
+}
+
+// A check over the limit waits for a slot, rather than counting as a failure
+func (s *BasicSuite) TestCheckLimit(c *C) {
+	checkLimit.SetLimit(1)
+	defer checkLimit.SetLimit(0)
+
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	backend := NewBackend(client.BackendConfig{Name: "limited", Addr: deadAddr, CheckAddr: deadAddr})
+	stats := backend.Stats()
+
+	// take the only slot, as a check already running would
+	sem := checkLimit.acquire()
+	done := make(chan struct{})
+	go func() {
+		backend.check()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		c.Fatal("the check ran over the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	limited := backend.Stats()
+	c.Assert(limited.CheckFail, Equals, 0)
+	c.Assert(limited.FailCount, Equals, 0)
+	c.Assert(limited.Up, Equals, stats.Up)
+	c.Assert(limited.LastCheck, Equals, stats.LastCheck)
+
+	// it runs once the slot is free
+	checkLimit.release(sem)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("the check didn't run once the limit allowed it")
+	}
+	c.Assert(backend.Stats().CheckFail, Equals, 1)
+}
+
+// Check that a HealthEvent is posted when a backend is marked down
+func (s *BasicSuite) TestHealthWebhook(c *C) {
+	events := make(chan HealthEvent, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event HealthEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			c.Error(err)
+		}
+		events <- event
+	}))
+	defer hook.Close()
+
+	healthWebhook.SetURL(hook.URL)
+	defer healthWebhook.SetURL("")
+
+	s.service.CheckInterval = 500
+	s.service.Fall = 1
+	s.AddBackend(c)
+
+	s.servers[0].Stop()
+
+	select {
+	case event := <-events:
+		c.Assert(event.Service, Equals, s.service.Name)
+		c.Assert(event.Backend, Equals, "backend_0")
+		c.Assert(event.OldState, Equals, "up")
+		c.Assert(event.NewState, Equals, "down")
+		c.Assert(event.Reason != "", Equals, true)
+	case <-time.After(2 * time.Second):
+		c.Fatal("no health event received")
+	}
+}
+
+// Each of the health_webhooks gets the event in its own payload
+func (s *BasicSuite) TestHealthWebhookTemplates(c *C) {
+	type post struct {
+		path, contentType, auth string
+		body                    map[string]interface{}
+	}
+	posts := make(chan post, 3)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			c.Error(err)
+		}
+		posts <- post{r.URL.Path, r.Header.Get("Content-Type"), r.Header.Get("Authorization"), body}
+	}))
+	defer hook.Close()
+
+	os.Setenv("SHUTTLE_TEST_ROUTING_KEY", "abc123")
+	defer os.Unsetenv("SHUTTLE_TEST_ROUTING_KEY")
+
+	healthWebhook.SetTargets([]client.WebhookConfig{
+		{URL: hook.URL + "/slack", Format: "slack"},
+		{
+			URL:    hook.URL + "/pagerduty",
+			Format: "pagerduty",
+			Params: map[string]string{"routing_key": "env:SHUTTLE_TEST_ROUTING_KEY"},
+		},
+		{
+			URL:         hook.URL + "/custom",
+			Template:    `{"backend": {{json .Backend}}, "down": {{eq .NewState "down"}}}`,
+			ContentType: "application/vnd.test+json",
+			Headers:     map[string]string{"Authorization": "Bearer token"},
+		},
+	})
+	defer healthWebhook.SetTargets(nil)
+
+	s.service.CheckInterval = 500
+	s.service.Fall = 1
+	s.AddBackend(c)
+
+	s.servers[0].Stop()
+
+	received := make(map[string]post)
+	for len(received) < 3 {
+		select {
+		case p := <-posts:
+			received[p.path] = p
+		case <-time.After(2 * time.Second):
+			c.Fatal("no health event received")
+		}
+	}
+
+	text, _ := received["/slack"].body["text"].(string)
+	c.Assert(strings.HasPrefix(text, s.service.Name+" backend backend_0 ("), Equals, true)
+	c.Assert(strings.Contains(text, "is down: "), Equals, true)
+
+	pd := received["/pagerduty"].body
+	c.Assert(pd["routing_key"], Equals, "abc123")
+	c.Assert(pd["event_action"], Equals, "trigger")
+	c.Assert(pd["dedup_key"], Equals, "shuttle/"+s.service.Name+"/backend_0")
+
+	custom := received["/custom"]
+	c.Assert(custom.contentType, Equals, "application/vnd.test+json")
+	c.Assert(custom.auth, Equals, "Bearer token")
+	c.Assert(custom.body["backend"], Equals, "backend_0")
+	c.Assert(custom.body["down"], Equals, true)
+}
+
+// A backend whose check address stops resolving is removed after the
+// DNSFailTimeout
+func (s *BasicSuite) TestDNSFailRemove(c *C) {
+	s.service.CheckInterval = 100
+	s.service.DNSFailTimeout = 300 * time.Millisecond
+
+	s.service.add(NewBackend(client.BackendConfig{
+		Name:      "unresolvable",
+		Addr:      s.servers[0].addr,
+		CheckAddr: "unresolvable.invalid:80",
+	}))
+	c.Assert(len(s.service.Config().Backends), Equals, 1)
+
+	time.Sleep(800 * time.Millisecond)
+	c.Assert(len(s.service.Config().Backends), Equals, 0)
+}
+
+// Check the hold down for a flapping backend
+func (s *BasicSuite) TestFlapDampening(c *C) {
+	b := NewBackend(client.BackendConfig{Name: "flapping"})
+	b.flapCount = 2
+	b.flapWindow = time.Minute
+	b.flapHoldDown = time.Second
+
+	now := time.Now()
+	b.dampen(now)
+	c.Assert(b.holdUntil.IsZero(), Equals, true)
+
+	b.dampen(now)
+	c.Assert(b.holdUntil, Equals, now.Add(time.Second))
+	c.Assert(b.Stats().HoldUntil, Equals, b.holdUntil)
+
+	// flapping again doubles the hold down
+	b.dampen(now)
+	b.dampen(now)
+	c.Assert(b.holdUntil, Equals, now.Add(2*time.Second))
+}
+
+// Hostname backends are resolved on every check
+func (s *BasicSuite) TestResolveHostname(c *C) {
+	s.service.CheckInterval = 100
+
+	_, port, _ := net.SplitHostPort(s.servers[0].addr)
+	addr := net.JoinHostPort("localhost", port)
+	s.service.add(NewBackend(client.BackendConfig{
+		Name:      "hostname",
+		Addr:      addr,
+		CheckAddr: addr,
+	}))
+
+	time.Sleep(300 * time.Millisecond)
+
+	stats := s.service.Stats()
+	c.Assert(stats.Backends[0].Up, Equals, true)
+	c.Assert(len(stats.Backends[0].Resolved) > 0, Equals, true)
+}
+
+// Resolve a backend address through a fake docker API
+func (s *BasicSuite) TestContainerBackend(c *C) {
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/containers/web/json" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, `{"NetworkSettings": {"Ports": {"80/tcp": [{"HostIp": "0.0.0.0", "HostPort": "32768"}]}}}`)
+	}))
+	defer docker.Close()
+
+	if err := setDockerHost("tcp://" + docker.Listener.Addr().String()); err != nil {
+		c.Fatal(err)
+	}
+	defer func() { dockerClient = nil }()
+
+	backend := NewBackend(client.BackendConfig{Name: "web", Container: "web:80"})
+	c.Assert(backend.Addr, Equals, "127.0.0.1:32768")
+
+	_, err := resolveContainer("missing:80", "tcp")
+	c.Assert(err, NotNil)
+}
+
+// Capture a TCP connection to a file
+func (s *BasicSuite) TestCapture(c *C) {
+	dir := c.MkDir()
+	s.service.capture = newCapture(s.service.Name, &client.CaptureConfig{Dir: dir})
+	defer func() { s.service.capture = nil }()
+
+	s.AddBackend(c)
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+
+	// wait for the proxy to close the capture
+	time.Sleep(100 * time.Millisecond)
+
+	files, err := filepath.Glob(filepath.Join(dir, s.service.Name+"-*.tap"))
+	c.Assert(err, IsNil)
+	c.Assert(len(files), Equals, 1)
+
+	data, err := ioutil.ReadFile(files[0])
+	c.Assert(err, IsNil)
+
+	// the client sent the first frame
+	c.Assert(len(data) > 5, Equals, true)
+	c.Assert(data[0], Equals, byte(captureFromClient))
+
+	// frames the sink hasn't taken yet are dropped rather than waited for
+	client, server := net.Pipe()
+	defer client.Close()
+	tap := &tapConn{Conn: server, frames: make(chan []byte, 1), remaining: 100}
+	tap.capture(captureFromClient, []byte("first"))
+	tap.capture(captureFromServer, []byte("second"))
+	c.Assert(tap.dropped, Equals, int64(6))
+	c.Assert(string(<-tap.frames), Equals, ">\x00\x00\x00\x05first")
+	tap.Close()
+}
+
+// Shutting down stops accepting connections, drains the open ones for the
+// timeout, and reports those it had to kill
+func (s *BasicSuite) TestShutdownReport(c *C) {
+	defer func(r *HostRouter) { httpRouter = r }(httpRouter)
+	httpRouter = nil
+
+	s.AddBackend(c)
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", s.service.Addr)
+		c.Assert(err, IsNil)
+		defer conn.Close()
+
+		_, err = io.WriteString(conn, "testing\n")
+		c.Assert(err, IsNil)
+		_, err = conn.Read(make([]byte, 1024))
+		c.Assert(err, IsNil)
+		conns = append(conns, conn)
+	}
+
+	// one finishes while draining, and the other is left open
+	time.AfterFunc(50*time.Millisecond, func() { conns[0].Close() })
+
+	report := drain("terminated", 300*time.Millisecond)
+	c.Assert(report.Signal, Equals, "terminated")
+	c.Assert(report.Drained, Equals, int64(1))
+	c.Assert(report.Killed, Equals, int64(1))
+	c.Assert(len(report.Services), Equals, 1)
+	c.Assert(report.Services[0].Conns, Equals, int64(2))
+
+	_, err := net.Dial("tcp", s.service.Addr)
+	c.Assert(err, NotNil)
+
+	path := filepath.Join(c.MkDir(), "shutdown.json")
+	c.Assert(writeShutdownReport(report, path), IsNil)
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	var written ShutdownReport
+	c.Assert(json.Unmarshal(data, &written), IsNil)
+	c.Assert(written.Killed, Equals, int64(1))
+}
+
+func (s *BasicSuite) TestReadyHooks(c *C) {
+	dir := c.MkDir()
+	out := filepath.Join(dir, "ready.out")
+	script := filepath.Join(dir, "ready.sh")
+	err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$1 $SHUTTLE_READY_REASON\" >> "+out+"\n"), 0755)
+	c.Assert(err, IsNil)
+
+	var posts []ReadyStat
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var stat ReadyStat
+		json.NewDecoder(r.Body).Decode(&stat)
+		posts = append(posts, stat)
+	}))
+	defer hook.Close()
+
+	r := &readiness{client: http.DefaultClient, script: script, url: hook.URL}
+
+	r.update()
+	c.Assert(r.Stats().Ready, Equals, false)
+
+	r.Lock()
+	r.started = true
+	r.Unlock()
+	r.update()
+	// no change, so the hooks aren't run again
+	r.update()
+	c.Assert(r.Stats().Ready, Equals, true)
+
+	r.Stop()
+	c.Assert(r.Stats().Reason, Equals, "shutting down")
+
+	data, err := ioutil.ReadFile(out)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "not-ready starting\nready \nnot-ready shutting down\n")
+
+	c.Assert(len(posts), Equals, 3)
+	c.Assert(posts[1].Ready, Equals, true)
+	c.Assert(posts[2].Reason, Equals, "shutting down")
+}
+
+func (s *BasicSuite) TestProfiles(c *C) {
+	cfg := client.Config{
+		Profiles: map[string]client.ServiceConfig{
+			"internal-api": {Balance: client.LeastConn, ClientTimeout: 1234, CheckInterval: 5000},
+		},
+		Services: []client.ServiceConfig{
+			{Name: "profiled", Addr: "127.0.0.1:2020", Profile: "internal-api"},
+			{Name: "overridden", Addr: "127.0.0.1:2021", Profile: "internal-api", ClientTimeout: 999},
+		},
+	}
+	c.Assert(Registry.UpdateConfig(cfg), IsNil)
+	defer Registry.RemoveService("profiled")
+	defer Registry.RemoveService("overridden")
+
+	profiled := Registry.GetService("profiled").Config()
+	c.Assert(profiled.Profile, Equals, "internal-api")
+	c.Assert(profiled.Balance, Equals, client.LeastConn)
+	c.Assert(profiled.ClientTimeout, Equals, 1234)
+	c.Assert(profiled.CheckInterval, Equals, 5000)
+
+	overridden := Registry.GetService("overridden").Config()
+	c.Assert(overridden.ClientTimeout, Equals, 999)
+	c.Assert(overridden.CheckInterval, Equals, 5000)
+
+	// the services follow a change to the profile
+	cfg = client.Config{
+		Profiles: map[string]client.ServiceConfig{
+			"internal-api": {ClientTimeout: 1234, CheckInterval: 2000, ServerTimeout: 3000},
+		},
+	}
+	c.Assert(Registry.UpdateConfig(cfg), IsNil)
+
+	profiled = Registry.GetService("profiled").Config()
+	c.Assert(profiled.Balance, Equals, client.RoundRobin)
+	c.Assert(profiled.CheckInterval, Equals, 2000)
+	c.Assert(profiled.ServerTimeout, Equals, 3000)
+
+	overridden = Registry.GetService("overridden").Config()
+	c.Assert(overridden.ClientTimeout, Equals, 999)
+	c.Assert(overridden.ServerTimeout, Equals, 3000)
+
+	c.Assert(Registry.Config().Profiles["internal-api"].CheckInterval, Equals, 2000)
+
+	err := Registry.AddService(client.ServiceConfig{Name: "unknown", Addr: "127.0.0.1:2022", Profile: "missing"})
+	c.Assert(err, ErrorMatches, "unknown profile missing")
+}
+
+func (s *BasicSuite) TestConfigTemplates(c *C) {
+	js := `{"services": [{"name": "static", "address": "127.0.0.1:9100"}],
+	"templates": [{
+		"service": {
+			"name": "tenant-{{tenant}}-{{port}}",
+			"address": "127.0.0.1:{{port}}",
+			"virtual_hosts": ["{{tenant}}.example.com"],
+			"backends": [{"name": "app", "address": "{{host}}:{{port}}"}]
+		},
+		"params": [{"tenant": "a", "host": "10.0.0.1"}, {"tenant": "b", "host": "10.0.0.2"}],
+		"range": {"name": "port", "from": 9000, "to": 9002}
+	}]}`
+
+	cfg, err := parseConfig("templated", []byte(js))
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Templates, IsNil)
+	c.Assert(len(cfg.Services), Equals, 7)
+
+	svc := cfg.Services[6]
+	c.Assert(svc.Name, Equals, "tenant-b-9002")
+	c.Assert(svc.Addr, Equals, "127.0.0.1:9002")
+	c.Assert(svc.VirtualHosts, DeepEquals, []string{"b.example.com"})
+	c.Assert(svc.Backends[0].Addr, Equals, "10.0.0.2:9002")
+
+	_, err = parseConfig("missing", []byte(`{"templates": [{"service": {"name": "{{id}}", "address": "{{addr}}"}, "params": [{"id": "x"}]}]}`))
+	c.Assert(err, ErrorMatches, "template {{id}}: no parameter addr")
+
+	_, err = parseConfig("duplicate", []byte(`{"templates": [{"service": {"name": "svc"}, "range": {"name": "n", "from": 1, "to": 2}}]}`))
+	c.Assert(err, ErrorMatches, "template svc: duplicate service svc")
+}
+
+func (s *BasicSuite) TestDrainBatch(c *C) {
+	s.AddBackend(c)
+	backend := s.service.Backends[0].Name
+
+	conn, err := net.Dial("tcp", s.service.Addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "testing\n")
+	c.Assert(err, IsNil)
+	_, err = conn.Read(make([]byte, 1024))
+	c.Assert(err, IsNil)
+
+	callback := make(chan DrainStatus, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var status DrainStatus
+		json.NewDecoder(r.Body).Decode(&status)
+		callback <- status
+	}))
+	defer hook.Close()
+
+	// nothing is drained if a backend is unknown
+	body := `{"backends": [{"service": "testService", "backend": "` + backend + `"}, {"service": "testService", "backend": "missing"}]}`
+	w := httptest.NewRecorder()
+	postDrain(w, httptest.NewRequest("POST", "/_drain", strings.NewReader(body)))
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+	c.Assert(s.service.Backends[0].Config().AdminState, Equals, "")
+
+	body = `{"backends": [{"service": "testService", "backend": "` + backend + `"}], "timeout": 5000, "callback": "` + hook.URL + `"}`
+	w = httptest.NewRecorder()
+	postDrain(w, httptest.NewRequest("POST", "/_drain", strings.NewReader(body)))
+	c.Assert(w.Code, Equals, http.StatusAccepted)
+
+	var status DrainStatus
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &status), IsNil)
+	c.Assert(status.Done, Equals, false)
+	c.Assert(status.Backends[0].Active, Equals, int64(1))
+	c.Assert(s.service.Backends[0].Config().AdminState, Equals, client.AdminDown)
+
+	conn.Close()
+
+	select {
+	case status = <-callback:
+	case <-time.After(2 * time.Second):
+		c.Fatal("no drain callback")
+	}
+	c.Assert(status.Done, Equals, true)
+	c.Assert(status.TimedOut, Equals, false)
+	c.Assert(status.Backends[0].Drained, Equals, true)
+
+	status, err = drains.Status(status.ID)
+	c.Assert(err, IsNil)
+	c.Assert(status.Done, Equals, true)
+}
+
+// Replay an access log and a capture against a candidate config, without
+// reaching its backends
+func (s *BasicSuite) TestReplay(c *C) {
+	errDir := c.MkDir()
+	cfg := client.Config{
+		Services: []client.ServiceConfig{
+			{
+				Name:         "replayWeb",
+				Addr:         "127.0.0.1:1",
+				VirtualHosts: []string{"web.test"},
+				Backends: []client.BackendConfig{
+					{Name: "web_0", Addr: "127.0.0.1:1"},
+				},
+				ErrorCapture: &client.ErrorCaptureConfig{Dir: errDir, Status: []int{200}},
+			},
+			{
+				Name: "replayEmpty",
+				Addr: "127.0.0.1:1",
+			},
+		},
+	}
+
+	dir := c.MkDir()
+	logPath := filepath.Join(dir, "access.log")
+	c.Assert(ioutil.WriteFile(logPath, []byte(
+		`127.0.0.1 - - [10/Oct/2026:13:55:36 +0000] "GET /a HTTP/1.1" 200 2326 "-" "curl"`+"\n"+
+			`web.test:80 127.0.0.1 - - [10/Oct/2026:13:55:36 +0000] "POST /b HTTP/1.1" 200 10`+"\n"+
+			`127.0.0.1 - - [10/Oct/2026:13:55:37 +0000] "GET http://other.test/c HTTP/1.1" 200 10`+"\n"+
+			"not a request\n"), 0644), IsNil)
+
+	var out strings.Builder
+	stats, err := runReplay(cfg, logPath, "web.test", &out)
+	c.Assert(err, IsNil)
+	c.Assert(stats["replayWeb"].Requests, Equals, 2)
+	c.Assert(stats["replayWeb"].Codes[200], Equals, 2)
+	c.Assert(stats[""].Requests, Equals, 1)
+	c.Assert(stats[""].Errors, Equals, 1)
+	c.Assert(strings.Contains(out.String(), "POST web.test/b -> replayWeb/web_0 status=200"), Equals, true)
+
+	// the sandbox services are removed
+	c.Assert(Registry.GetService("replayWeb"), IsNil)
+
+	// and wrote nothing outside the sandbox
+	captured, err := ioutil.ReadDir(errDir)
+	c.Assert(err, IsNil)
+	c.Assert(captured, HasLen, 0)
+
+	capDir := c.MkDir()
+	frame := append([]byte{captureFromClient, 0, 0, 0, 5}, "hello"...)
+	c.Assert(ioutil.WriteFile(filepath.Join(capDir, "replayWeb-1-127.0.0.1_1234.tap"), frame, 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(capDir, "replayEmpty-2-127.0.0.1_1234.tap"), frame, 0644), IsNil)
+
+	out.Reset()
+	stats, err = runReplay(cfg, capDir, "", &out)
+	c.Assert(err, IsNil)
+	c.Assert(stats["replayWeb"].Errors, Equals, 0)
+	c.Assert(stats["replayEmpty"].Errors, Equals, 1)
+	c.Assert(strings.Contains(out.String(), "TCP replayWeb -> replayWeb/web_0"), Equals, true)
+}
+
+// One service proxies both TCP and UDP to the same backends
+func (s *BasicSuite) TestDualNetwork(c *C) {
+	udpServer, err := NewUDPTestServer(s.servers[0].addr, c)
+	c.Assert(err, IsNil)
+	defer udpServer.Stop()
+
+	svcCfg := client.ServiceConfig{
+		Name:    "dualService",
+		Addr:    "127.0.0.1:2003",
+		Network: "tcp+udp",
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.servers[0].addr},
+		},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	checkResp(svcCfg.Addr, s.servers[0].addr, c)
+
+	rAddr, _ := net.ResolveUDPAddr("udp", svcCfg.Addr)
+	conn, err := net.DialUDP("udp", nil, rAddr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("TEST"))
+	c.Assert(err, IsNil)
+
+	time.Sleep(100 * time.Millisecond)
+	udpServer.Lock()
+	c.Assert(len(udpServer.packets), Equals, 1)
+	udpServer.Unlock()
+}
+
+// Route TLS connections to the service matching the SNI server name
+func (s *BasicSuite) TestSNIRouting(c *C) {
+	s.AddBackend(c)
+	s.service.Lock()
+	s.service.SNIRouting = true
+	s.service.Unlock()
+
+	svcCfg := client.ServiceConfig{
+		Name:         "sniService",
+		Addr:         "127.0.0.1:2004",
+		VirtualHosts: []string{"sni.example.com"},
+		Backends: []client.BackendConfig{
+			{Name: "backend_1", Addr: s.servers[1].addr},
+		},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	// capture a ClientHello to send through the proxy
+	cli, srv := net.Pipe()
+	go tls.Client(cli, &tls.Config{ServerName: "sni.example.com"}).Handshake()
+	hello := make([]byte, 4096)
+	n, err := srv.Read(hello)
+	c.Assert(err, IsNil)
+	cli.Close()
+	srv.Close()
+
+	conn, err := net.Dial("tcp", s.service.Addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	_, err = conn.Write(hello[:n])
+	c.Assert(err, IsNil)
+
+	// the server responds to every read, so only check the first
+	resp := make([]byte, len(s.servers[1].addr))
+	_, err = io.ReadFull(conn, resp)
+	c.Assert(err, IsNil)
+	c.Assert(string(resp), Equals, s.servers[1].addr)
+
+	// anything else goes to the service's own backends
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+}
+
+// Read a PROXY header from the client, and send one to the backend
+func (s *BasicSuite) TestProxyProtocol(c *C) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer backend.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:        "proxyService",
+		Addr:        "127.0.0.1:2005",
+		AcceptProxy: true,
+		SendProxy:   ProxyV2,
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: backend.Addr().String()},
+		},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	conn, err := net.Dial("tcp", svcCfg.Addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 1234 80\r\nhello"))
+	c.Assert(err, IsNil)
+
+	srvConn, err := backend.Accept()
+	c.Assert(err, IsNil)
+	defer srvConn.Close()
+
+	pConn, err := readProxyHeader(srvConn)
+	c.Assert(err, IsNil)
+	c.Assert(pConn.RemoteAddr().String(), Equals, "192.0.2.1:1234")
+	c.Assert(pConn.LocalAddr().String(), Equals, "192.0.2.2:80")
+
+	data := make([]byte, 5)
+	_, err = io.ReadFull(pConn, data)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello")
+
+	// connections without a header are closed
+	noHdr, err := net.Dial("tcp", svcCfg.Addr)
+	c.Assert(err, IsNil)
+	defer noHdr.Close()
+
+	_, err = noHdr.Write([]byte("not a proxy header\r\n"))
+	c.Assert(err, IsNil)
+	noHdr.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = noHdr.Read(data)
+	c.Assert(err, Equals, io.EOF)
+}
+
+// Write and read back PROXY headers for each version and address family
+func (s *BasicSuite) TestProxyHeaders(c *C) {
+	tcp4 := []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234},
+		&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 80},
+	}
+	tcp6 := []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234},
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+	}
+	unix := []net.Addr{
+		&net.UnixAddr{Name: "/tmp/client", Net: "unix"},
+		&net.UnixAddr{Name: "/tmp/server", Net: "unix"},
+	}
+
+	for _, version := range []string{ProxyV1, ProxyV2} {
+		for _, addrs := range [][]net.Addr{tcp4, tcp6, unix} {
+			hdr, err := proxyHeader(version, addrs[0], addrs[1])
+			c.Assert(err, IsNil)
+
+			cli, srv := net.Pipe()
+			go func() {
+				cli.Write(append(hdr, "data"...))
+				cli.Close()
+			}()
+
+			pConn, err := readProxyHeader(srv)
+			c.Assert(err, IsNil)
+
+			if _, ok := addrs[0].(*net.TCPAddr); ok {
+				c.Assert(pConn.RemoteAddr().String(), Equals, addrs[0].String())
+				c.Assert(pConn.LocalAddr().String(), Equals, addrs[1].String())
+			} else {
+				// the pipe's own address is kept
+				c.Assert(pConn.RemoteAddr().String(), Equals, "pipe")
+			}
+
+			data, err := ioutil.ReadAll(pConn)
+			c.Assert(err, IsNil)
+			c.Assert(string(data), Equals, "data")
+			srv.Close()
+		}
+	}
+
+	_, err := proxyHeader("v3", tcp4[0], tcp4[1])
+	c.Assert(err, NotNil)
+}
+
+// Connections over the rate limit are reset
+func (s *BasicSuite) TestRateLimit(c *C) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer backend.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:      "rateService",
+		Addr:      "127.0.0.1:2007",
+		RateLimit: 0.1,
+		RateBurst: 2,
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: backend.Addr().String()},
+		},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", svcCfg.Addr)
+		c.Assert(err, IsNil)
+		defer conn.Close()
+
+		srvConn, err := backend.Accept()
+		c.Assert(err, IsNil)
+		srvConn.Close()
+	}
+
+	conn, err := net.Dial("tcp", svcCfg.Addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, NotNil)
+	if netErr, ok := err.(net.Error); ok {
+		c.Assert(netErr.Timeout(), Equals, false)
+	}
+
+	stats, err := Registry.ServiceStats(svcCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(stats.RateLimited, Equals, int64(1))
+}
+
+// Read and write the config through each storage driver
+func (s *BasicSuite) TestConfigStores(c *C) {
+	var mu sync.Mutex
+	kv := make(map[string][]byte)
+
+	// a fake of the consul, etcd, and s3 APIs
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		body, _ := ioutil.ReadAll(r.Body)
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v3/kv/"):
+			var req etcdKV
+			json.Unmarshal(body, &req)
+			if r.URL.Path == "/v3/kv/put" {
+				kv[req.Key] = []byte(req.Value)
+				return
+			}
+			resp := map[string][]etcdKV{"kvs": {}}
+			if v, ok := kv[req.Key]; ok {
+				resp["kvs"] = append(resp["kvs"], etcdKV{Key: req.Key, Value: string(v)})
+			}
+			json.NewEncoder(w).Encode(resp)
+		default:
+			if strings.HasPrefix(r.URL.Path, "/bucket/") && !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=id/") {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if r.Method == "PUT" {
+				kv[r.URL.Path] = body
+				return
+			}
+			v, ok := kv[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(v)
+		}
+	}))
+	defer fake.Close()
+
+	os.Setenv("AWS_ENDPOINT_URL", fake.URL)
+	os.Setenv("AWS_ACCESS_KEY_ID", "id")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ENDPOINT_URL")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	host := strings.TrimPrefix(fake.URL, "http://")
+	locations := []string{
+		filepath.Join(c.MkDir(), "state.json"),
+		"file://" + filepath.Join(c.MkDir(), "state.json"),
+		"consul://" + host + "/shuttle/state",
+		"etcd://" + host + "/shuttle/state",
+		"s3://bucket/shuttle/state.json",
+	}
+
+	for _, loc := range locations {
+		store, err := newConfigStore(loc)
+		c.Assert(err, IsNil)
+
+		_, err = store.Read()
+		c.Assert(err, NotNil, Commentf("%s", loc))
+
+		c.Assert(store.Write([]byte(`{"services":[]}`)), IsNil)
+		data, err := store.Read()
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, `{"services":[]}`, Commentf("%s", loc))
+	}
+
+	_, err := newConfigStore("zookeeper://127.0.0.1/shuttle")
+	c.Assert(err, NotNil)
+}
+
+// Encrypt the config at rest with a key, and still read plaintext configs
+func (s *BasicSuite) TestEncryptedConfigStore(c *C) {
+	path := filepath.Join(c.MkDir(), "state.json")
+	c.Assert(ioutil.WriteFile(path, []byte(`{"services":[]}`), 0644), IsNil)
+
+	setConfigKey("secret")
+	defer setConfigKey("")
+
+	store, err := newConfigStore(path)
+	c.Assert(err, IsNil)
+
+	data, err := store.Read()
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `{"services":[]}`)
+
+	c.Assert(store.Write([]byte(`{"services":[{"name":"secret"}]}`)), IsNil)
+	raw, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(string(raw), string(encryptedConfigHeader)), Equals, true)
+	c.Assert(strings.Contains(string(raw), "secret"), Equals, false)
+
+	data, err = store.Read()
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `{"services":[{"name":"secret"}]}`)
+
+	// a different key, or none, can't read it
+	setConfigKey("other")
+	store, _ = newConfigStore(path)
+	_, err = store.Read()
+	c.Assert(err, NotNil)
+
+	setConfigKey("")
+	store, _ = newConfigStore(path)
+	_, err = store.Read()
+	c.Assert(err, NotNil)
+
+	// each state config is written with its own salt
+	setConfigKey("secret")
+	other := filepath.Join(c.MkDir(), "state.json")
+	store, _ = newConfigStore(other)
+	c.Assert(store.Write([]byte(`{"services":[{"name":"secret"}]}`)), IsNil)
+	otherRaw, err := ioutil.ReadFile(other)
+	c.Assert(err, IsNil)
+	salt := func(raw []byte) []byte {
+		sealed, err := base64.StdEncoding.DecodeString(string(raw[len(encryptedConfigHeader):]))
+		c.Assert(err, IsNil)
+		return sealed[:stateKeySaltSize]
+	}
+	c.Assert(salt(otherRaw), Not(DeepEquals), salt(raw))
+
+	// a config encrypted by an older release is still read
+	sum := sha256.Sum256([]byte("secret"))
+	gcm, err := configCipher(sum[:])
+	c.Assert(err, IsNil)
+	nonce := make([]byte, gcm.NonceSize())
+	sealed := gcm.Seal(nonce, nonce, []byte(`{"services":[]}`), nil)
+	legacy := append([]byte("shuttle-encrypted:v1:"), base64.StdEncoding.EncodeToString(sealed)...)
+	c.Assert(ioutil.WriteFile(path, legacy, 0644), IsNil)
+
+	store, _ = newConfigStore(path)
+	data, err = store.Read()
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `{"services":[]}`)
+}
+
+// Migrate unversioned configs, and reject configs from a newer release
+func (s *BasicSuite) TestMigrateConfig(c *C) {
+	legacy := []byte(`{"balance":"LC","services":[{"name":"legacy","address":"127.0.0.1:2006"}]}`)
+
+	migrated, version, err := client.MigrateConfig(legacy)
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, 0)
+
+	cfg, err := parseConfig("legacy", migrated)
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Version, Equals, client.ConfigVersion)
+	c.Assert(cfg.Balance, Equals, "LC")
+	c.Assert(cfg.Services[0].Name, Equals, "legacy")
+
+	_, _, err = client.MigrateConfig([]byte(fmt.Sprintf(`{"version":%d}`, client.ConfigVersion+1)))
+	c.Assert(err, NotNil)
+
+	c.Assert(client.CheckFields(migrated), IsNil)
+	c.Assert(client.CheckFields([]byte(`{"services":[{"name":"x","adress":"127.0.0.1:1"}]}`)), ErrorMatches, `.*unknown field "adress".*`)
+
+	dir := c.MkDir()
+	src, dst := filepath.Join(dir, "old.json"), filepath.Join(dir, "new.json")
+	c.Assert(ioutil.WriteFile(src, legacy, 0644), IsNil)
+	c.Assert(migrateConfig(src, dst), IsNil)
+
+	data, err := ioutil.ReadFile(dst)
+	c.Assert(err, IsNil)
+	_, version, err = client.MigrateConfig(data)
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, client.ConfigVersion)
+
+	// the state is always written with the current version
+	c.Assert(Registry.Config().Version, Equals, client.ConfigVersion)
+}
+
+// A LazyBind service doesn't listen until a backend passes a check
+func (s *BasicSuite) TestLazyBind(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:          "lazyService",
+		Addr:          "127.0.0.1:2001",
+		CheckInterval: 20,
+		LazyBind:      true,
+		Backends: []client.BackendConfig{
+			{
+				Name:      "backend_0",
+				Addr:      s.servers[0].addr,
+				CheckAddr: s.servers[0].addr,
+			},
+		},
+	}
+
+	err := Registry.AddService(svcCfg)
+	c.Assert(err, IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	_, err = net.Dial("tcp", svcCfg.Addr)
+	c.Assert(err, NotNil)
+
+	for i := 0; i < 50; i++ {
+		var conn net.Conn
+		conn, err = net.Dial("tcp", svcCfg.Addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.Assert(err, IsNil)
+
+	checkResp(svcCfg.Addr, s.servers[0].addr, c)
+}
+
+// Keep trying to bind an address that's in use
+func (s *BasicSuite) TestBindRetry(c *C) {
+	busy, err := net.Listen("tcp", "127.0.0.1:2002")
+	c.Assert(err, IsNil)
+
+	svcCfg := client.ServiceConfig{
+		Name: "retryService",
+		Addr: "127.0.0.1:2002",
+	}
+
+	// fails without a retry
+	c.Assert(Registry.AddService(svcCfg), NotNil)
+
+	svcCfg.BindRetry = 2000
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	svc := Registry.GetService(svcCfg.Name)
+	c.Assert(svc.Stats().Binding, Equals, bindRetrying)
+
+	busy.Close()
+	for i := 0; i < 50 && svc.Stats().Binding != bindBound; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.Assert(svc.Stats().Binding, Equals, bindBound)
+}
+
+// Clients get the NoBackendResponse when there's nowhere to connect
+func (s *BasicSuite) TestNoBackendResponse(c *C) {
+	s.service.Lock()
+	s.service.noBackendResponse = []byte("no backend\n")
+	s.service.Unlock()
+
+	conn, err := net.Dial("tcp", s.service.Addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	resp, err := ioutil.ReadAll(conn)
+	c.Assert(err, IsNil)
+	c.Assert(string(resp), Equals, "no backend\n")
+
+	c.Assert(s.service.Stats().NoBackend, Equals, int64(1))
+	c.Assert(s.service.Config().NoBackendResponse, Equals, "no backend\n")
+}
+
+// Balance across all backends once too few are healthy
+func (s *BasicSuite) TestPanicThreshold(c *C) {
+	s.AddBackend(c)
+	s.AddBackend(c)
+
+	down := s.service.get("backend_1")
+	down.Lock()
+	down.up = false
+	down.Unlock()
+
+	c.Assert(len(s.service.NextAddrs()), Equals, 1)
+	c.Assert(s.service.Stats().Panic, Equals, false)
+
+	s.service.Lock()
+	s.service.PanicThreshold = 60
+	s.service.Unlock()
+
+	c.Assert(len(s.service.NextAddrs()), Equals, 2)
+	c.Assert(s.service.Available(), Equals, 2)
+	c.Assert(s.service.Stats().Panic, Equals, true)
 }
 
 // Make sure the connection is re-dispatched when Dialing a backend fails
@@ -436,6 +1489,126 @@ func (s *BasicSuite) TestUpdateService(c *C) {
 	}
 }
 
+// Replacing a service on the same address swaps its whole config, without
+// restarting the listener
+func (s *BasicSuite) TestReplaceService(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:          "Replace",
+		Addr:          "127.0.0.1:9324",
+		ServerTimeout: 1234,
+		HTTPSRedirect: true,
+		Balance:       "LC",
+	}
+
+	// replacing a service that doesn't exist adds it
+	c.Assert(Registry.ReplaceService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	svc := Registry.GetService("Replace")
+	c.Assert(svc, NotNil)
+	c.Assert(svc.HTTPSRedirect, Equals, true)
+
+	svcCfg = client.ServiceConfig{
+		Name: "Replace",
+		Addr: "127.0.0.1:9324",
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.servers[0].addr},
+		},
+	}
+	c.Assert(Registry.ReplaceService(svcCfg), IsNil)
+
+	// the same service, with nothing left from the old config
+	replaced := Registry.GetService("Replace")
+	c.Assert(replaced, Equals, svc)
+	c.Assert(replaced.HTTPSRedirect, Equals, false)
+	c.Assert(replaced.Balance, Equals, "RR")
+	c.Assert(replaced.ServerTimeout, Not(Equals), 1234*time.Millisecond)
+	c.Assert(len(replaced.Backends), Equals, 1)
+
+	// the listener is still serving
+	checkResp(svcCfg.Addr, s.servers[0].addr, c)
+
+	svcCfg.Addr = "127.0.0.1:9325"
+	c.Assert(Registry.ReplaceService(svcCfg), Equals, ErrDuplicateService)
+}
+
+// Connections over the service's limit are reset until a slot is free
+func (s *BasicSuite) TestMaxConnections(c *C) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer backend.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:           "maxConnService",
+		Addr:           "127.0.0.1:2008",
+		MaxConnections: 1,
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: backend.Addr().String()},
+		},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	first, err := net.Dial("tcp", svcCfg.Addr)
+	c.Assert(err, IsNil)
+	srvConn, err := backend.Accept()
+	c.Assert(err, IsNil)
+
+	second, err := net.Dial("tcp", svcCfg.Addr)
+	c.Assert(err, IsNil)
+	defer second.Close()
+
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = second.Read(make([]byte, 1))
+	c.Assert(err, NotNil)
+	if netErr, ok := err.(net.Error); ok {
+		c.Assert(netErr.Timeout(), Equals, false)
+	}
+
+	// closing the first connection frees the slot
+	first.Close()
+	srvConn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	third, err := net.Dial("tcp", svcCfg.Addr)
+	c.Assert(err, IsNil)
+	defer third.Close()
+	srvConn, err = backend.Accept()
+	c.Assert(err, IsNil)
+	srvConn.Close()
+
+	stats, err := Registry.ServiceStats(svcCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(stats.ConnLimited, Equals, int64(1))
+}
+
+// The active optional features are listed in the stats
+func (s *BasicSuite) TestFeatures(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name: "Features",
+		Addr: "127.0.0.1:9325",
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	stats, err := Registry.ServiceStats(svcCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Features, DeepEquals, []string{})
+
+	svcCfg.AcceptProxy = true
+	svcCfg.RateLimit = 10
+	svcCfg.Backends = []client.BackendConfig{
+		{Name: "backend_0", Addr: s.servers[0].addr, SendProxy: ProxyV1},
+	}
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+
+	stats, err = Registry.ServiceStats(svcCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Features, DeepEquals, []string{"accept_proxy", "send_proxy", "rate_limit"})
+}
+
 // Add backends and run response tests in parallel
 func (s *BasicSuite) TestParallel(c *C) {
 	var wg sync.WaitGroup
@@ -620,6 +1793,216 @@ func (s *UDPSuite) TestWeightedRoundRobin(c *C) {
 	}
 }
 
+// Each port of a range is proxied to the same port of the backend's range
+func (s *UDPSuite) TestPortRange(c *C) {
+	var servers []*udpTestServer
+	for _, addr := range []string{"127.0.0.1:11130", "127.0.0.1:11131"} {
+		srv, err := NewUDPTestServer(addr, c)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer srv.Stop()
+		servers = append(servers, srv)
+	}
+
+	svcCfg := client.ServiceConfig{
+		Name:    "rangeService",
+		Addr:    "127.0.0.1:11120-11121",
+		Network: "udp",
+		Backends: []client.BackendConfig{
+			{Name: "backend", Addr: "127.0.0.1:11130-11131", Network: "udp"},
+		},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	rAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:11121")
+	conn, err := net.DialUDP("udp", nil, rAddr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("TEST"))
+	c.Assert(err, IsNil)
+	time.Sleep(100 * time.Millisecond)
+
+	servers[0].Lock()
+	c.Assert(len(servers[0].packets), Equals, 0)
+	servers[0].Unlock()
+	servers[1].Lock()
+	c.Assert(len(servers[1].packets), Equals, 1)
+	servers[1].Unlock()
+
+	stats := Registry.GetService(svcCfg.Name).Stats()
+	c.Assert(stats.Sessions, Equals, int64(1))
+	c.Assert(len(stats.Ports), Equals, 2)
+	c.Assert(stats.Ports[1].Port, Equals, 11121)
+	c.Assert(stats.Ports[1].Rcvd, Equals, int64(4))
+	c.Assert(stats.Ports[0].Rcvd, Equals, int64(0))
+}
+
+// A FanOut service sends every datagram to all the backends
+func (s *UDPSuite) TestFanOut(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:    "fanOutService",
+		Addr:    "127.0.0.1:11140",
+		Network: "udp",
+		FanOut:  true,
+	}
+
+	var servers []*udpTestServer
+	for i, addr := range []string{"127.0.0.1:11141", "127.0.0.1:11142"} {
+		srv, err := NewUDPTestServer(addr, c)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer srv.Stop()
+		servers = append(servers, srv)
+
+		svcCfg.Backends = append(svcCfg.Backends, client.BackendConfig{
+			Name:    fmt.Sprintf("backend%d", i),
+			Addr:    addr,
+			Network: "udp",
+		})
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	rAddr, _ := net.ResolveUDPAddr("udp", svcCfg.Addr)
+	conn, err := net.DialUDP("udp", nil, rAddr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err = conn.Write([]byte("TEST"))
+		c.Assert(err, IsNil)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for _, srv := range servers {
+		srv.Lock()
+		c.Assert(len(srv.packets), Equals, 3)
+		srv.Unlock()
+	}
+
+	stats := Registry.GetService(svcCfg.Name).Stats()
+	c.Assert(stats.Rcvd, Equals, int64(12))
+}
+
+// A backend that doesn't reply within the response window is skipped
+func (s *UDPSuite) TestResponseWindow(c *C) {
+	silent, err := NewUDPTestServer("127.0.0.1:11151", c)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer silent.Stop()
+
+	lAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:11152")
+	echo, err := net.ListenUDP("udp", lAddr)
+	c.Assert(err, IsNil)
+	defer echo.Close()
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	svcCfg := client.ServiceConfig{
+		Name:              "windowService",
+		Addr:              "127.0.0.1:11150",
+		Network:           "udp",
+		CheckInterval:     1000,
+		UDPResponseWindow: 50,
+		Backends: []client.BackendConfig{
+			{Name: "silent", Addr: silent.addr, Network: "udp"},
+			{Name: "echo", Addr: lAddr.String(), Network: "udp"},
+		},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	rAddr, _ := net.ResolveUDPAddr("udp", svcCfg.Addr)
+	conn, err := net.DialUDP("udp", nil, rAddr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	// one datagram to each backend
+	for i := 0; i < 2; i++ {
+		_, err = conn.Write([]byte("TEST"))
+		c.Assert(err, IsNil)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	svc := Registry.GetService(svcCfg.Name)
+	c.Assert(svc.Backends[0].Suspect(), Equals, true)
+	c.Assert(svc.Backends[1].Suspect(), Equals, false)
+
+	// everything goes to the responding backend while the other is suspect
+	for i := 0; i < 2; i++ {
+		_, err = conn.Write([]byte("TEST"))
+		c.Assert(err, IsNil)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	silent.Lock()
+	c.Assert(len(silent.packets), Equals, 1)
+	silent.Unlock()
+}
+
+// Datagrams over a source's packet or byte limit are dropped
+func (s *UDPSuite) TestUDPRateLimit(c *C) {
+	srv, err := NewUDPTestServer("127.0.0.1:11161", c)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer srv.Stop()
+
+	svcCfg := client.ServiceConfig{
+		Name:           "udpLimitService",
+		Addr:           "127.0.0.1:11160",
+		Network:        "udp",
+		UDPPacketRate:  0.1,
+		UDPPacketBurst: 3,
+		UDPByteRate:    0.1,
+		UDPByteBurst:   10,
+		Backends: []client.BackendConfig{
+			{Name: "backend0", Addr: srv.addr, Network: "udp"},
+		},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	rAddr, _ := net.ResolveUDPAddr("udp", svcCfg.Addr)
+	conn, err := net.DialUDP("udp", nil, rAddr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	// the third datagram is over the byte burst, and the fourth over the
+	// packet burst
+	for _, msg := range []string{"TEST", "TEST", "TEST", "T"} {
+		_, err = conn.Write([]byte(msg))
+		c.Assert(err, IsNil)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	srv.Lock()
+	c.Assert(len(srv.packets), Equals, 2)
+	srv.Unlock()
+
+	stats := Registry.GetService(svcCfg.Name).Stats()
+	c.Assert(stats.UDPDropped, Equals, int64(2))
+	c.Assert(stats.UDPDropBytes, Equals, int64(5))
+}
+
 // Throw a lot of packets at the proxy then count what went through
 // This doesn't pass or fail, just logs how much made it to the backend.
 func (s *UDPSuite) TestSpew(c *C) {
@@ -660,3 +2043,546 @@ func (s *UDPSuite) TestSpew(c *C) {
 	c.Logf("Proxied %d packets", stats.Rcvd/10)
 	c.Logf("Received %d packets", server.count)
 }
+
+// Secrets may be read from the environment or a file, and the config keeps
+// only the reference
+func (s *BasicSuite) TestSecretRefs(c *C) {
+	os.Setenv("SHUTTLE_TEST_TOKEN", "env-token")
+	defer os.Unsetenv("SHUTTLE_TEST_TOKEN")
+
+	auth := c.MkDir() + "/auth"
+	c.Assert(ioutil.WriteFile(auth, []byte("Basic dXNlcjpwYXNz\n"), 0600), IsNil)
+
+	svcCfg := client.ServiceConfig{
+		Name:             "Secrets",
+		Addr:             "127.0.0.1:9324",
+		MaintenanceToken: "env:SHUTTLE_TEST_TOKEN",
+		SetHeaders: map[string]string{
+			"Authorization": "file:" + auth,
+			"X-Missing":     "env:SHUTTLE_TEST_MISSING",
+			"X-Plain":       "plain",
+		},
+		JWT: &client.JWTConfig{Secret: "env:SHUTTLE_TEST_TOKEN"},
+	}
+
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	svc := Registry.GetService(svcCfg.Name)
+	c.Assert(svc, NotNil)
+	c.Assert(svc.maintenanceToken, Equals, "env-token")
+	c.Assert(svc.setHeaders, DeepEquals, map[string]string{
+		"Authorization": "Basic dXNlcjpwYXNz",
+		"X-Plain":       "plain",
+	})
+	c.Assert(svc.jwt.err, IsNil)
+	c.Assert(svc.jwt.cfg.Secret, Equals, "env-token")
+
+	cfg := svc.Config()
+	c.Assert(cfg.MaintenanceToken, Equals, "env:SHUTTLE_TEST_TOKEN")
+	c.Assert(cfg.SetHeaders["Authorization"], Equals, "file:"+auth)
+	c.Assert(cfg.JWT.Secret, Equals, "env:SHUTTLE_TEST_TOKEN")
+
+	// an unresolved JWT secret rejects every token
+	c.Assert(newJWTVerifier("Secrets", &client.JWTConfig{Secret: "env:SHUTTLE_TEST_MISSING"}).err, NotNil)
+
+	_, err := resolveSecret("file:" + auth + ".missing")
+	c.Assert(err, NotNil)
+}
+
+// Connection lifetimes are counted when they close, and open connections by
+// their current age
+func (s *BasicSuite) TestConnAges(c *C) {
+	s.AddBackend(c)
+
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+	for i := 0; i < 20 && s.service.Stats().ConnAges[0].Closed == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, err := net.Dial("tcp", s.service.Addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "testing\n")
+	c.Assert(err, IsNil)
+	_, err = conn.Read(make([]byte, 1024))
+	c.Assert(err, IsNil)
+
+	stats := s.service.Stats()
+	c.Assert(stats.ConnAges, HasLen, 6)
+	c.Assert(stats.ConnAges[0], Equals, AgeBucket{Under: "1s", Closed: 1, Active: 1})
+	c.Assert(stats.ConnAges[5].Under, Equals, "")
+	c.Assert(stats.OldestConn < 1000, Equals, true)
+
+	conn.Close()
+	for i := 0; i < 20 && s.service.Stats().ConnAges[0].Active > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(s.service.Stats().ConnAges[0], Equals, AgeBucket{Under: "1s", Closed: 2})
+}
+
+// A backend falls back to its other addresses, and keeps using the one that
+// connected.
+func (s *BasicSuite) TestFallbackAddrs(c *C) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	s.service.add(NewBackend(client.BackendConfig{
+		Name:          "fallback",
+		Addr:          deadAddr,
+		CheckAddr:     deadAddr,
+		FallbackAddrs: []string{s.servers[0].addr},
+	}))
+
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+
+	stats := s.service.Stats()
+	c.Assert(stats.Backends, HasLen, 1)
+	c.Assert(stats.Backends[0].FallbackAddrs, DeepEquals, []string{s.servers[0].addr})
+	c.Assert(stats.Backends[0].DialAddr, Equals, s.servers[0].addr)
+	c.Assert(stats.Backends[0].Errors, Equals, int64(0))
+
+	// the health check passes through the fallback address
+	b := s.service.get("fallback")
+	b.check()
+	c.Assert(b.Stats().CheckOK, Equals, 1)
+
+	cfg := s.service.Config()
+	c.Assert(cfg.Backends[0].FallbackAddrs, DeepEquals, []string{s.servers[0].addr})
+	c.Assert(cfg.Backends[0].Equal(b.Config()), Equals, true)
+}
+
+// The LB health responder reports the service's backend availability.
+func (s *BasicSuite) TestLBHealth(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:     "LBHealth",
+		Addr:     "127.0.0.1:11170",
+		LBHealth: &client.LBHealthConfig{Addr: "127.0.0.1:11171", MinAvailable: 100},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.servers[0].addr},
+			{Name: "b1", Addr: s.servers[1].addr},
+		},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	check := func(status, weight int) {
+		resp, err := http.Get("http://127.0.0.1:11171/_lb-health")
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+
+		var stat LBHealthStat
+		c.Assert(json.NewDecoder(resp.Body).Decode(&stat), IsNil)
+		c.Assert(resp.StatusCode, Equals, status)
+		c.Assert(stat.Weight, Equals, weight)
+		c.Assert(resp.Header.Get("X-LB-Weight"), Equals, strconv.Itoa(weight))
+	}
+
+	check(http.StatusOK, 100)
+
+	// fewer than MinAvailable percent of the backends
+	b0 := Registry.GetService(svcCfg.Name).get("b0")
+	c.Assert(b0.SetAdminState(client.AdminDown), IsNil)
+	check(http.StatusServiceUnavailable, 50)
+	c.Assert(b0.SetAdminState(""), IsNil)
+	check(http.StatusOK, 100)
+
+	resp, err := http.Get("http://127.0.0.1:11171/other")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+
+	// a new config moves the responder
+	svcCfg.LBHealth = &client.LBHealthConfig{Addr: "127.0.0.1:11171", Path: "/health"}
+	svcCfg.Backends = []client.BackendConfig{}
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	resp, err = http.Get("http://127.0.0.1:11171/health")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+
+	c.Assert(Registry.RemoveService(svcCfg.Name), IsNil)
+	_, err = http.Get("http://127.0.0.1:11171/health")
+	c.Assert(err, NotNil)
+}
+
+// COST balancing orders the backends by their reported load and weight.
+func (s *BasicSuite) TestLeastCost(c *C) {
+	loads := map[string]string{"/b0": "8", "/b1": `{"load": 3}`, "/b2": "garbage"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, loads[r.URL.Path])
+	}))
+	defer srv.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:    "LeastCost",
+		Addr:    "127.0.0.1:2000",
+		Balance: client.LeastCost,
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.servers[0].addr, LoadURL: srv.URL + "/b0", Weight: 2},
+			{Name: "b1", Addr: s.servers[1].addr, LoadURL: srv.URL + "/b1"},
+			{Name: "b2", Addr: s.servers[2].addr, LoadURL: srv.URL + "/b2"},
+		},
+	}
+
+	svc := NewService(svcCfg)
+	for _, b := range svc.Backends {
+		b.pollLoad()
+	}
+
+	// b2 reported nothing usable, and b0's load is halved by its weight
+	c.Assert(svc.NextAddrs(), DeepEquals, []string{s.servers[2].addr, s.servers[1].addr, s.servers[0].addr})
+
+	stats := svc.get("b1").Stats()
+	c.Assert(stats.Load, NotNil)
+	c.Assert(*stats.Load, Equals, 3.0)
+	c.Assert(svc.get("b2").Stats().Load, IsNil)
+
+	// the cost function can be replaced
+	svc.cost = func(b *Backend) float64 { return -float64(b.Weight) }
+	c.Assert(svc.NextAddrs()[0], Equals, s.servers[0].addr)
+
+	c.Assert(svc.Config().Backends[0].LoadURL, Equals, srv.URL+"/b0")
+}
+
+// Workers share their listeners with SO_REUSEPORT.
+func (s *BasicSuite) TestReusePort(c *C) {
+	l1, err := listenTCP("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l1.Close()
+
+	// without reusePort, the address is taken
+	_, err = listenTCP("tcp", l1.Addr().String())
+	c.Assert(err, NotNil)
+
+	reusePort = true
+	defer func() { reusePort = false }()
+
+	l2, err := listenTCP("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l2.Close()
+
+	l3, err := listenTCP("tcp", l2.Addr().String())
+	c.Assert(err, IsNil)
+	l3.Close()
+
+	u1, err := listenUDPConn("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer u1.Close()
+
+	u2, err := listenUDPConn("udp", u1.LocalAddr().String())
+	c.Assert(err, IsNil)
+	u2.Close()
+}
+
+// A backend moved between services in one config keeps its health state when
+// migrating, and starts over without.
+func (s *BasicSuite) TestMigrateBackend(c *C) {
+	from := client.ServiceConfig{
+		Name: "MoveFrom",
+		Addr: "127.0.0.1:2001",
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.servers[0].addr},
+			{Name: "b1", Addr: s.servers[1].addr},
+		},
+	}
+	to := client.ServiceConfig{
+		Name:     "MoveTo",
+		Addr:     "127.0.0.1:2002",
+		Backends: []client.BackendConfig{{Name: "b2", Addr: s.servers[2].addr}},
+	}
+
+	c.Assert(Registry.UpdateConfig(client.Config{Services: []client.ServiceConfig{from, to}}), IsNil)
+	defer Registry.RemoveService(from.Name)
+	defer Registry.RemoveService(to.Name)
+
+	fromSvc := Registry.GetService(from.Name)
+	toSvc := Registry.GetService(to.Name)
+
+	down := func(b *Backend) {
+		b.Lock()
+		b.up = false
+		b.checkFail = 7
+		b.lastError = "connection refused"
+		b.Unlock()
+		atomic.StoreInt64(&b.Conns, 42)
+	}
+	down(fromSvc.get("b0"))
+	down(fromSvc.get("b1"))
+
+	// move b0 with its state, and the services are applied in either order
+	from.Backends = from.Backends[1:]
+	to.Backends = append(to.Backends, client.BackendConfig{Name: "b0", Addr: s.servers[0].addr})
+	_, err := Registry.ApplyConfig(client.Config{Services: []client.ServiceConfig{to, from}}, false, true)
+	c.Assert(err, IsNil)
+
+	c.Assert(fromSvc.get("b0"), IsNil)
+	stats := toSvc.get("b0").Stats()
+	c.Assert(stats.Up, Equals, false)
+	c.Assert(stats.CheckFail, Equals, 7)
+	c.Assert(stats.LastError, Equals, "connection refused")
+	c.Assert(stats.Conns, Equals, int64(42))
+
+	// an unmoved backend is untouched
+	c.Assert(toSvc.get("b2").Stats().Up, Equals, true)
+
+	// without migrating, b1 starts over
+	from.Backends = []client.BackendConfig{}
+	to.Backends = append(to.Backends, client.BackendConfig{Name: "b1", Addr: s.servers[1].addr})
+	c.Assert(Registry.UpdateConfig(client.Config{Services: []client.ServiceConfig{from, to}}), IsNil)
+
+	stats = toSvc.get("b1").Stats()
+	c.Assert(stats.Up, Equals, true)
+	c.Assert(stats.CheckFail, Equals, 0)
+	c.Assert(stats.Conns, Equals, int64(0))
+}
+
+// With KeepBackendStats, a backend replaced or added back with the same name
+// and address carries over its stats.
+func (s *BasicSuite) TestKeepBackendStats(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:             "KeepStats",
+		Addr:             "127.0.0.1:2001",
+		KeepBackendStats: 60000,
+		Backends:         []client.BackendConfig{{Name: "b0", Addr: s.servers[0].addr}},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+	svc := Registry.GetService(svcCfg.Name)
+
+	atomic.StoreInt64(&svc.get("b0").Conns, 42)
+
+	// a changed backend replaces the old one
+	svcCfg.Backends[0].Weight = 2
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	c.Assert(svc.get("b0").Stats().Conns, Equals, int64(42))
+
+	// removed, and added back with a deploy
+	svcCfg.Backends = []client.BackendConfig{}
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	c.Assert(svc.get("b0"), IsNil)
+
+	svcCfg.Backends = []client.BackendConfig{{Name: "b0", Addr: s.servers[0].addr}}
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	c.Assert(svc.get("b0").Stats().Conns, Equals, int64(42))
+
+	// a new address is a new backend
+	svcCfg.Backends = []client.BackendConfig{}
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	svcCfg.Backends = []client.BackendConfig{{Name: "b0", Addr: s.servers[1].addr}}
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	c.Assert(svc.get("b0").Stats().Conns, Equals, int64(0))
+}
+
+// The supervisor answers a read from the next worker when the first is down.
+func (s *BasicSuite) TestSupervisorAdmin(c *C) {
+	dir := c.MkDir()
+	l, err := net.Listen("unix", filepath.Join(dir, "worker-2.sock"))
+	c.Assert(err, IsNil)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "worker 2")
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	procs := []*workerProc{
+		{id: 1, admin: filepath.Join(dir, "worker-1.sock")},
+		{id: 2, admin: filepath.Join(dir, "worker-2.sock")},
+	}
+
+	rec := httptest.NewRecorder()
+	supervisorAdminHandler(procs).ServeHTTP(rec, httptest.NewRequest("GET", "/_config", nil))
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, "worker 2")
+
+	rec = httptest.NewRecorder()
+	supervisorAdminHandler(procs[:1]).ServeHTTP(rec, httptest.NewRequest("GET", "/_config", nil))
+	c.Assert(rec.Code, Equals, http.StatusBadGateway)
+}
+
+func (s *BasicSuite) TestIdleServices(c *C) {
+	// the suite's service has a backend, so only the new one is idle
+	s.AddBackend(c)
+
+	svcCfg := client.ServiceConfig{Name: "Forgotten", Addr: "127.0.0.1:2001"}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	idleServices.Set(time.Minute, false)
+	defer idleServices.Set(0, false)
+
+	now := time.Now()
+	idleServices.check(now)
+	c.Assert(Registry.GetService(svcCfg.Name).Stats().Idle, Equals, false)
+
+	idleServices.check(now.Add(2 * time.Minute))
+	c.Assert(Registry.GetService(svcCfg.Name).Stats().Idle, Equals, true)
+	c.Assert(Registry.GetService(s.service.Name).Stats().Idle, Equals, false)
+
+	// a backend makes it active again
+	svcCfg.Backends = []client.BackendConfig{{Name: "b0", Addr: s.servers[0].addr}}
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	idleServices.check(now.Add(3 * time.Minute))
+	c.Assert(Registry.GetService(svcCfg.Name).Stats().Idle, Equals, false)
+
+	svcCfg.Backends = []client.BackendConfig{}
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	idleServices.Set(time.Minute, true)
+	idleServices.check(now.Add(4 * time.Minute))
+	idleServices.check(now.Add(6 * time.Minute))
+	c.Assert(Registry.GetService(svcCfg.Name), IsNil)
+	c.Assert(Registry.GetService(s.service.Name), NotNil)
+}
+
+// Services can run on an in-memory network, without binding ports.
+func (s *BasicSuite) TestMemNetwork(c *C) {
+	mem := NewMemNetwork()
+	Registry.SetNetwork(mem)
+	defer Registry.SetNetwork(nil)
+
+	svcCfg := client.ServiceConfig{
+		Name:     "InMemory",
+		Addr:     "127.0.0.1:2001",
+		Backends: []client.BackendConfig{{Name: "b0", Addr: s.servers[0].addr}},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	_, err := net.Dial("tcp", svcCfg.Addr)
+	c.Assert(err, NotNil)
+
+	conn, err := mem.Dial(svcCfg.Addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, "testing\n")
+	c.Assert(err, IsNil)
+	buff := make([]byte, 1024)
+	n, err := conn.Read(buff)
+	c.Assert(err, IsNil)
+	c.Assert(string(buff[:n]), Equals, s.servers[0].addr)
+
+	// the address is taken on the network until the service is removed
+	_, err = mem.Listen("tcp", svcCfg.Addr)
+	c.Assert(isAddrInUse(err), Equals, true)
+
+	c.Assert(Registry.RemoveService(svcCfg.Name), IsNil)
+	_, err = mem.Dial(svcCfg.Addr)
+	c.Assert(err, NotNil)
+}
+
+// A service on port 0 reports the port the system picked.
+func (s *BasicSuite) TestEphemeralPort(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:     "Ephemeral",
+		Addr:     "127.0.0.1:0",
+		Network:  "tcp+udp",
+		Backends: []client.BackendConfig{{Name: "b0", Addr: s.servers[0].addr}},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+
+	svc := Registry.GetService(svcCfg.Name)
+	bound := svc.Stats().BoundAddr
+	_, port, err := net.SplitHostPort(bound)
+	c.Assert(err, IsNil)
+	c.Assert(port, Not(Equals), "0")
+	c.Assert(svc.Config().Addr, Equals, svcCfg.Addr)
+	c.Assert(svc.Config().BoundAddr, Equals, bound)
+
+	checkResp(bound, s.servers[0].addr, c)
+
+	// UDP listens on the same port as TCP
+	svc.Lock()
+	udpAddr := svc.udpListeners[0].conn.LocalAddr().String()
+	svc.Unlock()
+	c.Assert(udpAddr, Equals, bound)
+
+	// the reported address doesn't make the config differ
+	c.Assert(svc.Config().Equal(svcCfg), Equals, true)
+}
+
+func (s *BasicSuite) TestBackendSchedule(c *C) {
+	offPeak := newSchedule("batch", []client.ScheduleWindow{
+		{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "20:00", End: "08:00", Timezone: "UTC", Weight: 3},
+		{Days: []string{"sat", "sun"}, Start: "00:00", End: "00:00", Timezone: "UTC", Weight: 2},
+		{Start: "25:00", End: "08:00"},
+		{Days: []string{"someday"}, Start: "08:00", End: "09:00"},
+	})
+	// the invalid windows are left out
+	c.Assert(offPeak, HasLen, 2)
+
+	b := &Backend{Name: "batch", Weight: 1, schedule: offPeak}
+	at := func(s string) int {
+		t, err := time.Parse(time.RFC3339, s)
+		c.Assert(err, IsNil)
+		return b.weightAt(t)
+	}
+
+	// 2021-03-01 was a Monday
+	c.Assert(at("2021-03-01T12:00:00Z"), Equals, 1)
+	c.Assert(at("2021-03-01T20:00:00Z"), Equals, 3)
+	c.Assert(at("2021-03-02T07:59:00Z"), Equals, 3)
+	c.Assert(at("2021-03-02T08:00:00Z"), Equals, 1)
+	// the window past midnight belongs to the day it started
+	c.Assert(at("2021-03-01T03:00:00Z"), Equals, 1)
+	// Saturday morning is still Friday night's window
+	c.Assert(at("2021-03-06T03:00:00Z"), Equals, 3)
+	c.Assert(at("2021-03-06T12:00:00Z"), Equals, 2)
+
+	// a backend scheduled to a weight of 0 isn't balanced
+	s.AddBackend(c)
+	s.AddBackend(c)
+	s.service.Backends[1].schedule = newSchedule("backend_1", []client.ScheduleWindow{
+		{Start: "00:00", End: "00:00", Weight: 0},
+	})
+	for i := 0; i < 4; i++ {
+		c.Assert(s.service.next()[0].Name, Equals, "backend_0")
+	}
+	c.Assert(s.service.Backends[1].Stats().Weight, Equals, 0)
+}
+
+func (s *BasicSuite) TestAccessLogFormat(c *C) {
+	combined, err := parseAccessFormat(combinedLogFormat)
+	c.Assert(err, IsNil)
+
+	var out strings.Builder
+	l := &accessLogger{fields: combined, out: &out}
+
+	req := httptest.NewRequest("GET", "http://test-vhost/path?q=1", nil)
+	req.RemoteAddr = "10.0.0.1:5555"
+	req.Header.Set("User-Agent", `agent "quoted"`)
+	req.SetBasicAuth("user", "pass")
+	l.log(&accessEntry{req: req, status: 200, bytes: 512, duration: time.Second})
+
+	line := strings.TrimSuffix(out.String(), "\n")
+	c.Assert(strings.HasPrefix(line, `10.0.0.1 - user [`), Equals, true)
+	c.Assert(strings.HasSuffix(line, `] "GET http://test-vhost/path?q=1 HTTP/1.1" 200 512 "-" "agent \"quoted\""`), Equals, true)
+
+	// the log can be replayed
+	method, host, uri, ok := parseAccessLog(line, "")
+	c.Assert(ok, Equals, true)
+	c.Assert(method, Equals, "GET")
+	c.Assert(host, Equals, "test-vhost")
+	c.Assert(uri, Equals, "/path?q=1")
+
+	custom, err := parseAccessFormat(`%v %m %U%q %s %b %{backend_name}x %{attempt}x %{error}x 100%%`)
+	c.Assert(err, IsNil)
+	out.Reset()
+	l.fields = custom
+	l.log(&accessEntry{
+		req:     req,
+		status:  502,
+		bytes:   -1,
+		backend: backendAttempt{Name: "b0", Attempt: 2},
+		err:     ErrNoBackend,
+	})
+	c.Assert(out.String(), Equals, "test-vhost GET /path?q=1 502 - b0 2 "+ErrNoBackend.Error()+" 100%\n")
+
+	for _, bad := range []string{"%", "%Z", "%{Referer", "%i", "%{nothing}x"} {
+		_, err := parseAccessFormat(bad)
+		c.Assert(err, NotNil, Commentf(bad))
+	}
+}
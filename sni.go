@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Route TLS connections by the server name in the ClientHello without
+// terminating them. The ClientHello is parsed from a copy of what the client
+// sent, and then replayed to the chosen backend.
+
+// returned from GetConfigForClient to stop the handshake once we have the
+// ClientHello
+var errHelloRead = errors.New("client hello read")
+
+// Read the ClientHello from conn, and return the SNI server name along with
+// all the bytes read from the client.
+func readServerName(conn net.Conn) (string, []byte, error) {
+	buf := &bytes.Buffer{}
+	name := ""
+
+	err := tls.Server(helloConn{Conn: conn, r: io.TeeReader(conn, buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+
+	if !errors.Is(err, errHelloRead) {
+		return "", buf.Bytes(), err
+	}
+	return name, buf.Bytes(), nil
+}
+
+// A read-only view of the client conn for parsing the ClientHello. Anything
+// the tls package tries to send to the client is discarded.
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c helloConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// A client conn which replays the bytes already read by readServerName.
+type sniConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func newSNIConn(conn net.Conn, peeked []byte) *sniConn {
+	return &sniConn{
+		Conn: conn,
+		r:    io.MultiReader(bytes.NewReader(peeked), conn),
+	}
+}
+
+func (c *sniConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *sniConn) CloseRead() error {
+	return c.Conn.(closeReader).CloseRead()
+}
+
+// Find the backends for a TLS connection from the service registered for
+// its server name, falling back to this service's own backends. The returned
+// conn must be used in place of conn.
+func (s *Service) routeSNI(conn net.Conn, backends []*Backend) (net.Conn, []*Backend) {
+	name, peeked, err := readServerName(conn)
+	conn = newSNIConn(conn, peeked)
+	if err != nil {
+		log.Debugf("DEBUG: No TLS server name from %s for %s: %s", conn.RemoteAddr(), s.Name, err)
+		return conn, backends
+	}
+
+	svc := Registry.GetVHostService(name)
+	if svc == nil || svc == s {
+		return conn, backends
+	}
+
+	log.Debugf("DEBUG: Routing %s for %s to %s", name, s.Name, svc.Name)
+	return conn, svc.next()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"sync"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Configs may be encrypted at rest with -state-key, since they can hold
+// tokens and URLs with credentials. An encrypted config is written as the
+// header followed by the base64 salt, AES-256-GCM nonce and ciphertext. The
+// key is derived from the -state-key secret with scrypt and the salt, which
+// is random for each state config, so a passphrase handed over in an
+// environment variable or file is as good as a key fetched from a KMS.
+//
+// Reading a config without the header returns it unchanged, so an existing
+// plaintext state is loaded and then encrypted on the next write. A config
+// written by an older release, with the SHA-256 of the secret as its key, is
+// read the same way.
+var (
+	encryptedConfigHeader   = []byte("shuttle-encrypted:v2:")
+	encryptedConfigHeaderV1 = []byte("shuttle-encrypted:v1:")
+)
+
+// the scrypt cost, which is paid once for each salt
+const (
+	stateKeySaltSize = 16
+	stateKeyN        = 1 << 15
+	stateKeyR        = 8
+	stateKeyP        = 1
+)
+
+// A -state-key secret, and the key derived from it for the last salt used.
+type configSecret struct {
+	sync.Mutex
+	secret []byte
+	salt   []byte
+	key    []byte
+}
+
+// The key set by -state-key, or nil to store configs as plaintext.
+var configKey *configSecret
+
+func setConfigKey(secret string) {
+	if secret == "" {
+		configKey = nil
+		return
+	}
+	configKey = &configSecret{secret: []byte(secret)}
+}
+
+// Return the key for a salt.
+func (k *configSecret) derive(salt []byte) ([]byte, error) {
+	k.Lock()
+	defer k.Unlock()
+
+	if k.key != nil && bytes.Equal(k.salt, salt) {
+		return k.key, nil
+	}
+
+	key, err := scrypt.Key(k.secret, salt, stateKeyN, stateKeyR, stateKeyP, 32)
+	if err != nil {
+		return nil, err
+	}
+	k.salt, k.key = salt, key
+	return key, nil
+}
+
+// Return the salt and key to write a config with, keeping the salt of the
+// config last read or written.
+func (k *configSecret) sealKey() ([]byte, []byte, error) {
+	k.Lock()
+	salt := k.salt
+	k.Unlock()
+
+	if salt == nil {
+		salt = make([]byte, stateKeySaltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	key, err := k.derive(salt)
+	return salt, key, err
+}
+
+// A configStore which encrypts the config written to the underlying store
+// when there's a key, and decrypts an encrypted config when read.
+type encryptedStore struct {
+	configStore
+	key *configSecret
+}
+
+func (e *encryptedStore) Read() ([]byte, error) {
+	data, err := e.configStore.Read()
+	if err != nil {
+		return nil, err
+	}
+	return decryptConfig(e.key, data)
+}
+
+func (e *encryptedStore) Write(data []byte) error {
+	if e.key == nil {
+		return e.configStore.Write(data)
+	}
+	sealed, err := encryptConfig(e.key, data)
+	if err != nil {
+		return err
+	}
+	return e.configStore.Write(sealed)
+}
+
+func configCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptConfig(k *configSecret, data []byte) ([]byte, error) {
+	salt, key, err := k.sealKey()
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := configCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, 0, len(salt)+len(nonce)+len(data)+gcm.Overhead())
+	sealed = append(sealed, salt...)
+	sealed = append(sealed, nonce...)
+	sealed = gcm.Seal(sealed, nonce, data, nil)
+
+	out := make([]byte, len(encryptedConfigHeader)+base64.StdEncoding.EncodedLen(len(sealed)))
+	copy(out, encryptedConfigHeader)
+	base64.StdEncoding.Encode(out[len(encryptedConfigHeader):], sealed)
+	return out, nil
+}
+
+func decryptConfig(k *configSecret, data []byte) ([]byte, error) {
+	header := encryptedConfigHeader
+	if bytes.HasPrefix(data, encryptedConfigHeaderV1) {
+		header = encryptedConfigHeaderV1
+	} else if !bytes.HasPrefix(data, header) {
+		return data, nil
+	}
+	if k == nil {
+		return nil, errors.New("config is encrypted, and no -state-key is set")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data[len(header):])))
+	if err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	if bytes.Equal(header, encryptedConfigHeaderV1) {
+		sum := sha256.Sum256(k.secret)
+		key = sum[:]
+	} else {
+		if len(sealed) < stateKeySaltSize {
+			return nil, errors.New("encrypted config is truncated")
+		}
+		salt := append([]byte(nil), sealed[:stateKeySaltSize]...)
+		sealed = sealed[stateKeySaltSize:]
+		if key, err = k.derive(salt); err != nil {
+			return nil, err
+		}
+	}
+
+	gcm, err := configCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("encrypted config is truncated")
+	}
+
+	data, err = gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("can't decrypt config: wrong -state-key or corrupt data")
+	}
+	return data, nil
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The traffic counters are updated atomically on the data path, without any
+// locks. Stats are read in two passes: the settings and state are copied
+// with the locks held just long enough to copy them, then the counters are
+// loaded without holding any locks at all.
+
+// The stats of a service, with the backends and listeners to load its
+// counters from.
+type statsReader struct {
+	svc      *Service
+	stats    ServiceStat
+	backends []*Backend
+	ports    []*udpPort
+	drain    *serviceDrain
+}
+
+// Copy the service's settings and state, and the backends and listeners it
+// has right now.
+func (s *Service) statsReader() *statsReader {
+	s.Lock()
+	r := &statsReader{
+		svc: s,
+		stats: ServiceStat{
+			Name:          s.Name,
+			Addr:          s.Addr,
+			BoundAddr:     s.boundAddr(),
+			VirtualHosts:  s.VirtualHosts,
+			Balance:       s.Balance,
+			CheckInterval: s.CheckInterval,
+			Fall:          s.Fall,
+			Rise:          s.Rise,
+			ClientTimeout: int(s.ClientTimeout / time.Millisecond),
+			ServerTimeout: int(s.ServerTimeout / time.Millisecond),
+			DialTimeout:   int(s.DialTimeout / time.Millisecond),
+			Binding:       s.bindState,
+			Panic:         s.panicMode,
+			Features:      s.features(),
+		},
+		backends: append([]*Backend(nil), s.Backends...),
+		ports:    append([]*udpPort(nil), s.udpListeners...),
+		drain:    s.drain,
+	}
+	budget := s.budget
+	s.Unlock()
+
+	r.stats.Degraded = budget.Degraded()
+	r.stats.ErrorRate = budget.Rate()
+	r.stats.Idle = idleServices.Idle(s)
+
+	for _, b := range r.backends {
+		r.stats.Backends = append(r.stats.Backends, b.stateStats())
+	}
+	return r
+}
+
+// Load the counters, and roll up the service totals from the same values
+// reported for its backends and ports.
+func (r *statsReader) count() {
+	s, stats := r.svc, &r.stats
+
+	stats.HTTPConns = atomic.LoadInt64(&s.HTTPConns)
+	stats.HTTPErrors = atomic.LoadInt64(&s.HTTPErrors)
+	stats.Upgrades = atomic.LoadInt64(&s.httpProxy.Upgrades)
+	stats.UpgradeActive = atomic.LoadInt64(&s.httpProxy.UpgradeActive)
+	stats.NoBackend = atomic.LoadInt64(&s.NoBackend)
+	stats.ClientAborted = atomic.LoadInt64(&s.ClientAborted)
+	stats.RateLimited = atomic.LoadInt64(&s.RateLimited)
+	stats.ConnLimited = atomic.LoadInt64(&s.ConnLimited)
+	stats.Shed = atomic.LoadInt64(&s.Shed)
+	stats.Overloaded = atomic.LoadInt64(&s.Overloaded)
+	stats.TooLarge = atomic.LoadInt64(&s.TooLarge)
+	stats.BadMethod = atomic.LoadInt64(&s.BadMethod)
+	stats.Compressed = atomic.LoadInt64(&s.Compressed)
+	stats.CompressSaved = atomic.LoadInt64(&s.CompressSaved)
+	stats.UDPDropped = atomic.LoadInt64(&s.UDPDropped)
+	stats.UDPDropBytes = atomic.LoadInt64(&s.UDPDropBytes)
+	stats.HTTPActive = atomic.LoadInt64(&s.HTTPActive)
+	stats.Rcvd = atomic.LoadInt64(&s.Rcvd)
+	stats.Sent = atomic.LoadInt64(&s.Sent)
+
+	ages, oldest := s.ages.Stats()
+	stats.ConnAges = ages
+	stats.OldestConn = int(oldest / time.Millisecond)
+
+	stats.Latency = s.latency.Stats()
+	stats.VHostLatency = s.vhostLatency.Stats()
+
+	// roll up the sessions for each port
+	for _, p := range r.ports {
+		sessions := atomic.LoadInt64(&p.Sessions)
+		stats.Sessions += sessions
+
+		if len(r.ports) > 1 {
+			stats.Ports = append(stats.Ports, PortStat{
+				Port:     p.conn.LocalAddr().(*net.UDPAddr).Port,
+				Rcvd:     atomic.LoadInt64(&p.Rcvd),
+				Sent:     atomic.LoadInt64(&p.Sent),
+				Sessions: sessions,
+			})
+		}
+	}
+
+	for i, b := range r.backends {
+		bs := &stats.Backends[i]
+		b.countStats(bs)
+		stats.Sent += bs.Sent
+		stats.Rcvd += bs.Rcvd
+		stats.Errors += bs.Errors
+		stats.Conns += bs.Conns
+		stats.Active += bs.Active
+	}
+
+	stats.Drain = r.drain.stat(openConns(*stats))
+}
+
+// The last consistent snapshot, shared by the requests which arrived while
+// it was taken.
+type statsSnapshot struct {
+	sync.Mutex
+	time  time.Time
+	stats []ServiceStat
+}
+
+// Snapshot returns the stats of every service as of a single point in time,
+// and that time. The state of all the services is copied first, then all the
+// counters are loaded in one pass, so no service's totals are from later than
+// another's, and no lock is held while the counters are read. Concurrent
+// callers share a snapshot rather than each taking their own.
+func (s *ServiceRegistry) Snapshot() (time.Time, []ServiceStat) {
+	requested := time.Now()
+
+	s.snapshot.Lock()
+	defer s.snapshot.Unlock()
+
+	// taken while we waited
+	if !s.snapshot.time.Before(requested) {
+		return s.snapshot.time, s.snapshot.stats
+	}
+
+	s.Lock()
+	services := make([]*Service, 0, len(s.svcs))
+	for _, service := range s.svcs {
+		services = append(services, service)
+	}
+	s.Unlock()
+
+	readers := make([]*statsReader, len(services))
+	for i, service := range services {
+		readers[i] = service.statsReader()
+	}
+
+	now := time.Now()
+	stats := make([]ServiceStat, len(readers))
+	for i, r := range readers {
+		r.count()
+		stats[i] = r.stats
+	}
+
+	s.snapshot.time, s.snapshot.stats = now, stats
+	return now, stats
+}
+
+// Limits for the long-polled stats deltas.
+const (
+	// how often the counters are checked while a delta request waits
+	deltaPoll = 250 * time.Millisecond
+
+	// generations kept to diff against; an older one gets the full stats
+	deltaGenerations = 16
+
+	deltaTimeout    = 30 * time.Second
+	deltaMaxTimeout = 5 * time.Minute
+)
+
+// StatsDelta holds the services which changed since an earlier generation of
+// the stats. Each service lists only the backends which changed. When the
+// generation asked for is unknown, Full is set and every service is listed
+// with all its backends.
+type StatsDelta struct {
+	Generation      uint64              `json:"generation"`
+	Full            bool                `json:"full"`
+	Services        []ServiceStat       `json:"services"`
+	Removed         []string            `json:"removed,omitempty"`
+	RemovedBackends map[string][]string `json:"removed_backends,omitempty"`
+}
+
+// The recent snapshots handed out to delta requests, by generation.
+type statsHistory struct {
+	sync.Mutex
+	generation uint64
+	snapshots  map[uint64][]ServiceStat
+}
+
+// Record a snapshot as a new generation, dropping the oldest.
+func (h *statsHistory) add(stats []ServiceStat) uint64 {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.snapshots == nil {
+		h.snapshots = make(map[uint64][]ServiceStat)
+	}
+
+	h.generation++
+	h.snapshots[h.generation] = stats
+	delete(h.snapshots, h.generation-deltaGenerations)
+	return h.generation
+}
+
+func (h *statsHistory) get(generation uint64) ([]ServiceStat, bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	stats, ok := h.snapshots[generation]
+	return stats, ok
+}
+
+// StatsDelta waits until some counter has changed by at least threshold since
+// the generation, or the state of a service or backend has changed at all,
+// and returns what changed. If nothing changes before the timeout, or done
+// is closed, the delta is empty and keeps the generation it was asked for.
+func (s *ServiceRegistry) StatsDelta(since uint64, threshold int64, timeout time.Duration, done <-chan struct{}) StatsDelta {
+	base, ok := s.history.get(since)
+	if !ok {
+		_, stats := s.Snapshot()
+		return StatsDelta{
+			Generation: s.history.add(stats),
+			Full:       true,
+			Services:   stats,
+		}
+	}
+
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	expire := time.NewTimer(timeout)
+	defer expire.Stop()
+	poll := time.NewTicker(deltaPoll)
+	defer poll.Stop()
+
+	for {
+		_, stats := s.Snapshot()
+		delta := diffStats(base, stats, threshold)
+		if len(delta.Services) > 0 || len(delta.Removed) > 0 || len(delta.RemovedBackends) > 0 {
+			delta.Generation = s.history.add(stats)
+			return delta
+		}
+
+		select {
+		case <-poll.C:
+		case <-expire.C:
+			return StatsDelta{Generation: since}
+		case <-done:
+			return StatsDelta{Generation: since}
+		}
+	}
+}
+
+// Compare two snapshots, listing the services and backends with a changed
+// state, or a counter changed by at least threshold.
+func diffStats(old, cur []ServiceStat, threshold int64) StatsDelta {
+	delta := StatsDelta{}
+
+	oldSvcs := make(map[string]ServiceStat, len(old))
+	for _, st := range old {
+		oldSvcs[st.Name] = st
+	}
+
+	for _, st := range cur {
+		prev, ok := oldSvcs[st.Name]
+		delete(oldSvcs, st.Name)
+		if !ok {
+			delta.Services = append(delta.Services, st)
+			continue
+		}
+
+		changed := serviceChanged(prev, st, threshold)
+
+		prevBackends := make(map[string]BackendStat, len(prev.Backends))
+		for _, b := range prev.Backends {
+			prevBackends[b.Name] = b
+		}
+
+		var backends []BackendStat
+		for _, b := range st.Backends {
+			p, ok := prevBackends[b.Name]
+			delete(prevBackends, b.Name)
+			if !ok || backendChanged(p, b, threshold) {
+				backends = append(backends, b)
+			}
+		}
+
+		for name := range prevBackends {
+			if delta.RemovedBackends == nil {
+				delta.RemovedBackends = make(map[string][]string)
+			}
+			delta.RemovedBackends[st.Name] = append(delta.RemovedBackends[st.Name], name)
+			changed = true
+		}
+
+		if changed || len(backends) > 0 {
+			st.Backends = backends
+			delta.Services = append(delta.Services, st)
+		}
+	}
+
+	for name := range oldSvcs {
+		delta.Removed = append(delta.Removed, name)
+	}
+	return delta
+}
+
+// The service's counters, which only count as a change past the threshold.
+func serviceCounters(st *ServiceStat) []*int64 {
+	return []*int64{
+		&st.Sent, &st.Rcvd, &st.Errors, &st.Conns, &st.Active,
+		&st.HTTPActive, &st.HTTPConns, &st.HTTPErrors, &st.NoBackend,
+		&st.ClientAborted, &st.RateLimited, &st.ConnLimited,
+		&st.UDPDropped, &st.UDPDropBytes, &st.Sessions, &st.Upgrades,
+		&st.UpgradeActive, &st.Shed, &st.Compressed, &st.CompressSaved,
+		&st.Overloaded, &st.TooLarge, &st.BadMethod,
+	}
+}
+
+func backendCounters(st *BackendStat) []*int64 {
+	return []*int64{
+		&st.Sent, &st.Rcvd, &st.Errors, &st.Conns, &st.Active, &st.HTTPActive,
+	}
+}
+
+// Report whether any counter moved by at least threshold, clearing the
+// counters in the copies so the rest of their state can be compared.
+func countersChanged(old, cur []*int64, threshold int64) bool {
+	changed := false
+	for i := range old {
+		d := *cur[i] - *old[i]
+		if d >= threshold || d <= -threshold {
+			changed = true
+		}
+		*old[i], *cur[i] = 0, 0
+	}
+	return changed
+}
+
+func serviceChanged(old, cur ServiceStat, threshold int64) bool {
+	if countersChanged(serviceCounters(&old), serviceCounters(&cur), threshold) {
+		return true
+	}
+	if latencyChanged(old.Latency, cur.Latency, threshold) {
+		return true
+	}
+
+	// backends are compared on their own, and the ports are only counters.
+	// The connection ages change with time alone, and the latencies with
+	// the requests counted.
+	old.Backends, cur.Backends = nil, nil
+	old.Ports, cur.Ports = nil, nil
+	old.ConnAges, cur.ConnAges = nil, nil
+	old.OldestConn, cur.OldestConn = 0, 0
+	old.Latency, cur.Latency = nil, nil
+	old.VHostLatency, cur.VHostLatency = nil, nil
+	return !reflect.DeepEqual(old, cur)
+}
+
+func backendChanged(old, cur BackendStat, threshold int64) bool {
+	if countersChanged(backendCounters(&old), backendCounters(&cur), threshold) {
+		return true
+	}
+	if latencyChanged(old.Latency, cur.Latency, threshold) {
+		return true
+	}
+
+	// health checks are only a change when they change the backend's state
+	old.CheckOK, cur.CheckOK = 0, 0
+	old.CheckFail, cur.CheckFail = 0, 0
+	old.LastCheck, cur.LastCheck = time.Time{}, time.Time{}
+	old.Latency, cur.Latency = nil, nil
+	return !reflect.DeepEqual(old, cur)
+}
+
+// Report whether at least threshold requests were added to a latency
+// histogram, or it was reset.
+func latencyChanged(old, cur *LatencyStat, threshold int64) bool {
+	var before, after int64
+	if old != nil {
+		before = old.Count
+	}
+	if cur != nil {
+		after = cur.Count
+	}
+	d := after - before
+	return d >= threshold || d <= -threshold
+}
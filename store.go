@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage drivers for the config files, so the state can be kept somewhere
+// that outlives the host. A config location is either a file path, or a URL
+// for one of the drivers:
+//
+//	file:///var/lib/shuttle/state.json
+//	consul://127.0.0.1:8500/shuttle/state
+//	etcd://127.0.0.1:2379/shuttle/state
+//	s3://bucket/shuttle/state.json
+//
+// Consul uses CONSUL_HTTP_TOKEN if set, and S3 uses the standard AWS_*
+// environment variables for credentials, region, and endpoint.
+type configStore interface {
+	Read() ([]byte, error)
+	Write(data []byte) error
+}
+
+var storeClient = &http.Client{Timeout: 10 * time.Second}
+
+// Return the configStore for a config location, encrypting the config at
+// rest if there's a configKey.
+func newConfigStore(location string) (configStore, error) {
+	store, err := openConfigStore(location)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedStore{configStore: store, key: configKey}, nil
+}
+
+func openConfigStore(location string) (configStore, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme == "" {
+		return fileStore(location), nil
+	}
+
+	key := strings.TrimPrefix(u.Path, "/")
+
+	switch u.Scheme {
+	case "file":
+		return fileStore(u.Path), nil
+	case "consul":
+		return &consulStore{addr: u.Host, key: key, token: os.Getenv("CONSUL_HTTP_TOKEN")}, nil
+	case "etcd":
+		return &etcdStore{addr: u.Host, key: key}, nil
+	case "s3":
+		return newS3Store(u.Host, key), nil
+	}
+
+	return nil, fmt.Errorf("unknown config store '%s'", u.Scheme)
+}
+
+// A config in a local file.
+type fileStore string
+
+func (f fileStore) Read() ([]byte, error) {
+	return ioutil.ReadFile(string(f))
+}
+
+// Write to a temp file and rename it, so the config is never left partly
+// written.
+func (f fileStore) Write(data []byte) error {
+	path := string(f)
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// A config in the Consul KV store.
+type consulStore struct {
+	addr  string
+	key   string
+	token string
+}
+
+func (c *consulStore) do(method string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, "http://"+c.addr+"/v1/kv/"+c.key+"?raw", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	return storeRequest(req)
+}
+
+func (c *consulStore) Read() ([]byte, error) {
+	return c.do("GET", nil)
+}
+
+func (c *consulStore) Write(data []byte) error {
+	_, err := c.do("PUT", data)
+	return err
+}
+
+// A config in etcd, through the v3 JSON gateway.
+type etcdStore struct {
+	addr string
+	key  string
+}
+
+type etcdKV struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+func (e *etcdStore) post(path string, kv etcdKV) ([]byte, error) {
+	body, _ := json.Marshal(kv)
+	req, err := http.NewRequest("POST", "http://"+e.addr+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return storeRequest(req)
+}
+
+func (e *etcdStore) Read() ([]byte, error) {
+	resp, err := e.post("/v3/kv/range", etcdKV{Key: base64.StdEncoding.EncodeToString([]byte(e.key))})
+	if err != nil {
+		return nil, err
+	}
+
+	var rng struct {
+		KVs []etcdKV `json:"kvs"`
+	}
+	if err := json.Unmarshal(resp, &rng); err != nil {
+		return nil, err
+	}
+	if len(rng.KVs) == 0 {
+		return nil, fmt.Errorf("etcd key %s not found", e.key)
+	}
+	return base64.StdEncoding.DecodeString(rng.KVs[0].Value)
+}
+
+func (e *etcdStore) Write(data []byte) error {
+	_, err := e.post("/v3/kv/put", etcdKV{
+		Key:   base64.StdEncoding.EncodeToString([]byte(e.key)),
+		Value: base64.StdEncoding.EncodeToString(data),
+	})
+	return err
+}
+
+// A config object in S3, or an S3 compatible store with AWS_ENDPOINT_URL.
+type s3Store struct {
+	bucket    string
+	key       string
+	region    string
+	endpoint  string
+	accessKey string
+	secretKey string
+	token     string
+}
+
+func newS3Store(bucket, key string) *s3Store {
+	s := &s3Store{
+		bucket:    bucket,
+		key:       key,
+		region:    os.Getenv("AWS_REGION"),
+		endpoint:  os.Getenv("AWS_ENDPOINT_URL"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+	}
+
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	return s
+}
+
+func (s *s3Store) url() string {
+	if s.endpoint != "" {
+		return strings.TrimSuffix(s.endpoint, "/") + "/" + s.bucket + "/" + s.key
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.bucket, s.region, s.key)
+}
+
+func (s *s3Store) do(method string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, s.url(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, body, time.Now().UTC())
+	return storeRequest(req)
+}
+
+func (s *s3Store) Read() ([]byte, error) {
+	return s.do("GET", nil)
+}
+
+func (s *s3Store) Write(data []byte) error {
+	_, err := s.do("PUT", data)
+	return err
+}
+
+// Sign the request with AWS Signature Version 4.
+func (s *s3Store) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.token)
+	}
+
+	names := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if s.token != "" {
+		names = append(names, "x-amz-security-token")
+	}
+
+	headers := ""
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		headers += name + ":" + strings.TrimSpace(value) + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Make a request to a remote store, and return the body of a successful
+// response.
+func storeRequest(req *http.Request) ([]byte, error) {
+	resp, err := storeClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Redacted(), resp.Status)
+	}
+	return body, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// The TLS versions, cipher suites, curves, and ALPN protocols offered by the
+// HTTPS and admin listeners.
+type tlsPolicy struct {
+	MinVersion       uint16
+	CipherSuites     []uint16
+	CurvePreferences []tls.CurveID
+	NextProtos       []string
+}
+
+// The policy for all TLS listeners, set from the command line.
+var serverTLS = &tlsPolicy{NextProtos: []string{"http/1.1"}}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurveIDs = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// Parse a policy from the flag values. Lists are comma separated, and empty
+// values leave the crypto/tls defaults in place.
+func parseTLSPolicy(minVersion, ciphers, curves, alpn string) (*tlsPolicy, error) {
+	p := &tlsPolicy{}
+
+	if minVersion != "" {
+		v, ok := tlsVersions[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version '%s'", minVersion)
+		}
+		p.MinVersion = v
+	}
+
+	suites := make(map[string]uint16)
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[cs.Name] = cs.ID
+	}
+
+	for _, name := range splitList(ciphers) {
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite '%s'", name)
+		}
+		p.CipherSuites = append(p.CipherSuites, id)
+	}
+
+	for _, name := range splitList(curves) {
+		id, ok := tlsCurveIDs[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve '%s'", name)
+		}
+		p.CurvePreferences = append(p.CurvePreferences, id)
+	}
+
+	p.NextProtos = splitList(alpn)
+	return p, nil
+}
+
+// Set the policy on a tls.Config.
+func (p *tlsPolicy) apply(cfg *tls.Config) {
+	cfg.MinVersion = p.MinVersion
+	cfg.CipherSuites = p.CipherSuites
+	cfg.CurvePreferences = p.CurvePreferences
+	cfg.NextProtos = p.NextProtos
+}
+
+// Split a comma separated list, ignoring empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+// +build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var errTOSUnsupported = errors.New("setting the IP TOS isn't supported on this platform")
+
+// The TOS is only set where the socket options are known, so a configured
+// client_tos or server_tos is an error here.
+func setTOS(conn *net.TCPConn, tos int) error {
+	return errTOSUnsupported
+}
@@ -0,0 +1,35 @@
+//go:build unix
+// +build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// set the IP TOS byte, or the IPv6 traffic class, on a connection
+func setTOS(conn *net.TCPConn, tos int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	ipv6 := false
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		ipv6 = true
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+			return
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,34 @@
+//go:build unix
+// +build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+	. "gopkg.in/check.v1"
+)
+
+func (s *BasicSuite) TestSetTOS(c *C) {
+	conn, err := net.Dial("tcp", s.servers[0].addr)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := setTOS(conn.(*net.TCPConn), 0x28); err != nil {
+		c.Fatal(err)
+	}
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	var tos int
+	raw.Control(func(fd uintptr) {
+		tos, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+	})
+	c.Assert(err, IsNil)
+	c.Assert(tos, Equals, 0x28)
+}
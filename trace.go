@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Request tracing with W3C Trace Context headers. A sampled request gets a
+// span for its trip through shuttle, which is logged when the backend
+// responds, and becomes the parent in the traceparent sent to the backend.
+// See https://www.w3.org/TR/trace-context/
+
+const traceHeader = "Traceparent"
+
+// version-traceid-parentid-flags, all lowercase hex
+var traceparentRe = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// The span for a sampled request.
+type traceSpan struct {
+	TraceID  string
+	SpanID   string
+	ParentID string
+}
+
+// Parse a traceparent header, returning the trace and parent IDs, and
+// whether the caller sampled the request.
+func parseTraceparent(h string) (traceID, parentID string, sampled, ok bool) {
+	m := traceparentRe.FindStringSubmatch(h)
+	if m == nil || m[1] == "ff" {
+		return "", "", false, false
+	}
+
+	// an all zero ID is invalid
+	if m[2] == "00000000000000000000000000000000" || m[3] == "0000000000000000" {
+		return "", "", false, false
+	}
+
+	var flags byte
+	fmt.Sscanf(m[4], "%02x", &flags)
+	return m[2], m[3], flags&1 == 1, true
+}
+
+// Start a span if the request is sampled, either by the caller or by the
+// service's TraceSample rate. Requests which aren't sampled pass through
+// with their traceparent untouched.
+func (s *Service) startTrace(pr *ProxyRequest) bool {
+	s.Lock()
+	sample := s.TraceSample
+	s.Unlock()
+
+	traceID, parentID, sampled, ok := parseTraceparent(pr.Request.Header.Get(traceHeader))
+	if !sampled && (sample <= 0 || rand.Float64() >= sample) {
+		return true
+	}
+
+	if !ok {
+		traceID, parentID = genId()+genId(), ""
+	}
+
+	pr.Trace = &traceSpan{
+		TraceID:  traceID,
+		SpanID:   genId(),
+		ParentID: parentID,
+	}
+	pr.Request.Header.Set(traceHeader, fmt.Sprintf("00-%s-%s-01", pr.Trace.TraceID, pr.Trace.SpanID))
+	return true
+}
+
+// Log the span of a sampled request.
+func (s *Service) finishTrace(pr *ProxyRequest) bool {
+	if pr.Trace == nil {
+		return true
+	}
+
+	var backend string
+	if pr.Response.Request != nil && pr.Response.Request.URL != nil {
+		backend = pr.Response.Request.URL.Host
+	}
+
+	log.Printf("TRACE: trace=%s span=%s parent=%s id=%s service=%s backend=%s status=%d duration=%s",
+		pr.Trace.TraceID, pr.Trace.SpanID, pr.Trace.ParentID, pr.Request.Header.Get(RequestIDHeader),
+		s.Name, backend, pr.Response.StatusCode, pr.FinishTime.Sub(pr.StartTime))
+	return true
+}
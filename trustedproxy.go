@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/skyfii/shuttle/log"
+)
+
+// proxyTrust holds the networks of the upstream proxies whose
+// X-Forwarded-Proto and X-Forwarded-For headers we believe.
+type proxyTrust struct {
+	sync.Mutex
+	// set is true once a list has been configured, so that a list of only
+	// invalid entries trusts nothing rather than everything.
+	set  bool
+	nets []*net.IPNet
+}
+
+var trustedProxies = &proxyTrust{}
+
+// Set the trusted networks. Entries may be a CIDR or a single IP address.
+// Invalid entries are logged and skipped. An empty list trusts every peer.
+func (t *proxyTrust) Set(cidrs []string) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil {
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					ip = ip.To4()
+					bits = 8 * net.IPv4len
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Errorf("ERROR: Invalid trusted proxy %q - %s", cidr, err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.set = len(cidrs) > 0
+	t.nets = nets
+}
+
+// Trusted reports whether forwarding headers from the peer at remoteAddr
+// should be honored.
+func (t *proxyTrust) Trusted(remoteAddr string) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if !t.set {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range t.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the client address for the request, taken from X-Forwarded-For only
+// when the direct peer is a trusted proxy.
+func clientAddr(r *http.Request) string {
+	if trustedProxies.Trusted(r.RemoteAddr) {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			return xff
+		}
+	}
+	return r.RemoteAddr
+}
+
+// Return the X-Forwarded-Proto value if the direct peer is a trusted proxy.
+func forwardedProto(r *http.Request) string {
+	if !trustedProxies.Trusted(r.RemoteAddr) {
+		return ""
+	}
+	return r.Header.Get("X-Forwarded-Proto")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"github.com/skyfii/shuttle/log"
+)
+
+// Upgrade requests, like WebSockets, take over the connection once the
+// backend switches protocols. The backend connection is dialed directly
+// rather than pooled by the Transport, and the client connection is hijacked
+// and spliced to it.
+
+// Return the protocol the request asks to upgrade to, if any.
+func upgradeType(h http.Header) string {
+	for _, v := range h["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// The backend connection after a 101 response, which may have read some of
+// the new protocol along with the response.
+type upgradedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *upgradedConn) Read(b []byte) (int, error) {
+	return c.br.Read(b)
+}
+
+// Send an Upgrade request over a new connection to the backend. If the
+// backend switches protocols, the response Body is the connection.
+func (p *ReverseProxy) dialUpgrade(req *http.Request) (*http.Response, error) {
+	conn, err := p.Dial(req.Context(), "tcp", req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// an ordinary response, and nothing else will use the connection
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{resp.Body, conn}
+		return resp, nil
+	}
+
+	// the upgraded connection lives as long as the client's, so the backend
+	// rwTimeout no longer applies
+	if sc, ok := conn.(*shuttleConn); ok {
+		sc.rwTimeout = 0
+	}
+
+	resp.Body = &upgradedConn{Conn: conn, br: br}
+	return resp, nil
+}
+
+// Switch the client to the backend's protocol, and splice the connections
+// until either side closes.
+func (p *ReverseProxy) serveUpgrade(rw http.ResponseWriter, req *http.Request, res *http.Response, proto string) {
+	backConn, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		log.Errorf("ERROR: id=%s backend switched protocols without an upgraded connection", req.Header.Get(RequestIDHeader))
+		res.Body.Close()
+		http.Error(rw, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer backConn.Close()
+
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		http.Error(rw, "can't switch protocols", http.StatusInternalServerError)
+		return
+	}
+
+	cliConn, brw, err := hj.Hijack()
+	if err != nil {
+		log.Errorf("ERROR: id=%s hijacking connection: %s", req.Header.Get(RequestIDHeader), err)
+		return
+	}
+	defer cliConn.Close()
+
+	header := rw.Header()
+	header.Set("Connection", "Upgrade")
+	header.Set("Upgrade", proto)
+
+	fmt.Fprintf(brw, "HTTP/1.1 101 %s\r\n", http.StatusText(http.StatusSwitchingProtocols))
+	header.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		log.Warnf("WARN: id=%s writing upgrade response: %s", req.Header.Get(RequestIDHeader), err)
+		return
+	}
+
+	atomic.AddInt64(&p.Upgrades, 1)
+	atomic.AddInt64(&p.UpgradeActive, 1)
+	defer atomic.AddInt64(&p.UpgradeActive, -1)
+
+	done := make(chan struct{}, 2)
+	splice := func(dst io.Writer, src io.Reader) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+
+	// the client may have sent more after the request, which is buffered
+	go splice(backConn, brw)
+	go splice(cliConn, backConn)
+
+	// once either side is done, closing both ends the other
+	<-done
+	cliConn.Close()
+	backConn.Close()
+	<-done
+}
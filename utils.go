@@ -3,9 +3,13 @@ package main
 import (
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"strconv"
 	"strings"
+	"syscall"
 )
 
 // marshal whatever we've got with out default indentation
@@ -39,3 +43,78 @@ func filterEmpty(a []string) []string {
 	}
 	return a[:len(a)-removed]
 }
+
+// Check if an address has port 0, for the system to pick the port.
+func ephemeralPort(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && port == "0"
+}
+
+// Check if a listen failed because the address is already in use.
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
+
+// Report if a network is one of SCTP's.
+func sctpNetwork(network string) bool {
+	return strings.HasPrefix(network, "sctp")
+}
+
+// Split a network into its TCP and UDP parts, where "tcp+udp" uses both.
+// A part is empty when the network doesn't include it. SCTP is proxied like
+// TCP, so it's returned as the TCP part.
+func splitNetwork(network string) (tcp, udp string) {
+	for _, n := range strings.Split(network, "+") {
+		switch n {
+		case "tcp", "tcp4", "tcp6", "sctp", "sctp4", "sctp6":
+			tcp = n
+		case "udp", "udp4", "udp6":
+			udp = n
+		}
+	}
+	return tcp, udp
+}
+
+// Split an address with an optional port range, "host:first-last", into the
+// host, the first port, and the number of ports.
+func splitPortRange(addr string) (host string, port, count int, err error) {
+	host, ports, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	first, last := ports, ports
+	if i := strings.Index(ports, "-"); i >= 0 {
+		first, last = ports[:i], ports[i+1:]
+	}
+
+	port, err = net.LookupPort("udp", first)
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	lastPort, err := net.LookupPort("udp", last)
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	if lastPort < port {
+		return "", 0, 0, fmt.Errorf("invalid port range %s", ports)
+	}
+	return host, port, lastPort - port + 1, nil
+}
+
+// Resolve the first UDP address of a port range, and return it with the
+// number of ports in the range.
+func resolveUDPRange(network, addr string) (*net.UDPAddr, int, error) {
+	host, port, count, err := splitPortRange(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	udpAddr, err := net.ResolveUDPAddr(network, net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, 0, err
+	}
+	return udpAddr, count, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// A backend with an address of service://name is another service in this
+// process, for layered routing such as a vhost service in front of a path
+// router in front of pools of backends. Its connections are handed to the
+// other service through an in-memory pipe rather than a loopback TCP
+// connection. A service with virtual hosts serves them HTTP, and any other
+// proxies them like the connections to its own listener. The backend is up
+// while the other service has a backend available.
+
+const serviceScheme = "service://"
+
+// Return the name of the service a backend address refers to, or "" if it's
+// a network address.
+func virtualService(addr string) string {
+	if !strings.HasPrefix(addr, serviceScheme) {
+		return ""
+	}
+	return strings.TrimPrefix(addr, serviceScheme)
+}
+
+// The backend address of an address dialed by the HTTP transport, which
+// brackets a service:// address and adds a port, as it isn't a host:port.
+func backendDialAddr(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil && virtualService(host) != "" {
+		return host
+	}
+	return addr
+}
+
+// Connect to the service named by a backend of the service from.
+func dialService(ctx context.Context, from, name string) (net.Conn, error) {
+	if name == from {
+		return nil, fmt.Errorf("service %s can't be its own backend", name)
+	}
+
+	svc := Registry.GetService(name)
+	if svc == nil {
+		return nil, fmt.Errorf("no service named %s", name)
+	}
+	return svc.dialLocal(ctx, from)
+}
+
+// Check a backend which is the named service.
+func checkService(name string) error {
+	svc := Registry.GetService(name)
+	if svc == nil {
+		return fmt.Errorf("no service named %s", name)
+	}
+	if svc.Available() == 0 {
+		return fmt.Errorf("service %s has no backend available", name)
+	}
+	if svc.Draining() {
+		return fmt.Errorf("service %s is draining", name)
+	}
+	return nil
+}
+
+// Marks the requests of a connection from another service, whose forwarding
+// headers are always kept.
+type localHopKey struct{}
+
+func fromLocalService(r *http.Request) bool {
+	return r.Context().Value(localHopKey{}) != nil
+}
+
+// Open a connection to this service from the service from.
+func (s *Service) dialLocal(ctx context.Context, from string) (net.Conn, error) {
+	// the peer isn't a host:port, so the hop adds nothing to the forwarding
+	// headers
+	local := memAddr(serviceScheme + s.Name)
+	remote := memAddr("shuttle/" + from)
+
+	cli, srv := net.Pipe()
+	cliConn := &memConn{Conn: cli, local: remote, remote: local}
+	srvConn := &memConn{Conn: srv, local: local, remote: remote}
+
+	s.Lock()
+	if len(s.VirtualHosts) == 0 {
+		s.Unlock()
+		go s.connectTCP(srvConn)
+		return cliConn, nil
+	}
+
+	if s.localHTTP == nil {
+		s.localHTTP = &memListener{
+			addr:   local,
+			conns:  make(chan net.Conn),
+			closed: make(chan struct{}),
+		}
+		server := &http.Server{
+			Handler: s,
+			ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+				return context.WithValue(ctx, localHopKey{}, true)
+			},
+		}
+		go server.Serve(s.localHTTP)
+	}
+	l := s.localHTTP
+	s.Unlock()
+
+	select {
+	case l.conns <- srvConn:
+		return cliConn, nil
+	case <-l.closed:
+		err := fmt.Errorf("service %s is stopped", s.Name)
+		cli.Close()
+		srv.Close()
+		return nil, err
+	case <-ctx.Done():
+		cli.Close()
+		srv.Close()
+		return nil, ctx.Err()
+	}
+}
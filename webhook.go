@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+	"github.com/skyfii/shuttle/client"
+	"github.com/skyfii/shuttle/log"
+)
+
+// HealthEvent is the json payload posted to the health webhook whenever a
+// backend is marked up or down.
+type HealthEvent struct {
+	Service  string    `json:"service"`
+	Backend  string    `json:"backend"`
+	Addr     string    `json:"address"`
+	OldState string    `json:"old_state"`
+	NewState string    `json:"new_state"`
+	Reason   string    `json:"reason,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// Webhook posts HealthEvents to an external URL, and to each of the
+// health_webhooks in the payload rendered for it.
+// Events are sent asynchronously, so a slow or unavailable endpoint never
+// blocks the health checks.
+type Webhook struct {
+	sync.Mutex
+	url     string
+	targets []*webhookTarget
+
+	client *http.Client
+}
+
+// A health_webhooks destination.
+type webhookTarget struct {
+	url         string
+	contentType string
+	headers     map[string]string
+	params      map[string]string
+	payload     *template.Template
+}
+
+// The values given to a payload template.
+type webhookData struct {
+	HealthEvent
+	Params map[string]string
+}
+
+// The built-in payload formats. PagerDuty alerts are resolved when the
+// backend or service recovers.
+var webhookFormats = map[string]string{
+	"slack": `{"text": {{json .Summary}}}`,
+	"pagerduty": `{"routing_key": {{json (index .Params "routing_key")}}, ` +
+		`"event_action": "{{if or (eq .NewState "up") (eq .NewState "ok") (eq .NewState "active")}}resolve{{else}}trigger{{end}}", ` +
+		`"dedup_key": {{json (printf "shuttle/%s/%s" .Service .Backend)}}, ` +
+		`"payload": {"summary": {{json .Summary}}, ` +
+		`"source": {{if .Addr}}{{json .Addr}}{{else}}{{json .Service}}{{end}}, "severity": "error", "timestamp": {{json .Time}}, ` +
+		`"custom_details": {{json .HealthEvent}}}}`,
+}
+
+// Summary describes the event in a line, for a chat message or an alert.
+func (d webhookData) Summary() string {
+	msg := d.Service
+	if d.Backend != "" {
+		msg = fmt.Sprintf("%s backend %s (%s)", msg, d.Backend, d.Addr)
+	}
+	msg = fmt.Sprintf("%s is %s", msg, d.NewState)
+	if d.Reason != "" {
+		msg = fmt.Sprintf("%s: %s", msg, d.Reason)
+	}
+	return msg
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		js, err := json.Marshal(v)
+		return string(js), err
+	},
+}
+
+var healthWebhook = NewWebhook("")
+
+func NewWebhook(url string) *Webhook {
+	return &Webhook{
+		url: url,
+		// aggressively timeout connections, like the ErrorResponse client
+		client: &http.Client{
+			Transport: &http.Transport{
+				Dial: (&net.Dialer{
+					Timeout: 2 * time.Second,
+				}).Dial,
+				TLSHandshakeTimeout: 2 * time.Second,
+			},
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+func (w *Webhook) URL() string {
+	w.Lock()
+	defer w.Unlock()
+	return w.url
+}
+
+func (w *Webhook) SetURL(url string) {
+	w.Lock()
+	defer w.Unlock()
+	w.url = url
+}
+
+// Set the health_webhooks destinations. One with an invalid template or
+// secret is logged and skipped.
+func (w *Webhook) SetTargets(cfgs []client.WebhookConfig) {
+	var targets []*webhookTarget
+	for _, cfg := range cfgs {
+		target, err := newWebhookTarget(cfg)
+		if err != nil {
+			log.Errorf("ERROR: Invalid health webhook: %s", err)
+			continue
+		}
+		targets = append(targets, target)
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	w.targets = targets
+}
+
+func newWebhookTarget(cfg client.WebhookConfig) (*webhookTarget, error) {
+	url, err := resolveSecret(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	target := &webhookTarget{
+		url:         url,
+		contentType: cfg.ContentType,
+		headers:     make(map[string]string),
+		params:      make(map[string]string),
+	}
+	if target.contentType == "" {
+		target.contentType = "application/json"
+	}
+
+	for key, val := range cfg.Headers {
+		if target.headers[key], err = resolveSecret(val); err != nil {
+			return nil, fmt.Errorf("header %s for %s: %s", key, url, err)
+		}
+	}
+	for key, val := range cfg.Params {
+		if target.params[key], err = resolveSecret(val); err != nil {
+			return nil, fmt.Errorf("param %s for %s: %s", key, url, err)
+		}
+	}
+
+	payload := cfg.Template
+	if payload == "" && cfg.Format != "" && cfg.Format != "json" {
+		var ok bool
+		if payload, ok = webhookFormats[cfg.Format]; !ok {
+			return nil, fmt.Errorf("unknown format %q for %s", cfg.Format, url)
+		}
+	}
+	if payload != "" {
+		target.payload, err = template.New(url).Funcs(webhookFuncs).Parse(payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return target, nil
+}
+
+// Send the event in the background. Nothing is sent if no URL is configured.
+func (w *Webhook) Send(event HealthEvent) {
+	w.Lock()
+	url, targets := w.url, w.targets
+	w.Unlock()
+
+	if url != "" {
+		go w.post(&webhookTarget{url: url, contentType: "application/json"}, event)
+	}
+	for _, target := range targets {
+		go w.post(target, event)
+	}
+}
+
+// Render the payload for the target, the event's json by default.
+func (t *webhookTarget) render(event HealthEvent) ([]byte, error) {
+	if t.payload == nil {
+		return json.Marshal(event)
+	}
+
+	var buf bytes.Buffer
+	err := t.payload.Execute(&buf, webhookData{HealthEvent: event, Params: t.params})
+	return buf.Bytes(), err
+}
+
+func (w *Webhook) post(target *webhookTarget, event HealthEvent) {
+	url := target.url
+	body, err := target.render(event)
+	if err != nil {
+		log.Errorf("ERROR: Unable to encode health event for %s: %s", url, err)
+		return
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		log.Warnf("WARN: Health webhook to %s failed: %s", url, err)
+		return
+	}
+	req.Header.Set("Content-Type", target.contentType)
+	for key, val := range target.headers {
+		req.Header.Set(key, val)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		log.Warnf("WARN: Health webhook to %s failed: %s", url, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Warnf("WARN: Health webhook to %s returned %d", url, resp.StatusCode)
+	}
+}
+
+// return the state name used in HealthEvents
+func stateName(up bool) string {
+	if up {
+		return "up"
+	}
+	return "down"
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"github.com/skyfii/shuttle/log"
+)
+
+// The prefork worker model. With -workers, the process started is a
+// supervisor which runs that many copies of shuttle as workers and restarts
+// any that exit. The workers share the proxy listeners with SO_REUSEPORT, so
+// the kernel spreads connections across them, and a crash only takes down
+// the connections of one worker.
+//
+// Each worker serves the admin API on a private unix socket. The supervisor
+// serves the admin address itself: reads are answered by the first worker
+// which responds, and changes are sent to all of them so they keep the same
+// config. Only the first worker writes the state config, which restarted
+// workers load.
+
+// Environment of a worker process, naming its number and admin socket.
+const (
+	workerEnv      = "SHUTTLE_WORKER"
+	workerAdminEnv = "SHUTTLE_WORKER_ADMIN"
+)
+
+// Bounds on the delay before restarting a worker which exited. Workers which
+// ran for maxWorkerBackoff before exiting are restarted immediately.
+const (
+	minWorkerBackoff = time.Second
+	maxWorkerBackoff = 30 * time.Second
+)
+
+// largest admin request body sent on to the workers
+const maxAdminBody = 32 << 20
+
+var (
+	// number of worker processes to supervise, 0 to serve from this process
+	workers int
+
+	// this process's worker number, from 1, or 0 if it isn't a worker
+	workerID int
+
+	// set SO_REUSEPORT on listeners, so the workers can share them
+	reusePort bool
+)
+
+// Set up this process as a worker if the supervisor started it. The admin
+// server moves to the worker's socket, which is reached through the
+// supervisor's admin server.
+func initWorker() {
+	id := os.Getenv(workerEnv)
+	if id == "" {
+		return
+	}
+
+	n, err := strconv.Atoi(id)
+	if err != nil || n < 1 {
+		log.Fatalf("FATAL: Invalid %s %q", workerEnv, id)
+	}
+
+	workerID = n
+	reusePort = true
+	adminListenAddr = os.Getenv(workerAdminEnv)
+	adminCert = ""
+	statsListenAddr = ""
+	log.Printf("INFO: Starting as worker %d", workerID)
+}
+
+func listenConfig() *net.ListenConfig {
+	lc := &net.ListenConfig{}
+	if reusePort {
+		lc.Control = reusePortControl
+	}
+	return lc
+}
+
+// Listen on a TCP address, shared with the other workers when running as
+// one.
+func listenTCP(network, addr string) (*net.TCPListener, error) {
+	l, err := listenConfig().Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return l.(*net.TCPListener), nil
+}
+
+// Listen on a UDP address, shared with the other workers when running as
+// one.
+func listenUDPConn(network, addr string) (*net.UDPConn, error) {
+	c, err := listenConfig().ListenPacket(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
+
+type workerProc struct {
+	id    int
+	admin string
+
+	sync.Mutex
+	cmd *exec.Cmd
+}
+
+// Run the supervisor, until it's signaled to stop.
+func runSupervisor(n int) {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("FATAL: Unable to find the shuttle executable: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "shuttle-workers")
+	if err != nil {
+		log.Fatalf("FATAL: Unable to create the worker socket directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	log.Printf("INFO: Supervising %d workers", n)
+
+	var procs []*workerProc
+	for i := 1; i <= n; i++ {
+		procs = append(procs, &workerProc{
+			id:    i,
+			admin: filepath.Join(dir, fmt.Sprintf("worker-%d.sock", i)),
+		})
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, p := range procs {
+		wg.Add(1)
+		go func(p *workerProc) {
+			defer wg.Done()
+			p.run(exe, stop)
+		}(p)
+	}
+
+	go serveSupervisorAdmin(procs)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sig
+
+	log.Printf("INFO: Stopping workers on %s", s)
+	close(stop)
+	for _, p := range procs {
+		p.signal(syscall.SIGTERM)
+	}
+	wg.Wait()
+}
+
+// Keep the worker running, restarting it with a backoff when it exits.
+func (p *workerProc) run(exe string, stop chan struct{}) {
+	backoff := minWorkerBackoff
+	for {
+		cmd := exec.Command(exe, os.Args[1:]...)
+		cmd.Env = append(os.Environ(),
+			workerEnv+"="+strconv.Itoa(p.id),
+			workerAdminEnv+"="+p.admin,
+		)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		start := time.Now()
+		p.Lock()
+		err := cmd.Start()
+		if err == nil {
+			p.cmd = cmd
+		}
+		p.Unlock()
+
+		if err == nil {
+			err = cmd.Wait()
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if time.Since(start) >= maxWorkerBackoff {
+			backoff = 0
+		}
+		log.Errorf("ERROR: Worker %d exited: %v, restarting in %s", p.id, err, backoff)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff < minWorkerBackoff {
+			backoff = minWorkerBackoff
+		}
+		if backoff > maxWorkerBackoff {
+			backoff = maxWorkerBackoff
+		}
+	}
+}
+
+func (p *workerProc) signal(sig os.Signal) {
+	p.Lock()
+	defer p.Unlock()
+	if p.cmd != nil && p.cmd.Process != nil {
+		p.cmd.Process.Signal(sig)
+	}
+}
+
+// Send an admin request to the worker's socket.
+func (p *workerProc) adminRequest(r *http.Request, body []byte) (*http.Response, error) {
+	c := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", p.admin)
+			},
+		},
+		Timeout: 30 * time.Second,
+	}
+	defer c.Transport.(*http.Transport).CloseIdleConnections()
+
+	req, err := http.NewRequest(r.Method, "http://worker"+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	copyHeader(req.Header, r.Header)
+
+	return c.Do(req)
+}
+
+// Return the handler which passes admin requests on to the workers.
+func supervisorAdminHandler(procs []*workerProc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxAdminBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// reads only need one worker's answer, from the first which responds
+		read := r.Method == "GET" || r.Method == "HEAD"
+
+		var first *http.Response
+		var firstID int
+		for _, p := range procs {
+			if read && first != nil {
+				break
+			}
+
+			resp, err := p.adminRequest(r, body)
+			if err != nil {
+				log.Errorf("ERROR: Admin request to worker %d failed: %s", p.id, err)
+				continue
+			}
+			if first == nil {
+				first, firstID = resp, p.id
+				defer resp.Body.Close()
+				continue
+			}
+			if resp.StatusCode != first.StatusCode {
+				log.Errorf("ERROR: Worker %d answered %s %s with %d, worker %d with %d",
+					p.id, r.Method, r.URL.Path, resp.StatusCode, firstID, first.StatusCode)
+			}
+			resp.Body.Close()
+		}
+
+		if first == nil {
+			http.Error(w, "no worker available", http.StatusBadGateway)
+			return
+		}
+
+		copyHeader(w.Header(), first.Header)
+		w.WriteHeader(first.StatusCode)
+		io.Copy(w, first.Body)
+	})
+}
+
+// Serve the admin address, passing requests on to the workers.
+func serveSupervisorAdmin(procs []*workerProc) {
+	handler := supervisorAdminHandler(procs)
+
+	if statsListenAddr != "" {
+		go serveStatsMirror(handler)
+	}
+
+	log.Println("INFO: Admin server listening on", adminListenAddr)
+
+	netw := "tcp"
+	if strings.HasPrefix(adminListenAddr, "/") {
+		netw = "unix"
+
+		// remove our old socket if we left it lying around
+		if stats, err := os.Stat(adminListenAddr); err == nil {
+			if stats.Mode()&os.ModeSocket != 0 {
+				os.Remove(adminListenAddr)
+			}
+		}
+
+		defer os.Remove(adminListenAddr)
+	}
+
+	listener, err := net.Listen(netw, adminListenAddr)
+	if err != nil {
+		log.Fatalf("FATAL: Admin server failed and exited with %s", err)
+	}
+
+	if adminCert != "" {
+		tlsCfg, err := adminTLSConfig()
+		if err != nil {
+			log.Fatalf("FATAL: Admin server TLS: %s", err)
+		}
+		listener = tls.NewListener(listener, tlsCfg)
+	}
+
+	http.Serve(listener, handler)
+}